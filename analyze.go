@@ -0,0 +1,65 @@
+package main
+
+import (
+	"context"
+	"log"
+	"sync"
+)
+
+// analyzeTracker accumulates bytes loaded to tables since the last ANALYZE by analyze_after_bytes.
+type analyzeTracker struct {
+	mu      sync.Mutex
+	loaded  map[string]int64
+	running map[string]bool
+}
+
+var analyzer = &analyzeTracker{loaded: make(map[string]int64), running: make(map[string]bool)}
+
+// add adds the size loaded to the table, and reports whether ANALYZE of the table should be started.
+// The bytes are reset when ANALYZE is started. ANALYZE of a table is not started while the previous one is running.
+func (a *analyzeTracker) add(table string, size, threshold int64) (int64, bool) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.loaded[table] += size
+	n := a.loaded[table]
+	if n < threshold || a.running[table] {
+		return n, false
+	}
+	a.loaded[table] = 0
+	a.running[table] = true
+	return n, true
+}
+
+func (a *analyzeTracker) done(table string) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	delete(a.running, table)
+}
+
+// analyzeLoaded starts ANALYZE of the table on clusters of the target in background,
+// when the bytes loaded to the table since the last ANALYZE reach analyze_after_bytes.
+func analyzeLoaded(ctx context.Context, target *Target, cap *[]string, size int64) {
+	if target.AnalyzeAfterBytes <= 0 {
+		return
+	}
+	table := target.tableName(cap)
+	key := target.String() + " " + table
+	n, ok := analyzer.add(key, size, target.AnalyzeAfterBytes)
+	if !ok {
+		return
+	}
+	id := CorrelationID(ctx)
+	log.Printf("[info] [%s] ANALYZE %s after %d bytes loaded by target %s", id, table, n, target)
+	// not canceled by the completion of the message
+	ctx = valueOnlyContext{ctx}
+	e := executorFrom(ctx)
+	go func() {
+		defer analyzer.done(key)
+		for _, r := range target.Clusters() {
+			query := "ANALYZE " + target.forCluster(r).tableName(cap)
+			if err := e.Exec(ctx, r.DSN(), query); err != nil {
+				log.Printf("[error] [%s] Failed to %s on %s. %s", id, query, r.Host, err)
+			}
+		}
+	}()
+}
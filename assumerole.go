@@ -0,0 +1,56 @@
+package main
+
+import (
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws/credentials"
+	"github.com/aws/aws-sdk-go/aws/credentials/stscreds"
+)
+
+// AssumeRoleExpiryWindow is the duration before expiry when the assumed credentials are refreshed.
+var AssumeRoleExpiryWindow = 5 * time.Minute
+
+// NewAssumeRoleCredentials returns the credentials of the assumed role for assume_role_arn.
+// The returned credentials must refresh themselves when expired.
+var NewAssumeRoleCredentials = func(roleARN string) *credentials.Credentials {
+	return stscreds.NewCredentials(Sessions.STS, roleARN, func(p *stscreds.AssumeRoleProvider) {
+		p.ExpiryWindow = AssumeRoleExpiryWindow
+	})
+}
+
+var (
+	assumedMu    sync.Mutex
+	assumedRoles = map[string]*credentials.Credentials{}
+)
+
+func assumedCredentials(roleARN string) *credentials.Credentials {
+	assumedMu.Lock()
+	defer assumedMu.Unlock()
+	if creds, ok := assumedRoles[roleARN]; ok {
+		return creds
+	}
+	creds := NewAssumeRoleCredentials(roleARN)
+	assumedRoles[roleARN] = creds
+	return creds
+}
+
+// resolveCredentials returns the credentials passed to COPY.
+// The access keys of assume_role_arn and file are retrieved at each call, so a long running daemon never passes expired keys.
+func resolveCredentials(cred Credentials) (Credentials, error) {
+	if cred.File != "" {
+		return fileCredentials(cred)
+	}
+	if cred.AssumeRoleARN == "" {
+		return cred, nil
+	}
+	v, err := assumedCredentials(cred.AssumeRoleARN).Get()
+	if err != nil {
+		return cred, fmt.Errorf("failed to assume role %s, %s", cred.AssumeRoleARN, err)
+	}
+	cred.AWS_ACCESS_KEY_ID = v.AccessKeyID
+	cred.AWS_SECRET_ACCESS_KEY = v.SecretAccessKey
+	cred.AWS_SESSION_TOKEN = v.SessionToken
+	return cred, nil
+}
@@ -0,0 +1,69 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	"github.com/lib/pq"
+)
+
+// BatchID tags rows loaded by COPY with a batch ID. COPY loads the object into a temporary staging table created
+// in the transaction like the table of the target, and the rows are inserted into the table with the batch ID column.
+type BatchID struct {
+	// Column is the batch ID column of the table of the target. Columns of the object are columns of the target.
+	Column string `yaml:"column"`
+	// Value is a SQL expression of the batch ID. ${correlation_id}, ${bucket} and ${key} are replaced by quoted literals.
+	// Default is ${correlation_id}, the ID of the message in logs.
+	Value string `yaml:"value"`
+}
+
+func (b *BatchID) validate(t *Target) error {
+	if b.Column == "" {
+		return fmt.Errorf("target.batch_id requires column")
+	}
+	if len(t.Columns) == 0 {
+		return fmt.Errorf("target.batch_id requires columns of the object")
+	}
+	return nil
+}
+
+func (b *BatchID) value() string {
+	if b.Value == "" {
+		return "${correlation_id}"
+	}
+	return b.Value
+}
+
+// batchIDStagingTable is the temporary table of batch_id. It is created and dropped in the transaction of each COPY,
+// so messages in flight never share it.
+const batchIDStagingTable = "rin_batch_id_staging"
+
+// stagingTarget returns a copy of the target which copies to the staging table of batch_id.
+func (t *Target) stagingTarget() *Target {
+	tc := t.withTable(batchIDStagingTable)
+	// temporary tables have no schema
+	tc.Redshift.Schema = ""
+	return tc
+}
+
+// BatchIDSQLs renders SQL of batch_id executed in the transaction of COPY into the staging table.
+// before creates the staging table like the table of the target, and after inserts the staged rows
+// with the batch ID into the table of the target and drops the staging table.
+func (t *Target) BatchIDSQLs(ctx context.Context, bucket, key string, capture *[]string) (before []string, after []string) {
+	staging := t.stagingTarget().tableName(capture)
+	table := t.tableName(capture)
+	value := strings.NewReplacer(
+		"${correlation_id}", quoteValue(CorrelationID(ctx)),
+		"${bucket}", quoteValue(bucket),
+		"${key}", quoteValue(key),
+	).Replace(t.BatchID.value())
+	cols := make([]string, len(t.Columns))
+	for i, c := range t.Columns {
+		cols[i] = pq.QuoteIdentifier(c)
+	}
+	columns := strings.Join(cols, ", ")
+	create := fmt.Sprintf("CREATE TEMP TABLE %s (LIKE %s)", staging, table)
+	insert := fmt.Sprintf("INSERT INTO %s (%s, %s) SELECT %s, %s FROM %s", table, columns, pq.QuoteIdentifier(t.BatchID.Column), columns, value, staging)
+	return []string{create}, []string{insert, "DROP TABLE " + staging}
+}
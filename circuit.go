@@ -0,0 +1,193 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"expvar"
+	"fmt"
+	"log"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// CircuitBreaker stops processing messages after consecutive COPY failures for the cool down,
+// then probes Redshift by a single message before resuming.
+type CircuitBreaker struct {
+	// Failures is the number of consecutive messages failed by COPY which opens the circuit.
+	Failures int           `yaml:"failures"`
+	CoolDown time.Duration `yaml:"cool_down"`
+}
+
+func (b *CircuitBreaker) validate() error {
+	if b.Failures <= 0 {
+		return fmt.Errorf("circuit_breaker.failures must be positive")
+	}
+	if b.CoolDown <= 0 {
+		return fmt.Errorf("circuit_breaker.cool_down is required")
+	}
+	return nil
+}
+
+// States of the circuit breaker.
+const (
+	CircuitClosed   = "closed"
+	CircuitOpen     = "open"
+	CircuitHalfOpen = "half-open"
+)
+
+var (
+	circuitBreakerOpen  = expvar.NewInt("circuit_breaker_open")
+	circuitBreakerTrips = expvar.NewInt("circuit_breaker_trips")
+)
+
+// CircuitBreakerState returns the state of circuit_breaker, and the number of times it has been opened.
+func CircuitBreakerState() (string, int64) {
+	copyCircuit.mu.Lock()
+	defer copyCircuit.mu.Unlock()
+	return copyCircuit.state, circuitBreakerTrips.Value()
+}
+
+var copyCircuit = newCopyBreaker()
+
+type copyBreaker struct {
+	mu        sync.Mutex
+	state     string
+	failures  int
+	openUntil time.Time
+	probing   bool
+	// changed is closed when the state is changed
+	changed chan struct{}
+}
+
+func newCopyBreaker() *copyBreaker {
+	return &copyBreaker{state: CircuitClosed, changed: make(chan struct{})}
+}
+
+// notify wakes up acquire. b.mu must be held.
+func (b *copyBreaker) notify() {
+	close(b.changed)
+	b.changed = make(chan struct{})
+}
+
+func (b *copyBreaker) reset() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.state = CircuitClosed
+	b.failures = 0
+	b.probing = false
+	circuitBreakerOpen.Set(0)
+	b.notify()
+}
+
+// acquire blocks while the circuit is open or a probe is in flight. It reports whether the next message is a probe.
+func (b *copyBreaker) acquire(ctx context.Context) bool {
+	for {
+		b.mu.Lock()
+		var wait <-chan time.Time
+		switch b.state {
+		case CircuitClosed:
+			b.mu.Unlock()
+			return false
+		case CircuitOpen:
+			d := time.Until(b.openUntil)
+			if d > 0 {
+				wait = time.After(d)
+				break
+			}
+			log.Println("[info] Circuit breaker is half-open. Probe Redshift by a message")
+			b.state = CircuitHalfOpen
+			fallthrough
+		case CircuitHalfOpen:
+			if !b.probing {
+				b.probing = true
+				b.mu.Unlock()
+				return true
+			}
+		}
+		changed := b.changed
+		b.mu.Unlock()
+		select {
+		case <-ctx.Done():
+			return false
+		case <-wait:
+		case <-changed:
+		}
+	}
+}
+
+// cancel gives up the probe when no message was received for it.
+func (b *copyBreaker) cancel(probe bool) {
+	if !probe {
+		return
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.probing = false
+	b.notify()
+}
+
+// record counts the result of a message. copied reports whether the message executed COPY on Redshift.
+// It reports whether the circuit is opened by the failure.
+func (b *copyBreaker) record(cb *CircuitBreaker, err error, probe, copied bool, now time.Time) bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	defer b.notify()
+	var ce *CopyError
+	copyFailed := errors.As(err, &ce)
+	if probe {
+		b.probing = false
+		switch {
+		case err == nil && !copied:
+			// a message completed without COPY (unmatched, skipped or deduplicated) never reached Redshift
+			log.Println("[debug] Probe completed without COPY. The next message probes again")
+		case err == nil || cb == nil:
+			log.Println("[info] Circuit breaker is closed. Resume processing messages")
+			b.state = CircuitClosed
+			b.failures = 0
+			circuitBreakerOpen.Set(0)
+		case copyFailed:
+			log.Printf("[error] Probe failed. Stop processing messages for %s", cb.CoolDown)
+			b.open(cb, now)
+			return true
+		}
+		// other failures are inconclusive. the next message probes again.
+		return false
+	}
+	if err == nil {
+		b.failures = 0
+		return false
+	}
+	if cb == nil || !copyFailed || b.state != CircuitClosed {
+		return false
+	}
+	b.failures++
+	if b.failures < cb.Failures {
+		return false
+	}
+	log.Printf("[error] Circuit breaker is open by %d consecutive COPY failures. Stop processing messages for %s", b.failures, cb.CoolDown)
+	b.open(cb, now)
+	return true
+}
+
+type copyAttemptsKey struct{}
+
+// withCopyAttempts returns a context which counts COPYs executed for the message.
+func withCopyAttempts(ctx context.Context) (context.Context, *int32) {
+	var n int32
+	return context.WithValue(ctx, copyAttemptsKey{}, &n), &n
+}
+
+// countCopyAttempt counts a COPY executed in ctx by execCopy.
+func countCopyAttempt(ctx context.Context) {
+	if n, ok := ctx.Value(copyAttemptsKey{}).(*int32); ok {
+		atomic.AddInt32(n, 1)
+	}
+}
+
+func (b *copyBreaker) open(cb *CircuitBreaker, now time.Time) {
+	b.state = CircuitOpen
+	b.openUntil = now.Add(cb.CoolDown)
+	circuitBreakerOpen.Set(1)
+	circuitBreakerTrips.Add(1)
+}
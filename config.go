@@ -1,34 +1,48 @@
 package main
 
 import (
+	"encoding/base64"
 	"fmt"
 	"io/ioutil"
 	"log"
 	"net/http"
 	"net/url"
 	"regexp"
+	"sort"
 	"strconv"
 	"strings"
+	"time"
+	"unicode/utf8"
 
 	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/endpoints"
 	"github.com/aws/aws-sdk-go/aws/session"
 	"github.com/aws/aws-sdk-go/service/s3"
 	"github.com/aws/aws-sdk-go/service/s3/s3manager"
+	"github.com/aws/aws-sdk-go/service/sqs"
 	"github.com/lib/pq"
 
 	goconfig "github.com/kayac/go-config"
+	yaml "gopkg.in/yaml.v2"
 )
 
 const (
 	S3URITemplate = "s3://%s/%s"
-	SQLTemplate   = "/* Rin */ COPY %s FROM %s CREDENTIALS '%s' REGION '%s' %s"
 	// Prefix SQL comment "/* Rin */". Because a query which start with "COPY", pq expect a PostgreSQL COPY command response, but a Redshift response is different it.
+	// When the comment is disabled by disable_sql_comment, an Executor must not prepare the query by pq.
+	SQLComment = "/* Rin */ "
 )
 
 func quoteValue(v string) string {
 	return "'" + strings.Replace(v, "'", "''", -1) + "'"
 }
 
+// quoteS3URI quotes the s3:// URI as a literal. Backslashes are doubled like quotes, because Redshift reads
+// backslash escapes in literals. Other characters of keys (e.g. "#", "?", spaces and unicode) are used as is.
+func quoteS3URI(uri string) string {
+	return quoteValue(strings.Replace(uri, `\`, `\\`, -1))
+}
+
 type Config struct {
 	QueueName   string      `yaml:"queue_name"`
 	Targets     []*Target   `yaml:"targets"`
@@ -36,6 +50,337 @@ type Config struct {
 	Redshift    *Redshift   `yaml:"redshift"`
 	S3          *S3         `yaml:"s3"`
 	SQLOption   string      `yaml:"sql_option"`
+	Strict      bool        `yaml:"strict"`
+
+	// Queues are SQS queues received in addition to queue_name, each by its own worker with its settings.
+	Queues []*Queue `yaml:"queues"`
+
+	// BucketRegions maps buckets to their regions. It overrides s3.region of targets for the bucket.
+	BucketRegions map[string]string `yaml:"bucket_regions"`
+	// RequireExplicitRegion fails loading when s3.region of any target is empty after merging.
+	RequireExplicitRegion bool `yaml:"require_explicit_region"`
+	// IgnoreBucketCase compares buckets of records with buckets of targets case-insensitively.
+	IgnoreBucketCase bool `yaml:"ignore_bucket_case"`
+	// RouteCacheSize is the number of key prefixes whose candidate targets are cached. Zero disables the cache.
+	RouteCacheSize int `yaml:"route_cache_size"`
+	targetIndex    *targetIndex
+
+	// APICredentials are credentials used by Rin to call AWS APIs (SQS, S3 and Redshift).
+	// When omitted, credentials are used. credentials fall back to them in COPY when credentials are empty.
+	APICredentials *Credentials `yaml:"api_credentials"`
+
+	// CredentialChain is the order of providers of credentials for AWS APIs: static, env, shared and instance.
+	// When omitted, the static keys are used if defined, or the SDK's default chain (env, shared and instance).
+	CredentialChain []string `yaml:"credential_chain"`
+
+	// NamedCredentials are credentials referenced by credentials_ref of targets.
+	NamedCredentials map[string]Credentials `yaml:"named_credentials"`
+
+	OmitRegionWhenSame bool `yaml:"omit_region_when_same"`
+	UseVPCEndpoint     bool `yaml:"use_vpc_endpoint"`
+	DisableSQLComment  bool `yaml:"disable_sql_comment"`
+
+	MaxInFlightMessages int `yaml:"max_inflight_messages"`
+	// MaxInFlightBytes pauses receiving messages while the sum of bodies of messages in flight exceeds the limit. A payload fetched from S3 is counted instead of its S3 pointer. Default is no limit.
+	MaxInFlightBytes int64 `yaml:"max_inflight_bytes"`
+
+	PartialFailure string `yaml:"partial_failure"`
+	// FanoutError is the policy for a record imported to multiple targets when one of them failed.
+	FanoutError string `yaml:"fanout_error"`
+	// RetryOnMissingTable keeps a message for redelivery when the target table does not exist, even if partial_failure is skip.
+	RetryOnMissingTable bool `yaml:"retry_on_missing_table"`
+
+	Delivery string `yaml:"delivery"`
+
+	// Unmatched is the policy for a message which matches no targets.
+	// UnmatchedQueueName is the queue which receives the message by "dlq".
+	Unmatched          string `yaml:"unmatched"`
+	UnmatchedQueueName string `yaml:"unmatched_queue_name"`
+
+	// MaxRecordsPerMessage rejects a message which has more records than the limit, and sends it to DeadLetterQueueName.
+	MaxRecordsPerMessage int    `yaml:"max_records_per_message"`
+	DeadLetterQueueName  string `yaml:"dead_letter_queue_name"`
+
+	// DeadLetterAttributes adds message attributes of the error, the receive count and the target
+	// to messages sent to dead_letter_queue_name.
+	DeadLetterAttributes bool `yaml:"dead_letter_attributes"`
+
+	// LogSQLMaxLength truncates SQL statements in logs to the length in bytes. Default is no truncation.
+	LogSQLMaxLength int `yaml:"log_sql_max_length"`
+
+	// MaxSQLLength is the maximum length in bytes of a COPY statement. Longer statements fail before execution. Default is MaxRedshiftSQLLength.
+	MaxSQLLength int `yaml:"max_sql_length"`
+
+	// SQLError is the policy for a message which has a record failed to build COPY SQL (e.g. an empty table name captured from the key).
+	SQLError string `yaml:"sql_error"`
+
+	// Malformed is the policy for a message whose body can't be parsed as an event.
+	// Default is "dlq" when DeadLetterQueueName is defined, otherwise "leave".
+	Malformed string `yaml:"malformed"`
+
+	// RetryQueue republishes a message failed to import with an increasing delay.
+	RetryQueue *RetryQueue `yaml:"retry_queue"`
+
+	// VisibilityHeartbeat extends the visibility timeout of messages while they are imported.
+	VisibilityHeartbeat *VisibilityHeartbeat `yaml:"visibility_heartbeat"`
+
+	// ReceiveAttributeNames and ReceiveMessageAttributeNames override the attributes requested by receiving SQS messages.
+	ReceiveAttributeNames        []string `yaml:"receive_attribute_names"`
+	ReceiveMessageAttributeNames []string `yaml:"receive_message_attribute_names"`
+
+	// MessageEncoding is the encoding of SQS message bodies. "gzip-base64" decodes and decompresses bodies before parsing.
+	MessageEncoding string `yaml:"message_encoding"`
+
+	// CopyPollInterval enables logging the progress of COPY by an AsyncExecutor.
+	// The COPY is still waited for by the message, which holds the slot of max_inflight_messages.
+	CopyPollInterval time.Duration `yaml:"copy_poll_interval"`
+
+	HTTP HTTPConfig `yaml:"http"`
+
+	// StartupDelay delays receiving messages after starting up.
+	StartupDelay time.Duration `yaml:"startup_delay"`
+	// Warmup connects to all Redshift of targets before receiving messages.
+	Warmup bool `yaml:"warmup"`
+	// WarmupConcurrency is the number of clusters warmed up concurrently. Default is DefaultWarmupConcurrency.
+	WarmupConcurrency int `yaml:"warmup_concurrency"`
+	// VerifySchema verifies that tables of targets with columns exist and have the columns before receiving messages.
+	VerifySchema bool `yaml:"verify_schema"`
+
+	// ShutdownGrace is the time to wait for messages in flight after shutting down. 0 cancels them immediately.
+	ShutdownGrace time.Duration `yaml:"shutdown_grace"`
+
+	// CopyDelay is the default copy_delay of targets.
+	CopyDelay time.Duration `yaml:"copy_delay"`
+
+	// AnalyzeAfterBytes is the default analyze_after_bytes of targets.
+	AnalyzeAfterBytes int64 `yaml:"analyze_after_bytes"`
+
+	// OnSuccessNotify is the default on_success_notify of targets.
+	OnSuccessNotify *Notify `yaml:"on_success_notify"`
+
+	// SQLAuditFile is a file which each statement is appended to as a JSON line before it is executed. COPY is redacted.
+	SQLAuditFile string `yaml:"sql_audit_file"`
+
+	// TraceOnError logs a trace of a message as JSON when processing the message failed.
+	TraceOnError bool `yaml:"trace_on_error"`
+
+	// LogResolvedTargets logs the target merged with the global sections as JSON at debug level for each matched record.
+	LogResolvedTargets bool `yaml:"log_resolved_targets"`
+
+	// TargetProvider loads targets from an external source by the interval, in addition to targets.
+	TargetProvider *TargetProviderConfig `yaml:"target_provider"`
+
+	// StallWindow warns when messages are received but none are processed within the window.
+	StallWindow time.Duration `yaml:"stall_window"`
+
+	// RedshiftHealthInterval pings each Redshift of targets by the interval, and publishes the results to redshift_up.
+	RedshiftHealthInterval time.Duration `yaml:"redshift_health_interval"`
+
+	// DiskFull pauses receiving messages when a COPY failed by Redshift out of disk, instead of retrying.
+	DiskFull *DiskFull `yaml:"disk_full"`
+
+	// CircuitBreaker stops processing messages after consecutive COPY failures.
+	CircuitBreaker *CircuitBreaker `yaml:"circuit_breaker"`
+
+	// DedupeWindow skips a record which has the same bucket, key and ETag as a record imported within the window.
+	DedupeWindow time.Duration `yaml:"dedupe_window"`
+
+	// MessageDedupeWindow skips a message of a FIFO queue which has the same MessageDeduplicationId as a message processed within the window.
+	MessageDedupeWindow time.Duration `yaml:"message_dedupe_window"`
+
+	// MessageTimeout is the deadline of processing a message from parsing to deleting it.
+	// A message exceeding the deadline is abandoned, and will be received again. Default is no deadline.
+	MessageTimeout time.Duration `yaml:"message_timeout"`
+
+	// AllowedSources restricts sources of COPY. When empty, all sources are allowed.
+	AllowedSources []AllowedSource `yaml:"allowed_sources"`
+}
+
+// AllowedSource is a pair of bucket and key prefix allowed as a source of COPY.
+type AllowedSource struct {
+	Bucket    string `yaml:"bucket"`
+	KeyPrefix string `yaml:"key_prefix"`
+}
+
+// SourceAllowed reports whether the object is covered by allowed_sources.
+func (c *Config) SourceAllowed(bucket, key string) bool {
+	if len(c.AllowedSources) == 0 {
+		return true
+	}
+	for _, s := range c.AllowedSources {
+		if equalBucket(s.Bucket, bucket, c.IgnoreBucketCase) && strings.HasPrefix(key, s.KeyPrefix) {
+			return true
+		}
+	}
+	return false
+}
+
+// Policies for a message which has failed records.
+const (
+	// PartialFailureFail retries the whole message.
+	PartialFailureFail = "fail"
+	// PartialFailureSkip skips failed records and deletes the message.
+	PartialFailureSkip = "skip"
+)
+
+// Policies for a failed target of a record imported to multiple targets.
+const (
+	// FanoutErrorAbort stops importing to the remaining targets, and retries all targets by redelivery.
+	FanoutErrorAbort = "abort"
+	// FanoutErrorContinue imports to the remaining targets, and retries only failed targets by redelivery.
+	FanoutErrorContinue = "continue"
+)
+
+// Delivery semantics of messages.
+const (
+	// DeliveryAtLeastOnce deletes a message after COPY succeeded. A message may be imported twice.
+	DeliveryAtLeastOnce = "at-least-once"
+	// DeliveryAtMostOnce deletes a message before COPY. A message may be lost when COPY failed.
+	DeliveryAtMostOnce = "at-most-once"
+)
+
+// Policies for a message which has a record failed to build COPY SQL.
+const (
+	// SQLErrorLeave leaves the message in the queue. It is received again after the visibility timeout.
+	SQLErrorLeave = "leave"
+	// SQLErrorDLQ sends the message to dead_letter_queue_name and deletes it.
+	SQLErrorDLQ = "dlq"
+)
+
+// Policies for a message whose body can't be parsed as an event.
+const (
+	// MalformedDLQ sends the message to dead_letter_queue_name and deletes it.
+	MalformedDLQ = "dlq"
+	// MalformedDelete deletes the message.
+	MalformedDelete = "delete"
+	// MalformedLeave leaves the message in the queue. It is received again after the visibility timeout.
+	MalformedLeave = "leave"
+)
+
+// Policies for a message which matches no targets.
+const (
+	// UnmatchedLeave leaves the message in the queue. It is received again after the visibility timeout.
+	UnmatchedLeave = "leave"
+	// UnmatchedDelete deletes the message.
+	UnmatchedDelete = "delete"
+	// UnmatchedDLQ sends the message to unmatched_queue_name and deletes it.
+	UnmatchedDLQ = "dlq"
+)
+
+// Encodings of SQS message bodies.
+const (
+	MessageEncodingNone       = "none"
+	MessageEncodingGzipBase64 = "gzip-base64"
+)
+
+// DefaultReceiveAttributeNames are SQS system attributes requested by default. They are logged for each message.
+var DefaultReceiveAttributeNames = []string{
+	sqs.MessageSystemAttributeNameSentTimestamp,
+	sqs.MessageSystemAttributeNameApproximateReceiveCount,
+}
+
+// receiveAttributeNames returns names of system attributes and message attributes requested by receiving SQS messages of the queue.
+// Features which use attributes add their names here.
+func (c *Config) receiveAttributeNames(queue string) ([]string, []string) {
+	attrs := c.ReceiveAttributeNames
+	if attrs == nil {
+		attrs = DefaultReceiveAttributeNames
+	}
+	if isFIFO(queue) && !hasString(attrs, "All") && !hasString(attrs, sqs.MessageSystemAttributeNameMessageDeduplicationId) {
+		attrs = append(append([]string{}, attrs...), sqs.MessageSystemAttributeNameMessageDeduplicationId)
+	}
+	msgAttrs := c.ReceiveMessageAttributeNames
+	if c.RetryQueue != nil && !hasString(msgAttrs, "All") && !hasString(msgAttrs, RetryCountAttribute) {
+		msgAttrs = append(append([]string{}, msgAttrs...), RetryCountAttribute)
+	}
+	return attrs, msgAttrs
+}
+
+// MaxRedshiftSQLLength is the maximum length of a SQL statement of Redshift.
+const MaxRedshiftSQLLength = 16 * 1024 * 1024
+
+// checkSQLLength fails when the query is longer than max_sql_length.
+func (c *Config) checkSQLLength(query string) error {
+	max := c.MaxSQLLength
+	if max <= 0 {
+		max = MaxRedshiftSQLLength
+	}
+	if n := len(query); n > max {
+		return fmt.Errorf("SQL statement of %d bytes exceeds max_sql_length %d", n, max)
+	}
+	return nil
+}
+
+// logSQL truncates the SQL logged by log_sql_max_length. The executed SQL is not truncated.
+func (c *Config) logSQL(query string) string {
+	max := c.LogSQLMaxLength
+	if max <= 0 || len(query) <= max {
+		return query
+	}
+	return fmt.Sprintf("%s... (truncated, %d bytes)", truncateRunes(query, max), len(query))
+}
+
+// truncateRunes truncates s to max bytes at most, without splitting a multi-byte character.
+func truncateRunes(s string, max int) string {
+	if len(s) <= max {
+		return s
+	}
+	n := max
+	for n > 0 && !utf8.RuneStart(s[n]) {
+		n--
+	}
+	return s[:n]
+}
+
+// isFIFO reports whether the queue is a FIFO queue. Each of queue_name and queues is decided by its name.
+func isFIFO(queue string) bool {
+	return strings.HasSuffix(queue, ".fifo")
+}
+
+func (c *Config) malformed() string {
+	if c.Malformed != "" {
+		return c.Malformed
+	}
+	if c.DeadLetterQueueName != "" {
+		return MalformedDLQ
+	}
+	return MalformedLeave
+}
+
+func (c *Config) messageDedupeWindow() time.Duration {
+	if c.MessageDedupeWindow <= 0 {
+		return DefaultMessageDedupeWindow
+	}
+	return c.MessageDedupeWindow
+}
+
+func hasString(ss []string, s string) bool {
+	for _, v := range ss {
+		if v == s {
+			return true
+		}
+	}
+	return false
+}
+
+func (c *Config) maxInFlightMessages() int {
+	if c.MaxInFlightMessages <= 0 {
+		return 1
+	}
+	return c.MaxInFlightMessages
+}
+
+// concurrentMessages returns the max number of messages in flight of queue_name and queues.
+func (c *Config) concurrentMessages() int {
+	n := c.maxInFlightMessages()
+	for _, q := range c.Queues {
+		if q.MaxInFlightMessages > 0 {
+			n += q.MaxInFlightMessages
+		} else {
+			n += c.maxInFlightMessages()
+		}
+	}
+	return n
 }
 
 type Credentials struct {
@@ -43,14 +388,159 @@ type Credentials struct {
 	AWS_SECRET_ACCESS_KEY string `yaml:"aws_secret_access_key"`
 	AWS_REGION            string `yaml:"aws_region"`
 	AWS_IAM_ROLE          string `yaml:"aws_iam_role"`
+	Partition             string `yaml:"partition"`
+
+	// AWS_SESSION_TOKEN is rendered as token of temporary access keys.
+	AWS_SESSION_TOKEN string `yaml:"aws_session_token"`
+	// AssumeRoleARN is a role which Rin assumes to pass temporary access keys to COPY.
+	// The keys are refreshed before expiry, and resolved at each COPY.
+	AssumeRoleARN string `yaml:"assume_role_arn"`
+
+	// File is a JSON or INI file which has access keys passed to COPY, re-read when it is modified for rotated keys.
+	// FileProfile is the profile of the INI file. Default is "default".
+	File        string `yaml:"file"`
+	FileProfile string `yaml:"file_profile"`
+
+	// MasterSymmetricKey is a base64 encoded key for client-side encrypted objects. COPY requires ENCRYPTED in sql_option.
+	MasterSymmetricKey string `yaml:"master_symmetric_key"`
+}
+
+// AWSCredentials returns the credentials used to call AWS APIs.
+func (c *Config) AWSCredentials() Credentials {
+	if c.APICredentials != nil {
+		return *c.APICredentials
+	}
+	return c.Credentials
+}
+
+// bucketRegion returns the region of the bucket by bucket_regions, the global s3 section or the API credentials.
+func (c *Config) bucketRegion(bucket string) string {
+	if region, ok := lookupBucketRegion(c.BucketRegions, bucket, c.IgnoreBucketCase); ok {
+		return region
+	}
+	if c.S3 != nil && c.S3.Region != "" {
+		return c.S3.Region
+	}
+	return c.AWSCredentials().AWS_REGION
+}
+
+// lookupBucketRegion returns the region of the bucket in bucket_regions, case-insensitively under ignore_bucket_case.
+func lookupBucketRegion(regions map[string]string, bucket string, ignoreCase bool) (string, bool) {
+	if region, ok := regions[bucket]; ok {
+		return region, true
+	}
+	if ignoreCase {
+		for b, region := range regions {
+			if strings.EqualFold(b, bucket) {
+				return region, true
+			}
+		}
+	}
+	return "", false
+}
+
+func (c Credentials) empty() bool {
+	return c.AWS_ACCESS_KEY_ID == "" && c.AWS_IAM_ROLE == "" && c.AssumeRoleARN == "" && c.File == ""
+}
+
+// PartitionID returns the AWS partition (aws, aws-cn, aws-us-gov) of the credentials.
+// When the partition is not configured, it is derived from the region.
+func (c Credentials) PartitionID() string {
+	if c.Partition != "" {
+		return c.Partition
+	}
+	return partitionForRegion(c.AWS_REGION)
+}
+
+func partitionForRegion(region string) string {
+	if p, ok := endpoints.PartitionForRegion(endpoints.DefaultPartitions(), region); ok {
+		return p.ID()
+	}
+	switch {
+	case strings.HasPrefix(region, "cn-"):
+		return endpoints.AwsCnPartitionID
+	case strings.HasPrefix(region, "us-gov-"):
+		return endpoints.AwsUsGovPartitionID
+	}
+	return endpoints.AwsPartitionID
+}
+
+var iamRoleARNRegexp = regexp.MustCompile(`^arn:(aws[a-z-]*):iam::[0-9]{12}:role/.+$`)
+
+// IAMRoles returns IAM role ARNs of aws_iam_role. Multiple roles are separated by comma for role chaining.
+func (c Credentials) IAMRoles() []string {
+	if c.AWS_IAM_ROLE == "" {
+		return nil
+	}
+	roles := strings.Split(c.AWS_IAM_ROLE, ",")
+	for i, role := range roles {
+		roles[i] = strings.TrimSpace(role)
+	}
+	return roles
+}
+
+func (c Credentials) validate() error {
+	partition := c.PartitionID()
+	if c.Partition != "" && c.AWS_REGION != "" && partitionForRegion(c.AWS_REGION) != c.Partition {
+		return fmt.Errorf("credentials.aws_region %s is not in the partition %s", c.AWS_REGION, c.Partition)
+	}
+	if c.MasterSymmetricKey != "" {
+		if _, err := base64.StdEncoding.DecodeString(c.MasterSymmetricKey); err != nil {
+			return fmt.Errorf("credentials.master_symmetric_key is not base64 encoded")
+		}
+	}
+	for _, role := range c.IAMRoles() {
+		m := iamRoleARNRegexp.FindStringSubmatch(role)
+		if m == nil {
+			return fmt.Errorf("credentials.aws_iam_role %q is not an IAM role ARN", role)
+		}
+		if m[1] != partition {
+			return fmt.Errorf("credentials.aws_iam_role %q is not in the partition %s", role, partition)
+		}
+	}
+	return nil
+}
+
+// validateAuth checks the credentials have exactly one authorization of COPY: access keys or aws_iam_role.
+func (c Credentials) validateAuth() error {
+	keys := c.AWS_ACCESS_KEY_ID != "" || c.AWS_SECRET_ACCESS_KEY != ""
+	if c.File != "" {
+		if keys || c.AWS_IAM_ROLE != "" || c.AssumeRoleARN != "" {
+			return fmt.Errorf("file is exclusive with access keys, aws_iam_role and assume_role_arn")
+		}
+		return nil
+	}
+	if c.AssumeRoleARN != "" {
+		if keys || c.AWS_IAM_ROLE != "" {
+			return fmt.Errorf("assume_role_arn is exclusive with access keys and aws_iam_role")
+		}
+		return nil
+	}
+	switch {
+	case keys && c.AWS_IAM_ROLE != "":
+		return fmt.Errorf("aws_iam_role and access keys are exclusive")
+	case keys && (c.AWS_ACCESS_KEY_ID == "" || c.AWS_SECRET_ACCESS_KEY == ""):
+		return fmt.Errorf("access keys require both aws_access_key_id and aws_secret_access_key")
+	case !keys && c.AWS_IAM_ROLE == "":
+		return fmt.Errorf("either access keys or aws_iam_role is required")
+	}
+	return nil
 }
 
 func (c Credentials) RedshiftCredential() string {
+	var cred string
 	if c.AWS_IAM_ROLE != "" {
-		return fmt.Sprintf("aws_iam_role=%s", c.AWS_IAM_ROLE)
+		cred = fmt.Sprintf("aws_iam_role=%s", strings.Join(c.IAMRoles(), ","))
 	} else {
-		return fmt.Sprintf("aws_access_key_id=%s;aws_secret_access_key=%s", c.AWS_ACCESS_KEY_ID, c.AWS_SECRET_ACCESS_KEY)
+		cred = fmt.Sprintf("aws_access_key_id=%s;aws_secret_access_key=%s", c.AWS_ACCESS_KEY_ID, c.AWS_SECRET_ACCESS_KEY)
+		if c.AWS_SESSION_TOKEN != "" {
+			cred += ";token=" + c.AWS_SESSION_TOKEN
+		}
 	}
+	if c.MasterSymmetricKey != "" {
+		cred += ";master_symmetric_key=" + c.MasterSymmetricKey
+	}
+	return cred
 }
 
 type Target struct {
@@ -60,7 +550,131 @@ type Target struct {
 	Break     bool      `yaml:"break"`
 	Discard   bool      `yaml:"discard"`
 
-	keyMatcher func(string) (bool, *[]string)
+	// Fallback targets match only records which no other targets match, e.g. to load unexpected objects into a quarantine table.
+	Fallback bool `yaml:"fallback"`
+
+	// MinSize and MaxSize limit the size in bytes of objects which the target matches. Zero means no limit.
+	MinSize int64 `yaml:"min_size"`
+	MaxSize int64 `yaml:"max_size"`
+
+	// AnalyzeAfterBytes runs ANALYZE of the table in background when the size in bytes of objects loaded
+	// since the last ANALYZE reaches it. Zero disables it.
+	AnalyzeAfterBytes int64 `yaml:"analyze_after_bytes"`
+
+	// Enabled is false for targets staged in the config. Disabled targets never match. Default is true.
+	Enabled *bool `yaml:"enabled"`
+
+	// Labels are selected by the -labels runtime filter, to divide targets of a config into deployments.
+	Labels map[string]string `yaml:"labels"`
+
+	// CredentialsRef is a name of named_credentials used by COPY instead of the global credentials.
+	CredentialsRef string `yaml:"credentials_ref"`
+	credentials    *Credentials
+
+	// key identifies the target in metrics and the summary.
+	key string
+
+	// SQLOptionFile is a path or URL of the file which contains sql_option. It is read once at loading.
+	SQLOptionFile string `yaml:"sql_option_file"`
+
+	// CopyPrefix copies all objects under the prefix of a marker object which has MarkerSuffix.
+	CopyPrefix   bool   `yaml:"copy_prefix"`
+	MarkerSuffix string `yaml:"marker_suffix"`
+
+	// OmitRegionWhenSame omits the REGION clause when the bucket is in the region of the cluster.
+	OmitRegionWhenSame *bool `yaml:"omit_region_when_same"`
+	// UseVPCEndpoint omits the REGION clause always, for COPY through a S3 VPC endpoint.
+	// The bucket must be in the region of the cluster.
+	UseVPCEndpoint *bool `yaml:"use_vpc_endpoint"`
+	// DisableSQLComment omits the SQLComment prefix of COPY.
+	DisableSQLComment *bool `yaml:"disable_sql_comment"`
+
+	// Format "from-metadata" chooses the data format by Content-Type of the object.
+	Format string `yaml:"format"`
+
+	// JSON renders FORMAT AS JSON with the value: "auto", "auto ignorecase", "noshred" or a s3:// URI of a JSONPaths file.
+	JSON string `yaml:"json"`
+
+	// Columns is a column list of the table to load.
+	Columns []string `yaml:"columns"`
+
+	// CompRows, TrimBlanks, MaxError and GZIP are rendered as COPY options COMPROWS, TRIMBLANKS, MAXERROR and GZIP.
+	CompRows   int  `yaml:"comprows"`
+	TrimBlanks bool `yaml:"trimblanks"`
+	MaxError   int  `yaml:"max_error"`
+	GZIP       bool `yaml:"gzip"`
+
+	// ReportLoadErrors logs a summary of rows skipped by COPY from stl_load_errors.
+	ReportLoadErrors bool `yaml:"report_load_errors"`
+
+	// CheckExists checks the object exists by HEAD before COPY.
+	CheckExists bool `yaml:"check_exists"`
+
+	// SkipArchived skips objects in GLACIER and DEEP_ARCHIVE storage classes, which COPY can't read.
+	// The storage class is read from the record, or by HEAD when HeadStorageClass and the record has no storage class.
+	SkipArchived     bool `yaml:"skip_archived"`
+	HeadStorageClass bool `yaml:"head_storage_class"`
+
+	// MaxRetries and RetryInterval override the retry settings of the redshift section.
+	MaxRetries    *int          `yaml:"max_retries"`
+	RetryInterval time.Duration `yaml:"retry_interval"`
+
+	// OnSuccessSQL is SQL executed after COPY in the same transaction.
+	// ${bucket} and ${key} are replaced by quoted literals, ${table} by the quoted table and ${rows} by pg_last_copy_count().
+	OnSuccessSQL string `yaml:"on_success_sql"`
+
+	// TableResolver is a query which returns the table (table or schema.table) of COPY for the object, e.g. the table
+	// underlying a late binding view. ${bucket}, ${key} and ${table} (the table of the target) are replaced by quoted literals.
+	TableResolver string `yaml:"table_resolver"`
+
+	// BatchID copies into a temporary staging table, and inserts the rows into the table with a batch ID column.
+	BatchID *BatchID `yaml:"batch_id"`
+
+	// BeforeCopySQL is SQL executed before COPY in the same transaction, e.g. to stage the partition of the object.
+	// ${bucket}, ${key}, ${table} are replaced as on_success_sql, and ${partition} by the quoted value parsed by partition_from_key.
+	BeforeCopySQL string `yaml:"before_copy_sql"`
+	// PartitionFromKey is a regexp to parse the partition value from the key. The value is capture groups joined by "-",
+	// e.g. "2021-01-02" from "logs/2021/01/02/x.json" by (\d{4})/(\d{2})/(\d{2}), or the whole match without groups.
+	PartitionFromKey string `yaml:"partition_from_key"`
+	partitionRegexp  *regexp.Regexp
+
+	// OnSuccessNotify publishes a LoadNotification to the SNS topic or the SQS queue after a successful COPY.
+	OnSuccessNotify *Notify `yaml:"on_success_notify"`
+
+	// Mirrors are clusters which COPY is also executed on, defined by a list of redshift.
+	// Quorum is the number of clusters which COPY must succeed on. Default is all of them.
+	Mirrors []*Redshift `yaml:"-"`
+	Quorum  int         `yaml:"quorum"`
+
+	// MinInterval delays a COPY until the interval has passed since the previous COPY to the same table.
+	MinInterval time.Duration `yaml:"min_interval"`
+
+	// CrossRegion declares that the bucket and the cluster of the target are in different regions intentionally.
+	// Without it, the mismatch is warned at startup, or fails in strict mode.
+	CrossRegion bool `yaml:"cross_region"`
+
+	// CopyDelay delays a COPY until the delay has passed since the event time of the record,
+	// to wait for the object to become visible in the region.
+	CopyDelay time.Duration `yaml:"copy_delay"`
+
+	// Ordered serializes COPYs to the same table in the order of event times of records.
+	// Records are buffered for OrderWindow (default DefaultOrderWindow) to reorder events arriving out of order.
+	Ordered     bool          `yaml:"ordered"`
+	OrderWindow time.Duration `yaml:"order_window"`
+
+	// SNS selects records by the SNS topic or a message attribute in addition to the bucket and key.
+	SNS *SNSRoute `yaml:"sns"`
+
+	// AddPartition registers objects as partitions of the external table instead of COPY.
+	AddPartition *AddPartition `yaml:"add_partition"`
+
+	// ObjectTags selects records by tags of the object in addition to the bucket and key. All tags must have the values.
+	ObjectTags map[string]string `yaml:"object_tags"`
+
+	keyMatcher       func(string) (bool, *[]string)
+	ignoreBucketCase bool
+	// bucketRegions is bucket_regions, for REGION of COPY by buckets of records.
+	bucketRegions map[string]string
 }
 
 type SQLParam struct {
@@ -78,21 +692,119 @@ func (t *Target) String() string {
 	if t.Break {
 		s = s + " => Break"
 	}
+	if !t.IsEnabled() {
+		s = s + " (disabled)"
+	}
 	return s
 }
 
+// metricKey returns the key of the target in metrics, unique among targets of the config.
+// String of targets is not unique, e.g. targets of the same table divided by min_size and max_size.
+func (t *Target) metricKey() string {
+	if t.key == "" {
+		return t.String()
+	}
+	return t.key
+}
+
+// assignTargetKeys names the targets by their positions for metricKey.
+func (c *Config) assignTargetKeys() {
+	for i, t := range c.Targets {
+		// the same targets are shared by configs composed with a target provider
+		if key := fmt.Sprintf("targets[%d] %s", i, t); t.key != key {
+			t.key = key
+		}
+	}
+}
+
+// Clusters returns the Redshift and mirrors of the target.
+func (t *Target) Clusters() []*Redshift {
+	return append([]*Redshift{t.Redshift}, t.Mirrors...)
+}
+
+// forCluster returns a copy of the target for the cluster.
+func (t *Target) forCluster(r *Redshift) *Target {
+	if r == t.Redshift {
+		return t
+	}
+	tc := *t
+	tc.Redshift = r
+	return &tc
+}
+
+func (t *Target) quorum() int {
+	if n := len(t.Mirrors) + 1; t.Quorum <= 0 || t.Quorum > n {
+		return n
+	}
+	return t.Quorum
+}
+
+// IsEnabled reports whether the target is enabled.
+func (t *Target) IsEnabled() bool {
+	return t.Enabled == nil || *t.Enabled
+}
+
 func (t *Target) Match(bucket, key string) (bool, *[]string) {
-	if bucket != t.S3.Bucket {
+	if !t.IsEnabled() || !t.matchBucket(bucket) {
+		return false, nil
+	}
+	key = t.S3.normalizeKey(key)
+	if t.CopyPrefix && (!strings.HasSuffix(key, t.MarkerSuffix) || !strings.Contains(key, "/")) {
+		// a marker at the root of the bucket would copy the whole bucket
+		return false, nil
+	}
+	if !strings.HasSuffix(key, t.S3.KeySuffix) {
 		return false, nil
 	}
-	return t.keyMatcher(key)
+	return t.keyMatcher(t.S3.stripKey(key))
 }
 
 func (t *Target) MatchEventRecord(r *EventRecord) (bool, *[]string) {
-	return t.Match(r.S3.Bucket.Name, r.S3.Object.Key)
+	ok, cap := t.Match(r.S3.Bucket.Name, r.S3.Object.Key)
+	if ok && !t.matchSize(r.S3.Object.Size) {
+		return false, nil
+	}
+	if !ok || t.SNS == nil {
+		return ok, cap
+	}
+	return t.SNS.match(r, cap)
+}
+
+func (t *Target) matchBucket(bucket string) bool {
+	return equalBucket(t.S3.Bucket, bucket, t.ignoreBucketCase)
+}
+
+// equalBucket compares bucket names, case-insensitively under ignore_bucket_case.
+func equalBucket(a, b string, ignoreCase bool) bool {
+	if ignoreCase {
+		return strings.EqualFold(a, b)
+	}
+	return a == b
+}
+
+func (t *Target) matchSize(size int64) bool {
+	if t.MinSize > 0 && size < t.MinSize {
+		return false
+	}
+	return t.MaxSize <= 0 || size <= t.MaxSize
+}
+
+// CheckRecord checks that the bucket and region of the record are consistent with the target.
+func (t *Target) CheckRecord(r *EventRecord) error {
+	if !t.matchBucket(r.S3.Bucket.Name) {
+		return &MatchError{t.String(), fmt.Errorf("bucket %s of the record differs from the target bucket %s", r.S3.Bucket.Name, t.S3.Bucket)}
+	}
+	if r.AWSRegion != "" && t.S3.Region != "" && r.AWSRegion != t.S3.Region {
+		return &MatchError{t.String(), fmt.Errorf("region %s of the record differs from the target region %s", r.AWSRegion, t.S3.Region)}
+	}
+	return nil
 }
 
 func (t *Target) buildKeyMatcher() error {
+	if t.CopyPrefix && t.MarkerSuffix == "" {
+		return fmt.Errorf("target.marker_suffix is required for copy_prefix")
+	}
+	var groups int
 	if prefix := t.S3.KeyPrefix; prefix != "" {
 		t.keyMatcher = func(key string) (bool, *[]string) {
 			if strings.HasPrefix(key, prefix) {
@@ -107,44 +819,428 @@ func (t *Target) buildKeyMatcher() error {
 		if err != nil {
 			return err
 		}
-		t.keyMatcher = func(key string) (bool, *[]string) {
-			capture := reg.FindStringSubmatch(key)
-			if len(capture) == 0 {
-				return false, nil
-			} else {
-				return true, &capture
-			}
+		groups = reg.NumSubexp()
+		t.keyMatcher = func(key string) (bool, *[]string) {
+			capture := reg.FindStringSubmatch(key)
+			if len(capture) == 0 {
+				return false, nil
+			} else {
+				return true, &capture
+			}
+		}
+	} else {
+		if t.SNS == nil && !t.Fallback {
+			log.Printf("[warn] target %s has no key_prefix and key_regexp. It matches all keys in the bucket.", t.S3)
+		}
+		t.keyMatcher = func(key string) (bool, *[]string) {
+			capture := []string{key}
+			return true, &capture
+		}
+	}
+	if t.SNS != nil && t.SNS.Attribute != "" && t.SNS.AttributeValue == "" {
+		// the value of the attribute is captured as the next group
+		groups++
+	}
+	if t.Redshift != nil {
+		placeHolders := []string{t.Redshift.Schema, t.Redshift.Table}
+		if t.AddPartition != nil {
+			placeHolders = append(placeHolders, t.AddPartition.placeHolders()...)
+		}
+		for _, s := range placeHolders {
+			if n := maxPlaceHolder(s); n > groups {
+				return fmt.Errorf("target %s references $%d, but the key matcher captures %d groups", t.S3, n, groups)
+			}
+		}
+	}
+	return nil
+}
+
+var placeHolderRegexp = regexp.MustCompile(`\$([0-9]+)`)
+
+func maxPlaceHolder(s string) int {
+	var max int
+	for _, m := range placeHolderRegexp.FindAllStringSubmatch(s, -1) {
+		if n, _ := strconv.Atoi(m[1]); n > max {
+			max = n
+		}
+	}
+	return max
+}
+
+func expandPlaceHolder(s string, capture *[]string) string {
+	for i, v := range *capture {
+		s = strings.Replace(s, "$"+strconv.Itoa(i), v, -1)
+	}
+	return s
+}
+
+// SourceKey returns the key of COPY source for the key.
+// When CopyPrefix is enabled, it returns the prefix (folder) of the key.
+func (t *Target) SourceKey(key string) string {
+	if !t.CopyPrefix {
+		return key
+	}
+	return key[:strings.LastIndex(key, "/")+1]
+}
+
+// region returns the region of REGION clause of COPY from the bucket.
+// bucket_regions is looked up by the bucket of the record, which may differ from the target bucket in case.
+func (t *Target) region(bucket string) string {
+	if aws.BoolValue(t.UseVPCEndpoint) {
+		return ""
+	}
+	region := t.S3.Region
+	if r, ok := lookupBucketRegion(t.bucketRegions, bucket, t.ignoreBucketCase); ok {
+		region = r
+	}
+	if aws.BoolValue(t.OmitRegionWhenSame) && region == t.Redshift.ClusterRegion() {
+		return ""
+	}
+	return region
+}
+
+// copyOptions returns the COPY options of typed fields followed by the option.
+func (t *Target) copyOptions(option string) []string {
+	var opts []string
+	if t.JSON != "" {
+		opts = append(opts, "FORMAT AS JSON "+quoteValue(t.JSON))
+	}
+	if t.CompRows > 0 {
+		opts = append(opts, "COMPROWS "+strconv.Itoa(t.CompRows))
+	}
+	if t.TrimBlanks {
+		opts = append(opts, "TRIMBLANKS")
+	}
+	if t.MaxError > 0 {
+		opts = append(opts, "MAXERROR "+strconv.Itoa(t.MaxError))
+	}
+	if t.GZIP {
+		opts = append(opts, "GZIP")
+	}
+	if option = strings.TrimSpace(option); option != "" {
+		opts = append(opts, option)
+	}
+	return opts
+}
+
+// typedOptionKeywords returns keywords of COPY options rendered by typed fields of the target.
+func (t *Target) typedOptionKeywords() []string {
+	var keywords []string
+	if t.JSON != "" {
+		keywords = append(keywords, "JSON")
+	}
+	if t.CompRows > 0 {
+		keywords = append(keywords, "COMPROWS")
+	}
+	if t.TrimBlanks {
+		keywords = append(keywords, "TRIMBLANKS")
+	}
+	if t.MaxError > 0 {
+		keywords = append(keywords, "MAXERROR")
+	}
+	if t.GZIP {
+		keywords = append(keywords, "GZIP")
+	}
+	return keywords
+}
+
+// conflictingOptions returns keywords in sql_option which are also rendered by typed fields.
+func (t *Target) conflictingOptions() []string {
+	keywords := t.typedOptionKeywords()
+	if len(keywords) == 0 || t.SQLOption == "" {
+		return nil
+	}
+	tokens, err := tokenizeSQL(t.SQLOption)
+	if err != nil {
+		return nil
+	}
+	var conflicts []string
+	for _, k := range keywords {
+		for _, tok := range tokens {
+			if tok.kind == 'w' && tok.value == k {
+				conflicts = append(conflicts, k)
+				break
+			}
+		}
+	}
+	return conflicts
+}
+
+// JSONFormatValues are values of json except for JSONPaths URIs.
+var JSONFormatValues = []string{"auto", "auto ignorecase", "noshred"}
+
+var jsonPathsURIRegexp = regexp.MustCompile(`^s3://[a-z0-9][a-z0-9.-]{1,61}[a-z0-9]/[^']+$`)
+
+func validateJSONFormat(v string) error {
+	for _, f := range JSONFormatValues {
+		if v == f {
+			return nil
+		}
+	}
+	if jsonPathsURIRegexp.MatchString(v) {
+		return nil
+	}
+	return fmt.Errorf("target.json %q must be %s or a s3:// URI of a JSONPaths file", v, strings.Join(JSONFormatValues, ", "))
+}
+
+// copyStatement is the parts of a COPY statement.
+// String renders the clauses in the order of the COPY syntax:
+// COPY table [(columns)] FROM source CREDENTIALS credentials [REGION region] [options].
+type copyStatement struct {
+	table       string
+	columns     []string
+	source      string
+	credentials string
+	region      string
+	options     []string
+}
+
+func (s *copyStatement) validate() error {
+	if s.table == "" {
+		return fmt.Errorf("COPY has no table")
+	}
+	if s.source == "" {
+		return fmt.Errorf("COPY has no source")
+	}
+	for _, o := range s.options {
+		if !balancedQuotes(o) {
+			return fmt.Errorf("COPY option has unbalanced quotes: %s", o)
+		}
+	}
+	return nil
+}
+
+func (s *copyStatement) String() string {
+	var b strings.Builder
+	b.WriteString("COPY ")
+	b.WriteString(s.table)
+	if len(s.columns) > 0 {
+		cols := make([]string, len(s.columns))
+		for i, c := range s.columns {
+			cols[i] = pq.QuoteIdentifier(c)
+		}
+		b.WriteString(" (" + strings.Join(cols, ", ") + ")")
+	}
+	b.WriteString(" FROM " + quoteS3URI(s.source))
+	b.WriteString(" " + credentialsClause(s.credentials))
+	if s.region != "" {
+		b.WriteString(" REGION " + quoteValue(s.region))
+	}
+	for _, o := range s.options {
+		b.WriteString(" " + o)
+	}
+	return normalizeSpace(b.String())
+}
+
+// normalizeSpace replaces runs of whitespaces out of quotes with a single space, and trims the query.
+// Literals and identifiers in quotes are kept as is. -- comments are removed before newlines are replaced,
+// so a comment never comments out the rest of the query.
+func normalizeSpace(query string) string {
+	query = stripSQLComments(query)
+	var b strings.Builder
+	var quote byte
+	space := false
+	for i := 0; i < len(query); i++ {
+		c := query[i]
+		if quote == 0 && (c == ' ' || c == '\t' || c == '\n' || c == '\r') {
+			space = true
+			continue
+		}
+		if space && b.Len() > 0 {
+			b.WriteByte(' ')
+		}
+		space = false
+		switch {
+		case quote == 0 && (c == '\'' || c == '"'):
+			quote = c
+		case c == quote:
+			// an escaped quote closes and reopens the quote
+			quote = 0
+		}
+		b.WriteByte(c)
+	}
+	return b.String()
+}
+
+// stripSQLComments removes -- comments out of quotes up to the end of each line. Newlines are kept.
+func stripSQLComments(query string) string {
+	var b strings.Builder
+	var quote byte
+	for i := 0; i < len(query); i++ {
+		c := query[i]
+		if quote == 0 && c == '-' && i+1 < len(query) && query[i+1] == '-' {
+			for i < len(query) && query[i] != '\n' {
+				i++
+			}
+			if i < len(query) {
+				b.WriteByte('\n')
+			}
+			continue
+		}
+		switch {
+		case quote == 0 && (c == '\'' || c == '"'):
+			quote = c
+		case c == quote:
+			quote = 0
+		}
+		b.WriteByte(c)
+	}
+	return b.String()
+}
+
+func credentialsClause(cred string) string {
+	return "CREDENTIALS " + quoteValue(cred)
+}
+
+// BuildCopySQLRedacted builds COPY SQL, and also returns the SQL which the credentials are redacted for logging.
+func (t *Target) BuildCopySQLRedacted(key string, cred Credentials, capture *[]string) (string, string, error) {
+	query, err := t.BuildCopySQL(key, cred, capture)
+	if err != nil {
+		return "", "", err
+	}
+	return query, redactCredentials(query, t.CopyCredentials(cred)), nil
+}
+
+// RedactedCredentials replaces the CREDENTIALS clause in redacted SQL.
+const RedactedCredentials = "CREDENTIALS '***'"
+
+func redactCredentials(query string, cred Credentials) string {
+	return strings.Replace(query, credentialsClause(cred.RedshiftCredential()), RedactedCredentials, 1)
+}
+
+// CopyCredentials returns the credentials for COPY. It is the named credentials referenced by the target, or cred.
+func (t *Target) CopyCredentials(cred Credentials) Credentials {
+	if t.credentials != nil {
+		return *t.credentials
+	}
+	return cred
+}
+
+// tableName returns the quoted table name of COPY expanded by the capture.
+func (t *Target) tableName(capture *[]string) string {
+	table := pq.QuoteIdentifier(expandPlaceHolder(t.Redshift.Table, capture))
+	if t.Redshift.Schema == "" {
+		return table
+	}
+	return pq.QuoteIdentifier(expandPlaceHolder(t.Redshift.Schema, capture)) + "." + table
+}
+
+// plainTableName returns the unquoted name of the table, "schema.table" or "table".
+func (t *Target) plainTableName(capture *[]string) string {
+	table := expandPlaceHolder(t.Redshift.Table, capture)
+	if t.Redshift.Schema == "" {
+		return table
+	}
+	return expandPlaceHolder(t.Redshift.Schema, capture) + "." + table
+}
+
+// SuccessSQL renders on_success_sql for the object. It returns an empty string when on_success_sql is not defined.
+func (t *Target) SuccessSQL(bucket, key string, capture *[]string) string {
+	if t.OnSuccessSQL == "" {
+		return ""
+	}
+	return strings.NewReplacer(
+		"${bucket}", quoteValue(bucket),
+		"${key}", quoteValue(key),
+		"${table}", t.tableName(capture),
+		"${rows}", "pg_last_copy_count()",
+	).Replace(t.OnSuccessSQL)
+}
+
+// PreCopySQL renders before_copy_sql for the object. It returns an empty string when before_copy_sql is not defined.
+func (t *Target) PreCopySQL(bucket, key string, capture *[]string) (string, error) {
+	if t.BeforeCopySQL == "" {
+		return "", nil
+	}
+	var partition string
+	if t.partitionRegexp != nil {
+		m := t.partitionRegexp.FindStringSubmatch(key)
+		if m == nil {
+			return "", fmt.Errorf("partition_from_key %s does not match the key %s", t.PartitionFromKey, key)
+		}
+		if len(m) == 1 {
+			partition = m[0]
+		} else {
+			partition = strings.Join(m[1:], "-")
 		}
+	}
+	return strings.NewReplacer(
+		"${bucket}", quoteValue(bucket),
+		"${key}", quoteValue(key),
+		"${table}", t.tableName(capture),
+		"${partition}", quoteValue(partition),
+	).Replace(t.BeforeCopySQL), nil
+}
+
+// TableResolverSQL renders table_resolver for the object.
+func (t *Target) TableResolverSQL(bucket, key string, capture *[]string) string {
+	return strings.NewReplacer(
+		"${bucket}", quoteValue(bucket),
+		"${key}", quoteValue(key),
+		"${table}", quoteValue(t.plainTableName(capture)),
+	).Replace(t.TableResolver)
+}
+
+// withTable returns a copy of the target which copies to the table, "table" or "schema.table".
+func (t *Target) withTable(name string) *Target {
+	tc := *t
+	r := *t.Redshift
+	if i := strings.LastIndex(name, "."); i >= 0 {
+		r.Schema, r.Table = name[:i], name[i+1:]
 	} else {
-		return fmt.Errorf("target.key_prefix or key_regexp is not defined")
+		r.Table = name
 	}
-	return nil
+	tc.Redshift = &r
+	return &tc
 }
 
-func expandPlaceHolder(s string, capture *[]string) string {
-	for i, v := range *capture {
-		s = strings.Replace(s, "$"+strconv.Itoa(i), v, -1)
+func (t *Target) buildPartitionRegexp() error {
+	if t.PartitionFromKey == "" {
+		if strings.Contains(t.BeforeCopySQL, "${partition}") {
+			return fmt.Errorf("target %s: ${partition} of before_copy_sql requires partition_from_key", t.S3)
+		}
+		return nil
 	}
-	return s
+	reg, err := regexp.Compile(t.PartitionFromKey)
+	if err != nil {
+		return fmt.Errorf("target %s: invalid partition_from_key, %s", t.S3, err)
+	}
+	t.partitionRegexp = reg
+	return nil
 }
 
 func (t *Target) BuildCopySQL(key string, cred Credentials, capture *[]string) (string, error) {
-	var table string
-	_table := expandPlaceHolder(t.Redshift.Table, capture)
-	if t.Redshift.Schema == "" {
-		table = pq.QuoteIdentifier(_table)
-	} else {
-		_schema := expandPlaceHolder(t.Redshift.Schema, capture)
-		table = pq.QuoteIdentifier(_schema) + "." + pq.QuoteIdentifier(_table)
-	}
-	query := fmt.Sprintf(
-		SQLTemplate,
-		table,
-		quoteValue(fmt.Sprintf(S3URITemplate, t.S3.Bucket, key)),
-		cred.RedshiftCredential(),
-		t.S3.Region,
-		t.SQLOption,
-	)
+	return t.BuildCopySQLWithOption(key, cred, capture, t.SQLOption)
+}
+
+// BuildCopySQLWithOption builds COPY SQL with the option instead of the target's sql_option.
+func (t *Target) BuildCopySQLWithOption(key string, cred Credentials, capture *[]string, option string) (string, error) {
+	return t.buildCopySQL(t.S3.Bucket, key, t.CopyCredentials(cred), capture, option)
+}
+
+// buildCopySQL builds COPY SQL for the object of the bucket with the credentials resolved for the target.
+func (t *Target) buildCopySQL(bucket, key string, cred Credentials, capture *[]string, option string) (string, error) {
+	if table := expandPlaceHolder(t.Redshift.Table, capture); table == "" || placeHolderRegexp.MatchString(table) {
+		return "", fmt.Errorf("invalid table name %q expanded from %s for key %s", table, t.Redshift.Table, key)
+	}
+	if t.CopyPrefix && t.SourceKey(key) == "" {
+		return "", fmt.Errorf("copy_prefix can't copy the whole bucket by the marker %s at the root", key)
+	}
+	stmt := &copyStatement{
+		table:       t.tableName(capture),
+		columns:     t.Columns,
+		source:      fmt.Sprintf(S3URITemplate, t.S3.sourceBucket(), t.SourceKey(key)),
+		credentials: cred.RedshiftCredential(),
+		region:      t.region(bucket),
+		options:     t.copyOptions(option),
+	}
+	if err := stmt.validate(); err != nil {
+		return "", err
+	}
+	query := stmt.String()
+	if !aws.BoolValue(t.DisableSQLComment) {
+		query = SQLComment + query
+	}
 	return query, nil
 }
 
@@ -153,17 +1249,112 @@ type S3 struct {
 	Bucket    string `yaml:"bucket"`
 	KeyPrefix string `yaml:"key_prefix"`
 	KeyRegexp string `yaml:"key_regexp"`
+	KeySuffix string `yaml:"key_suffix"`
+
+	// KeyStripPrefix is prefixes stripped from keys before matching by key_prefix and key_regexp.
+	// The original key is used for the COPY source.
+	KeyStripPrefix stringList `yaml:"key_strip_prefix"`
+
+	// NormalizeSeparators converts backslashes in keys to slashes before matching.
+	// The original key is used for the COPY source.
+	NormalizeSeparators bool `yaml:"normalize_separators"`
+
+	// AccessPoint is an ARN of a S3 access point of the bucket. COPY reads objects through it,
+	// by the source s3://<access point ARN>/<key>. Records are matched by the bucket.
+	AccessPoint string `yaml:"access_point"`
+}
+
+// sourceBucket returns the bucket part of s3:// URIs of COPY sources.
+func (s3 *S3) sourceBucket() string {
+	if s3.AccessPoint != "" {
+		return s3.AccessPoint
+	}
+	return s3.Bucket
+}
+
+var accessPointARNRegexp = regexp.MustCompile(`^arn:aws[a-z-]*:s3:[a-z0-9-]+:[0-9]{12}:accesspoint/[a-z0-9][a-z0-9-]{1,48}[a-z0-9]$`)
+
+// SNSRoute matches records by the envelope of SNS notifications.
+type SNSRoute struct {
+	// TopicARN matches records published to the topic.
+	TopicARN string `yaml:"topic_arn"`
+	// Attribute matches records of messages which have the message attribute.
+	// When AttributeValue is empty, any value matches and the value is captured as the next placeholder of the key matcher.
+	Attribute      string `yaml:"attribute"`
+	AttributeValue string `yaml:"attribute_value"`
+}
+
+func (r *SNSRoute) match(record *EventRecord, capture *[]string) (bool, *[]string) {
+	if r.TopicARN != "" && record.TopicARN != r.TopicARN {
+		return false, nil
+	}
+	if r.Attribute == "" {
+		return true, capture
+	}
+	v, ok := record.MessageAttributes[r.Attribute]
+	if !ok {
+		return false, nil
+	}
+	if r.AttributeValue != "" {
+		return v == r.AttributeValue, capture
+	}
+	if v == "" {
+		return false, nil
+	}
+	c := append(append([]string{}, *capture...), v)
+	return true, &c
+}
+
+// normalizeKey returns the key which backslashes are converted to slashes by normalize_separators.
+func (s3 S3) normalizeKey(key string) string {
+	if !s3.NormalizeSeparators {
+		return key
+	}
+	return strings.Replace(key, `\`, "/", -1)
+}
+
+// stripKey returns the key without the first prefix of key_strip_prefix which the key has.
+func (s3 S3) stripKey(key string) string {
+	for _, p := range s3.KeyStripPrefix {
+		if strings.HasPrefix(key, p) {
+			return strings.TrimPrefix(key, p)
+		}
+	}
+	return key
+}
+
+// stringList is a list of strings, which can be written as a string in yaml.
+type stringList []string
+
+func (l *stringList) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	var s string
+	if err := unmarshal(&s); err == nil {
+		*l = stringList{s}
+		return nil
+	}
+	var ss []string
+	if err := unmarshal(&ss); err != nil {
+		return err
+	}
+	*l = ss
+	return nil
 }
 
 func (s3 S3) String() string {
+	var s string
 	if s3.KeyPrefix != "" {
-		return fmt.Sprintf(S3URITemplate, s3.Bucket, s3.KeyPrefix)
+		s = fmt.Sprintf(S3URITemplate, s3.Bucket, s3.KeyPrefix)
 	} else {
-		return fmt.Sprintf(S3URITemplate, s3.Bucket, s3.KeyRegexp)
+		s = fmt.Sprintf(S3URITemplate, s3.Bucket, s3.KeyRegexp)
 	}
+	if s3.KeySuffix != "" {
+		s = s + "*" + s3.KeySuffix
+	}
+	return s
 }
 
 type Redshift struct {
+	Region           string `yaml:"region"`
 	Host             string `yaml:"host"`
 	Port             int    `yaml:"port"`
 	DBName           string `yaml:"dbname"`
@@ -172,22 +1363,180 @@ type Redshift struct {
 	Schema           string `yaml:"schema"`
 	Table            string `yaml:"table"`
 	ReconnectOnError *bool  `yaml:"reconnect_on_error"`
+
+	// ApplicationName is set to application_name of connections to attribute queries in system tables. Default is "rin".
+	ApplicationName string `yaml:"application_name"`
+
+	SessionSettings map[string]string `yaml:"session_settings"`
+
+	// SearchPath is set to search_path before each COPY. Schemas are quoted, so mixed-case names are preserved.
+	SearchPath []string `yaml:"search_path"`
+
+	// MaxTotalConns limits open connections to each cluster (the pool of a DSN), and concurrent COPYs across all targets.
+	// It is read from the global redshift section.
+	MaxTotalConns int `yaml:"max_total_conns"`
+
+	// ConnMaxLifetime and ConnMaxIdleTime recycle pooled connections before Redshift or the network drops them.
+	// They are read from the global redshift section.
+	ConnMaxLifetime time.Duration `yaml:"conn_max_lifetime"`
+	ConnMaxIdleTime time.Duration `yaml:"conn_max_idle_time"`
+
+	// MaxRetries is the number of retries of a failed COPY before failing the message.
+	MaxRetries    *int          `yaml:"max_retries"`
+	RetryInterval time.Duration `yaml:"retry_interval"`
+
+	// mirrors are clusters after the first one of the redshift list.
+	mirrors []*Redshift
+}
+
+// UnmarshalYAML accepts a list of clusters. The first one is the Redshift, and the others are mirrors of it.
+func (r *Redshift) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	type plain Redshift
+	var list []plain
+	if err := unmarshal(&list); err == nil {
+		if len(list) == 0 {
+			return fmt.Errorf("redshift must have at least one cluster")
+		}
+		*r = Redshift(list[0])
+		for _, m := range list[1:] {
+			mirror := Redshift(m)
+			r.mirrors = append(r.mirrors, &mirror)
+		}
+		return nil
+	}
+	return unmarshal((*plain)(r))
+}
+
+// inherit fills empty connection and session settings by the parent.
+func (r *Redshift) inherit(parent *Redshift) {
+	if r.Region == "" {
+		r.Region = parent.Region
+	}
+	if r.Host == "" {
+		r.Host = parent.Host
+	}
+	if r.Port == 0 {
+		r.Port = parent.Port
+	}
+	if r.DBName == "" {
+		r.DBName = parent.DBName
+	}
+	if r.User == "" {
+		r.User = parent.User
+	}
+	if r.Password == "" {
+		r.Password = parent.Password
+	}
+	if r.Schema == "" {
+		r.Schema = parent.Schema
+	}
+	if r.Table == "" {
+		r.Table = parent.Table
+	}
+	if r.ReconnectOnError == nil {
+		r.ReconnectOnError = parent.ReconnectOnError
+	}
+	if r.ApplicationName == "" {
+		r.ApplicationName = parent.ApplicationName
+	}
+	if r.SessionSettings == nil {
+		r.SessionSettings = parent.SessionSettings
+	}
+	if r.SearchPath == nil {
+		r.SearchPath = parent.SearchPath
+	}
+	if r.MaxRetries == nil {
+		r.MaxRetries = parent.MaxRetries
+	}
+	if r.RetryInterval == 0 {
+		r.RetryInterval = parent.RetryInterval
+	}
+}
+
+var sessionSettingNameRegexp = regexp.MustCompile(`^[a-zA-Z_][a-zA-Z0-9_]*$`)
+
+func (r Redshift) validateSessionSettings() error {
+	for name := range r.SessionSettings {
+		if !sessionSettingNameRegexp.MatchString(name) {
+			return fmt.Errorf("invalid session setting name %q", name)
+		}
+		if len(r.SearchPath) > 0 && strings.EqualFold(name, "search_path") {
+			return fmt.Errorf("search_path is defined in both search_path and session_settings")
+		}
+	}
+	for _, schema := range r.SearchPath {
+		if schema == "" {
+			return fmt.Errorf("search_path has an empty schema")
+		}
+	}
+	return nil
+}
+
+// SessionSQLs returns SET LOCAL statements for search_path and the session settings, sorted by the name.
+// SET LOCAL lasts until the end of the transaction, so the settings never leak to
+// the other statements sharing a pooled connection.
+func (r Redshift) SessionSQLs() []string {
+	return r.sessionSQLs("SET LOCAL")
+}
+
+// sessionSQLs returns the statements of the session settings by the verb.
+// Statements out of a transaction need "SET", followed by RESET ALL.
+func (r Redshift) sessionSQLs(verb string) []string {
+	names := make([]string, 0, len(r.SessionSettings))
+	for name := range r.SessionSettings {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	sqls := make([]string, 0, len(names)+1)
+	if len(r.SearchPath) > 0 {
+		schemas := make([]string, len(r.SearchPath))
+		for i, s := range r.SearchPath {
+			schemas[i] = pq.QuoteIdentifier(s)
+		}
+		sqls = append(sqls, verb+" search_path TO "+strings.Join(schemas, ", "))
+	}
+	for _, name := range names {
+		sqls = append(sqls, fmt.Sprintf("%s %s TO %s", verb, name, quoteValue(r.SessionSettings[name])))
+	}
+	return sqls
+}
+
+// ClusterRegion returns the region of the cluster.
+// When the region is not configured, it is derived from the host name of the cluster endpoint.
+func (r Redshift) ClusterRegion() string {
+	if r.Region != "" {
+		return r.Region
+	}
+	// examplecluster.abc123xyz789.us-west-2.redshift.amazonaws.com
+	parts := strings.Split(r.Host, ".")
+	if len(parts) >= 5 && parts[3] == "redshift" {
+		return parts[2]
+	}
+	return ""
 }
 
 func (r Redshift) DSN() string {
-	return fmt.Sprintf("postgres://%s:%s@%s:%d/%s",
-		url.QueryEscape(r.User), url.QueryEscape(r.Password),
-		url.QueryEscape(r.Host), r.Port, url.QueryEscape(r.DBName),
-	)
+	return r.DSNWith(r.User, r.Password)
 }
 
 func (r Redshift) DSNWith(user, password string) string {
-	return fmt.Sprintf("postgres://%s:%s@%s:%d/%s",
+	return fmt.Sprintf("postgres://%s:%s@%s:%d/%s?application_name=%s",
 		url.QueryEscape(user), url.QueryEscape(password),
 		url.QueryEscape(r.Host), r.Port, url.QueryEscape(r.DBName),
+		url.QueryEscape(r.applicationName()),
 	)
 }
 
+// DefaultApplicationName is application_name of connections when redshift.application_name is not set.
+const DefaultApplicationName = "rin"
+
+func (r Redshift) applicationName() string {
+	if r.ApplicationName == "" {
+		return DefaultApplicationName
+	}
+	return r.ApplicationName
+}
+
 func (r Redshift) VisibleDSN() string {
 	return fmt.Sprintf("redshift://%s:****@%s:%d/%s",
 		url.QueryEscape(r.User),
@@ -253,88 +1602,387 @@ func fetchS3(u *url.URL) ([]byte, error) {
 func LoadConfig(path string) (*Config, error) {
 	src, err := loadSrcFrom(path)
 	if err != nil {
-		return nil, err
+		return nil, &ConfigError{err}
 	}
 	var c Config
 	err = goconfig.LoadWithEnvBytes(&c, src)
 	if err != nil {
-		return nil, err
+		return nil, &ConfigError{err}
 	}
-	err = (&c).merge()
-	if err != nil {
-		return nil, err
+	// problems of targets found by merge are reported with the others
+	errs := ValidationErrors{}.add((&c).merge()).add((&c).validate())
+	if err := errs.err(); err != nil {
+		return &c, &ConfigError{err}
 	}
-	return &c, (&c).validate()
+	c.buildTargetIndex()
+	c.assignTargetKeys()
+	return &c, nil
 }
 
 func (c *Config) validate() error {
+	var errs ValidationErrors
 	if c.QueueName == "" {
-		return fmt.Errorf("queue_name required")
+		errs = append(errs, fmt.Errorf("queue_name required"))
 	}
 	if len(c.Targets) == 0 {
-		return fmt.Errorf("no targets defined")
+		errs = append(errs, fmt.Errorf("no targets defined"))
 	}
-	return nil
+	queues := map[string]bool{c.QueueName: true}
+	for i, q := range c.Queues {
+		if err := q.validate(); err != nil {
+			errs = append(errs, fmt.Errorf("queues[%d]: %s", i, err))
+		} else if queues[q.Name] {
+			errs = append(errs, fmt.Errorf("queues[%d]: %s is defined twice", i, q.Name))
+		}
+		queues[q.Name] = true
+	}
+	if c.APICredentials != nil {
+		if err := c.APICredentials.validate(); err != nil {
+			errs = append(errs, fmt.Errorf("api_credentials: %s", err))
+		}
+	}
+	if err := c.Credentials.validate(); err != nil {
+		errs = append(errs, err)
+	}
+	names := make([]string, 0, len(c.NamedCredentials))
+	for name := range c.NamedCredentials {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		if err := c.NamedCredentials[name].validate(); err != nil {
+			errs = append(errs, fmt.Errorf("named_credentials.%s: %s", name, err))
+		}
+	}
+	switch c.PartialFailure {
+	case "", PartialFailureFail, PartialFailureSkip:
+	default:
+		errs = append(errs, fmt.Errorf("partial_failure must be %s or %s", PartialFailureFail, PartialFailureSkip))
+	}
+	switch c.FanoutError {
+	case "", FanoutErrorAbort, FanoutErrorContinue:
+	default:
+		errs = append(errs, fmt.Errorf("fanout_error must be %s or %s", FanoutErrorAbort, FanoutErrorContinue))
+	}
+	switch c.Delivery {
+	case "", DeliveryAtLeastOnce, DeliveryAtMostOnce:
+	default:
+		errs = append(errs, fmt.Errorf("delivery must be %s or %s", DeliveryAtLeastOnce, DeliveryAtMostOnce))
+	}
+	switch c.Unmatched {
+	case "", UnmatchedLeave, UnmatchedDelete:
+	case UnmatchedDLQ:
+		if c.UnmatchedQueueName == "" {
+			errs = append(errs, fmt.Errorf("unmatched_queue_name is required for unmatched: %s", UnmatchedDLQ))
+		}
+	default:
+		errs = append(errs, fmt.Errorf("unmatched must be %s, %s or %s", UnmatchedLeave, UnmatchedDelete, UnmatchedDLQ))
+	}
+	if p := c.TargetProvider; p != nil && p.DynamoDB != nil && p.DynamoDB.TableName == "" {
+		errs = append(errs, fmt.Errorf("target_provider.dynamodb.table_name is required"))
+	}
+	if c.MaxSQLLength < 0 {
+		errs = append(errs, fmt.Errorf("max_sql_length must be a positive number"))
+	}
+	if c.MaxRecordsPerMessage < 0 {
+		errs = append(errs, fmt.Errorf("max_records_per_message must be a positive number"))
+	}
+	if c.MaxRecordsPerMessage > 0 && c.DeadLetterQueueName == "" {
+		errs = append(errs, fmt.Errorf("dead_letter_queue_name is required for max_records_per_message"))
+	}
+	if c.RetryQueue != nil {
+		if err := c.RetryQueue.validate(); err != nil {
+			errs = append(errs, err)
+		}
+		if !queues[c.RetryQueue.QueueName] {
+			// messages sent to the queue would be never imported
+			errs = append(errs, fmt.Errorf("retry_queue.queue_name %s is not received by Rin. It must be queue_name or one of queues", c.RetryQueue.QueueName))
+		}
+	}
+	if c.VisibilityHeartbeat != nil {
+		if err := c.VisibilityHeartbeat.validate(); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	if err := validateCredentialChain(c.CredentialChain, c.AWSCredentials()); err != nil {
+		errs = append(errs, err)
+	}
+	if c.DiskFull != nil {
+		if err := c.DiskFull.validate(); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	if c.CircuitBreaker != nil {
+		if err := c.CircuitBreaker.validate(); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	switch c.SQLError {
+	case "", SQLErrorLeave:
+	case SQLErrorDLQ:
+		if c.DeadLetterQueueName == "" {
+			errs = append(errs, fmt.Errorf("dead_letter_queue_name is required for sql_error: %s", SQLErrorDLQ))
+		}
+	default:
+		errs = append(errs, fmt.Errorf("sql_error must be %s or %s", SQLErrorLeave, SQLErrorDLQ))
+	}
+	switch c.Malformed {
+	case "", MalformedDelete, MalformedLeave:
+	case MalformedDLQ:
+		if c.DeadLetterQueueName == "" {
+			errs = append(errs, fmt.Errorf("dead_letter_queue_name is required for malformed: %s", MalformedDLQ))
+		}
+	default:
+		errs = append(errs, fmt.Errorf("malformed must be %s, %s or %s", MalformedDLQ, MalformedDelete, MalformedLeave))
+	}
+	switch c.MessageEncoding {
+	case "", MessageEncodingNone, MessageEncodingGzipBase64:
+	default:
+		errs = append(errs, fmt.Errorf("message_encoding must be %s or %s", MessageEncodingNone, MessageEncodingGzipBase64))
+	}
+	for i, s := range c.AllowedSources {
+		if s.Bucket == "" {
+			errs = append(errs, fmt.Errorf("allowed_sources[%d]: bucket is required", i))
+		}
+	}
+	defined := make(map[string]int, len(c.Targets))
+	for i, t := range c.Targets {
+		if t.S3.Bucket == "" {
+			errs = append(errs, fmt.Errorf("targets[%d]: s3.bucket is not defined in the target and the global s3 section", i))
+		}
+		if b, err := yaml.Marshal(t); err == nil {
+			if j, ok := defined[string(b)]; ok {
+				err := fmt.Errorf("targets[%d] is a duplicate of targets[%d] %s", i, j, t)
+				if c.Strict {
+					errs = append(errs, err)
+				} else {
+					log.Printf("[warn] %s", err)
+				}
+			} else {
+				defined[string(b)] = i
+			}
+		}
+		if ap := t.S3.AccessPoint; ap != "" && !accessPointARNRegexp.MatchString(ap) {
+			errs = append(errs, fmt.Errorf("targets[%d]: s3.access_point %q is not an ARN of a S3 access point", i, ap))
+		}
+		if t.MinSize < 0 || t.MaxSize < 0 || (t.MaxSize > 0 && t.MinSize > t.MaxSize) {
+			errs = append(errs, fmt.Errorf("targets[%d]: min_size %d and max_size %d are not a valid range", i, t.MinSize, t.MaxSize))
+		}
+		if t.AnalyzeAfterBytes < 0 {
+			errs = append(errs, fmt.Errorf("targets[%d]: analyze_after_bytes must not be negative", i))
+		}
+		if t.Ordered && c.concurrentMessages() <= 1 {
+			// a single message in flight waits for order_window with no messages to reorder
+			errs = append(errs, fmt.Errorf("targets[%d]: ordered requires max_inflight_messages more than 1 to reorder messages", i))
+		}
+		if c.RequireExplicitRegion && !t.Discard && t.S3.Region == "" {
+			errs = append(errs, fmt.Errorf("targets[%d]: s3.region is not defined in the target, the global s3 section and bucket_regions", i))
+		}
+		if !t.Discard && t.AddPartition == nil {
+			// resolved after falling back to api_credentials or named_credentials
+			if err := t.CopyCredentials(c.Credentials).validateAuth(); err != nil {
+				source := "credentials"
+				if t.CredentialsRef != "" {
+					source = "named_credentials." + t.CredentialsRef
+				}
+				errs = append(errs, fmt.Errorf("targets[%d]: %s of COPY: %s", i, source, err))
+			}
+		}
+	}
+	return errs.err()
 }
 
 func (c *Config) merge() error {
+	if c.APICredentials != nil && c.Credentials.empty() {
+		// COPY falls back to api_credentials
+		region := c.Credentials.AWS_REGION
+		c.Credentials = *c.APICredentials
+		if region != "" {
+			c.Credentials.AWS_REGION = region
+		}
+	}
+	if c.RetryQueue != nil && c.RetryQueue.QueueName == "" {
+		c.RetryQueue.QueueName = c.QueueName
+	}
 	cr := c.Redshift
 	cs := c.S3
-	for _, t := range c.Targets {
-		if t.SQLOption == "" {
-			t.SQLOption = c.SQLOption
+	if cs == nil {
+		cs = &S3{}
+	}
+	var errs ValidationErrors
+	for i, t := range c.Targets {
+		for _, err := range c.mergeTarget(t, cr, cs) {
+			errs = append(errs, fmt.Errorf("targets[%d]: %s", i, err))
 		}
-		tr := t.Redshift
-		if tr == nil {
-			t.Redshift = cr
+	}
+	return errs.err()
+}
+
+// mergeTarget fills the target by the global sections, and returns all problems of the target.
+func (c *Config) mergeTarget(t *Target, cr *Redshift, cs *S3) []error {
+	var errs []error
+	t.ignoreBucketCase = c.IgnoreBucketCase
+	t.bucketRegions = c.BucketRegions
+	if t.SQLOptionFile != "" {
+		if t.SQLOption != "" {
+			errs = append(errs, fmt.Errorf("target.sql_option and sql_option_file are exclusive"))
+		} else if b, err := loadSrcFrom(t.SQLOptionFile); err != nil {
+			errs = append(errs, fmt.Errorf("failed to read sql_option_file %s, %s", t.SQLOptionFile, err))
 		} else {
-			if tr.Host == "" {
-				tr.Host = cr.Host
-			}
-			if tr.Port == 0 {
-				tr.Port = cr.Port
-			}
-			if tr.DBName == "" {
-				tr.DBName = cr.DBName
-			}
-			if tr.User == "" {
-				tr.User = cr.User
-			}
-			if tr.Password == "" {
-				tr.Password = cr.Password
-			}
-			if tr.Schema == "" {
-				tr.Schema = cr.Schema
-			}
-			if tr.Table == "" {
-				tr.Table = cr.Table
-			}
-			if tr.ReconnectOnError == nil {
-				tr.ReconnectOnError = cr.ReconnectOnError
+			t.SQLOption = strings.TrimSpace(stripSQLComments(string(b)))
+			if !balancedQuotes(t.SQLOption) {
+				errs = append(errs, fmt.Errorf("sql_option_file %s has unbalanced quotes", t.SQLOptionFile))
 			}
 		}
-
-		ts := t.S3
-		if ts == nil {
-			t.S3 = cs
+	}
+	if t.SQLOption == "" {
+		t.SQLOption = c.SQLOption
+	}
+	if t.CredentialsRef != "" {
+		if cred, ok := c.NamedCredentials[t.CredentialsRef]; ok {
+			t.credentials = &cred
 		} else {
-			if ts.Bucket == "" {
-				ts.Bucket = cs.Bucket
-			}
-			if ts.Region == "" {
-				ts.Region = cs.Region
-			}
-			if ts.KeyPrefix == "" {
-				ts.KeyPrefix = cs.KeyPrefix
+			errs = append(errs, fmt.Errorf("target.credentials_ref %s is not defined in named_credentials", t.CredentialsRef))
+		}
+	}
+	if t.OmitRegionWhenSame == nil {
+		t.OmitRegionWhenSame = aws.Bool(c.OmitRegionWhenSame)
+	}
+	if t.UseVPCEndpoint == nil {
+		t.UseVPCEndpoint = aws.Bool(c.UseVPCEndpoint)
+	}
+	if t.DisableSQLComment == nil {
+		t.DisableSQLComment = aws.Bool(c.DisableSQLComment)
+	}
+	tr := t.Redshift
+	if tr == nil {
+		t.Redshift = cr
+	} else if cr != nil {
+		tr.inherit(cr)
+	}
+	if t.Redshift != nil && t.Mirrors == nil {
+		// mirrors inherit the first cluster
+		for _, m := range t.Redshift.mirrors {
+			m.inherit(t.Redshift)
+			if err := m.validateSessionSettings(); err != nil {
+				errs = append(errs, err)
 			}
-			if ts.KeyRegexp == "" {
-				ts.KeyRegexp = cs.KeyRegexp
+		}
+		t.Mirrors = t.Redshift.mirrors
+	}
+	if t.Quorum < 0 || t.Quorum > len(t.Mirrors)+1 {
+		errs = append(errs, fmt.Errorf("target.quorum must be between 1 and the number of clusters %d", len(t.Mirrors)+1))
+	}
+	if t.Redshift != nil {
+		if t.MaxRetries == nil {
+			t.MaxRetries = aws.Int(aws.IntValue(t.Redshift.MaxRetries))
+		}
+		if t.RetryInterval == 0 {
+			t.RetryInterval = t.Redshift.RetryInterval
+		}
+	}
+	if t.CopyDelay == 0 {
+		t.CopyDelay = c.CopyDelay
+	}
+	if t.AnalyzeAfterBytes == 0 {
+		t.AnalyzeAfterBytes = c.AnalyzeAfterBytes
+	}
+	if t.OnSuccessNotify == nil {
+		t.OnSuccessNotify = c.OnSuccessNotify
+	}
+	if t.OnSuccessNotify != nil {
+		if err := t.OnSuccessNotify.validate(); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	if t.Redshift != nil {
+		if err := t.Redshift.validateSessionSettings(); err != nil {
+			errs = append(errs, err)
+		}
+	}
+
+	ts := t.S3
+	if ts == nil {
+		t.S3 = cs
+	} else if cs != nil {
+		if ts.Bucket == "" {
+			ts.Bucket = cs.Bucket
+			if ts.AccessPoint == "" {
+				ts.AccessPoint = cs.AccessPoint
 			}
 		}
-		err := t.buildKeyMatcher()
-		if err != nil {
-			return err
+		if ts.Region == "" {
+			ts.Region = cs.Region
+		}
+		if ts.KeyPrefix == "" {
+			ts.KeyPrefix = cs.KeyPrefix
+		}
+		if ts.KeyRegexp == "" {
+			ts.KeyRegexp = cs.KeyRegexp
+		}
+		if ts.KeySuffix == "" {
+			ts.KeySuffix = cs.KeySuffix
+		}
+		if ts.KeyStripPrefix == nil {
+			ts.KeyStripPrefix = cs.KeyStripPrefix
+		}
+		if cs.NormalizeSeparators {
+			ts.NormalizeSeparators = true
 		}
 	}
-	return nil
+	if region, ok := c.BucketRegions[t.S3.Bucket]; ok && region != t.S3.Region {
+		ts := *t.S3
+		ts.Region = region
+		t.S3 = &ts
+	}
+	switch t.Format {
+	case "", FormatFromMetadata:
+	default:
+		errs = append(errs, fmt.Errorf("target.format %q is not supported", t.Format))
+	}
+	if t.CompRows < 0 {
+		errs = append(errs, fmt.Errorf("target.comprows must be a positive number"))
+	}
+	if t.JSON != "" {
+		if t.Format == FormatFromMetadata {
+			errs = append(errs, fmt.Errorf("target.json and format %s are exclusive", FormatFromMetadata))
+		}
+		if err := validateJSONFormat(t.JSON); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	if t.AddPartition != nil {
+		if t.Format == FormatFromMetadata || t.CopyPrefix {
+			errs = append(errs, fmt.Errorf("target.add_partition is exclusive with format %s and copy_prefix", FormatFromMetadata))
+		}
+		if err := t.AddPartition.validate(); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	if t.BatchID != nil {
+		if t.AddPartition != nil {
+			errs = append(errs, fmt.Errorf("target.batch_id and add_partition are exclusive"))
+		}
+		if err := t.BatchID.validate(t); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	if t.SNS != nil && t.SNS.TopicARN == "" && t.SNS.Attribute == "" {
+		errs = append(errs, fmt.Errorf("target.sns requires topic_arn or attribute"))
+	}
+	if conflicts := t.conflictingOptions(); len(conflicts) > 0 {
+		err := fmt.Errorf("target %s has sql_option %s which are also set by typed fields", t.S3, strings.Join(conflicts, ", "))
+		if c.Strict {
+			errs = append(errs, err)
+		} else {
+			log.Printf("[warn] %s", err)
+		}
+	}
+	if err := t.buildKeyMatcher(); err != nil {
+		errs = append(errs, err)
+	}
+	if err := t.buildPartitionRegexp(); err != nil {
+		errs = append(errs, err)
+	}
+	return errs
 }
@@ -0,0 +1,63 @@
+package main
+
+import (
+	"fmt"
+
+	"github.com/aws/aws-sdk-go/aws/credentials"
+	"github.com/aws/aws-sdk-go/aws/defaults"
+)
+
+// Providers of credential_chain.
+const (
+	CredentialStatic   = "static"   // aws_access_key_id and aws_secret_access_key of the config
+	CredentialEnv      = "env"      // AWS_ACCESS_KEY_ID and AWS_SECRET_ACCESS_KEY
+	CredentialShared   = "shared"   // the shared credentials file by AWS_PROFILE
+	CredentialInstance = "instance" // the ECS task role or the EC2 instance role
+)
+
+func validateCredentialChain(chain []string, cred Credentials) error {
+	seen := make(map[string]bool, len(chain))
+	for _, name := range chain {
+		switch name {
+		case CredentialStatic:
+			if cred.AWS_ACCESS_KEY_ID == "" || cred.AWS_SECRET_ACCESS_KEY == "" {
+				return fmt.Errorf("credential_chain %s requires aws_access_key_id and aws_secret_access_key", name)
+			}
+		case CredentialEnv, CredentialShared, CredentialInstance:
+		default:
+			return fmt.Errorf("credential_chain must be %s, %s, %s or %s: %s", CredentialStatic, CredentialEnv, CredentialShared, CredentialInstance, name)
+		}
+		if seen[name] {
+			return fmt.Errorf("credential_chain has %s twice", name)
+		}
+		seen[name] = true
+	}
+	return nil
+}
+
+// NewCredentialChain returns credentials of AWS clients which try providers in the order of credential_chain.
+// It returns nil without credential_chain, then the static keys of the config or the SDK's default chain is used.
+func NewCredentialChain(c *Config) *credentials.Credentials {
+	if len(c.CredentialChain) == 0 {
+		return nil
+	}
+	cred := c.AWSCredentials()
+	providers := make([]credentials.Provider, 0, len(c.CredentialChain))
+	for _, name := range c.CredentialChain {
+		switch name {
+		case CredentialStatic:
+			providers = append(providers, &credentials.StaticProvider{Value: credentials.Value{
+				AccessKeyID:     cred.AWS_ACCESS_KEY_ID,
+				SecretAccessKey: cred.AWS_SECRET_ACCESS_KEY,
+				SessionToken:    cred.AWS_SESSION_TOKEN,
+			}})
+		case CredentialEnv:
+			providers = append(providers, &credentials.EnvProvider{})
+		case CredentialShared:
+			providers = append(providers, &credentials.SharedCredentialsProvider{})
+		case CredentialInstance:
+			providers = append(providers, defaults.RemoteCredProvider(*defaults.Config(), defaults.Handlers()))
+		}
+	}
+	return credentials.NewCredentials(&credentials.ChainProvider{Providers: providers, VerboseErrors: true})
+}
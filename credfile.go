@@ -0,0 +1,89 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws/credentials"
+)
+
+// credentialFiles caches access keys read from credentials.file until the file is modified.
+var credentialFiles = &credentialFileCache{files: make(map[string]*credentialFile)}
+
+type credentialFileCache struct {
+	mu    sync.Mutex
+	files map[string]*credentialFile
+}
+
+type credentialFile struct {
+	modTime time.Time
+	size    int64
+	value   credentials.Value
+}
+
+// credentialFileJSON is the JSON format of credentials.file, the output of STS or credential_process.
+type credentialFileJSON struct {
+	AccessKeyID     string `json:"AccessKeyId"`
+	SecretAccessKey string `json:"SecretAccessKey"`
+	SessionToken    string `json:"SessionToken"`
+}
+
+// get returns the access keys in the file. The file is read again when its modification time or size is changed.
+func (cache *credentialFileCache) get(path, profile string) (credentials.Value, error) {
+	st, err := os.Stat(path)
+	if err != nil {
+		return credentials.Value{}, err
+	}
+	key := path + "#" + profile
+	cache.mu.Lock()
+	defer cache.mu.Unlock()
+	if f, ok := cache.files[key]; ok && f.modTime.Equal(st.ModTime()) && f.size == st.Size() {
+		return f.value, nil
+	}
+	v, err := readCredentialFile(path, profile)
+	if err != nil {
+		return v, err
+	}
+	cache.files[key] = &credentialFile{modTime: st.ModTime(), size: st.Size(), value: v}
+	return v, nil
+}
+
+// readCredentialFile reads access keys from a JSON file (AccessKeyId, SecretAccessKey and SessionToken),
+// or the profile of an INI file in the format of the shared credentials file.
+func readCredentialFile(path, profile string) (credentials.Value, error) {
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return credentials.Value{}, err
+	}
+	if bytes.HasPrefix(bytes.TrimSpace(b), []byte("{")) {
+		var j credentialFileJSON
+		if err := json.Unmarshal(b, &j); err != nil {
+			return credentials.Value{}, fmt.Errorf("invalid JSON, %s", err)
+		}
+		if j.AccessKeyID == "" || j.SecretAccessKey == "" {
+			return credentials.Value{}, fmt.Errorf("AccessKeyId and SecretAccessKey are required")
+		}
+		return credentials.Value{AccessKeyID: j.AccessKeyID, SecretAccessKey: j.SecretAccessKey, SessionToken: j.SessionToken}, nil
+	}
+	if profile == "" {
+		profile = "default"
+	}
+	return credentials.NewSharedCredentials(path, profile).Get()
+}
+
+// fileCredentials returns the credentials with the access keys of credentials.file.
+func fileCredentials(cred Credentials) (Credentials, error) {
+	v, err := credentialFiles.get(cred.File, cred.FileProfile)
+	if err != nil {
+		return cred, fmt.Errorf("failed to read credentials from %s, %s", cred.File, err)
+	}
+	cred.AWS_ACCESS_KEY_ID = v.AccessKeyID
+	cred.AWS_SECRET_ACCESS_KEY = v.SecretAccessKey
+	cred.AWS_SESSION_TOKEN = v.SessionToken
+	return cred, nil
+}
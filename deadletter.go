@@ -0,0 +1,75 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"log"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// Message attributes added to messages sent to dead_letter_queue_name by dead_letter_attributes.
+const (
+	DeadLetterErrorAttribute        = "RinError"
+	DeadLetterReceiveCountAttribute = "RinReceiveCount"
+	DeadLetterTargetAttribute       = "RinTarget"
+)
+
+// maxDeadLetterErrorLength truncates the error in DeadLetterErrorAttribute.
+const maxDeadLetterErrorLength = 1024
+
+// maxMessageAttributes is the max number of message attributes of a SQS message.
+const maxMessageAttributes = 10
+
+// deadLetter returns a copy of the message which has attributes of the error, the receive count and the target of the error.
+// Attributes of the message are kept in the order of names up to the limit of SQS.
+func deadLetter(msg *Message, err error) *Message {
+	attrs := make(map[string]string, maxMessageAttributes)
+	attrs[DeadLetterErrorAttribute] = truncateRunes(err.Error(), maxDeadLetterErrorLength)
+	if n := msg.ReceiveCount(); n > 0 {
+		attrs[DeadLetterReceiveCountAttribute] = strconv.Itoa(n)
+	}
+	if target := errorTarget(err); target != "" {
+		attrs[DeadLetterTargetAttribute] = target
+	}
+	names := make([]string, 0, len(msg.MessageAttributes))
+	for name := range msg.MessageAttributes {
+		if _, ok := attrs[name]; !ok {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+	for i, name := range names {
+		if len(attrs) >= maxMessageAttributes {
+			log.Printf("[warn] Dropped message attributes %s of the dead letter over the limit %d", strings.Join(names[i:], ", "), maxMessageAttributes)
+			break
+		}
+		attrs[name] = msg.MessageAttributes[name]
+	}
+	return &Message{Body: msg.Body, MessageAttributes: attrs}
+}
+
+// errorTarget returns the target of the error, or an empty string when the error is not of a target.
+func errorTarget(err error) string {
+	var se *SQLBuildError
+	var me *MatchError
+	var ce *CopyError
+	switch {
+	case errors.As(err, &se):
+		return se.Target
+	case errors.As(err, &me):
+		return me.Target
+	case errors.As(err, &ce):
+		return ce.Target
+	}
+	return ""
+}
+
+// sendToDeadLetterQueue sends the message failed by err to dead_letter_queue_name.
+func sendToDeadLetterQueue(ctx context.Context, c *Config, src MessageSource, msg *Message, err error) error {
+	if c.DeadLetterAttributes {
+		msg = deadLetter(msg, err)
+	}
+	return sendToQueue(ctx, src, c.DeadLetterQueueName, msg)
+}
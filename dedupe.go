@@ -0,0 +1,149 @@
+package main
+
+import (
+	"sync"
+	"time"
+)
+
+// recentRecords remembers records imported recently to skip duplicate notifications within dedupe_window.
+var recentRecords = &dedupeCache{seen: make(map[string]time.Time)}
+
+type dedupeCache struct {
+	mu   sync.Mutex
+	seen map[string]time.Time
+}
+
+func dedupeKey(r *EventRecord) string {
+	if r.S3.Object.ETag == "" {
+		return ""
+	}
+	return r.S3.Bucket.Name + "/" + r.S3.Object.Key + "@" + r.S3.Object.ETag
+}
+
+// isDuplicate reports whether the record was imported within the window before now.
+// Otherwise the record is remembered, and must be forgotten when it is not imported.
+func (d *dedupeCache) isDuplicate(r *EventRecord, now time.Time, window time.Duration) bool {
+	return d.checkAndRemember(dedupeKey(r), now, window)
+}
+
+func (d *dedupeCache) forget(r *EventRecord) {
+	d.forgetKey(dedupeKey(r))
+}
+
+// checkAndRemember reports whether the key was remembered within the window before now, and forgets expired keys.
+// Otherwise it remembers the key under the same lock, so only one of concurrent deliveries of the key is processed.
+func (d *dedupeCache) checkAndRemember(key string, now time.Time, window time.Duration) bool {
+	if key == "" {
+		return false
+	}
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	for k, at := range d.seen {
+		if now.Sub(at) >= window {
+			delete(d.seen, k)
+		}
+	}
+	if _, ok := d.seen[key]; ok {
+		return true
+	}
+	d.seen[key] = now
+	return false
+}
+
+// forgetKey forgets the key remembered by checkAndRemember, when processing of it failed.
+func (d *dedupeCache) forgetKey(key string) {
+	if key == "" {
+		return
+	}
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	delete(d.seen, key)
+}
+
+// recentMessages remembers MessageDeduplicationId of messages processed recently on FIFO queues.
+var recentMessages = &dedupeCache{seen: make(map[string]time.Time)}
+
+// DefaultMessageDedupeWindow is the default message_dedupe_window, the deduplication interval of SQS FIFO queues.
+const DefaultMessageDedupeWindow = 5 * time.Minute
+
+// completedTargets remembers targets, and clusters of targets, imported successfully for records which have
+// failed targets by fanout_error: continue.
+var completedTargets = &fanoutTracker{done: make(map[string]map[string]time.Time)}
+
+// fanoutRetention is how long completed targets of a record are remembered for redelivery.
+const fanoutRetention = 24 * time.Hour
+
+type fanoutTracker struct {
+	mu   sync.Mutex
+	done map[string]map[string]time.Time
+}
+
+func fanoutKey(r *EventRecord) string {
+	if key := dedupeKey(r); key != "" {
+		return key
+	}
+	return r.S3.Bucket.Name + "/" + r.S3.Object.Key
+}
+
+// clusterName is the name of a cluster of the target in completions of a record.
+func clusterName(t *Target, dsn string) string {
+	return t.String() + " " + dsn
+}
+
+func (f *fanoutTracker) completed(r *EventRecord, t *Target) bool {
+	return f.has(r, t.String())
+}
+
+func (f *fanoutTracker) complete(r *EventRecord, t *Target, now time.Time) {
+	f.add(r, t.String(), now)
+}
+
+// completedClusters marks clusters of the target imported before in done.
+func (f *fanoutTracker) completedClusters(r *EventRecord, t *Target, done map[string]bool) {
+	for _, c := range t.Clusters() {
+		if dsn := c.DSN(); f.has(r, clusterName(t, dsn)) {
+			done[dsn] = true
+		}
+	}
+}
+
+// completeClusters remembers clusters in done as imported.
+func (f *fanoutTracker) completeClusters(r *EventRecord, t *Target, done map[string]bool, now time.Time) {
+	for dsn := range done {
+		f.add(r, clusterName(t, dsn), now)
+	}
+}
+
+func (f *fanoutTracker) has(r *EventRecord, name string) bool {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	_, ok := f.done[fanoutKey(r)][name]
+	return ok
+}
+
+func (f *fanoutTracker) add(r *EventRecord, name string, now time.Time) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	for k, targets := range f.done {
+		for n, at := range targets {
+			if now.Sub(at) >= fanoutRetention {
+				delete(targets, n)
+			}
+		}
+		if len(targets) == 0 {
+			delete(f.done, k)
+		}
+	}
+	key := fanoutKey(r)
+	if f.done[key] == nil {
+		f.done[key] = make(map[string]time.Time)
+	}
+	f.done[key][name] = now
+}
+
+// forget forgets completed targets of the record after all targets succeeded.
+func (f *fanoutTracker) forget(r *EventRecord) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	delete(f.done, fanoutKey(r))
+}
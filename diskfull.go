@@ -0,0 +1,129 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"expvar"
+	"fmt"
+	"log"
+	"regexp"
+	"sync"
+	"time"
+
+	"github.com/lib/pq"
+)
+
+// DefaultDiskFullMaxPause is the default max_pause of disk_full.
+const DefaultDiskFullMaxPause = time.Hour
+
+// DiskFull is a circuit breaker for Redshift out of disk. When a COPY failed by disk full,
+// receiving messages is paused for Pause, which doubles by consecutive failures up to MaxPause.
+type DiskFull struct {
+	Pause    time.Duration `yaml:"pause"`
+	MaxPause time.Duration `yaml:"max_pause"`
+}
+
+func (d *DiskFull) validate() error {
+	if d.Pause <= 0 {
+		return fmt.Errorf("disk_full.pause is required")
+	}
+	if d.MaxPause != 0 && d.MaxPause < d.Pause {
+		return fmt.Errorf("disk_full.max_pause must be longer than the pause")
+	}
+	return nil
+}
+
+func (d *DiskFull) maxPause() time.Duration {
+	if d.MaxPause == 0 {
+		return DefaultDiskFullMaxPause
+	}
+	return d.MaxPause
+}
+
+var (
+	redshiftDiskFull = expvar.NewInt("redshift_disk_full")
+	diskFullOpen     = expvar.NewInt("disk_full_circuit_open")
+)
+
+// diskFullRegexp matches errors of Redshift out of disk, which are reported as XX000 (internal_error).
+var diskFullRegexp = regexp.MustCompile(`(?i)disk full`)
+
+// isDiskFull reports whether the err is caused by Redshift out of disk.
+func isDiskFull(err error) bool {
+	var e *pq.Error
+	if errors.As(err, &e) && (e.Code == "53100" || e.Code == "XX000" && diskFullRegexp.MatchString(e.Message)) {
+		return true
+	}
+	return err != nil && diskFullRegexp.MatchString(err.Error())
+}
+
+// DiskFullErrors returns the number of COPYs failed by disk full, and whether receiving messages is paused by them.
+func DiskFullErrors() (int64, bool) {
+	return redshiftDiskFull.Value(), diskFullOpen.Value() == 1
+}
+
+// diskFullCircuit pauses the worker while Redshift is out of disk.
+var diskFullCircuit = &diskFullBreaker{}
+
+type diskFullBreaker struct {
+	mu        sync.Mutex
+	failures  int
+	openUntil time.Time
+}
+
+func (b *diskFullBreaker) reset() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.failures = 0
+	b.openUntil = time.Time{}
+	diskFullOpen.Set(0)
+}
+
+// succeeded resets consecutive failures. An open circuit is kept open until the pause has passed.
+func (b *diskFullBreaker) succeeded() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.failures = 0
+}
+
+// trip opens the circuit for the pause of the policy, doubled by consecutive failures.
+func (b *diskFullBreaker) trip(d *DiskFull, now time.Time) {
+	redshiftDiskFull.Add(1)
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.failures++
+	pause := d.Pause
+	for i := 1; i < b.failures && pause < d.maxPause(); i++ {
+		pause *= 2
+	}
+	if pause > d.maxPause() {
+		pause = d.maxPause()
+	}
+	if until := now.Add(pause); until.After(b.openUntil) {
+		b.openUntil = until
+	}
+	diskFullOpen.Set(1)
+	log.Printf("[error] Redshift is out of disk. Pause receiving messages for %s", pause)
+}
+
+// wait blocks until the circuit is closed or ctx is done.
+func (b *diskFullBreaker) wait(ctx context.Context) {
+	for {
+		b.mu.Lock()
+		d := time.Until(b.openUntil)
+		if d <= 0 {
+			b.openUntil = time.Time{}
+			diskFullOpen.Set(0)
+		}
+		b.mu.Unlock()
+		if d <= 0 {
+			return
+		}
+		log.Printf("[warn] Receiving messages is paused by disk full for %s", d.Round(time.Second))
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(d):
+		}
+	}
+}
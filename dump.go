@@ -0,0 +1,91 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+
+	yaml "gopkg.in/yaml.v2"
+)
+
+const redactedValue = "****"
+
+// DumpConfig writes targets in the config file after merging the global sections, with secrets redacted.
+func DumpConfig(configFile string, w io.Writer) error {
+	log.Println("[info] Loading config:", configFile)
+	config, err := LoadConfig(configFile)
+	if err != nil {
+		return err
+	}
+	targets := make([]Target, 0, len(config.Targets))
+	for _, t := range config.Targets {
+		targets = append(targets, redactedTarget(t))
+	}
+	b, err := yaml.Marshal(struct {
+		Targets []Target `yaml:"targets"`
+	}{targets})
+	if err != nil {
+		return err
+	}
+	_, err = w.Write(b)
+	return err
+}
+
+// redactedTarget returns a copy of the target which secrets are redacted.
+func redactedTarget(t *Target) Target {
+	target := *t
+	if t.Redshift != nil {
+		r := *t.Redshift
+		if r.Password != "" {
+			r.Password = redactedValue
+		}
+		target.Redshift = &r
+	}
+	return target
+}
+
+// logResolvedTarget logs the target merged with the global sections as JSON at debug level, by log_resolved_targets.
+func logResolvedTarget(ctx context.Context, c *Config, t *Target) {
+	if !c.LogResolvedTargets {
+		return
+	}
+	b, err := resolvedTargetJSON(t)
+	if err != nil {
+		log.Printf("[warn] [%s] Can't log the resolved target %s. %s", CorrelationID(ctx), t, err)
+		return
+	}
+	log.Printf("[debug] [%s] Resolved target %s: %s", CorrelationID(ctx), t, b)
+}
+
+// resolvedTargetJSON encodes the redacted target by keys of the config file.
+func resolvedTargetJSON(t *Target) ([]byte, error) {
+	b, err := yaml.Marshal(redactedTarget(t))
+	if err != nil {
+		return nil, err
+	}
+	var v interface{}
+	if err := yaml.Unmarshal(b, &v); err != nil {
+		return nil, err
+	}
+	return json.Marshal(jsonValue(v))
+}
+
+// jsonValue converts maps decoded by yaml to maps which can be encoded as JSON.
+func jsonValue(v interface{}) interface{} {
+	switch v := v.(type) {
+	case map[interface{}]interface{}:
+		m := make(map[string]interface{}, len(v))
+		for k, e := range v {
+			m[fmt.Sprint(k)] = jsonValue(e)
+		}
+		return m
+	case []interface{}:
+		for i, e := range v {
+			v[i] = jsonValue(e)
+		}
+		return v
+	}
+	return v
+}
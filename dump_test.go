@@ -0,0 +1,76 @@
+package rin_test
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"log"
+	"os"
+	"strings"
+	"testing"
+
+	rin "github.com/fujiwara/Rin"
+)
+
+func TestDumpConfig(t *testing.T) {
+	loadTestConfig(t, "test/config.yml")
+	var out bytes.Buffer
+	if err := rin.DumpConfig("test/config.yml", &out); err != nil {
+		t.Fatal(err)
+	}
+	s := out.String()
+	// sql_option and redshift.host are inherited from the global sections
+	for _, expected := range []string{
+		`sql_option: JSON 'auto' GZIP`,
+		`host: localhost`,
+		`password: '****'`,
+	} {
+		if !strings.Contains(s, expected) {
+			t.Errorf("dump must contain %s", expected)
+		}
+	}
+	if strings.Contains(s, "test_pass") {
+		t.Error("password must be redacted")
+	}
+}
+
+func TestLogResolvedTargets(t *testing.T) {
+	config := loadTestConfig(t, "test/config.yml")
+	config.LogResolvedTargets = true
+	useFakeExecutor(t)
+	var buf bytes.Buffer
+	log.SetOutput(&buf)
+	src := rin.NewMemorySource(readFixture(t, "test/notification.json"))
+	err := rin.RunWithSource(context.Background(), config, src, true)
+	log.SetOutput(os.Stderr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var resolved map[string]interface{}
+	for _, line := range strings.Split(buf.String(), "\n") {
+		i := strings.Index(line, ": {")
+		if i < 0 || !strings.Contains(line, "[debug]") || !strings.Contains(line, "Resolved target ") {
+			continue
+		}
+		if err := json.Unmarshal([]byte(line[i+2:]), &resolved); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if resolved == nil {
+		t.Fatalf("the resolved target must be logged at debug level:\n%s", buf.String())
+	}
+	// inherited from the global sections
+	if resolved["sql_option"] != "JSON 'auto' GZIP" {
+		t.Errorf("sql_option must be inherited: %v", resolved["sql_option"])
+	}
+	r := resolved["redshift"].(map[string]interface{})
+	if r["host"] != "localhost" || r["table"] != "foo" {
+		t.Errorf("redshift must be merged: %v", r)
+	}
+	if r["password"] != "****" || strings.Contains(buf.String(), "test_pass") {
+		t.Errorf("password must be redacted: %v", r["password"])
+	}
+	if s3 := resolved["s3"].(map[string]interface{}); s3["region"] != "ap-northeast-1" {
+		t.Errorf("s3.region must be inherited: %v", s3)
+	}
+}
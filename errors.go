@@ -0,0 +1,121 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+)
+
+// ConfigError is returned when a configuration is invalid.
+type ConfigError struct {
+	Err error
+}
+
+func (e *ConfigError) Error() string { return e.Err.Error() }
+func (e *ConfigError) Unwrap() error { return e.Err }
+
+// ParseError is returned when a message body can't be parsed as an event.
+type ParseError struct {
+	Err error
+}
+
+func (e *ParseError) Error() string { return e.Err.Error() }
+func (e *ParseError) Unwrap() error { return e.Err }
+
+// MatchError is returned when a record matched a target is inconsistent with it.
+type MatchError struct {
+	Target string
+	Err    error
+}
+
+func (e *MatchError) Error() string { return e.Err.Error() }
+func (e *MatchError) Unwrap() error { return e.Err }
+
+// SQLBuildError is returned when COPY SQL can't be built for a record. It is not retried.
+type SQLBuildError struct {
+	Target string
+	Err    error
+}
+
+func (e *SQLBuildError) Error() string { return e.Err.Error() }
+func (e *SQLBuildError) Unwrap() error { return e.Err }
+
+// CopyError is returned when COPY failed. Err is the error returned by the Executor (e.g. *pq.Error).
+type CopyError struct {
+	Target string
+	Err    error
+}
+
+func (e *CopyError) Error() string { return e.Err.Error() }
+func (e *CopyError) Unwrap() error { return e.Err }
+
+// PausedError is returned when a record matched a paused target. The message is left on the queue without backoff.
+type PausedError struct {
+	Target string
+}
+
+func (e *PausedError) Error() string {
+	return "target " + e.Target + " is paused"
+}
+
+// ValidationErrors are all problems found by validating a config, reported at once.
+type ValidationErrors []error
+
+func (e ValidationErrors) Error() string {
+	if len(e) == 1 {
+		return e[0].Error()
+	}
+	msgs := make([]string, len(e))
+	for i, err := range e {
+		msgs[i] = err.Error()
+	}
+	return fmt.Sprintf("%d problems: %s", len(e), strings.Join(msgs, "; "))
+}
+
+func (e ValidationErrors) Unwrap() []error { return e }
+
+// add appends the problems of err, which is nil or ValidationErrors.
+func (e ValidationErrors) add(err error) ValidationErrors {
+	if ve, ok := err.(ValidationErrors); ok {
+		return append(e, ve...)
+	}
+	if err != nil {
+		return append(e, err)
+	}
+	return e
+}
+
+func (e ValidationErrors) err() error {
+	if len(e) == 0 {
+		return nil
+	}
+	return e
+}
+
+// WarmupError is a failure of warming up the connection to a cluster.
+type WarmupError struct {
+	DSN string // without the password
+	Err error
+}
+
+func (e *WarmupError) Error() string { return fmt.Sprintf("%s: %s", e.DSN, e.Err) }
+func (e *WarmupError) Unwrap() error { return e.Err }
+
+// WarmupErrors are failures of all clusters failed to warm up.
+type WarmupErrors []error
+
+func (e WarmupErrors) Error() string {
+	msgs := make([]string, len(e))
+	for i, err := range e {
+		msgs[i] = err.Error()
+	}
+	return fmt.Sprintf("%d clusters failed: %s", len(e), strings.Join(msgs, "; "))
+}
+
+func (e WarmupErrors) Unwrap() []error { return e }
+
+func (e WarmupErrors) err() error {
+	if len(e) == 0 {
+		return nil
+	}
+	return e
+}
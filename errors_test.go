@@ -0,0 +1,117 @@
+package rin_test
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"testing"
+
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	rin "github.com/fujiwara/Rin"
+	"github.com/lib/pq"
+)
+
+func TestConfigError(t *testing.T) {
+	for name, f := range brokenConfigs(t) {
+		_, err := rin.LoadConfig(f)
+		var ce *rin.ConfigError
+		if !errors.As(err, &ce) {
+			t.Errorf("%s: error must be a ConfigError: %#v", name, err)
+		}
+	}
+}
+
+func TestParseError(t *testing.T) {
+	_, err := rin.ParseEvent([]byte("{broken"))
+	var pe *rin.ParseError
+	if !errors.As(err, &pe) {
+		t.Errorf("error must be a ParseError: %#v", err)
+	}
+}
+
+func TestMatchError(t *testing.T) {
+	config := loadTestConfig(t, "test/config.yml")
+	config.Strict = true
+	useFakeExecutor(t)
+	event, err := rin.ParseEvent([]byte(otherRegionMessage))
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = rin.ImportWithContext(context.Background(), config, event)
+	var me *rin.MatchError
+	if !errors.As(err, &me) {
+		t.Fatalf("error must be a MatchError: %#v", err)
+	}
+	if me.Error() != "region us-east-1 of the record differs from the target region ap-northeast-1" {
+		t.Errorf("unexpected message %s", me.Error())
+	}
+}
+
+func TestCopyError(t *testing.T) {
+	config := loadTestConfig(t, "test/config.yml")
+	fe := useFakeExecutor(t)
+	fe.err = &pq.Error{Code: "42501", Message: "permission denied for relation foo"}
+	event, err := rin.ParseEvent([]byte(readFixture(t, "test/notification.json")))
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = rin.ImportWithContext(context.Background(), config, event)
+	var ce *rin.CopyError
+	if !errors.As(err, &ce) {
+		t.Fatalf("error must be a CopyError: %#v", err)
+	}
+	if ce.Target != config.Targets[1].String() {
+		t.Errorf("unexpected target %s", ce.Target)
+	}
+	var pqe *pq.Error
+	if !errors.As(err, &pqe) || pqe.Code != "42501" {
+		t.Errorf("CopyError must wrap pq.Error: %#v", ce.Err)
+	}
+	if err.Error() != "pq: permission denied for relation foo" {
+		t.Errorf("unexpected message %s", err.Error())
+	}
+}
+
+func TestExitCode(t *testing.T) {
+	_, configErr := rin.LoadConfig("test/config.yml.invalid_regexp")
+	tests := []struct {
+		name     string
+		err      error
+		result   *rin.BatchResult
+		expected int
+	}{
+		{"ok", nil, nil, rin.ExitOK},
+		{"all succeeded", nil, &rin.BatchResult{Succeeded: 3}, rin.ExitOK},
+		{"config", configErr, nil, rin.ExitConfigError},
+		{"aws auth", awserr.New("InvalidClientTokenId", "The security token included in the request is invalid", nil), nil, rin.ExitAuthError},
+		{"wrapped aws auth", fmt.Errorf("failed to run: %w", awserr.New("AccessDenied", "Access Denied", nil)), nil, rin.ExitAuthError},
+		{"redshift auth", &pq.Error{Code: "28P01", Message: "password authentication failed"}, nil, rin.ExitAuthError},
+		{"other", errors.New("something wrong"), nil, rin.ExitError},
+		{"other aws", awserr.New("AWS.SimpleQueueService.NonExistentQueue", "not found", nil), nil, rin.ExitError},
+		{"partial failure", nil, &rin.BatchResult{Succeeded: 2, Failed: 1}, rin.ExitPartialFailure},
+		{"total failure", nil, &rin.BatchResult{Failed: 3}, rin.ExitTotalFailure},
+	}
+	for _, tt := range tests {
+		if code := rin.ExitCode(tt.err, tt.result); code != tt.expected {
+			t.Errorf("%s: unexpected exit code %d, expected %d", tt.name, code, tt.expected)
+		}
+	}
+}
+
+func TestBatchResult(t *testing.T) {
+	config := loadTestConfig(t, "test/config.yml")
+	fe := useFakeExecutor(t)
+	fe.err = errors.New("copy failed")
+	var result rin.BatchResult
+	src := rin.NewMemorySource(readFixture(t, "test/notification.json"), unmatchedMessage)
+	err := rin.Run(context.Background(), config, rin.RunOptions{Source: src, BatchMode: true, Result: &result})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result.Succeeded != 1 || result.Failed != 1 {
+		t.Errorf("unexpected result %#v", result)
+	}
+	if code := rin.ExitCode(err, &result); code != rin.ExitPartialFailure {
+		t.Errorf("unexpected exit code %d", code)
+	}
+}
@@ -1,33 +1,88 @@
 package main
 
 import (
+	"bytes"
+	"compress/gzip"
+	"encoding/base64"
 	"encoding/json"
 	"fmt"
+	"io/ioutil"
+	"log"
 	"net/url"
+	"strconv"
 	"strings"
 )
 
+// KnownEventVersions are eventVersion of S3 event notifications which ParseEvent understands.
+// Older versions and lower-cased field names are mapped onto EventRecord.
+var KnownEventVersions = []string{"1.0", "2.0", "2.1", "2.2", "2.3"}
+
+func knownEventVersion(v string) bool {
+	for _, k := range KnownEventVersions {
+		if v == k {
+			return true
+		}
+	}
+	return false
+}
+
+// ParseEventWithEncoding decodes b by the message_encoding and parses the event.
+func ParseEventWithEncoding(b []byte, encoding string) (Event, error) {
+	if encoding == MessageEncodingGzipBase64 {
+		var err error
+		if b, err = decodeGzipBase64(b); err != nil {
+			return Event{}, &ParseError{err}
+		}
+	}
+	return ParseEvent(b)
+}
+
+func decodeGzipBase64(b []byte) ([]byte, error) {
+	z, err := base64.StdEncoding.DecodeString(string(bytes.TrimSpace(b)))
+	if err != nil {
+		return nil, err
+	}
+	r, err := gzip.NewReader(bytes.NewReader(z))
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+	return ioutil.ReadAll(r)
+}
+
 func ParseEvent(b []byte) (Event, error) {
 	var e Event
 
 	// If event comes to sqs through sns, we need to unmarshal the sns event first
 	var snsE SnsEvent
 	if err := json.Unmarshal(b, &snsE); err != nil {
-		return e, err
+		return e, &ParseError{err}
 	}
 	if snsE.Message != nil {
 		b = []byte(*snsE.Message)
 	}
+	attributes := snsE.attributes()
 
 	// Unmarshall s3 event
 	if err := json.Unmarshal(b, &e); err != nil {
-		return e, err
+		return e, &ParseError{err}
 	}
 	if len(e.Records) == 0 && e.IsTestEvent() {
 		return e, nil
 	}
 	for _, r := range e.Records {
-		if !strings.Contains(r.S3.Object.Key, "%") {
+		r.TopicARN, r.MessageAttributes = snsE.TopicArn, attributes
+		if knownEventVersion(r.EventVersion) {
+			log.Printf("[debug] S3 event version %s", r.EventVersion)
+		} else {
+			log.Printf("[warn] Unknown S3 event version %q. Parse it as the current version", r.EventVersion)
+		}
+		if r.S3.Bucket.Name == "" && strings.HasPrefix(r.S3.Bucket.ARN, s3ARNPrefix) {
+			// version 1.0 notifications may have only the ARN of the bucket
+			r.S3.Bucket.Name = strings.TrimPrefix(r.S3.Bucket.ARN, s3ARNPrefix)
+		}
+		// keys of S3 events are URL-encoded, and spaces are encoded as "+"
+		if !strings.ContainsAny(r.S3.Object.Key, "%+") {
 			continue
 		}
 		if _key, err := url.QueryUnescape(r.S3.Object.Key); err == nil {
@@ -38,7 +93,26 @@ func ParseEvent(b []byte) (Event, error) {
 }
 
 type SnsEvent struct {
-	Message *string
+	Message           *string
+	TopicArn          string
+	MessageAttributes map[string]SnsMessageAttribute
+}
+
+type SnsMessageAttribute struct {
+	Type  string
+	Value string
+}
+
+// attributes returns values of the message attributes, or nil when the envelope has no attributes.
+func (e SnsEvent) attributes() map[string]string {
+	if len(e.MessageAttributes) == 0 {
+		return nil
+	}
+	m := make(map[string]string, len(e.MessageAttributes))
+	for name, a := range e.MessageAttributes {
+		m[name] = a.Value
+	}
+	return m
 }
 
 type Event struct {
@@ -70,12 +144,44 @@ type EventRecord struct {
 	EventTime    string  `json:"eventTime"`
 	AWSRegion    string  `json:"awsRegion"`
 	S3           S3Event `json:"s3"`
+
+	UserIdentity      UserIdentity      `json:"userIdentity"`
+	RequestParameters RequestParameters `json:"requestParameters"`
+
+	// TopicARN and MessageAttributes are taken from the SNS envelope, or from the SQS message attributes.
+	TopicARN          string            `json:"-"`
+	MessageAttributes map[string]string `json:"-"`
 }
 
 func (r EventRecord) String() string {
 	return r.EventName + " " + fmt.Sprintf(S3URITemplate, r.S3.Bucket.Name, r.S3.Object.Key)
 }
 
+// UserIdentity is the requester of the event.
+type UserIdentity struct {
+	PrincipalID string `json:"principalId"`
+}
+
+// RequestParameters are parameters of the request which caused the event.
+type RequestParameters struct {
+	SourceIPAddress string `json:"sourceIPAddress"`
+}
+
+// AuditString returns provenance of the object for audit logs: the sequencer, the requester and the source IP address when present.
+func (r EventRecord) AuditString() string {
+	fields := []string{fmt.Sprintf(S3URITemplate, r.S3.Bucket.Name, r.S3.Object.Key)}
+	for _, f := range []struct{ name, value string }{
+		{"sequencer", r.S3.Object.Sequencer},
+		{"principal", r.UserIdentity.PrincipalID},
+		{"source IP", r.RequestParameters.SourceIPAddress},
+	} {
+		if f.value != "" {
+			fields = append(fields, f.name+": "+f.value)
+		}
+	}
+	return strings.Join(fields, ", ")
+}
+
 type S3Event struct {
 	S3SchemaVersion string   `json:"s3SchemaVersion"`
 	ConfigurationID string   `json:"configurationId"`
@@ -83,13 +189,43 @@ type S3Event struct {
 	Object          S3Object `json:"object"`
 }
 
+const s3ARNPrefix = "arn:aws:s3:::"
+
 type S3Bucket struct {
 	Name string `json:"name"`
 	ARN  string `json:"arn"`
 }
 
 type S3Object struct {
-	Key  string `json:"key"`
-	Size int64  `json:"size"`
-	ETag string `json:"eTag"`
+	Key       string `json:"key"`
+	Size      int64  `json:"size"`
+	ETag      string `json:"eTag"`
+	Sequencer string `json:"sequencer"`
+	// StorageClass is the storage class of the object. It is empty unless the producer of the event sets it.
+	StorageClass string `json:"storageClass,omitempty"`
+}
+
+// UnmarshalJSON accepts size as a string, which is used by version 1.0 notifications.
+func (o *S3Object) UnmarshalJSON(b []byte) error {
+	var v struct {
+		Key          string      `json:"key"`
+		Size         json.Number `json:"size"`
+		ETag         string      `json:"eTag"`
+		Sequencer    string      `json:"sequencer"`
+		StorageClass string      `json:"storageClass"`
+	}
+	if err := json.Unmarshal(b, &v); err != nil {
+		return err
+	}
+	o.Key, o.ETag, o.Sequencer, o.StorageClass = v.Key, v.ETag, v.Sequencer, v.StorageClass
+	if v.Size == "" {
+		o.Size = 0
+		return nil
+	}
+	size, err := strconv.ParseInt(v.Size.String(), 10, 64)
+	if err != nil {
+		return fmt.Errorf("invalid object size %q", v.Size)
+	}
+	o.Size = size
+	return nil
 }
@@ -1,8 +1,12 @@
 package rin_test
 
 import (
+	"bytes"
+	"context"
 	"io/ioutil"
+	"log"
 	"os"
+	"strings"
 	"testing"
 
 	rin "github.com/fujiwara/Rin"
@@ -73,6 +77,23 @@ func TestParseEvent(t *testing.T) {
 	}
 }
 
+func TestParseEventEncodedKeys(t *testing.T) {
+	for encoded, key := range map[string]string{
+		"test/foo/my+file.json":                     "test/foo/my file.json",
+		"test/foo/a%23b+%3F.json":                   "test/foo/a#b ?.json",
+		"test/foo/a%2Bb.json":                       "test/foo/a+b.json",
+		"test/foo/%E6%97%A5%E6%9C%AC%E8%AA%9E.json": "test/foo/日本語.json",
+	} {
+		event, err := rin.ParseEvent([]byte(`{"Records":[{"eventName":"ObjectCreated:Put","s3":{"bucket":{"name":"test.bucket.test"},"object":{"key":"` + encoded + `"}}}]}`))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := event.Records[0].S3.Object.Key; got != key {
+			t.Errorf("%s must be decoded to %s: %s", encoded, key, got)
+		}
+	}
+}
+
 func TestParseTestEvent(t *testing.T) {
 	f, err := os.Open("test/testevent.json")
 	if err != nil {
@@ -112,3 +133,84 @@ func TestParseTestEventSns(t *testing.T) {
 		t.Errorf("unexpected string %s", event.String())
 	}
 }
+
+func TestParseEventGzipBase64(t *testing.T) {
+	b, err := ioutil.ReadFile("test/event.json.gz.b64")
+	if err != nil {
+		t.Fatal(err)
+	}
+	event, err := rin.ParseEventWithEncoding(b, rin.MessageEncodingGzipBase64)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(event.Records) != 1 || event.Records[0].S3.Bucket.Name != "test.bucket.test" {
+		t.Errorf("unexpected records %v", event)
+	}
+
+	plain, err := ioutil.ReadFile("test/event.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, encoding := range []string{"", rin.MessageEncodingNone} {
+		if _, err := rin.ParseEventWithEncoding(plain, encoding); err != nil {
+			t.Errorf("plain JSON must be parsed with encoding %q: %s", encoding, err)
+		}
+	}
+	if _, err := rin.ParseEventWithEncoding(plain, rin.MessageEncodingGzipBase64); err == nil {
+		t.Error("plain JSON must not be parsed as gzip-base64")
+	}
+}
+
+func TestParseEventVersions(t *testing.T) {
+	for _, name := range []string{"test/event.json", "test/event.v1.json", "test/event.v2.2.json"} {
+		b, err := ioutil.ReadFile(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		event, err := rin.ParseEvent(b)
+		if err != nil {
+			t.Errorf("%s: %s", name, err)
+			continue
+		}
+		if len(event.Records) != 1 {
+			t.Errorf("%s: unexpected records %v", name, event.Records)
+			continue
+		}
+		r := event.Records[0]
+		if r.S3.Bucket.Name != "test.bucket.test" || r.S3.Object.Size != 443 || r.S3.Object.ETag != "86fcdfb65af50a994cf63ddd280cea0d" {
+			t.Errorf("%s: unexpected record %#v", name, r.S3)
+		}
+		if !strings.HasPrefix(r.EventName, "Object") || r.EventVersion == "" {
+			t.Errorf("%s: unexpected event %s version %s", name, r.EventName, r.EventVersion)
+		}
+	}
+}
+
+func TestAuditFields(t *testing.T) {
+	b, err := ioutil.ReadFile("test/event.v2.2.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	event, err := rin.ParseEvent(b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	r := event.Records[0]
+	if r.S3.Object.Sequencer != "0055AED6DCD90281E5" || r.UserIdentity.PrincipalID != "AWS:AIDAITB24YMP65EXRRFHC" || r.RequestParameters.SourceIPAddress != "10.115.144.24" {
+		t.Errorf("unexpected audit fields %#v", r)
+	}
+
+	config := loadTestConfig(t, "test/config.yml")
+	useFakeExecutor(t)
+	var buf bytes.Buffer
+	log.SetOutput(&buf)
+	_, err = rin.ImportWithContext(context.Background(), config, event)
+	log.SetOutput(os.Stderr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := "from s3://test.bucket.test/test/foo/xxx.json, sequencer: 0055AED6DCD90281E5, principal: AWS:AIDAITB24YMP65EXRRFHC, source IP: 10.115.144.24"
+	if !strings.Contains(buf.String(), "Audit: loaded to target") || !strings.Contains(buf.String(), expected) {
+		t.Errorf("audit fields must be logged:\n%s", buf.String())
+	}
+}
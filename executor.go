@@ -0,0 +1,501 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"fmt"
+	"log"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Executor executes SQL statements built by BuildCopySQL on the Redshift specified by dsn.
+// The statements are executed in order in a single transaction.
+type Executor interface {
+	Exec(ctx context.Context, dsn string, queries ...string) error
+}
+
+// QueryIDExecutor is an Executor which also returns the Redshift query ID of the last statement.
+type QueryIDExecutor interface {
+	Executor
+	ExecWithQueryID(ctx context.Context, dsn string, queries ...string) (int64, error)
+}
+
+// AsyncExecutor is an Executor which starts statements without waiting for the completion.
+type AsyncExecutor interface {
+	Executor
+	Start(ctx context.Context, dsn string, queries ...string) (CopyJob, error)
+}
+
+// AutocommitExecutor is an Executor which also executes statements out of a transaction,
+// for statements which can't run inside a transaction block (e.g. ALTER TABLE ADD PARTITION of external tables).
+type AutocommitExecutor interface {
+	Executor
+	ExecAutocommit(ctx context.Context, dsn string, queries ...string) error
+}
+
+// ValueQuerier is an Executor which also queries a single value, for table_resolver.
+// It returns sql.ErrNoRows when the query returns no rows.
+type ValueQuerier interface {
+	Executor
+	QueryValue(ctx context.Context, dsn string, query string) (string, error)
+}
+
+// LoadErrorExecutor is an Executor which also returns rows skipped by COPY, for report_load_errors.
+type LoadErrorExecutor interface {
+	Executor
+	ExecWithLoadErrors(ctx context.Context, dsn string, queries ...string) ([]LoadError, error)
+}
+
+// LoadError is the number of rows skipped by COPY for the column and the reason.
+type LoadError struct {
+	Column string
+	Reason string
+	Count  int
+}
+
+// CopyJob is statements started by AsyncExecutor.
+type CopyJob interface {
+	// Poll reports whether the statements have been completed, and the result with the query id of COPY.
+	Poll(ctx context.Context) (bool, int64, error)
+}
+
+// DefaultExecutor is the Executor used to import records.
+var DefaultExecutor Executor = &RedshiftExecutor{}
+
+type executorKey struct{}
+
+func withExecutor(ctx context.Context, e Executor) context.Context {
+	return context.WithValue(ctx, executorKey{}, e)
+}
+
+// executorFrom returns the Executor given by RunOptions, or DefaultExecutor.
+func executorFrom(ctx context.Context) Executor {
+	if e, ok := ctx.Value(executorKey{}).(Executor); ok {
+		return e
+	}
+	return DefaultExecutor
+}
+
+// RedshiftExecutor is an Executor using database/sql connections in DBPool.
+type RedshiftExecutor struct{}
+
+type txBeginner interface {
+	BeginTx(ctx context.Context, opts *sql.TxOptions) (*sql.Tx, error)
+}
+
+func (e *RedshiftExecutor) Exec(ctx context.Context, dsn string, queries ...string) error {
+	_, err := e.ExecWithQueryID(ctx, dsn, queries...)
+	return err
+}
+
+// ExecWithQueryID executes the queries and gets pg_last_query_id() right after the COPY in the same transaction.
+// pg_last_copy_count() is also recorded by RecordCopyRows.
+func (e *RedshiftExecutor) ExecWithQueryID(ctx context.Context, dsn string, queries ...string) (int64, error) {
+	start := time.Now()
+	db, err := ConnectToRedshift(dsn, poolSettings())
+	if err != nil {
+		return 0, err
+	}
+	CopyDurationsFrom(ctx).Connect = since(&start)
+	var queryID, rows int64
+	copied := false
+	err = execInTx(ctx, db, queries, func(txn *sql.Tx) error {
+		copied = true
+		return txn.QueryRowContext(ctx, lastCopyQuery).Scan(&queryID, &rows)
+	})
+	if err == nil && copied {
+		RecordCopyRows(ctx, rows)
+	}
+	return queryID, err
+}
+
+// lastCopyQuery gets the query id and the number of rows loaded by the last COPY in the session.
+const lastCopyQuery = "SELECT pg_last_query_id(), pg_last_copy_count()"
+
+// loadErrorsQuery summarizes stl_load_errors of the last COPY in the session.
+const loadErrorsQuery = "SELECT TRIM(colname), TRIM(err_reason), COUNT(*) FROM stl_load_errors WHERE query = pg_last_copy_id() GROUP BY 1, 2 ORDER BY 3 DESC"
+
+// ExecAutocommit executes the queries one by one on a connection without a transaction.
+// It resets the session settings before returning the connection to the pool.
+func (e *RedshiftExecutor) ExecAutocommit(ctx context.Context, dsn string, queries ...string) error {
+	db, err := ConnectToRedshift(dsn, poolSettings())
+	if err != nil {
+		return err
+	}
+	conn, err := db.Conn(ctx)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	defer func() {
+		if _, err := conn.ExecContext(context.Background(), "RESET ALL"); err != nil {
+			log.Println("[warn] failed to reset the session.", err)
+			conn.Raw(func(interface{}) error { return driver.ErrBadConn })
+		}
+	}()
+	for _, query := range queries {
+		if _, err := conn.ExecContext(ctx, query); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// QueryValue returns the first column of the first row of the query.
+func (e *RedshiftExecutor) QueryValue(ctx context.Context, dsn string, query string) (string, error) {
+	db, err := ConnectToRedshift(dsn, poolSettings())
+	if err != nil {
+		return "", err
+	}
+	var v string
+	err = db.QueryRowContext(ctx, query).Scan(&v)
+	return v, err
+}
+
+// ExecWithLoadErrors executes the queries and gets stl_load_errors of the COPY right after it in the same transaction.
+// pg_last_copy_count() is also recorded by RecordCopyRows.
+func (e *RedshiftExecutor) ExecWithLoadErrors(ctx context.Context, dsn string, queries ...string) ([]LoadError, error) {
+	start := time.Now()
+	db, err := ConnectToRedshift(dsn, poolSettings())
+	if err != nil {
+		return nil, err
+	}
+	CopyDurationsFrom(ctx).Connect = since(&start)
+	var loadErrors []LoadError
+	var queryID, copyRows int64
+	copied := false
+	err = execInTx(ctx, db, queries, func(txn *sql.Tx) error {
+		copied = true
+		if err := txn.QueryRowContext(ctx, lastCopyQuery).Scan(&queryID, &copyRows); err != nil {
+			return err
+		}
+		rows, err := txn.QueryContext(ctx, loadErrorsQuery)
+		if err != nil {
+			return err
+		}
+		defer rows.Close()
+		for rows.Next() {
+			var le LoadError
+			if err := rows.Scan(&le.Column, &le.Reason, &le.Count); err != nil {
+				return err
+			}
+			loadErrors = append(loadErrors, le)
+		}
+		return rows.Err()
+	})
+	if err == nil && copied {
+		RecordCopyRows(ctx, copyRows)
+	}
+	return loadErrors, err
+}
+
+// Start executes the queries on a dedicated connection in background.
+// The job reports the completion of the queries, and logs queries in flight on stv_inflight by the backend pid of the connection.
+// pg_last_copy_count() is recorded by RecordCopyRows on the completion.
+func (e *RedshiftExecutor) Start(ctx context.Context, dsn string, queries ...string) (CopyJob, error) {
+	start := time.Now()
+	db, err := ConnectToRedshift(dsn, poolSettings())
+	if err != nil {
+		return nil, err
+	}
+	conn, err := db.Conn(ctx)
+	if err != nil {
+		return nil, err
+	}
+	CopyDurationsFrom(ctx).Connect = since(&start)
+	job := &redshiftCopyJob{db: db, done: make(chan error, 1)}
+	if err := conn.QueryRowContext(ctx, "SELECT pg_backend_pid()").Scan(&job.pid); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	go func() {
+		defer conn.Close()
+		var rows int64
+		copied := false
+		err := execInTx(ctx, conn, queries, func(txn *sql.Tx) error {
+			copied = true
+			return txn.QueryRowContext(ctx, lastCopyQuery).Scan(&job.queryID, &rows)
+		})
+		if err == nil && copied {
+			RecordCopyRows(ctx, rows)
+		}
+		job.done <- err
+	}()
+	return job, nil
+}
+
+type redshiftCopyJob struct {
+	db      *sql.DB
+	pid     int64
+	queryID int64
+	done    chan error
+}
+
+func (j *redshiftCopyJob) Poll(ctx context.Context) (bool, int64, error) {
+	select {
+	case err := <-j.done:
+		return true, j.queryID, err
+	default:
+	}
+	var n int
+	err := j.db.QueryRowContext(ctx, "SELECT COUNT(*) FROM stv_inflight WHERE pid = $1", j.pid).Scan(&n)
+	if err != nil {
+		log.Printf("[warn] [%s] Can't poll stv_inflight for pid %d. %s", CorrelationID(ctx), j.pid, err)
+	} else {
+		log.Printf("[debug] [%s] %d queries are in flight for pid %d", CorrelationID(ctx), n, j.pid)
+	}
+	return false, 0, nil
+}
+
+// execInTx executes the queries in a transaction. afterCopy is called right after the COPY of the queries,
+// before statements following it (e.g. on_success_sql) run in the session.
+func execInTx(ctx context.Context, b txBeginner, queries []string, afterCopy func(*sql.Tx) error) error {
+	d := CopyDurationsFrom(ctx)
+	start := time.Now()
+	txn, err := b.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer txn.Rollback()
+	// BeginTx acquires a connection of the pool, opening a new one when no idle connection.
+	d.Connect += since(&start)
+
+	copied := false
+	for _, query := range queries {
+		if err := execStatement(ctx, txn, query); err != nil {
+			return err
+		}
+		if afterCopy != nil && !copied && isCopyStatement(query) {
+			copied = true
+			if err := afterCopy(txn); err != nil {
+				return err
+			}
+		}
+	}
+	d.Copy = since(&start)
+	err = txn.Commit()
+	d.Commit = since(&start)
+	return err
+}
+
+// isCopyStatement reports whether the query is COPY, including COPY prefixed by the comment "/* Rin */".
+func isCopyStatement(query string) bool {
+	query = strings.TrimSpace(query)
+	if strings.HasPrefix(query, "/*") {
+		if i := strings.Index(query, "*/"); i >= 0 {
+			query = strings.TrimSpace(query[i+2:])
+		}
+	}
+	return len(query) >= 4 && strings.EqualFold(query[:4], "COPY")
+}
+
+func execStatement(ctx context.Context, txn *sql.Tx, query string) error {
+	if len(query) >= 4 && strings.EqualFold(query[:4], "COPY") {
+		// pq prepares a query which starts with "COPY" as a PostgreSQL COPY FROM STDIN.
+		// Execute it by the simple query protocol to handle the Redshift response.
+		_, err := txn.ExecContext(ctx, query)
+		return err
+	}
+	stmt, err := txn.PrepareContext(ctx, query)
+	if err != nil {
+		return err
+	}
+	defer stmt.Close()
+	_, err = stmt.ExecContext(ctx)
+	return err
+}
+
+// connSlots limits concurrent COPYs across all targets by redshift.max_total_conns.
+// Open connections of each pool are limited by ConfigurePool, including queries besides COPY.
+var connSlots = &slots{}
+
+// slots is a semaphore which grants slots to waiters in round-robin of their keys,
+// so that a flood of COPYs for a table does not block COPYs for other tables.
+type slots struct {
+	mu      sync.Mutex
+	n       int
+	used    int
+	waiters map[string][]chan struct{}
+	// keys of waiters in the order to be granted
+	order []string
+}
+
+// acquire blocks until a slot of n slots is granted for the key, and returns a function releasing the slot.
+func (s *slots) acquire(ctx context.Context, n int, key string) (func(), error) {
+	if n <= 0 {
+		s.resize(0)
+		return func() {}, nil
+	}
+	s.mu.Lock()
+	if s.n != n {
+		// resized by reloading
+		s.n = n
+		s.dispatch()
+	}
+	if s.used < s.n && len(s.order) == 0 {
+		s.used++
+		s.mu.Unlock()
+		return s.release, nil
+	}
+	ch := make(chan struct{})
+	if s.waiters == nil {
+		s.waiters = make(map[string][]chan struct{})
+	}
+	if len(s.waiters[key]) == 0 {
+		s.order = append(s.order, key)
+	}
+	s.waiters[key] = append(s.waiters[key], ch)
+	s.mu.Unlock()
+
+	log.Printf("[debug] [%s] Waiting for a connection slot of max_total_conns %d", CorrelationID(ctx), n)
+	select {
+	case <-ch:
+		return s.release, nil
+	case <-ctx.Done():
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	select {
+	case <-ch:
+		// granted while canceling
+		s.used--
+		s.dispatch()
+	default:
+		s.remove(key, ch)
+	}
+	return nil, ctx.Err()
+}
+
+func (s *slots) resize(n int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.n != n {
+		s.n = n
+		s.dispatch()
+	}
+}
+
+func (s *slots) release() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.used--
+	s.dispatch()
+}
+
+// dispatch grants free slots to the first waiter of keys in turn. s.mu must be locked.
+func (s *slots) dispatch() {
+	for len(s.order) > 0 && (s.n <= 0 || s.used < s.n) {
+		key := s.order[0]
+		s.order = s.order[1:]
+		q := s.waiters[key]
+		ch := q[0]
+		if len(q) > 1 {
+			s.waiters[key] = q[1:]
+			s.order = append(s.order, key)
+		} else {
+			delete(s.waiters, key)
+		}
+		s.used++
+		close(ch)
+	}
+}
+
+// remove removes the waiter of the key. s.mu must be locked.
+func (s *slots) remove(key string, ch chan struct{}) {
+	q := s.waiters[key]
+	for i, w := range q {
+		if w != ch {
+			continue
+		}
+		q = append(q[:i:i], q[i+1:]...)
+		break
+	}
+	if len(q) > 0 {
+		s.waiters[key] = q
+		return
+	}
+	delete(s.waiters, key)
+	for i, k := range s.order {
+		if k == key {
+			s.order = append(s.order[:i:i], s.order[i+1:]...)
+			break
+		}
+	}
+}
+
+// execCopy executes the queries by the Executor and returns a note of the result for logging.
+// key identifies the table for fair scheduling of max_total_conns.
+func execCopy(ctx context.Context, c *Config, dsn, key string, queries []string, reportLoadErrors bool) (string, error) {
+	var maxConns int
+	if c.Redshift != nil {
+		maxConns = c.Redshift.MaxTotalConns
+	}
+	release, err := connSlots.acquire(ctx, maxConns, key)
+	if err != nil {
+		return "", err
+	}
+	defer release()
+	countCopyAttempt(ctx)
+	e := executorFrom(ctx)
+	if le, ok := e.(LoadErrorExecutor); ok && reportLoadErrors {
+		loadErrors, err := le.ExecWithLoadErrors(ctx, dsn, queries...)
+		if err == nil {
+			logLoadErrors(ctx, loadErrors)
+		}
+		return "", err
+	}
+	if ae, ok := e.(AsyncExecutor); ok && c.CopyPollInterval > 0 {
+		queryID, err := pollCopy(ctx, c.CopyPollInterval, ae, dsn, queries)
+		return fmt.Sprintf(" query_id: %d", queryID), err
+	}
+	if qe, ok := e.(QueryIDExecutor); ok {
+		queryID, err := qe.ExecWithQueryID(ctx, dsn, queries...)
+		return fmt.Sprintf(" query_id: %d", queryID), err
+	}
+	return "", e.Exec(ctx, dsn, queries...)
+}
+
+// pollCopy waits for the completion of the COPY started by ae, and returns the query id.
+// The slot of max_inflight_messages is yielded while polling, so the worker receives other messages meanwhile.
+func pollCopy(ctx context.Context, interval time.Duration, ae AsyncExecutor, dsn string, queries []string) (int64, error) {
+	job, err := ae.Start(ctx, dsn, queries...)
+	if err != nil {
+		return 0, err
+	}
+	if slot := inFlightSlotFrom(ctx); slot != nil {
+		slot.yield()
+		defer slot.reclaim()
+	}
+	start := time.Now()
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return 0, ctx.Err()
+		case <-ticker.C:
+		}
+		done, queryID, err := job.Poll(ctx)
+		if done {
+			return queryID, err
+		}
+		log.Printf("[info] [%s] COPY is in progress. elapsed: %s", CorrelationID(ctx), time.Since(start).Round(time.Second))
+	}
+}
+
+func logLoadErrors(ctx context.Context, loadErrors []LoadError) {
+	if len(loadErrors) == 0 {
+		log.Printf("[info] [%s] COPY skipped no rows", CorrelationID(ctx))
+		return
+	}
+	var total int
+	summary := make([]string, 0, len(loadErrors))
+	for _, le := range loadErrors {
+		total += le.Count
+		summary = append(summary, fmt.Sprintf("%s: %s (%d)", le.Column, le.Reason, le.Count))
+	}
+	log.Printf("[warn] [%s] COPY skipped %d rows. %s", CorrelationID(ctx), total, strings.Join(summary, ", "))
+}
@@ -0,0 +1,356 @@
+package rin_test
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"log"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	rin "github.com/fujiwara/Rin"
+	"github.com/fujiwara/Rin/rintest"
+)
+
+var _ rin.Executor = rintest.NewExecutor()
+
+type asyncExecutor struct {
+	fakeExecutor
+	pollsToComplete int
+	polls           int
+}
+
+func (e *asyncExecutor) Start(ctx context.Context, dsn string, queries ...string) (rin.CopyJob, error) {
+	return &asyncJob{e: e, dsn: dsn, queries: queries}, nil
+}
+
+type asyncJob struct {
+	e       *asyncExecutor
+	dsn     string
+	queries []string
+}
+
+func (j *asyncJob) Poll(ctx context.Context) (bool, int64, error) {
+	j.e.mu.Lock()
+	j.e.polls++
+	polls := j.e.polls
+	j.e.mu.Unlock()
+	if polls < j.e.pollsToComplete {
+		return false, 0, nil
+	}
+	return true, 42, j.e.Exec(ctx, j.dsn, j.queries...)
+}
+
+// blockingAsyncExecutor completes the first COPY after the second one has started.
+type blockingAsyncExecutor struct {
+	fakeExecutor
+	started chan struct{}
+	starts  int
+}
+
+func (e *blockingAsyncExecutor) Start(ctx context.Context, dsn string, queries ...string) (rin.CopyJob, error) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	e.starts++
+	if e.starts == 2 {
+		close(e.started)
+	}
+	return &blockingAsyncJob{e: e, first: e.starts == 1, dsn: dsn, queries: queries}, nil
+}
+
+type blockingAsyncJob struct {
+	e       *blockingAsyncExecutor
+	first   bool
+	dsn     string
+	queries []string
+}
+
+func (j *blockingAsyncJob) Poll(ctx context.Context) (bool, int64, error) {
+	if j.first {
+		select {
+		case <-j.e.started:
+		case <-time.After(time.Second):
+			return true, 0, errors.New("the second COPY never started")
+		}
+	}
+	return true, 1, j.e.Exec(ctx, j.dsn, j.queries...)
+}
+
+func TestAsyncCopyYieldsInFlightSlot(t *testing.T) {
+	config := loadTestConfig(t, "test/config.yml")
+	config.CopyPollInterval = 10 * time.Millisecond
+	config.MaxInFlightMessages = 1
+	ae := &blockingAsyncExecutor{started: make(chan struct{})}
+	orig := rin.DefaultExecutor
+	rin.DefaultExecutor = ae
+	defer func() { rin.DefaultExecutor = orig }()
+
+	body := readFixture(t, "test/notification.json")
+	src := rin.NewMemorySource(body, body)
+	if err := rin.RunWithSource(context.Background(), config, src, true); err != nil {
+		t.Fatal(err)
+	}
+	if n := len(src.Deleted()); n != 2 {
+		t.Errorf("the second message must be processed while the first COPY is polled: %d", n)
+	}
+}
+
+func TestAsyncCopy(t *testing.T) {
+	config := loadTestConfig(t, "test/config.yml")
+	config.CopyPollInterval = 10 * time.Millisecond
+	ae := &asyncExecutor{pollsToComplete: 3}
+	orig := rin.DefaultExecutor
+	rin.DefaultExecutor = ae
+	defer func() { rin.DefaultExecutor = orig }()
+	var buf bytes.Buffer
+	log.SetOutput(&buf)
+	defer log.SetOutput(os.Stderr)
+
+	src := rin.NewMemorySource(readFixture(t, "test/notification.json"))
+	if err := rin.RunWithSource(context.Background(), config, src, true); err != nil {
+		t.Fatal(err)
+	}
+	if ae.polls != 3 {
+		t.Errorf("unexpected polls %d", ae.polls)
+	}
+	if !strings.Contains(buf.String(), "query_id: 42") {
+		t.Errorf("query id of the async COPY must be logged: %s", buf.String())
+	}
+	if len(ae.queries) != 1 {
+		t.Errorf("unexpected executed queries %v", ae.queries)
+	}
+	if n := len(src.Deleted()); n != 1 {
+		t.Errorf("message must be deleted after completion: %d", n)
+	}
+}
+
+// durationExecutor records fixed durations of COPY phases.
+type durationExecutor struct {
+	fakeExecutor
+	durations rin.CopyDurations
+}
+
+func (e *durationExecutor) Exec(ctx context.Context, dsn string, queries ...string) error {
+	*rin.CopyDurationsFrom(ctx) = e.durations
+	return e.fakeExecutor.Exec(ctx, dsn, queries...)
+}
+
+func TestCopyDurations(t *testing.T) {
+	config := loadTestConfig(t, "test/config.yml")
+	de := &durationExecutor{durations: rin.CopyDurations{
+		Connect: 120 * time.Millisecond,
+		Copy:    3 * time.Second,
+		Commit:  40 * time.Millisecond,
+	}}
+	orig := rin.DefaultExecutor
+	rin.DefaultExecutor = de
+	defer func() { rin.DefaultExecutor = orig }()
+	var buf bytes.Buffer
+	log.SetOutput(&buf)
+	defer log.SetOutput(os.Stderr)
+
+	before := rin.CopyDurationCount("copy")
+	src := rin.NewMemorySource(readFixture(t, "test/notification.json"))
+	if err := rin.RunWithSource(context.Background(), config, src, true); err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(buf.String(), "COPY durations connect=120ms copy=3s commit=40ms") {
+		t.Errorf("durations must be logged: %s", buf.String())
+	}
+	for _, phase := range []string{"connect", "copy", "commit"} {
+		if n := rin.CopyDurationCount(phase); n < 1 {
+			t.Errorf("duration of %s must be observed: %d", phase, n)
+		}
+	}
+	if n := rin.CopyDurationCount("copy"); n != before+1 {
+		t.Errorf("unexpected count of copy durations %d", n)
+	}
+}
+
+// concurrencyExecutor records the max number of concurrent Exec.
+type concurrencyExecutor struct {
+	fakeExecutor
+	current, max int
+}
+
+func (e *concurrencyExecutor) Exec(ctx context.Context, dsn string, queries ...string) error {
+	e.mu.Lock()
+	e.current++
+	if e.current > e.max {
+		e.max = e.current
+	}
+	e.mu.Unlock()
+	time.Sleep(50 * time.Millisecond)
+	e.mu.Lock()
+	e.current--
+	e.mu.Unlock()
+	return e.fakeExecutor.Exec(ctx, dsn, queries...)
+}
+
+func TestMaxTotalConns(t *testing.T) {
+	config := loadTestConfig(t, "test/config.yml")
+	config.MaxInFlightMessages = 4
+	config.Redshift.MaxTotalConns = 2
+	config.Targets[1].Redshift.Host = "foo.example.com"
+	config.Targets[3].Redshift.Host = "bar.example.com"
+	ce := &concurrencyExecutor{}
+	orig := rin.DefaultExecutor
+	rin.DefaultExecutor = ce
+	defer func() { rin.DefaultExecutor = orig }()
+
+	var bodies []string
+	for _, key := range []string{"test/foo/1.json", "test/foo/2.json", "test/bar/1.json", "test/bar/2.json"} {
+		bodies = append(bodies, `{"Records":[{"eventName":"ObjectCreated:Put","s3":{"bucket":{"name":"test.bucket.test"},"object":{"key":"`+key+`"}}}]}`)
+	}
+	src := rin.NewMemorySource(bodies...)
+	if err := rin.RunWithSource(context.Background(), config, src, true); err != nil {
+		t.Fatal(err)
+	}
+	if len(ce.dsns) != 4 {
+		t.Fatalf("all messages must be imported: %v", ce.dsns)
+	}
+	pools := make(map[string]bool)
+	for _, dsn := range ce.dsns {
+		pools[dsn] = true
+	}
+	if len(pools) != 2 {
+		t.Errorf("messages must be imported to 2 pools: %v", ce.dsns)
+	}
+	if ce.max > 2 {
+		t.Errorf("concurrent COPYs must be limited by max_total_conns: %d", ce.max)
+	}
+}
+
+func TestMaxTotalConnsFairness(t *testing.T) {
+	config := loadTestConfig(t, "test/config.yml")
+	config.MaxInFlightMessages = 6
+	config.Redshift.MaxTotalConns = 1
+	ce := &concurrencyExecutor{}
+	orig := rin.DefaultExecutor
+	rin.DefaultExecutor = ce
+	defer func() { rin.DefaultExecutor = orig }()
+
+	var bodies []string
+	for _, key := range []string{"test/foo/1.json", "test/foo/2.json", "test/foo/3.json", "test/foo/4.json", "test/foo/5.json", "test/bar/1.json"} {
+		bodies = append(bodies, `{"Records":[{"eventName":"ObjectCreated:Put","s3":{"bucket":{"name":"test.bucket.test"},"object":{"key":"`+key+`"}}}]}`)
+	}
+	src := rin.NewMemorySource(bodies...)
+	if err := rin.RunWithSource(context.Background(), config, src, true); err != nil {
+		t.Fatal(err)
+	}
+	if len(ce.queries) != 6 {
+		t.Fatalf("all messages must be imported: %v", ce.queries)
+	}
+	for i, q := range ce.queries {
+		if !strings.Contains(q, `COPY "xxx"."bar"`) {
+			continue
+		}
+		if i > 2 {
+			t.Errorf("COPY to bar must not wait for all COPYs to foo: %d of %v", i, ce.queries)
+		}
+	}
+	if ce.max > 1 {
+		t.Errorf("concurrent COPYs must be limited by max_total_conns: %d", ce.max)
+	}
+}
+
+func TestLoadLatency(t *testing.T) {
+	config := loadTestConfig(t, "test/config.yml")
+	useFakeExecutor(t)
+	target := config.Targets[1]
+	var buf bytes.Buffer
+	log.SetOutput(&buf)
+	defer log.SetOutput(os.Stderr)
+
+	eventTime := time.Now().Add(-90 * time.Second)
+	event := rin.Event{Records: []*rin.EventRecord{{EventTime: eventTime.UTC().Format(time.RFC3339Nano)}}}
+	event.Records[0].S3.Bucket.Name = "test.bucket.test"
+	event.Records[0].S3.Object.Key = "test/foo/latency.json"
+	before, beforeSum := rin.LoadLatencyTotals(target)
+	if _, err := rin.ImportWithContext(context.Background(), config, event); err != nil {
+		t.Fatal(err)
+	}
+	n, sum := rin.LoadLatencyTotals(target)
+	if n != before+1 {
+		t.Fatalf("latency must be observed: %d", n)
+	}
+	if d := sum - beforeSum; d < 90*time.Second || d > 100*time.Second {
+		t.Errorf("latency must be computed from the event time: %s", d)
+	}
+	if !strings.Contains(buf.String(), "Load latency of target") {
+		t.Errorf("latency must be logged: %s", buf.String())
+	}
+}
+
+func TestLoadLatencyOfSameTable(t *testing.T) {
+	config := loadConfigWith(t, `targets:
+  - redshift:
+      table: latency
+    s3:
+      key_prefix: test/foo/
+    min_size: 1024
+
+  - redshift:
+      table: latency
+    s3:
+      key_prefix: test/foo/
+    max_size: 1023
+`)
+	useFakeExecutor(t)
+	large, small := config.Targets[0], config.Targets[1]
+	event := rin.Event{Records: []*rin.EventRecord{{EventTime: time.Now().UTC().Format(time.RFC3339Nano)}}}
+	event.Records[0].S3.Bucket.Name = "test.bucket.test"
+	event.Records[0].S3.Object.Key = "test/foo/latency.json"
+	event.Records[0].S3.Object.Size = 2048
+	beforeLarge, _ := rin.LoadLatencyTotals(large)
+	beforeSmall, _ := rin.LoadLatencyTotals(small)
+	if _, err := rin.ImportWithContext(context.Background(), config, event); err != nil {
+		t.Fatal(err)
+	}
+	if n, _ := rin.LoadLatencyTotals(large); n != beforeLarge+1 {
+		t.Errorf("latency of the matched target must be observed: %d", n)
+	}
+	if n, _ := rin.LoadLatencyTotals(small); n != beforeSmall {
+		t.Errorf("latency of the other target of the same table must not be observed: %d", n)
+	}
+}
+
+// loadErrorExecutor returns simulated rows of stl_load_errors.
+type loadErrorExecutor struct {
+	fakeExecutor
+	loadErrors []rin.LoadError
+}
+
+func (e *loadErrorExecutor) ExecWithLoadErrors(ctx context.Context, dsn string, queries ...string) ([]rin.LoadError, error) {
+	return e.loadErrors, e.Exec(ctx, dsn, queries...)
+}
+
+func TestReportLoadErrors(t *testing.T) {
+	config := loadTestConfig(t, "test/config.yml")
+	target := config.Targets[1]
+	target.MaxError = 1000
+	target.ReportLoadErrors = true
+	le := &loadErrorExecutor{loadErrors: []rin.LoadError{
+		{Column: "price", Reason: "Invalid digit", Count: 3},
+		{Column: "created_at", Reason: "Invalid timestamp format", Count: 1},
+	}}
+	orig := rin.DefaultExecutor
+	rin.DefaultExecutor = le
+	defer func() { rin.DefaultExecutor = orig }()
+	var buf bytes.Buffer
+	log.SetOutput(&buf)
+	defer log.SetOutput(os.Stderr)
+
+	src := rin.NewMemorySource(readFixture(t, "test/notification.json"))
+	if err := rin.RunWithSource(context.Background(), config, src, true); err != nil {
+		t.Fatal(err)
+	}
+	if len(le.queries) != 1 || !strings.Contains(le.queries[0], "MAXERROR 1000") {
+		t.Errorf("COPY must have MAXERROR: %v", le.queries)
+	}
+	if !strings.Contains(buf.String(), "COPY skipped 4 rows. price: Invalid digit (3), created_at: Invalid timestamp format (1)") {
+		t.Errorf("summary of load errors must be logged: %s", buf.String())
+	}
+}
@@ -0,0 +1,93 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"sync/atomic"
+
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/lib/pq"
+)
+
+// Exit codes of the CLI. They are stable for orchestrators which run Rin in batch mode.
+const (
+	ExitOK             = 0
+	ExitError          = 1 // other errors
+	ExitConfigError    = 2 // the config is invalid or can't be loaded
+	ExitAuthError      = 3 // AWS or Redshift rejected the credentials
+	ExitPartialFailure = 4 // batch mode: some messages failed, and others succeeded
+	ExitTotalFailure   = 5 // batch mode: all messages failed
+)
+
+// authErrorCodes are codes of AWS errors caused by credentials.
+var authErrorCodes = map[string]bool{
+	"AccessDenied":                true,
+	"AccessDeniedException":       true,
+	"ExpiredToken":                true,
+	"ExpiredTokenException":       true,
+	"InvalidAccessKeyId":          true,
+	"InvalidClientTokenId":        true,
+	"NoCredentialProviders":       true,
+	"SignatureDoesNotMatch":       true,
+	"UnrecognizedClientException": true,
+}
+
+// BatchResult counts messages processed by a worker. Messages with no errors are succeeded, including skipped ones.
+type BatchResult struct {
+	Succeeded int64
+	Failed    int64
+}
+
+func (r *BatchResult) record(err error) {
+	if err == nil {
+		atomic.AddInt64(&r.Succeeded, 1)
+	} else {
+		atomic.AddInt64(&r.Failed, 1)
+	}
+}
+
+type batchResultKey struct{}
+
+func withBatchResult(ctx context.Context, r *BatchResult) context.Context {
+	if r == nil {
+		return ctx
+	}
+	return context.WithValue(ctx, batchResultKey{}, r)
+}
+
+func recordBatchResult(ctx context.Context, err error) {
+	if r, ok := ctx.Value(batchResultKey{}).(*BatchResult); ok {
+		r.record(err)
+	}
+}
+
+// ExitCode returns the exit code of the CLI for err returned by a command and the result of messages.
+func ExitCode(err error, r *BatchResult) int {
+	if err != nil {
+		var ce *ConfigError
+		switch {
+		case errors.As(err, &ce):
+			return ExitConfigError
+		case isAuthError(err):
+			return ExitAuthError
+		}
+		return ExitError
+	}
+	if r == nil || atomic.LoadInt64(&r.Failed) == 0 {
+		return ExitOK
+	}
+	if atomic.LoadInt64(&r.Succeeded) > 0 {
+		return ExitPartialFailure
+	}
+	return ExitTotalFailure
+}
+
+func isAuthError(err error) bool {
+	var ae awserr.Error
+	if errors.As(err, &ae) && authErrorCodes[ae.Code()] {
+		return true
+	}
+	var pe *pq.Error
+	// invalid_authorization_specification and invalid_password
+	return errors.As(err, &pe) && pe.Code.Class() == "28"
+}
@@ -0,0 +1,86 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"strings"
+)
+
+// TargetFilter pauses targets by table names at runtime. Names are "table" or "schema.table".
+type TargetFilter struct {
+	// Only activates the targets of the tables only, when not empty.
+	Only []string
+	// Exclude pauses the targets of the tables.
+	Exclude []string
+	// Labels activates only the targets which have all the labels, when not empty.
+	// Other targets are not paused but never match, so records matched only them follow the unmatched policy.
+	Labels map[string]string
+}
+
+// ParseTableList parses comma separated table names.
+func ParseTableList(s string) []string {
+	var names []string
+	for _, name := range strings.Split(s, ",") {
+		if name = strings.TrimSpace(name); name != "" {
+			names = append(names, name)
+		}
+	}
+	return names
+}
+
+// ParseLabels parses comma separated labels of name=value.
+func ParseLabels(s string) (map[string]string, error) {
+	labels := make(map[string]string)
+	for _, l := range strings.Split(s, ",") {
+		if l = strings.TrimSpace(l); l == "" {
+			continue
+		}
+		kv := strings.SplitN(l, "=", 2)
+		if len(kv) != 2 || kv[0] == "" {
+			return nil, fmt.Errorf("invalid label %q. must be name=value", l)
+		}
+		labels[kv[0]] = kv[1]
+	}
+	return labels, nil
+}
+
+// Selected reports whether the target has all labels of the filter.
+func (f TargetFilter) Selected(t *Target) bool {
+	for name, value := range f.Labels {
+		if v, ok := t.Labels[name]; !ok || v != value {
+			return false
+		}
+	}
+	return true
+}
+
+// Paused reports whether the target is paused by the filter. Discard targets are never paused.
+func (f TargetFilter) Paused(t *Target) bool {
+	if t.Discard || t.Redshift == nil {
+		return false
+	}
+	if len(f.Only) > 0 && !t.Redshift.hasTableName(f.Only) {
+		return true
+	}
+	return t.Redshift.hasTableName(f.Exclude)
+}
+
+func (r *Redshift) hasTableName(names []string) bool {
+	for _, name := range names {
+		if name == r.Table || (r.Schema != "" && name == r.Schema+"."+r.Table) {
+			return true
+		}
+	}
+	return false
+}
+
+type targetFilterKey struct{}
+
+func withTargetFilter(ctx context.Context, f TargetFilter) context.Context {
+	return context.WithValue(ctx, targetFilterKey{}, f)
+}
+
+func targetFilterFrom(ctx context.Context) TargetFilter {
+	f, _ := ctx.Value(targetFilterKey{}).(TargetFilter)
+	return f
+}
@@ -1,12 +1,15 @@
 module github.com/fujiwara/Rin
 
-go 1.12
+go 1.15
 
 require (
 	github.com/aws/aws-sdk-go v1.18.3
 	github.com/hashicorp/logutils v1.0.0
 	github.com/kayac/go-config v0.1.0
 	github.com/lib/pq v1.0.0
-	github.com/stretchr/testify v1.3.0 // indirect
-	golang.org/x/net v0.0.0-20190322120337-addf6b3196f6 // indirect
+	go.opentelemetry.io/otel v1.0.0
+	go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp v1.0.0
+	go.opentelemetry.io/otel/sdk v1.0.0
+	go.opentelemetry.io/otel/trace v1.0.0
+	gopkg.in/yaml.v2 v2.2.3
 )
@@ -0,0 +1,73 @@
+package main
+
+import (
+	"context"
+	"expvar"
+	"log"
+	"time"
+)
+
+// redshiftUp is 1 when the last ping to the Redshift succeeded, or 0, keyed by VisibleDSN.
+var redshiftUp = expvar.NewMap("redshift_up")
+
+// RedshiftUp returns the result of the last ping to the Redshift of the DSN shown by VisibleDSN.
+func RedshiftUp(visibleDSN string) (up bool, ok bool) {
+	v, ok := redshiftUp.Get(visibleDSN).(*expvar.Int)
+	if !ok {
+		return false, false
+	}
+	return v.Value() == 1, true
+}
+
+// runRedshiftHealth pings each distinct Redshift of targets of the current config by the interval.
+func runRedshiftHealth(ctx context.Context, w Warmer, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		checkRedshiftHealth(ctx, CurrentConfig(), w, interval)
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+func checkRedshiftHealth(ctx context.Context, c *Config, w Warmer, timeout time.Duration) {
+	checked := make(map[string]bool)
+	for _, t := range c.Targets {
+		if t.Discard || !t.IsEnabled() || t.Redshift == nil {
+			continue
+		}
+		for _, r := range t.Clusters() {
+			dsn := r.DSN()
+			if checked[dsn] {
+				continue
+			}
+			checked[dsn] = true
+			pctx, cancel := context.WithTimeout(ctx, timeout)
+			err := w.Warmup(pctx, dsn)
+			cancel()
+			if ctx.Err() != nil {
+				return
+			}
+			setRedshiftUp(r.VisibleDSN(), err)
+		}
+	}
+}
+
+func setRedshiftUp(name string, err error) {
+	up, known := RedshiftUp(name)
+	v := new(expvar.Int)
+	if err != nil {
+		if up || !known {
+			log.Printf("[error] Redshift %s is down. %s", name, err)
+		}
+	} else {
+		v.Set(1)
+		if !up && known {
+			log.Printf("[info] Redshift %s is up", name)
+		}
+	}
+	redshiftUp.Set(name, v)
+}
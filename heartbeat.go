@@ -0,0 +1,90 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"sync"
+	"time"
+)
+
+// MaxVisibilityTimeout is the max visibility timeout of SQS since a message is received.
+const MaxVisibilityTimeout = 12 * time.Hour
+
+// VisibilityHeartbeat extends the visibility timeout of a message by the interval while the message is imported,
+// so a long COPY is not processed again by another worker.
+type VisibilityHeartbeat struct {
+	Interval time.Duration `yaml:"interval"`
+	// Timeout is the visibility timeout set by each heartbeat. Default is twice of the interval.
+	Timeout time.Duration `yaml:"timeout"`
+	// MaxExtension stops extending after the duration since the import started. Default is 12h, the max of SQS.
+	MaxExtension time.Duration `yaml:"max_extension"`
+}
+
+func (h *VisibilityHeartbeat) validate() error {
+	if h.Interval <= 0 {
+		return fmt.Errorf("visibility_heartbeat.interval is required")
+	}
+	if h.Timeout != 0 && h.Timeout <= h.Interval {
+		return fmt.Errorf("visibility_heartbeat.timeout must be longer than the interval")
+	}
+	if h.timeout() > MaxVisibilityTimeout || h.MaxExtension > MaxVisibilityTimeout {
+		return fmt.Errorf("visibility_heartbeat.timeout and max_extension must be up to %s", MaxVisibilityTimeout)
+	}
+	return nil
+}
+
+func (h *VisibilityHeartbeat) timeout() time.Duration {
+	if h.Timeout == 0 {
+		return 2 * h.Interval
+	}
+	return h.Timeout
+}
+
+func (h *VisibilityHeartbeat) maxExtension() time.Duration {
+	if h.MaxExtension == 0 {
+		return MaxVisibilityTimeout
+	}
+	return h.MaxExtension
+}
+
+// startVisibilityHeartbeat extends the visibility timeout of the message until the returned function is called.
+// It does nothing without a heartbeat or when the source can't change the visibility.
+func startVisibilityHeartbeat(ctx context.Context, h *VisibilityHeartbeat, src MessageSource, msg *Message) func() {
+	vs, ok := src.(VisibilitySource)
+	if h == nil || !ok {
+		return func() {}
+	}
+	msgId := CorrelationID(ctx)
+	hctx, cancel := context.WithCancel(ctx)
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		deadline := time.Now().Add(h.maxExtension())
+		ticker := time.NewTicker(h.Interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-hctx.Done():
+				return
+			case now := <-ticker.C:
+				if now.After(deadline) {
+					log.Printf("[warn] [%s] Stop extending the visibility timeout after visibility_heartbeat.max_extension %s", msgId, h.maxExtension())
+					return
+				}
+				if err := vs.ChangeVisibility(hctx, msg.Handle, h.timeout()); err != nil {
+					if hctx.Err() == nil {
+						log.Printf("[warn] [%s] Can't extend the visibility timeout. %s", msgId, err)
+					}
+					continue
+				}
+				log.Printf("[debug] [%s] Extended the visibility timeout to %s", msgId, h.timeout())
+			}
+		}
+	}()
+	return func() {
+		cancel()
+		wg.Wait()
+	}
+}
@@ -0,0 +1,162 @@
+package main
+
+import (
+	"context"
+	"crypto/subtle"
+	"encoding/json"
+	"expvar"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"strings"
+	"time"
+)
+
+type HTTPConfig struct {
+	Addr string `yaml:"addr"`
+	// StalenessThreshold fails /ready when any target has not been imported successfully within it.
+	StalenessThreshold time.Duration `yaml:"staleness_threshold"`
+	// AdminToken enables POST /copy for requests which have "Authorization: Bearer <token>".
+	AdminToken string `yaml:"admin_token"`
+}
+
+var startedAt = time.Now()
+
+// NewHTTPHandler returns a handler serving /metrics, /version, /health and /ready, and /copy when admin_token is set.
+func NewHTTPHandler(c *Config) http.Handler {
+	return newHTTPHandler(func() *Config { return c })
+}
+
+// newHTTPHandler returns the handler which serves requests by the config returned by config for each request.
+func newHTTPHandler(config func() *Config) http.Handler {
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", expvar.Handler())
+	mux.HandleFunc("/version", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(CurrentBuildInfo())
+	})
+	mux.HandleFunc("/health", func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprintln(w, "OK")
+	})
+	mux.HandleFunc("/ready", func(w http.ResponseWriter, r *http.Request) {
+		c := config()
+		if StartingUp() {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			fmt.Fprintln(w, "starting up")
+			return
+		}
+		if elapsed, ok := stall.stalled(time.Now(), c.StallWindow); ok {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			fmt.Fprintln(w, "stalled: no messages were processed for", elapsed.Truncate(time.Second))
+			return
+		}
+		if stale := staleTargets(c, time.Now()); len(stale) > 0 {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			fmt.Fprintln(w, "stale targets:", strings.Join(stale, ", "))
+			return
+		}
+		fmt.Fprintln(w, "OK")
+	})
+	mux.HandleFunc("/copy", func(w http.ResponseWriter, r *http.Request) {
+		c := config()
+		if c.HTTP.AdminToken == "" {
+			http.NotFound(w, r)
+			return
+		}
+		serveCopy(w, r, c)
+	})
+	return mux
+}
+
+// CopyRequest is a request body of POST /copy.
+type CopyRequest struct {
+	Bucket string `json:"bucket"`
+	Key    string `json:"key"`
+}
+
+// CopyResponse is a response body of POST /copy.
+type CopyResponse struct {
+	Processed int    `json:"processed"`
+	Error     string `json:"error,omitempty"`
+}
+
+// serveCopy imports the object in the request by the same path as S3 events, and responds the result.
+// The request context has values of the context of Run, e.g. the executor and the target filter of RunOptions.
+func serveCopy(w http.ResponseWriter, r *http.Request, c *Config) {
+	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", http.MethodPost)
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	auth := r.Header.Get("Authorization")
+	token := strings.TrimPrefix(auth, "Bearer ")
+	if token == auth || subtle.ConstantTimeCompare([]byte(token), []byte(c.HTTP.AdminToken)) != 1 {
+		http.Error(w, "unauthorized", http.StatusUnauthorized)
+		return
+	}
+	var req CopyRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.Bucket == "" || req.Key == "" {
+		http.Error(w, "bucket and key are required", http.StatusBadRequest)
+		return
+	}
+	id := newCorrelationID()
+	ctx := withCorrelationID(r.Context(), id)
+	record := &EventRecord{EventName: "ManualCopy"}
+	record.S3.Bucket.Name = req.Bucket
+	record.S3.Object.Key = req.Key
+	log.Printf("[info] [%s] Manual COPY requested for %s", id, record)
+
+	n, err := ImportWithContext(ctx, c, Event{Records: []*EventRecord{record}})
+	res := CopyResponse{Processed: n}
+	status := http.StatusOK
+	if err != nil {
+		res.Error = err.Error()
+		status = http.StatusInternalServerError
+	} else if n == 0 {
+		res.Error = fmt.Sprintf("s3://%s/%s is not matched for any targets", req.Bucket, req.Key)
+		status = http.StatusNotFound
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(res)
+}
+
+func staleTargets(c *Config, now time.Time) []string {
+	threshold := c.HTTP.StalenessThreshold
+	if threshold <= 0 {
+		return nil
+	}
+	var stale []string
+	for _, t := range c.Targets {
+		if t.Discard || !t.IsEnabled() {
+			continue
+		}
+		last, ok := TargetLastSuccess(t)
+		if !ok || last.Before(startedAt) {
+			last = startedAt
+		}
+		if now.Sub(last) > threshold {
+			stale = append(stale, t.metricKey())
+		}
+	}
+	return stale
+}
+
+func runHTTPServer(ctx context.Context, c *Config) {
+	srv := &http.Server{
+		Addr: c.HTTP.Addr,
+		// reloaded configs are applied to requests
+		Handler: newHTTPHandler(CurrentConfig),
+		// requests are served by the executor and the filter of Run until the server is shut down
+		BaseContext: func(net.Listener) context.Context { return valueOnlyContext{ctx} },
+	}
+	go func() {
+		<-ctx.Done()
+		srv.Shutdown(context.Background())
+	}()
+	log.Println("[info] Starting HTTP server on", c.HTTP.Addr)
+	if err := srv.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+		log.Println("[error] HTTP server failed.", err)
+	}
+}
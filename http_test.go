@@ -0,0 +1,259 @@
+package rin_test
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	rin "github.com/fujiwara/Rin"
+)
+
+func TestTargetLastSuccess(t *testing.T) {
+	config := loadTestConfig(t, "test/config.yml")
+	useFakeExecutor(t)
+	target := config.Targets[1]
+
+	before := time.Now().Add(-time.Second)
+	src := rin.NewMemorySource(readFixture(t, "test/notification.json"))
+	if err := rin.RunWithSource(context.Background(), config, src, true); err != nil {
+		t.Fatal(err)
+	}
+	last, ok := rin.TargetLastSuccess(target)
+	if !ok {
+		t.Fatal("last success must be recorded")
+	}
+	if last.Before(before) {
+		t.Errorf("last success must be updated: %s", last)
+	}
+}
+
+func TestTargetLastSuccessOfSameTable(t *testing.T) {
+	config := loadConfigWith(t, `targets:
+  - redshift:
+      table: foo
+    s3:
+      key_prefix: test/foo/
+    min_size: 1024
+
+  - redshift:
+      table: foo
+    s3:
+      key_prefix: test/foo/
+    max_size: 1023
+`)
+	useFakeExecutor(t)
+	large, small := config.Targets[0], config.Targets[1]
+	if large.String() != small.String() {
+		t.Fatalf("targets must be the same by String: %s, %s", large, small)
+	}
+	// the object of test/notification.json is 443 bytes
+	src := rin.NewMemorySource(readFixture(t, "test/notification.json"))
+	if err := rin.RunWithSource(context.Background(), config, src, true); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := rin.TargetLastSuccess(small); !ok {
+		t.Error("last success of the matched target must be recorded")
+	}
+	if last, ok := rin.TargetLastSuccess(large); ok {
+		t.Errorf("last success of the other target of the same table must not be recorded: %s", last)
+	}
+}
+
+func TestBytesLoaded(t *testing.T) {
+	config := loadTestConfig(t, "test/config.yml")
+	useFakeExecutor(t)
+	before := rin.BytesLoaded("foo")
+	body := readFixture(t, "test/notification.json")
+	src := rin.NewMemorySource(body, body)
+	if err := rin.RunWithSource(context.Background(), config, src, true); err != nil {
+		t.Fatal(err)
+	}
+	// the object of test/notification.json is 443 bytes
+	if n := rin.BytesLoaded("foo") - before; n != 2*443 {
+		t.Errorf("bytes loaded must be incremented by the object size: %d", n)
+	}
+}
+
+func TestReadyStaleness(t *testing.T) {
+	config := loadTestConfig(t, "test/config.yml")
+	handler := rin.NewHTTPHandler(config)
+
+	rec := httptest.NewRecorder()
+	handler.ServeHTTP(rec, httptest.NewRequest("GET", "/ready", nil))
+	if rec.Code != http.StatusOK {
+		t.Errorf("unexpected status %d without threshold", rec.Code)
+	}
+
+	config.HTTP.StalenessThreshold = time.Nanosecond
+	time.Sleep(time.Millisecond)
+	rec = httptest.NewRecorder()
+	handler.ServeHTTP(rec, httptest.NewRequest("GET", "/ready", nil))
+	if rec.Code != http.StatusServiceUnavailable {
+		t.Errorf("unexpected status %d for stale targets", rec.Code)
+	}
+}
+
+func TestVersionEndpoint(t *testing.T) {
+	config := loadTestConfig(t, "test/config.yml")
+	handler := rin.NewHTTPHandler(config)
+
+	rec := httptest.NewRecorder()
+	handler.ServeHTTP(rec, httptest.NewRequest("GET", "/version", nil))
+	if rec.Code != http.StatusOK {
+		t.Fatalf("unexpected status %d", rec.Code)
+	}
+	var b rin.BuildInfo
+	if err := json.NewDecoder(rec.Body).Decode(&b); err != nil {
+		t.Fatal(err)
+	}
+	if b != rin.CurrentBuildInfo() {
+		t.Errorf("unexpected build info %#v", b)
+	}
+	// built without ldflags
+	if b.Version == "" || b.Commit != "unknown" || b.BuildDate != "unknown" || b.GoVersion == "" {
+		t.Errorf("build info must have defaults %#v", b)
+	}
+}
+
+func TestCopyEndpoint(t *testing.T) {
+	config := loadTestConfig(t, "test/config.yml")
+	fe := useFakeExecutor(t)
+	handler := rin.NewHTTPHandler(config)
+	post := func(token, body string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest("POST", "/copy", strings.NewReader(body))
+		if token != "" {
+			req.Header.Set("Authorization", "Bearer "+token)
+		}
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, req)
+		return rec
+	}
+	body := `{"bucket":"test.bucket.test","key":"test/foo/xxx.json"}`
+
+	if rec := post("secret", body); rec.Code != http.StatusNotFound {
+		t.Errorf("/copy must be disabled without admin_token: %d", rec.Code)
+	}
+
+	config.HTTP.AdminToken = "secret"
+	handler = rin.NewHTTPHandler(config)
+	if rec := post("", body); rec.Code != http.StatusUnauthorized {
+		t.Errorf("unexpected status %d without token", rec.Code)
+	}
+	if rec := post("wrong", body); rec.Code != http.StatusUnauthorized {
+		t.Errorf("unexpected status %d with wrong token", rec.Code)
+	}
+	if len(fe.queries) != 0 {
+		t.Fatalf("unauthorized request must not COPY: %v", fe.queries)
+	}
+
+	rec := post("secret", body)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("unexpected status %d %s", rec.Code, rec.Body.String())
+	}
+	var res rin.CopyResponse
+	if err := json.NewDecoder(rec.Body).Decode(&res); err != nil {
+		t.Fatal(err)
+	}
+	if res.Processed != 1 {
+		t.Errorf("unexpected response %#v", res)
+	}
+	if len(fe.queries) != 1 || !strings.Contains(fe.queries[0], "s3://test.bucket.test/test/foo/xxx.json") {
+		t.Errorf("unexpected queries %v", fe.queries)
+	}
+
+	if rec := post("secret", `{"bucket":"test.bucket.test","key":"unknown/xxx.json"}`); rec.Code != http.StatusNotFound {
+		t.Errorf("unexpected status %d for unmatched key", rec.Code)
+	}
+	fe.err = errors.New("COPY failed")
+	if rec := post("secret", body); rec.Code != http.StatusInternalServerError {
+		t.Errorf("unexpected status %d for failed COPY", rec.Code)
+	}
+
+	req := httptest.NewRequest("POST", "/copy", strings.NewReader(body))
+	req.Header.Set("Authorization", "secret")
+	rec = httptest.NewRecorder()
+	handler.ServeHTTP(rec, req)
+	if rec.Code != http.StatusUnauthorized {
+		t.Errorf("unexpected status %d for the token without Bearer", rec.Code)
+	}
+}
+
+func TestCopyEndpointOfRun(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := l.Addr().String()
+	l.Close()
+	config := loadConfigWith(t, `http:
+  addr: `+addr+`
+  admin_token: secret
+targets:
+  - redshift:
+      table: foo
+    s3:
+      key_prefix: test/foo/
+  - redshift:
+      schema: xxx
+      table: bar
+    s3:
+      key_prefix: test/bar/
+`)
+	fe := &fakeExecutor{}
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error)
+	go func() {
+		done <- rin.Run(ctx, config, rin.RunOptions{
+			Source:   rin.NewMemorySource(),
+			Executor: fe,
+			Filter:   rin.TargetFilter{Exclude: []string{"xxx.bar"}},
+		})
+	}()
+	defer func() {
+		cancel()
+		<-done
+	}()
+	post := func(token, key string) int {
+		body := `{"bucket":"test.bucket.test","key":"` + key + `"}`
+		req, _ := http.NewRequest("POST", "http://"+addr+"/copy", strings.NewReader(body))
+		req.Header.Set("Authorization", "Bearer "+token)
+		res, err := http.DefaultClient.Do(req)
+		if err != nil {
+			return 0
+		}
+		res.Body.Close()
+		return res.StatusCode
+	}
+	var code int
+	for i := 0; i < 100 && code == 0; i++ {
+		time.Sleep(10 * time.Millisecond)
+		code = post("secret", "test/foo/xxx.json")
+	}
+	if code != http.StatusOK {
+		t.Fatalf("unexpected status %d", code)
+	}
+	fe.mu.Lock()
+	if len(fe.queries) != 1 {
+		t.Errorf("COPY must be executed by the executor of RunOptions: %v", fe.queries)
+	}
+	fe.mu.Unlock()
+	if code := post("secret", "test/bar/xxx.csv"); code != http.StatusInternalServerError {
+		t.Errorf("the paused target must not be imported by the filter of RunOptions: %d", code)
+	}
+
+	reloaded := *config
+	reloaded.HTTP.AdminToken = "rotated"
+	rin.SwapConfig(&reloaded)
+	if code := post("secret", "test/foo/xxx.json"); code != http.StatusUnauthorized {
+		t.Errorf("the token of the reloaded config must be required: %d", code)
+	}
+	if code := post("rotated", "test/foo/xxx.json"); code != http.StatusOK {
+		t.Errorf("the token of the reloaded config must be accepted: %d", code)
+	}
+}
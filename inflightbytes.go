@@ -0,0 +1,103 @@
+package main
+
+import (
+	"context"
+	"expvar"
+	"log"
+	"sync"
+)
+
+// inFlightBytes is the estimated size of messages in flight, the sum of their bodies or payloads fetched from S3.
+var inFlightBytes = expvar.NewInt("inflight_bytes")
+
+// InFlightBytes returns the estimated size in bytes of messages received but not completed yet.
+func InFlightBytes() int64 {
+	return inFlightBytes.Value()
+}
+
+// byteBudget pauses receiving messages while the size of messages in flight exceeds max_inflight_bytes.
+type byteBudget struct {
+	mu      sync.Mutex
+	limit   int64
+	used    int64
+	changed chan struct{}
+}
+
+func newByteBudget(limit int64) *byteBudget {
+	return &byteBudget{limit: limit, changed: make(chan struct{})}
+}
+
+// wait blocks until the size in flight is under the limit or ctx is done.
+// A message larger than the limit is received when no other messages are in flight.
+func (b *byteBudget) wait(ctx context.Context) {
+	if b.limit <= 0 {
+		return
+	}
+	logged := false
+	for {
+		b.mu.Lock()
+		used, changed := b.used, b.changed
+		b.mu.Unlock()
+		if used < b.limit {
+			return
+		}
+		if !logged {
+			log.Printf("[info] Pause receiving messages. %d bytes in flight reached max_inflight_bytes %d", used, b.limit)
+			logged = true
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-changed:
+		}
+	}
+}
+
+// reserve adds n bytes of a received message, and returns the reservation to release them after the message is completed.
+func (b *byteBudget) reserve(n int64) *byteReservation {
+	b.update(n)
+	return &byteReservation{budget: b, n: n}
+}
+
+// byteReservation is the size of a message in flight.
+type byteReservation struct {
+	budget *byteBudget
+	mu     sync.Mutex
+	n      int64
+}
+
+// resize replaces the size of the message, e.g. by the payload fetched from S3 for the body of an S3 pointer.
+func (r *byteReservation) resize(n int64) {
+	if r == nil {
+		return
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.budget.update(n - r.n)
+	r.n = n
+}
+
+// release releases the size of the completed message.
+func (r *byteReservation) release() {
+	r.resize(0)
+}
+
+type byteReservationKey struct{}
+
+func withByteReservation(ctx context.Context, r *byteReservation) context.Context {
+	return context.WithValue(ctx, byteReservationKey{}, r)
+}
+
+func byteReservationFrom(ctx context.Context) *byteReservation {
+	r, _ := ctx.Value(byteReservationKey{}).(*byteReservation)
+	return r
+}
+
+func (b *byteBudget) update(n int64) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.used += n
+	inFlightBytes.Add(n)
+	close(b.changed)
+	b.changed = make(chan struct{})
+}
@@ -0,0 +1,109 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"regexp"
+	"strings"
+
+	"github.com/aws/aws-sdk-go/aws"
+)
+
+var (
+	envPlaceholderRegexp = regexp.MustCompile(`\{\{\s*(?:must_)?env\s+"([^"]+)"`)
+	regionRegexp         = regexp.MustCompile(`^[a-z]{2}(-gov)?-[a-z]+-[0-9]+$`)
+)
+
+// Lint loads the config file and checks common mistakes.
+// It returns all problems found.
+func Lint(path string) []error {
+	var problems []error
+	src, err := loadSrcFrom(path)
+	if err != nil {
+		return []error{err}
+	}
+	for _, m := range envPlaceholderRegexp.FindAllStringSubmatch(string(src), -1) {
+		if os.Getenv(m[1]) == "" {
+			problems = append(problems, fmt.Errorf("environment variable %s is not set", m[1]))
+		}
+	}
+	c, err := LoadConfig(path)
+	if err != nil {
+		return append(problems, err)
+	}
+	return append(problems, c.lint()...)
+}
+
+func (c *Config) lint() []error {
+	var problems []error
+	if r := c.Credentials.AWS_REGION; r != "" && !regionRegexp.MatchString(r) {
+		problems = append(problems, fmt.Errorf("credentials.aws_region %q is invalid", r))
+	}
+	for i, t := range c.Targets {
+		name := fmt.Sprintf("targets[%d]", i)
+		problems = append(problems, t.lint(name)...)
+		for j := i + 1; j < len(c.Targets); j++ {
+			if err := t.lintOverlap(c.Targets[j]); err != nil {
+				problems = append(problems, fmt.Errorf("%s and targets[%d] %s", name, j, err))
+			}
+		}
+	}
+	return problems
+}
+
+func (t *Target) lint(name string) []error {
+	var problems []error
+	if t.S3.Bucket == "" {
+		problems = append(problems, fmt.Errorf("%s: s3.bucket is not defined", name))
+	}
+	if r := t.S3.Region; r == "" {
+		problems = append(problems, fmt.Errorf("%s: s3.region is not defined", name))
+	} else if !regionRegexp.MatchString(r) {
+		problems = append(problems, fmt.Errorf("%s: s3.region %q is invalid", name, r))
+	}
+	if t.Discard {
+		return problems
+	}
+	if t.Redshift == nil {
+		return append(problems, fmt.Errorf("%s: redshift is not defined", name))
+	}
+	for _, f := range [][2]string{
+		{"host", t.Redshift.Host},
+		{"dbname", t.Redshift.DBName},
+		{"user", t.Redshift.User},
+		{"table", t.Redshift.Table},
+	} {
+		if f[1] == "" {
+			problems = append(problems, fmt.Errorf("%s: redshift.%s is not defined", name, f[0]))
+		}
+	}
+	if aws.BoolValue(t.UseVPCEndpoint) && t.S3.Region != "" && t.S3.Region != t.Redshift.ClusterRegion() {
+		problems = append(problems, fmt.Errorf("%s: use_vpc_endpoint requires s3.region %s to be the region of the cluster %s", name, t.S3.Region, t.Redshift.ClusterRegion()))
+	}
+	if !balancedQuotes(t.SQLOption) {
+		problems = append(problems, fmt.Errorf("%s: sql_option has unbalanced quotes: %s", name, t.SQLOption))
+	}
+	return problems
+}
+
+// lintOverlap checks whether the keys matched by the next target are also matched by t.
+func (t *Target) lintOverlap(next *Target) error {
+	if t.S3.Bucket != next.S3.Bucket || t.S3.KeyPrefix == "" || next.S3.KeyPrefix == "" {
+		return nil
+	}
+	if !strings.HasPrefix(next.S3.KeyPrefix, t.S3.KeyPrefix) {
+		return nil
+	}
+	if !strings.HasSuffix(next.S3.KeySuffix, t.S3.KeySuffix) && !strings.HasSuffix(t.S3.KeySuffix, next.S3.KeySuffix) {
+		// no keys have both suffixes
+		return nil
+	}
+	if t.Break || t.Discard {
+		return fmt.Errorf("overlap: key_prefix %s is never matched because of key_prefix %s", next.S3.KeyPrefix, t.S3.KeyPrefix)
+	}
+	return fmt.Errorf("overlap: keys under %s are imported by both targets", next.S3.KeyPrefix)
+}
+
+func balancedQuotes(s string) bool {
+	return strings.Count(s, "'")%2 == 0
+}
@@ -0,0 +1,62 @@
+package rin_test
+
+import (
+	"os"
+	"strings"
+	"testing"
+
+	rin "github.com/fujiwara/Rin"
+)
+
+func TestLint(t *testing.T) {
+	os.Setenv("AWS_SECRET_ACCESS_KEY", "SSS")
+	if problems := rin.Lint("test/config.yml"); len(problems) != 0 {
+		t.Errorf("unexpected problems %v", problems)
+	}
+
+	problems := rin.Lint(writeConfigWith(t, `credentials:
+  aws_secret_access_key: '{{ env "RIN_LINT_UNDEFINED_ENV" }}'
+targets:
+  - redshift:
+      table: foo
+    s3:
+      key_prefix: test/foo
+    break: true
+
+  - redshift:
+      table: foo_bar
+    s3:
+      key_prefix: test/foo/bar
+
+  - redshift:
+      table: baz
+    s3:
+      key_prefix: test/baz
+      region: tokyo
+    sql_option: "CSV DELIMITER ','' ESCAPE"
+
+  - s3:
+      key_prefix: test/qux
+`))
+	expected := []string{
+		"environment variable RIN_LINT_UNDEFINED_ENV is not set",
+		"targets[0] and targets[1] overlap: key_prefix test/foo/bar is never matched",
+		`targets[2]: s3.region "tokyo" is invalid`,
+		"targets[2]: sql_option has unbalanced quotes",
+		"targets[3]: redshift.table is not defined",
+	}
+	if len(problems) != len(expected) {
+		t.Errorf("unexpected problems %v", problems)
+	}
+	for _, e := range expected {
+		found := false
+		for _, p := range problems {
+			if strings.Contains(p.Error(), e) {
+				found = true
+			}
+		}
+		if !found {
+			t.Errorf("problem %q is not reported in %v", e, problems)
+		}
+	}
+}
@@ -1,10 +1,13 @@
 package main
 
 import (
+	"context"
 	"flag"
 	"fmt"
 	"log"
 	"os"
+	"strings"
+	"time"
 
 	//rin "github.com/fujiwara/Rin"
 	//"rin"
@@ -15,6 +18,7 @@ import (
 
 var (
 	version   string
+	commit    string
 	buildDate string
 )
 
@@ -25,7 +29,25 @@ func main() {
 		batchMode   bool
 		debug       bool
 		dryRun      bool
+		from        string
+		to          string
+		max         int
+		only        string
+		exclude     string
+		bucket      string
+		key         string
+		maxRuntime  time.Duration
+		eventFile   string
+		keysFile    string
+		skipQueue   bool
+		labels      string
+		failFast    bool
 	)
+	var subcommand string
+	args := os.Args[1:]
+	if len(args) > 0 && !strings.HasPrefix(args[0], "-") {
+		subcommand, args = args[0], args[1:]
+	}
 	flag.StringVar(&config, "config", "config.yaml", "config file path")
 	flag.StringVar(&config, "c", "config.yaml", "config file path")
 	flag.BoolVar(&debug, "debug", false, "enable debug logging")
@@ -34,12 +56,28 @@ func main() {
 	flag.BoolVar(&showVersion, "v", false, "show version")
 	flag.BoolVar(&batchMode, "batch", false, "batch mode")
 	flag.BoolVar(&batchMode, "b", false, "batch mode")
-	flag.BoolVar(&dryRun, "dry-run", false, "dry run mode (load configuration only)")
-	flag.Parse()
+	flag.BoolVar(&dryRun, "dry-run", false, "dry run mode (load configuration only. replay: without COPY)")
+	flag.StringVar(&from, "from", "", "redrive: queue name to move messages from (e.g. dead-letter queue)")
+	flag.StringVar(&to, "to", "", "redrive: queue name to move messages to (default: queue_name of config)")
+	flag.IntVar(&max, "max", 0, "redrive: max number of messages to move (0: messages in the queue at the start)")
+	flag.StringVar(&only, "only", "", "activate only targets of the tables (comma separated table or schema.table)")
+	flag.StringVar(&exclude, "exclude", "", "pause targets of the tables (comma separated table or schema.table)")
+	flag.StringVar(&labels, "labels", "", "activate only targets which have all the labels (comma separated name=value)")
+	flag.StringVar(&bucket, "bucket", "", "validate-sql: bucket of the object")
+	flag.StringVar(&key, "key", "", "validate-sql: key of the object")
+	flag.StringVar(&eventFile, "event", "", "replay: path or URL of the S3 event file")
+	flag.StringVar(&keysFile, "keys", "", "route-test: path or URL of the file of objects (s3:// URIs or bucket and key per line)")
+	flag.DurationVar(&maxRuntime, "max-runtime", 0, "shut down after the duration (0: unlimited)")
+	flag.BoolVar(&failFast, "fail-fast", false, "stop after the first message failed by COPY, and exit with an error")
+	flag.BoolVar(&skipQueue, "skip-queue-check", false, "start without checking the queue of queue_name exists")
+	flag.CommandLine.Parse(args)
 
 	if showVersion {
-		fmt.Println("version:", version)
-		fmt.Println("build:", buildDate)
+		b := CurrentBuildInfo()
+		fmt.Println("version:", b.Version)
+		fmt.Println("commit:", b.Commit)
+		fmt.Println("build:", b.BuildDate)
+		fmt.Println("go:", b.GoVersion)
 		return
 	}
 
@@ -53,14 +91,106 @@ func main() {
 		Writer:   os.Stderr,
 	}
 	log.SetOutput(filter)
-	log.Println("[info] rin version:", version)
+	log.Println("[info] rin version:", CurrentBuildInfo().Version)
 
-	run := Run
+	switch subcommand {
+	case "":
+	case "lint":
+		problems := Lint(config)
+		for _, p := range problems {
+			fmt.Println(p)
+		}
+		if len(problems) > 0 {
+			os.Exit(ExitError)
+		}
+		return
+	case "check-queue":
+		if err := CheckQueue(context.Background(), config, os.Stdout); err != nil {
+			log.Println("[error]", err)
+			os.Exit(ExitCode(err, nil))
+		}
+		return
+	case "config-dump":
+		if err := DumpConfig(config, os.Stdout); err != nil {
+			log.Println("[error]", err)
+			os.Exit(ExitCode(err, nil))
+		}
+		return
+	case "redrive":
+		if err := Redrive(context.Background(), config, from, to, max); err != nil {
+			log.Println("[error]", err)
+			os.Exit(ExitCode(err, nil))
+		}
+		return
+	case "tail":
+		if err := TailConfigFile(context.Background(), config, os.Stdout); err != nil {
+			log.Println("[error]", err)
+			os.Exit(ExitCode(err, nil))
+		}
+		return
+	case "replay":
+		if err := Replay(context.Background(), config, eventFile, dryRun, os.Stdout); err != nil {
+			log.Println("[error]", err)
+			os.Exit(ExitCode(err, nil))
+		}
+		return
+	case "route-test":
+		if err := RouteTest(config, keysFile, os.Stdout); err != nil {
+			log.Println("[error]", err)
+			os.Exit(ExitCode(err, nil))
+		}
+		return
+	case "validate-sql":
+		if err := ValidateSQL(config, bucket, key, os.Stdout); err != nil {
+			log.Println("[error]", err)
+			os.Exit(ExitCode(err, nil))
+		}
+		return
+	default:
+		log.Println("[error] unknown subcommand:", subcommand)
+		os.Exit(ExitError)
+	}
+
+	// failed messages make the exit code of batch mode only
+	var result *BatchResult
+	if batchMode {
+		result = &BatchResult{}
+	}
+	selected, err := ParseLabels(labels)
+	if err != nil {
+		log.Println("[error]", err)
+		os.Exit(ExitError)
+	}
+	run := func(configFile string, batchMode bool) error {
+		return RunConfigFile(context.Background(), configFile, RunOptions{
+			BatchMode:      batchMode,
+			MaxRuntime:     maxRuntime,
+			Result:         result,
+			SkipQueueCheck: skipQueue,
+			FailFast:       failFast,
+			Filter: TargetFilter{
+				Only:    ParseTableList(only),
+				Exclude: ParseTableList(exclude),
+				Labels:  selected,
+			},
+		})
+	}
 	if dryRun {
 		run = DryRun
 	}
-	if err := run(config, batchMode); err != nil {
+	shutdown, err := SetupOTelTracer(context.Background())
+	if err != nil {
 		log.Println("[error]", err)
-		os.Exit(1)
+		os.Exit(ExitError)
+	}
+	err = run(config, batchMode)
+	if err != nil {
+		log.Println("[error]", err)
+	}
+	if serr := shutdown(context.Background()); serr != nil {
+		log.Println("[warn] failed to export spans,", serr)
+	}
+	if code := ExitCode(err, result); code != ExitOK {
+		os.Exit(code)
 	}
 }
@@ -0,0 +1,130 @@
+package main
+
+import (
+	"expvar"
+	"strconv"
+	"time"
+)
+
+// Metrics are published by expvar, and served by /metrics of the HTTP server.
+var (
+	targetLastSuccess = expvar.NewMap("target_last_success_unixtime")
+	copyDuration      = expvar.NewMap("copy_duration_seconds")
+	loadLatency       = expvar.NewMap("load_latency_seconds")
+	sqsDeleteFailures = expvar.NewInt("sqs_delete_failures")
+	sqsDeleteGaveUp   = expvar.NewInt("sqs_delete_gave_up")
+	bytesLoaded       = expvar.NewMap("rin_bytes_loaded_total")
+	routeCacheHits    = expvar.NewInt("route_cache_hits")
+	routeCacheMisses  = expvar.NewInt("route_cache_misses")
+)
+
+// DurationBuckets are upper bounds in seconds of histogram buckets of copy_duration_seconds.
+var DurationBuckets = []float64{0.1, 0.5, 1, 5, 10, 30, 60, 300}
+
+// LatencyBuckets are upper bounds in seconds of histogram buckets of load_latency_seconds.
+var LatencyBuckets = []float64{10, 30, 60, 300, 600, 1800, 3600}
+
+func recordTargetSuccess(t *Target, now time.Time) {
+	v := new(expvar.Int)
+	v.Set(now.Unix())
+	targetLastSuccess.Set(t.metricKey(), v)
+}
+
+// TargetLastSuccess returns the time when the target was imported successfully at last.
+func TargetLastSuccess(t *Target) (time.Time, bool) {
+	v, ok := targetLastSuccess.Get(t.metricKey()).(*expvar.Int)
+	if !ok {
+		return time.Time{}, false
+	}
+	return time.Unix(v.Value(), 0), true
+}
+
+// recordBytesLoaded adds the size of the object loaded to the table.
+func recordBytesLoaded(table string, size int64) {
+	bytesLoaded.Add(table, size)
+}
+
+// BytesLoaded returns the total size of objects loaded to the table ("table" or "schema.table").
+func BytesLoaded(table string) int64 {
+	v, ok := bytesLoaded.Get(table).(*expvar.Int)
+	if !ok {
+		return 0
+	}
+	return v.Value()
+}
+
+// RouteCacheStats returns the number of lookups of candidate targets hit and missed by route_cache_size.
+func RouteCacheStats() (hits, misses int64) {
+	return routeCacheHits.Value(), routeCacheMisses.Value()
+}
+
+// SQSDeleteFailures returns the number of failed attempts to delete messages, and messages given up deleting.
+func SQSDeleteFailures() (attempts, gaveUp int64) {
+	return sqsDeleteFailures.Value(), sqsDeleteGaveUp.Value()
+}
+
+// observeDuration counts d in the histogram of the phase of COPY.
+func observeDuration(phase string, d time.Duration) {
+	observe(copyDuration, phase, DurationBuckets, d)
+}
+
+// observe counts d in the histogram of the name in m.
+// A bucket "le_N" counts durations less than or equal to N seconds, and "count" and "sum" are totals.
+func observe(m *expvar.Map, name string, buckets []float64, d time.Duration) {
+	h, ok := m.Get(name).(*expvar.Map)
+	if !ok {
+		h = new(expvar.Map).Init()
+		m.Set(name, h)
+	}
+	sec := d.Seconds()
+	for _, b := range buckets {
+		if sec <= b {
+			h.Add("le_"+strconv.FormatFloat(b, 'f', -1, 64), 1)
+		}
+	}
+	h.Add("count", 1)
+	h.AddFloat("sum", sec)
+}
+
+func observeCopyDurations(d *CopyDurations) {
+	observeDuration("connect", d.Connect)
+	observeDuration("copy", d.Copy)
+	observeDuration("commit", d.Commit)
+}
+
+// CopyDurationCount returns the number of durations observed for the phase of COPY.
+func CopyDurationCount(phase string) int64 {
+	n, _ := histogramTotals(copyDuration, phase)
+	return n
+}
+
+// LoadLatency returns the duration from the event time of the record to now.
+func LoadLatency(r *EventRecord, now time.Time) (time.Duration, bool) {
+	at, err := time.Parse(time.RFC3339Nano, r.EventTime)
+	if err != nil {
+		return 0, false
+	}
+	return now.Sub(at), true
+}
+
+// LoadLatencyTotals returns the number and the sum of load latencies observed for the target.
+func LoadLatencyTotals(t *Target) (int64, time.Duration) {
+	n, sum := histogramTotals(loadLatency, t.metricKey())
+	return n, time.Duration(sum * float64(time.Second))
+}
+
+func histogramTotals(m *expvar.Map, name string) (int64, float64) {
+	h, ok := m.Get(name).(*expvar.Map)
+	if !ok {
+		return 0, 0
+	}
+	var n int64
+	var sum float64
+	if v, ok := h.Get("count").(*expvar.Int); ok {
+		n = v.Value()
+	}
+	if v, ok := h.Get("sum").(*expvar.Float); ok {
+		sum = v.Value()
+	}
+	return n, sum
+}
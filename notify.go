@@ -0,0 +1,116 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/sns"
+	"github.com/aws/aws-sdk-go/service/sns/snsiface"
+	"github.com/aws/aws-sdk-go/service/sqs"
+)
+
+// SNSAPI is the SNS client used to publish notifications of on_success_notify.
+// When nil, a client is created from Sessions.SNS.
+var SNSAPI snsiface.SNSAPI
+
+func snsClient() snsiface.SNSAPI {
+	if SNSAPI != nil {
+		return SNSAPI
+	}
+	return sns.New(Sessions.SNS)
+}
+
+// Notify is a destination of notifications published after a successful COPY.
+// One of TopicARN or QueueName is required.
+type Notify struct {
+	TopicARN  string `yaml:"topic_arn"`
+	QueueName string `yaml:"queue_name"`
+}
+
+func (n *Notify) String() string {
+	if n.TopicARN != "" {
+		return n.TopicARN
+	}
+	return n.QueueName
+}
+
+func (n *Notify) validate() error {
+	if (n.TopicARN == "") == (n.QueueName == "") {
+		return fmt.Errorf("on_success_notify requires one of topic_arn or queue_name")
+	}
+	return nil
+}
+
+// LoadNotification is the message published to on_success_notify.
+// Rows is omitted when the Executor does not report the number of loaded rows.
+type LoadNotification struct {
+	Table     string    `json:"table"`
+	Bucket    string    `json:"bucket"`
+	Key       string    `json:"key"`
+	Rows      *int64    `json:"rows,omitempty"`
+	Timestamp time.Time `json:"timestamp"`
+}
+
+func (n *Notify) publish(ctx context.Context, ln LoadNotification) error {
+	b, err := json.Marshal(ln)
+	if err != nil {
+		return err
+	}
+	if n.TopicARN != "" {
+		_, err = snsClient().PublishWithContext(ctx, &sns.PublishInput{
+			TopicArn: aws.String(n.TopicARN),
+			Message:  aws.String(string(b)),
+		})
+		return err
+	}
+	svc := sqsClient()
+	u, err := queueURL(ctx, svc, n.QueueName)
+	if err != nil {
+		return err
+	}
+	_, err = svc.SendMessageWithContext(ctx, &sqs.SendMessageInput{
+		QueueUrl:    u,
+		MessageBody: aws.String(string(b)),
+	})
+	return err
+}
+
+// notifyLoaded publishes the notification of the record imported to the target.
+// Failures are logged only, because the COPY has been committed.
+func notifyLoaded(ctx context.Context, target *Target, record *EventRecord, cap *[]string, rows *int64, now time.Time) {
+	n := target.OnSuccessNotify
+	if n == nil {
+		return
+	}
+	ln := LoadNotification{
+		Table:     target.plainTableName(cap),
+		Bucket:    record.S3.Bucket.Name,
+		Key:       record.S3.Object.Key,
+		Rows:      rows,
+		Timestamp: now.UTC(),
+	}
+	if err := n.publish(ctx, ln); err != nil {
+		log.Printf("[error] [%s] Can't notify %s of loading to target %s. %s", CorrelationID(ctx), n, target, err)
+		return
+	}
+	log.Printf("[debug] [%s] Notified %s of loading to target %s", CorrelationID(ctx), n, target)
+}
+
+type copyRowsKey struct{}
+
+func withCopyRows(ctx context.Context) (context.Context, *int64) {
+	rows := int64(-1)
+	return context.WithValue(ctx, copyRowsKey{}, &rows), &rows
+}
+
+// RecordCopyRows records the number of rows loaded by COPY executing in ctx.
+// An Executor calls it to report rows to on_success_notify.
+func RecordCopyRows(ctx context.Context, n int64) {
+	if rows, ok := ctx.Value(copyRowsKey{}).(*int64); ok {
+		*rows = n
+	}
+}
@@ -0,0 +1,100 @@
+package rin_test
+
+import (
+	"context"
+	"encoding/json"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/request"
+	"github.com/aws/aws-sdk-go/service/sns"
+	"github.com/aws/aws-sdk-go/service/sns/snsiface"
+	rin "github.com/fujiwara/Rin"
+)
+
+type mockSNS struct {
+	snsiface.SNSAPI
+	published []*sns.PublishInput
+}
+
+func (m *mockSNS) PublishWithContext(ctx aws.Context, in *sns.PublishInput, opts ...request.Option) (*sns.PublishOutput, error) {
+	m.published = append(m.published, in)
+	return &sns.PublishOutput{}, nil
+}
+
+// rowsExecutor reports the number of loaded rows.
+type rowsExecutor struct {
+	fakeExecutor
+	rows int64
+}
+
+func (e *rowsExecutor) Exec(ctx context.Context, dsn string, queries ...string) error {
+	if err := e.fakeExecutor.Exec(ctx, dsn, queries...); err != nil {
+		return err
+	}
+	rin.RecordCopyRows(ctx, e.rows)
+	return nil
+}
+
+func TestOnSuccessNotify(t *testing.T) {
+	config := loadConfigWith(t, `on_success_notify:
+  topic_arn: "arn:aws:sns:ap-northeast-1:123456789012:rin-loaded"
+targets:
+  - redshift:
+      schema: $1
+      table: events
+    s3:
+      key_regexp: ^logs/([a-z]+)/
+
+  - redshift:
+      table: foo
+    s3:
+      key_prefix: test/foo/
+    on_success_notify:
+      queue_name: rin_loaded
+`)
+	m := &mockSNS{}
+	orig := rin.SNSAPI
+	rin.SNSAPI = m
+	defer func() { rin.SNSAPI = orig }()
+	mq := &mockSQS{queueURL: "https://sqs.ap-northeast-1.amazonaws.com/123456789012/"}
+	useMockSQS(t, mq)
+	e := &rowsExecutor{rows: 42}
+	origExecutor := rin.DefaultExecutor
+	rin.DefaultExecutor = e
+	defer func() { rin.DefaultExecutor = origExecutor }()
+
+	event := rin.Event{Records: []*rin.EventRecord{{}, {}}}
+	event.Records[0].S3.Bucket.Name = "test.bucket.test"
+	event.Records[0].S3.Object.Key = "logs/app/x.json"
+	event.Records[1].S3.Bucket.Name = "test.bucket.test"
+	event.Records[1].S3.Object.Key = "test/foo/y.json"
+	start := time.Now().Add(-time.Second)
+	if _, err := rin.ImportWithContext(context.Background(), config, event); err != nil {
+		t.Fatal(err)
+	}
+
+	if len(m.published) != 1 || *m.published[0].TopicArn != "arn:aws:sns:ap-northeast-1:123456789012:rin-loaded" {
+		t.Fatalf("unexpected published notifications %v", m.published)
+	}
+	var n rin.LoadNotification
+	if err := json.Unmarshal([]byte(*m.published[0].Message), &n); err != nil {
+		t.Fatal(err)
+	}
+	if n.Table != "app.events" || n.Bucket != "test.bucket.test" || n.Key != "logs/app/x.json" || n.Rows == nil || *n.Rows != 42 || n.Timestamp.Before(start) {
+		t.Errorf("unexpected notification %s", *m.published[0].Message)
+	}
+
+	sent := mq.queues["https://sqs.ap-northeast-1.amazonaws.com/123456789012/rin_loaded"]
+	if len(sent) != 1 {
+		t.Fatalf("the notification of the target must be sent to the queue: %v", mq.queues)
+	}
+	n = rin.LoadNotification{}
+	if err := json.Unmarshal([]byte(*sent[0].Body), &n); err != nil {
+		t.Fatal(err)
+	}
+	if n.Table != "foo" || n.Key != "test/foo/y.json" || *n.Rows != 42 {
+		t.Errorf("unexpected notification %s", *sent[0].Body)
+	}
+}
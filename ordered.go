@@ -0,0 +1,119 @@
+package main
+
+import (
+	"context"
+	"log"
+	"sort"
+	"sync"
+	"time"
+)
+
+// DefaultOrderWindow is the default order_window of ordered targets.
+var DefaultOrderWindow = time.Second
+
+// copySequencer serializes COPYs of ordered targets to the same table in the order of event times.
+var copySequencer = newSequencer()
+
+type sequencer struct {
+	mu      sync.Mutex
+	pending map[string][]*sequenced
+	running map[string]bool
+	changed chan struct{}
+}
+
+type sequenced struct {
+	eventTime time.Time
+	readyAt   time.Time
+}
+
+func newSequencer() *sequencer {
+	return &sequencer{
+		pending: make(map[string][]*sequenced),
+		running: make(map[string]bool),
+		changed: make(chan struct{}),
+	}
+}
+
+// notify wakes up waiters. It must be called with the lock.
+func (s *sequencer) notify() {
+	close(s.changed)
+	s.changed = make(chan struct{})
+}
+
+func (s *sequencer) remove(key string, e *sequenced) {
+	list := s.pending[key]
+	for i, p := range list {
+		if p == e {
+			s.pending[key] = append(list[:i], list[i+1:]...)
+			break
+		}
+	}
+	if len(s.pending[key]) == 0 {
+		delete(s.pending, key)
+	}
+}
+
+// acquire waits until the window has passed since the arrival, and no earlier event of the key is pending or running.
+// The returned function releases the key for the next event.
+func (s *sequencer) acquire(ctx context.Context, key string, eventTime time.Time, window time.Duration) (func(), error) {
+	e := &sequenced{eventTime: eventTime, readyAt: time.Now().Add(window)}
+	s.mu.Lock()
+	list := append(s.pending[key], e)
+	sort.SliceStable(list, func(i, j int) bool { return list[i].eventTime.Before(list[j].eventTime) })
+	s.pending[key] = list
+	s.notify()
+	for {
+		wait := time.Until(e.readyAt)
+		if wait <= 0 && !s.running[key] && s.pending[key][0] == e {
+			s.remove(key, e)
+			s.running[key] = true
+			s.mu.Unlock()
+			return func() {
+				s.mu.Lock()
+				defer s.mu.Unlock()
+				delete(s.running, key)
+				s.notify()
+			}, nil
+		}
+		changed := s.changed
+		s.mu.Unlock()
+		if wait <= 0 {
+			wait = time.Hour
+		}
+		timer := time.NewTimer(wait)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			s.mu.Lock()
+			s.remove(key, e)
+			s.notify()
+			s.mu.Unlock()
+			return nil, ctx.Err()
+		case <-changed:
+		case <-timer.C:
+		}
+		timer.Stop()
+		s.mu.Lock()
+	}
+}
+
+func (t *Target) orderWindow() time.Duration {
+	if t.OrderWindow <= 0 {
+		return DefaultOrderWindow
+	}
+	return t.OrderWindow
+}
+
+// waitForOrder waits for the turn of the record to COPY to the table of the ordered target.
+// When the event time is unknown, the record is ordered by the time it arrived.
+func waitForOrder(ctx context.Context, target *Target, record *EventRecord, cap *[]string) (func(), error) {
+	if !target.Ordered {
+		return func() {}, nil
+	}
+	at, err := time.Parse(time.RFC3339Nano, record.EventTime)
+	if err != nil {
+		at = time.Now()
+	}
+	log.Printf("[debug] [%s] Waiting for the turn of event time %s to COPY to %s", CorrelationID(ctx), at.Format(time.RFC3339Nano), target.tableName(cap))
+	return copySequencer.acquire(ctx, target.tableKey(cap), at, target.orderWindow())
+}
@@ -0,0 +1,83 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"sort"
+
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/semconv/v1.4.0"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// instrumentationName is the name of the OpenTelemetry tracer of Rin.
+const instrumentationName = "github.com/fujiwara/Rin"
+
+type otelTracer struct {
+	tracer trace.Tracer
+}
+
+// NewOTelTracer adapts the tracer of the OpenTelemetry TracerProvider to a Tracer.
+func NewOTelTracer(tp trace.TracerProvider) Tracer {
+	return &otelTracer{tracer: tp.Tracer(instrumentationName)}
+}
+
+func (t *otelTracer) StartSpan(ctx context.Context, name string) (context.Context, func(attrs map[string]string, err error)) {
+	ctx, span := t.tracer.Start(ctx, name)
+	return ctx, func(attrs map[string]string, err error) {
+		keys := make([]string, 0, len(attrs))
+		for k := range attrs {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+		kvs := make([]attribute.KeyValue, 0, len(keys))
+		for _, k := range keys {
+			kvs = append(kvs, attribute.String(k, attrs[k]))
+		}
+		span.SetAttributes(kvs...)
+		if err != nil {
+			span.RecordError(err)
+			span.SetStatus(codes.Error, err.Error())
+		}
+		span.End()
+	}
+}
+
+// SetupOTelTracer installs DefaultTracer which exports spans by OTLP over HTTP, configured by the OTEL_* environment variables.
+// Spans are exported when OTEL_TRACES_EXPORTER is otlp, or an endpoint is set by OTEL_EXPORTER_OTLP_ENDPOINT or
+// OTEL_EXPORTER_OTLP_TRACES_ENDPOINT. OTEL_TRACES_EXPORTER=none disables it.
+// The returned shutdown flushes the spans, and it must be called before the process exits.
+func SetupOTelTracer(ctx context.Context) (shutdown func(context.Context) error, err error) {
+	shutdown = func(context.Context) error { return nil }
+	switch exporter := os.Getenv("OTEL_TRACES_EXPORTER"); exporter {
+	case "none":
+		return shutdown, nil
+	case "":
+		if os.Getenv("OTEL_EXPORTER_OTLP_ENDPOINT") == "" && os.Getenv("OTEL_EXPORTER_OTLP_TRACES_ENDPOINT") == "" {
+			return shutdown, nil
+		}
+	case "otlp":
+	default:
+		return shutdown, fmt.Errorf("OTEL_TRACES_EXPORTER %s is not supported (otlp or none)", exporter)
+	}
+	exp, err := otlptracehttp.New(ctx)
+	if err != nil {
+		return shutdown, fmt.Errorf("failed to create the OTLP exporter, %s", err)
+	}
+	// OTEL_SERVICE_NAME and OTEL_RESOURCE_ATTRIBUTES override the service name
+	res, err := resource.New(ctx,
+		resource.WithAttributes(semconv.ServiceNameKey.String("rin"), semconv.ServiceVersionKey.String(CurrentBuildInfo().Version)),
+		resource.WithFromEnv(),
+	)
+	if err != nil {
+		return shutdown, fmt.Errorf("failed to detect the resource of traces, %s", err)
+	}
+	tp := sdktrace.NewTracerProvider(sdktrace.WithBatcher(exp), sdktrace.WithResource(res))
+	DefaultTracer = NewOTelTracer(tp)
+	return tp.Shutdown, nil
+}
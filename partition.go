@@ -0,0 +1,110 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"strings"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/lib/pq"
+)
+
+// AddPartition registers the object as a partition of the Spectrum external table instead of COPY.
+type AddPartition struct {
+	// Partitions are partition columns and values in the order of the table definition. Values are expanded by placeholders.
+	Partitions []PartitionValue `yaml:"partitions"`
+	// Location is the s3:// URI of the partition, expanded by placeholders. Default is the folder of the key.
+	Location string `yaml:"location"`
+}
+
+// PartitionValue is a partition column and its value.
+type PartitionValue struct {
+	Name  string `yaml:"name"`
+	Value string `yaml:"value"`
+}
+
+func (p *AddPartition) validate() error {
+	if len(p.Partitions) == 0 {
+		return fmt.Errorf("target.add_partition.partitions is required")
+	}
+	for i, v := range p.Partitions {
+		if v.Name == "" || v.Value == "" {
+			return fmt.Errorf("target.add_partition.partitions[%d] requires name and value", i)
+		}
+	}
+	return nil
+}
+
+// placeHolders returns strings of add_partition which may have placeholders.
+func (p *AddPartition) placeHolders() []string {
+	s := []string{p.Location}
+	for _, v := range p.Partitions {
+		s = append(s, v.Value)
+	}
+	return s
+}
+
+// BuildAddPartitionSQL builds ALTER TABLE ADD PARTITION for the object.
+func (t *Target) BuildAddPartitionSQL(bucket, key string, capture *[]string) (string, error) {
+	p := t.AddPartition
+	if p == nil {
+		return "", fmt.Errorf("target %s has no add_partition", t)
+	}
+	values := make([]string, len(p.Partitions))
+	for i, v := range p.Partitions {
+		value := expandPlaceHolder(v.Value, capture)
+		if value == "" {
+			return "", fmt.Errorf("partition %s has an empty value for key %s", v.Name, key)
+		}
+		values[i] = pq.QuoteIdentifier(v.Name) + "=" + quoteValue(value)
+	}
+	location := fmt.Sprintf(S3URITemplate, bucket, key[:strings.LastIndex(key, "/")+1])
+	if p.Location != "" {
+		location = expandPlaceHolder(p.Location, capture)
+	}
+	query := fmt.Sprintf("ALTER TABLE %s ADD IF NOT EXISTS PARTITION (%s) LOCATION %s",
+		t.tableName(capture), strings.Join(values, ", "), quoteS3URI(location))
+	if !aws.BoolValue(t.DisableSQLComment) {
+		query = SQLComment + query
+	}
+	return query, nil
+}
+
+// addPartitionToCluster executes ALTER TABLE ADD PARTITION for the record on the cluster of the target.
+// It runs out of a transaction by an AutocommitExecutor, because it can't run inside a transaction block.
+func addPartitionToCluster(ctx context.Context, c *Config, target *Target, record *EventRecord, cap *[]string) error {
+	id := CorrelationID(ctx)
+	query, err := target.BuildAddPartitionSQL(record.S3.Bucket.Name, record.S3.Object.Key, cap)
+	if err == nil {
+		err = c.checkSQLLength(query)
+	}
+	if err != nil {
+		return &SQLBuildError{Target: target.String(), Err: err}
+	}
+	log.Printf("[debug] [%s] SQL: %s", id, c.logSQL(query))
+	tracef(ctx, TraceSQL, "%s", c.logSQL(query))
+	e, autocommit := executorFrom(ctx).(AutocommitExecutor)
+	queries := append(target.Redshift.SessionSQLs(), query)
+	if autocommit {
+		// SET LOCAL has no effect out of a transaction. ExecAutocommit resets the session after all.
+		queries = append(target.Redshift.sessionSQLs("SET"), query)
+	}
+	if err := auditSQL(ctx, c, target, queries); err != nil {
+		return err
+	}
+	dsn := target.Redshift.DSN()
+	if autocommit {
+		err = e.ExecAutocommit(ctx, dsn, queries...)
+	} else {
+		err = executorFrom(ctx).Exec(ctx, dsn, queries...)
+	}
+	if err != nil {
+		log.Printf("[error] [%s] ADD PARTITION failed. %s", id, err)
+		tracef(ctx, TraceCopy, "failed to target %s. %s", target, err)
+		return &CopyError{target.String(), err}
+	}
+	log.Printf("[info] [%s] ADD PARTITION completed to target %s", id, target)
+	tracef(ctx, TraceCopy, "partition added to target %s", target)
+	return nil
+}
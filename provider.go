@@ -0,0 +1,209 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+	"github.com/aws/aws-sdk-go/service/dynamodb/dynamodbiface"
+	yaml "gopkg.in/yaml.v2"
+)
+
+// TargetProvider loads targets from an external source. The targets are appended to targets of the config file.
+// Targets must return new values by each call, because they are merged with the config in place.
+type TargetProvider interface {
+	Targets(ctx context.Context) ([]*Target, error)
+}
+
+// DefaultTargetRefreshInterval is the interval of loading targets from a TargetProvider.
+var DefaultTargetRefreshInterval = time.Minute
+
+// TargetProviderConfig is the target_provider section.
+type TargetProviderConfig struct {
+	DynamoDB *DynamoDBTargetProvider `yaml:"dynamodb"`
+	Interval time.Duration           `yaml:"interval"`
+}
+
+func (c *TargetProviderConfig) interval() time.Duration {
+	if c == nil || c.Interval <= 0 {
+		return DefaultTargetRefreshInterval
+	}
+	return c.Interval
+}
+
+// DynamoDBAPI is the DynamoDB client used by DynamoDBTargetProvider.
+// When nil, a client is created from Sessions.DynamoDB.
+var DynamoDBAPI dynamodbiface.DynamoDBAPI
+
+func dynamoDBClient() dynamodbiface.DynamoDBAPI {
+	if DynamoDBAPI != nil {
+		return DynamoDBAPI
+	}
+	return dynamodb.New(Sessions.DynamoDB)
+}
+
+// DynamoDBTargetProvider loads targets from items of the DynamoDB table.
+// Each item has a target in the config file syntax (YAML or JSON) as a string attribute.
+type DynamoDBTargetProvider struct {
+	TableName string `yaml:"table_name"`
+	// Attribute is the name of the attribute which has a target. Default is "target".
+	Attribute string `yaml:"attribute"`
+}
+
+func (p *DynamoDBTargetProvider) attribute() string {
+	if p.Attribute == "" {
+		return "target"
+	}
+	return p.Attribute
+}
+
+// Targets scans the table, and returns targets ordered by the scan.
+func (p *DynamoDBTargetProvider) Targets(ctx context.Context) ([]*Target, error) {
+	var targets []*Target
+	var parseErr error
+	attr := p.attribute()
+	err := dynamoDBClient().ScanPagesWithContext(ctx, &dynamodb.ScanInput{
+		TableName:       aws.String(p.TableName),
+		ConsistentRead:  aws.Bool(true),
+		AttributesToGet: aws.StringSlice([]string{attr}),
+	}, func(out *dynamodb.ScanOutput, last bool) bool {
+		for _, item := range out.Items {
+			v, ok := item[attr]
+			if !ok || v.S == nil {
+				parseErr = fmt.Errorf("an item of %s has no string attribute %s", p.TableName, attr)
+				return false
+			}
+			var t Target
+			if err := yaml.Unmarshal([]byte(*v.S), &t); err != nil {
+				parseErr = fmt.Errorf("invalid target in %s, %s", p.TableName, err)
+				return false
+			}
+			targets = append(targets, &t)
+		}
+		return true
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to scan %s, %s", p.TableName, err)
+	}
+	if parseErr != nil {
+		return nil, parseErr
+	}
+	return targets, nil
+}
+
+// withTargets returns a copy of the config which has the targets after its own targets.
+// The targets inherit the global sections of the config as targets of the config file.
+func (c *Config) withTargets(targets []*Target) (*Config, error) {
+	if len(targets) > 0 {
+		extra := *c
+		extra.Targets = targets
+		errs := ValidationErrors{}.add(extra.merge()).add(extra.validate())
+		if err := errs.err(); err != nil {
+			return nil, err
+		}
+	}
+	merged := *c
+	merged.Targets = make([]*Target, 0, len(c.Targets)+len(targets))
+	merged.Targets = append(append(merged.Targets, c.Targets...), targets...)
+	merged.buildTargetIndex()
+	merged.assignTargetKeys()
+	return &merged, nil
+}
+
+// targetRefresher activates the config of the file with targets of the provider.
+type targetRefresher struct {
+	// provider is given by RunOptions, and used instead of target_provider of configs.
+	provider TargetProvider
+	mu       sync.Mutex
+	base     *Config
+}
+
+// providerOf returns the provider of targets for the base config, or nil when targets are not provided.
+func (r *targetRefresher) providerOf(base *Config) TargetProvider {
+	if r.provider != nil {
+		return r.provider
+	}
+	if p := base.TargetProvider; p != nil && p.DynamoDB != nil {
+		initSessions(base)
+		return p.DynamoDB
+	}
+	return nil
+}
+
+// compose returns the base config with targets loaded from the provider, or the base itself without the provider.
+func (r *targetRefresher) compose(ctx context.Context, base *Config) (*Config, error) {
+	provider := r.providerOf(base)
+	if provider == nil {
+		return base, nil
+	}
+	targets, err := provider.Targets(ctx)
+	if err != nil {
+		return nil, err
+	}
+	c, err := base.withTargets(targets)
+	if err != nil {
+		return nil, err
+	}
+	log.Printf("[debug] Loaded %d targets from the target provider", len(targets))
+	return c, nil
+}
+
+// refresh loads targets from the provider, and activates the config with them.
+func (r *targetRefresher) refresh(ctx context.Context) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.providerOf(r.base) == nil {
+		// target_provider has been removed by reloading
+		return nil
+	}
+	c, err := r.compose(ctx, r.base)
+	if err != nil {
+		return err
+	}
+	SwapConfig(c)
+	return nil
+}
+
+// reload wraps the reload function of the config file to compose targets of the provider.
+// Changes of target_provider of the config file are applied by the reload.
+func (r *targetRefresher) reload(ctx context.Context, reload func() (*Config, error)) func() (*Config, error) {
+	return func() (*Config, error) {
+		r.mu.Lock()
+		defer r.mu.Unlock()
+		base, err := reload()
+		if err != nil {
+			return nil, err
+		}
+		c, err := r.compose(ctx, base)
+		if err != nil {
+			return nil, err
+		}
+		r.base = base
+		return c, nil
+	}
+}
+
+// interval returns target_provider.interval of the base config.
+func (r *targetRefresher) interval() time.Duration {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.base.TargetProvider.interval()
+}
+
+// run refreshes targets by the interval of the config reloaded last.
+func (r *targetRefresher) run(ctx context.Context) {
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(r.interval()):
+		}
+		if err := r.refresh(ctx); err != nil && ctx.Err() == nil {
+			log.Println("[error] Failed to load targets from the target provider. Keep the current targets.", err)
+		}
+	}
+}
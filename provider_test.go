@@ -0,0 +1,156 @@
+package rin_test
+
+import (
+	"context"
+	"os"
+	"sync"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/request"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+	"github.com/aws/aws-sdk-go/service/dynamodb/dynamodbiface"
+	yaml "gopkg.in/yaml.v2"
+
+	rin "github.com/fujiwara/Rin"
+)
+
+// fakeProvider returns targets parsed from the YAML of the current calls.
+type fakeProvider struct {
+	mu    sync.Mutex
+	calls int
+	yamls []string
+}
+
+func (p *fakeProvider) Targets(ctx context.Context) ([]*rin.Target, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	src := p.yamls[len(p.yamls)-1]
+	if p.calls < len(p.yamls) {
+		src = p.yamls[p.calls]
+	}
+	p.calls++
+	var targets []*rin.Target
+	if err := yaml.Unmarshal([]byte(src), &targets); err != nil {
+		return nil, err
+	}
+	return targets, nil
+}
+
+func (p *fakeProvider) Calls() int {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.calls
+}
+
+const providedTargets = `
+- redshift:
+    table: provided
+  s3:
+    key_prefix: test/provided/
+`
+
+var providedMessage = `{"Records":[{"eventName":"ObjectCreated:Put","s3":{"bucket":{"name":"test.bucket.test"},"object":{"key":"test/provided/x.json"}}}]}`
+
+func TestRunWithTargetProvider(t *testing.T) {
+	config := loadTestConfig(t, "test/config.yml")
+	config.TargetProvider = &rin.TargetProviderConfig{Interval: 20 * time.Millisecond}
+	fe := useFakeExecutor(t)
+	provider := &fakeProvider{yamls: []string{"[]", providedTargets}}
+	src := rin.NewMemorySource(readFixture(t, "test/notification.json"))
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	done := make(chan error, 1)
+	go func() {
+		done <- rin.Run(ctx, config, rin.RunOptions{Source: src, TargetProvider: provider})
+	}()
+
+	deadline := time.Now().Add(3 * time.Second)
+	for provider.Calls() < 2 && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	src.Add(providedMessage)
+	for len(src.Deleted()) < 2 && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	cancel()
+	if err := <-done; err != nil {
+		t.Fatal(err)
+	}
+	if countQueries(fe.queries, "foo") != 1 {
+		t.Errorf("targets of the config file must be kept: %v", fe.queries)
+	}
+	if countQueries(fe.queries, "provided") != 1 {
+		t.Errorf("targets loaded by the provider must be matched without restart: %v", fe.queries)
+	}
+	if n := len(rin.CurrentConfig().Targets); n != len(config.Targets)+1 {
+		t.Errorf("unexpected number of targets %d", n)
+	}
+}
+
+// scanDynamoDB returns an item of the target for each scan.
+type scanDynamoDB struct {
+	dynamodbiface.DynamoDBAPI
+	target string
+}
+
+func (d *scanDynamoDB) ScanPagesWithContext(ctx aws.Context, in *dynamodb.ScanInput, fn func(*dynamodb.ScanOutput, bool) bool, opts ...request.Option) error {
+	fn(&dynamodb.ScanOutput{
+		Items: []map[string]*dynamodb.AttributeValue{
+			{"target": {S: aws.String(d.target)}},
+		},
+	}, true)
+	return nil
+}
+
+func TestReloadTargetProvider(t *testing.T) {
+	config := loadTestConfig(t, "test/config.yml")
+	useFakeExecutor(t)
+	rin.DynamoDBAPI = &scanDynamoDB{target: "{redshift: {table: provided}, s3: {key_prefix: test/provided/}}"}
+	defer func() { rin.DynamoDBAPI = nil }()
+
+	reload := func() (*rin.Config, error) {
+		c, err := rin.LoadConfig("test/config.yml")
+		if err != nil {
+			return nil, err
+		}
+		c.TargetProvider = &rin.TargetProviderConfig{
+			DynamoDB: &rin.DynamoDBTargetProvider{TableName: "targets"},
+			Interval: 20 * time.Millisecond,
+		}
+		return c, nil
+	}
+	src := rin.NewMemorySource(readFixture(t, "test/notification.json"))
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	done := make(chan error, 1)
+	go func() {
+		done <- rin.Run(ctx, config, rin.RunOptions{Source: src, Reload: reload})
+	}()
+	for len(src.Deleted()) == 0 {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if rin.CurrentConfig() != config {
+		t.Error("the config without target_provider must be activated as is")
+	}
+
+	syscall.Kill(os.Getpid(), syscall.SIGHUP)
+	deadline := time.Now().Add(3 * time.Second)
+	for len(rin.CurrentConfig().Targets) == len(config.Targets) && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	targets := rin.CurrentConfig().Targets
+	if n := len(targets); n != len(config.Targets)+1 {
+		t.Fatalf("target_provider of the reloaded config must be applied, got %d targets", n)
+	}
+	if got := targets[len(targets)-1].Redshift.Table; got != "provided" {
+		t.Errorf("unexpected provided target %s", got)
+	}
+	cancel()
+	if err := <-done; err != nil {
+		t.Error(err)
+	}
+}
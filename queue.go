@@ -0,0 +1,214 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log"
+	"strconv"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/sqs"
+	"github.com/aws/aws-sdk-go/service/sqs/sqsiface"
+)
+
+// SQSAPI is the SQS client used to receive messages.
+// When nil, a client is created from Sessions.SQS.
+var SQSAPI sqsiface.SQSAPI
+
+func sqsClient() sqsiface.SQSAPI {
+	if SQSAPI != nil {
+		return SQSAPI
+	}
+	return sqs.New(Sessions.SQS)
+}
+
+// CheckQueueAttributes are the queue attributes shown by CheckQueue.
+var CheckQueueAttributes = []string{
+	sqs.QueueAttributeNameApproximateNumberOfMessages,
+	sqs.QueueAttributeNameApproximateNumberOfMessagesNotVisible,
+	sqs.QueueAttributeNameVisibilityTimeout,
+}
+
+// CheckQueue checks the queue defined in the config file is reachable, and writes its URL and attributes to w.
+func CheckQueue(ctx context.Context, configFile string, w io.Writer) error {
+	log.Println("[info] Loading config:", configFile)
+	config, err := LoadConfig(configFile)
+	if err != nil {
+		return err
+	}
+	initSessions(config)
+	svc := sqsClient()
+
+	res, err := svc.GetQueueUrlWithContext(ctx, &sqs.GetQueueUrlInput{
+		QueueName: aws.String(config.QueueName),
+	})
+	if err != nil {
+		return fmt.Errorf("can't resolve the queue %s in %s. %s", config.QueueName, config.AWSCredentials().AWS_REGION, err)
+	}
+	fmt.Fprintln(w, "queue_url:", aws.StringValue(res.QueueUrl))
+
+	attrs, err := svc.GetQueueAttributesWithContext(ctx, &sqs.GetQueueAttributesInput{
+		QueueUrl:       res.QueueUrl,
+		AttributeNames: aws.StringSlice(CheckQueueAttributes),
+	})
+	if err != nil {
+		return fmt.Errorf("can't get attributes of the queue %s. %s", config.QueueName, err)
+	}
+	for _, name := range CheckQueueAttributes {
+		fmt.Fprintf(w, "%s: %s\n", name, aws.StringValue(attrs.Attributes[name]))
+	}
+	return nil
+}
+
+// redriveBatchSize is the max number of messages moved by a batch. It is the limit of SQS batch APIs.
+const redriveBatchSize = 10
+
+// redriveWaitTimeSeconds is the long polling of redrive. Short polling may return no messages
+// from a queue which has messages, and stop redrive early.
+const redriveWaitTimeSeconds = 5
+
+// Redrive moves at most max messages (the messages in the queue at the start when max <= 0) from the queue named from to the queue named to.
+// When to is empty, the queue_name of the config file is used.
+func Redrive(ctx context.Context, configFile, from, to string, max int) error {
+	log.Println("[info] Loading config:", configFile)
+	config, err := LoadConfig(configFile)
+	if err != nil {
+		return err
+	}
+	if to == "" {
+		to = config.QueueName
+	}
+	if from == "" {
+		return fmt.Errorf("a queue to redrive from is required")
+	}
+	if from == to {
+		return fmt.Errorf("can't redrive messages to the same queue %s", from)
+	}
+	initSessions(config)
+	svc := sqsClient()
+
+	fromURL, err := queueURL(ctx, svc, from)
+	if err != nil {
+		return err
+	}
+	toURL, err := queueURL(ctx, svc, to)
+	if err != nil {
+		return err
+	}
+	if aws.StringValue(fromURL) == aws.StringValue(toURL) {
+		return fmt.Errorf("can't redrive messages to the same queue %s", aws.StringValue(fromURL))
+	}
+	if max <= 0 {
+		// messages sent to the queue while redriving are left, so redrive always ends
+		if max, err = approximateMessages(ctx, svc, fromURL); err != nil {
+			return fmt.Errorf("can't get the number of messages of the queue %s. %s", from, err)
+		}
+	}
+	log.Printf("[info] Redrive %d messages from %s to %s", max, aws.StringValue(fromURL), aws.StringValue(toURL))
+
+	var moved int
+	for moved < max {
+		size := redriveBatchSize
+		if max > 0 && max-moved < size {
+			size = max - moved
+		}
+		n, err := redriveBatch(ctx, svc, fromURL, toURL, size)
+		moved += n
+		if err != nil {
+			return fmt.Errorf("redrive failed after %d messages moved. %s", moved, err)
+		}
+		if n == 0 {
+			break
+		}
+		log.Printf("[info] %d messages moved", moved)
+	}
+	log.Printf("[info] Redrive completed. %d messages moved", moved)
+	return nil
+}
+
+func queueURL(ctx context.Context, svc sqsiface.SQSAPI, name string) (*string, error) {
+	res, err := svc.GetQueueUrlWithContext(ctx, &sqs.GetQueueUrlInput{
+		QueueName: aws.String(name),
+	})
+	if err != nil {
+		return nil, fmt.Errorf("can't resolve the queue %s. %s", name, err)
+	}
+	return res.QueueUrl, nil
+}
+
+func approximateMessages(ctx context.Context, svc sqsiface.SQSAPI, url *string) (int, error) {
+	name := sqs.QueueAttributeNameApproximateNumberOfMessages
+	res, err := svc.GetQueueAttributesWithContext(ctx, &sqs.GetQueueAttributesInput{
+		QueueUrl:       url,
+		AttributeNames: aws.StringSlice([]string{name}),
+	})
+	if err != nil {
+		return 0, err
+	}
+	return strconv.Atoi(aws.StringValue(res.Attributes[name]))
+}
+
+// redriveBatch moves a batch of messages, and returns the number of moved messages.
+func redriveBatch(ctx context.Context, svc sqsiface.SQSAPI, fromURL, toURL *string, size int) (int, error) {
+	res, err := svc.ReceiveMessageWithContext(ctx, &sqs.ReceiveMessageInput{
+		QueueUrl:              fromURL,
+		MaxNumberOfMessages:   aws.Int64(int64(size)),
+		WaitTimeSeconds:       aws.Int64(redriveWaitTimeSeconds),
+		AttributeNames:        aws.StringSlice([]string{sqs.MessageSystemAttributeNameMessageGroupId}),
+		MessageAttributeNames: aws.StringSlice([]string{"All"}),
+	})
+	if err != nil {
+		return 0, err
+	}
+	if len(res.Messages) == 0 {
+		return 0, nil
+	}
+	entries := make([]*sqs.SendMessageBatchRequestEntry, 0, len(res.Messages))
+	handles := make(map[string]*string, len(res.Messages))
+	for i, msg := range res.Messages {
+		id := strconv.Itoa(i)
+		entry := &sqs.SendMessageBatchRequestEntry{
+			Id:                aws.String(id),
+			MessageBody:       msg.Body,
+			MessageAttributes: msg.MessageAttributes,
+		}
+		if g, ok := msg.Attributes[sqs.MessageSystemAttributeNameMessageGroupId]; ok {
+			entry.MessageGroupId = g
+			entry.MessageDeduplicationId = msg.MessageId
+		}
+		entries = append(entries, entry)
+		handles[id] = msg.ReceiptHandle
+	}
+	sent, err := svc.SendMessageBatchWithContext(ctx, &sqs.SendMessageBatchInput{
+		QueueUrl: toURL,
+		Entries:  entries,
+	})
+	if err != nil {
+		return 0, err
+	}
+	for _, f := range sent.Failed {
+		log.Printf("[warn] Can't send message %s. %s", aws.StringValue(f.Id), aws.StringValue(f.Message))
+	}
+	if len(sent.Successful) == 0 {
+		return 0, fmt.Errorf("all messages were failed to send")
+	}
+	deletes := make([]*sqs.DeleteMessageBatchRequestEntry, 0, len(sent.Successful))
+	for _, s := range sent.Successful {
+		deletes = append(deletes, &sqs.DeleteMessageBatchRequestEntry{
+			Id:            s.Id,
+			ReceiptHandle: handles[aws.StringValue(s.Id)],
+		})
+	}
+	deleted, err := svc.DeleteMessageBatchWithContext(ctx, &sqs.DeleteMessageBatchInput{
+		QueueUrl: fromURL,
+		Entries:  deletes,
+	})
+	if err != nil {
+		return len(sent.Successful), err
+	}
+	for _, f := range deleted.Failed {
+		log.Printf("[warn] Can't delete message %s from the queue. It may be redriven twice. %s", aws.StringValue(f.Id), aws.StringValue(f.Message))
+	}
+	return len(sent.Successful), nil
+}
@@ -0,0 +1,475 @@
+package rin_test
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/aws/request"
+	"github.com/aws/aws-sdk-go/service/sqs"
+	"github.com/aws/aws-sdk-go/service/sqs/sqsiface"
+	rin "github.com/fujiwara/Rin"
+)
+
+type mockSQS struct {
+	sqsiface.SQSAPI
+	queueURL string
+	attrs    map[string]string
+	err      error
+	// queues are messages by queue URLs
+	queues map[string][]*sqs.Message
+}
+
+func (m *mockSQS) GetQueueUrlWithContext(ctx aws.Context, in *sqs.GetQueueUrlInput, opts ...request.Option) (*sqs.GetQueueUrlOutput, error) {
+	if m.err != nil {
+		return nil, m.err
+	}
+	return &sqs.GetQueueUrlOutput{QueueUrl: aws.String(m.queueURL + *in.QueueName)}, nil
+}
+
+func (m *mockSQS) GetQueueAttributesWithContext(ctx aws.Context, in *sqs.GetQueueAttributesInput, opts ...request.Option) (*sqs.GetQueueAttributesOutput, error) {
+	return &sqs.GetQueueAttributesOutput{Attributes: aws.StringMap(m.attrs)}, nil
+}
+
+func (m *mockSQS) ReceiveMessageWithContext(ctx aws.Context, in *sqs.ReceiveMessageInput, opts ...request.Option) (*sqs.ReceiveMessageOutput, error) {
+	q := m.queues[*in.QueueUrl]
+	n := int(*in.MaxNumberOfMessages)
+	if n > len(q) {
+		n = len(q)
+	}
+	return &sqs.ReceiveMessageOutput{Messages: q[:n]}, nil
+}
+
+func (m *mockSQS) SendMessageBatchWithContext(ctx aws.Context, in *sqs.SendMessageBatchInput, opts ...request.Option) (*sqs.SendMessageBatchOutput, error) {
+	out := &sqs.SendMessageBatchOutput{}
+	for _, e := range in.Entries {
+		m.queues[*in.QueueUrl] = append(m.queues[*in.QueueUrl], &sqs.Message{
+			MessageId:     e.Id,
+			ReceiptHandle: aws.String("sent-" + *e.Id),
+			Body:          e.MessageBody,
+		})
+		out.Successful = append(out.Successful, &sqs.SendMessageBatchResultEntry{Id: e.Id})
+	}
+	return out, nil
+}
+
+func (m *mockSQS) SendMessageWithContext(ctx aws.Context, in *sqs.SendMessageInput, opts ...request.Option) (*sqs.SendMessageOutput, error) {
+	if m.queues == nil {
+		m.queues = make(map[string][]*sqs.Message)
+	}
+	m.queues[*in.QueueUrl] = append(m.queues[*in.QueueUrl], &sqs.Message{Body: in.MessageBody})
+	return &sqs.SendMessageOutput{}, nil
+}
+
+func (m *mockSQS) DeleteMessageBatchWithContext(ctx aws.Context, in *sqs.DeleteMessageBatchInput, opts ...request.Option) (*sqs.DeleteMessageBatchOutput, error) {
+	out := &sqs.DeleteMessageBatchOutput{}
+	for _, e := range in.Entries {
+		q := m.queues[*in.QueueUrl]
+		for i, msg := range q {
+			if *msg.ReceiptHandle == *e.ReceiptHandle {
+				m.queues[*in.QueueUrl] = append(q[:i:i], q[i+1:]...)
+				break
+			}
+		}
+		out.Successful = append(out.Successful, &sqs.DeleteMessageBatchResultEntry{Id: e.Id})
+	}
+	return out, nil
+}
+
+// inFlightSQS is a mockSQS safe for workers of queues. Received messages are hidden until deleted.
+type inFlightSQS struct {
+	mockSQS
+	mu       sync.Mutex
+	received map[string]bool
+}
+
+// newInFlightSQS returns inFlightSQS which has messages of the bodies by queue names.
+func newInFlightSQS(prefix string, bodies map[string][]string) *inFlightSQS {
+	m := &inFlightSQS{
+		mockSQS:  mockSQS{queueURL: prefix, queues: map[string][]*sqs.Message{}},
+		received: map[string]bool{},
+	}
+	for name, bs := range bodies {
+		for _, b := range bs {
+			m.Add(name, b)
+		}
+	}
+	return m
+}
+
+// Add sends a message of the body to the queue.
+func (m *inFlightSQS) Add(name, body string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	url := m.queueURL + name
+	id := name + "-" + strconv.Itoa(len(m.queues[url])+len(m.received))
+	m.queues[url] = append(m.queues[url], &sqs.Message{
+		MessageId:     aws.String(id),
+		ReceiptHandle: aws.String("handle-" + id),
+		Body:          aws.String(body),
+	})
+}
+
+func (m *inFlightSQS) ReceiveMessageWithContext(ctx aws.Context, in *sqs.ReceiveMessageInput, opts ...request.Option) (*sqs.ReceiveMessageOutput, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	out := &sqs.ReceiveMessageOutput{}
+	for _, msg := range m.queues[*in.QueueUrl] {
+		if len(out.Messages) < int(*in.MaxNumberOfMessages) && !m.received[*msg.ReceiptHandle] {
+			m.received[*msg.ReceiptHandle] = true
+			out.Messages = append(out.Messages, msg)
+		}
+	}
+	return out, nil
+}
+
+func (m *inFlightSQS) DeleteMessageBatchWithContext(ctx aws.Context, in *sqs.DeleteMessageBatchInput, opts ...request.Option) (*sqs.DeleteMessageBatchOutput, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.mockSQS.DeleteMessageBatchWithContext(ctx, in, opts...)
+}
+
+func (m *inFlightSQS) DeleteMessageWithContext(ctx aws.Context, in *sqs.DeleteMessageInput, opts ...request.Option) (*sqs.DeleteMessageOutput, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	q := m.queues[*in.QueueUrl]
+	for i, msg := range q {
+		if *msg.ReceiptHandle == *in.ReceiptHandle {
+			m.queues[*in.QueueUrl] = append(q[:i:i], q[i+1:]...)
+			break
+		}
+	}
+	return &sqs.DeleteMessageOutput{}, nil
+}
+
+// Len returns the number of messages not deleted from the queue.
+func (m *inFlightSQS) Len(url string) int {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return len(m.queues[url])
+}
+
+func useMockSQS(t *testing.T, m sqsiface.SQSAPI) {
+	orig := rin.SQSAPI
+	rin.SQSAPI = m
+	t.Cleanup(func() { rin.SQSAPI = orig })
+}
+
+func TestCheckQueue(t *testing.T) {
+	useMockSQS(t, &mockSQS{
+		queueURL: "https://sqs.ap-northeast-1.amazonaws.com/123456789012/",
+		attrs: map[string]string{
+			"ApproximateNumberOfMessages":           "3",
+			"ApproximateNumberOfMessagesNotVisible": "1",
+			"VisibilityTimeout":                     "30",
+		},
+	})
+	var out bytes.Buffer
+	if err := rin.CheckQueue(context.Background(), "test/config.yml", &out); err != nil {
+		t.Fatal(err)
+	}
+	expected := `queue_url: https://sqs.ap-northeast-1.amazonaws.com/123456789012/rin_test
+ApproximateNumberOfMessages: 3
+ApproximateNumberOfMessagesNotVisible: 1
+VisibilityTimeout: 30
+`
+	if out.String() != expected {
+		t.Errorf("unexpected output %s", out.String())
+	}
+}
+
+func TestCheckQueueFailed(t *testing.T) {
+	useMockSQS(t, &mockSQS{err: errors.New("AWS.SimpleQueueService.NonExistentQueue")})
+	var out bytes.Buffer
+	err := rin.CheckQueue(context.Background(), "test/config.yml", &out)
+	if err == nil {
+		t.Fatal("must be failed")
+	}
+	if !strings.Contains(err.Error(), "rin_test") {
+		t.Errorf("error must describe the queue: %s", err)
+	}
+}
+
+func TestRunQueueNotFound(t *testing.T) {
+	m := &mockSQS{
+		queueURL: "https://sqs.ap-northeast-1.amazonaws.com/123456789012/",
+		queues:   map[string][]*sqs.Message{},
+		err:      awserr.New(sqs.ErrCodeQueueDoesNotExist, "The specified queue does not exist", nil),
+	}
+	useMockSQS(t, m)
+	config := loadTestConfig(t, "test/config.yml")
+	err := rin.Run(context.Background(), config, rin.RunOptions{BatchMode: true})
+	if err == nil || !strings.Contains(err.Error(), "queue rin_test not found") {
+		t.Fatalf("a nonexistent queue must fail the startup: %v", err)
+	}
+	if code := rin.ExitCode(err, nil); code != rin.ExitConfigError {
+		t.Errorf("unexpected exit code %d", code)
+	}
+
+	// skip-queue-check resolves the queue on receiving
+	src := rin.NewLazySQSSource(m, "rin_test")
+	if _, err := src.Receive(context.Background()); err == nil || !strings.Contains(err.Error(), "rin_test") {
+		t.Errorf("receiving must fail until the queue is resolved: %v", err)
+	}
+	m.err = nil
+	_, err = src.Receive(context.Background())
+	var nm rin.NoMessageError
+	if !errors.As(err, &nm) {
+		t.Errorf("the queue must be resolved: %v", err)
+	}
+}
+
+func TestRedrive(t *testing.T) {
+	prefix := "https://sqs.ap-northeast-1.amazonaws.com/123456789012/"
+	m := &mockSQS{queueURL: prefix, queues: map[string][]*sqs.Message{}}
+	for i := 0; i < 25; i++ {
+		id := strconv.Itoa(i)
+		m.queues[prefix+"rin_dlq"] = append(m.queues[prefix+"rin_dlq"], &sqs.Message{
+			MessageId:     aws.String(id),
+			ReceiptHandle: aws.String("handle-" + id),
+			Body:          aws.String("body-" + id),
+		})
+	}
+	useMockSQS(t, m)
+
+	if err := rin.Redrive(context.Background(), "test/config.yml", "rin_dlq", "", 15); err != nil {
+		t.Fatal(err)
+	}
+	if n := len(m.queues[prefix+"rin_dlq"]); n != 10 {
+		t.Errorf("unexpected messages left in the DLQ %d", n)
+	}
+	moved := m.queues[prefix+"rin_test"]
+	if len(moved) != 15 {
+		t.Fatalf("unexpected messages moved to the queue %d", len(moved))
+	}
+	if *moved[0].Body != "body-0" || *moved[14].Body != "body-14" {
+		t.Errorf("unexpected moved messages %s ... %s", *moved[0].Body, *moved[14].Body)
+	}
+
+	// messages sent to the DLQ after the start are left
+	m.attrs = map[string]string{"ApproximateNumberOfMessages": "8"}
+	if err := rin.Redrive(context.Background(), "test/config.yml", "rin_dlq", "", 0); err != nil {
+		t.Fatal(err)
+	}
+	if n := len(m.queues[prefix+"rin_dlq"]); n != 2 {
+		t.Errorf("messages in the queue at the start must be moved without max: %d left", n)
+	}
+}
+
+func TestRedriveLongPolling(t *testing.T) {
+	prefix := "https://sqs.ap-northeast-1.amazonaws.com/123456789012/"
+	m := &receiveRecorder{mockSQS: mockSQS{
+		queueURL: prefix,
+		queues:   map[string][]*sqs.Message{},
+		attrs:    map[string]string{"ApproximateNumberOfMessages": "1"},
+	}}
+	useMockSQS(t, m)
+	if err := rin.Redrive(context.Background(), "test/config.yml", "rin_dlq", "", 0); err != nil {
+		t.Fatal(err)
+	}
+	if len(m.inputs) != 1 || aws.Int64Value(m.inputs[0].WaitTimeSeconds) == 0 {
+		t.Errorf("redrive must receive messages by long polling: %v", m.inputs)
+	}
+}
+
+func TestRedriveToSameQueue(t *testing.T) {
+	m := &mockSQS{queueURL: "https://sqs.ap-northeast-1.amazonaws.com/123456789012/", queues: map[string][]*sqs.Message{}}
+	useMockSQS(t, m)
+	for _, to := range []string{"rin_test", ""} {
+		if err := rin.Redrive(context.Background(), "test/config.yml", "rin_test", to, 0); err == nil {
+			t.Errorf("redrive to the same queue %q must be rejected", to)
+		}
+	}
+}
+
+// receiveRecorder records inputs of ReceiveMessage.
+type receiveRecorder struct {
+	mockSQS
+	mu     sync.Mutex
+	inputs []*sqs.ReceiveMessageInput
+}
+
+func (m *receiveRecorder) ReceiveMessageWithContext(ctx aws.Context, in *sqs.ReceiveMessageInput, opts ...request.Option) (*sqs.ReceiveMessageOutput, error) {
+	m.mu.Lock()
+	m.inputs = append(m.inputs, in)
+	m.mu.Unlock()
+	return m.mockSQS.ReceiveMessageWithContext(ctx, in, opts...)
+}
+
+// attributeNames returns attribute names of the first input received from the queue URL.
+func (m *receiveRecorder) attributeNames(url string) []string {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for _, in := range m.inputs {
+		if aws.StringValue(in.QueueUrl) == url {
+			return aws.StringValueSlice(in.AttributeNames)
+		}
+	}
+	return nil
+}
+
+func TestReceiveAttributeNames(t *testing.T) {
+	for _, tc := range []struct {
+		queue                 string
+		attrs, msgAttrs       []string
+		expected, expectedMsg []string
+	}{
+		{"", nil, nil, []string{"SentTimestamp", "ApproximateReceiveCount"}, nil},
+		{"", []string{"All"}, []string{"table"}, []string{"All"}, []string{"table"}},
+		{"rin_test.fifo", nil, nil, []string{"SentTimestamp", "ApproximateReceiveCount", "MessageDeduplicationId"}, nil},
+	} {
+		config := loadTestConfig(t, "test/config.yml")
+		if tc.queue != "" {
+			config.QueueName = tc.queue
+		}
+		config.ReceiveAttributeNames = tc.attrs
+		config.ReceiveMessageAttributeNames = tc.msgAttrs
+		m := &receiveRecorder{mockSQS: mockSQS{queueURL: "https://sqs.example.com/", queues: map[string][]*sqs.Message{}}}
+		useMockSQS(t, m)
+		if err := rin.Run(context.Background(), config, rin.RunOptions{BatchMode: true}); err != nil {
+			t.Fatal(err)
+		}
+		if len(m.inputs) == 0 {
+			t.Fatal("messages must be received")
+		}
+		in := m.inputs[0]
+		if got := aws.StringValueSlice(in.AttributeNames); strings.Join(got, ",") != strings.Join(tc.expected, ",") {
+			t.Errorf("unexpected attribute names %v", got)
+		}
+		if got := aws.StringValueSlice(in.MessageAttributeNames); strings.Join(got, ",") != strings.Join(tc.expectedMsg, ",") {
+			t.Errorf("unexpected message attribute names %v", got)
+		}
+	}
+}
+
+func TestReceiveAttributeNamesOfQueues(t *testing.T) {
+	config := loadTestConfig(t, "test/config.yml")
+	config.Queues = []*rin.Queue{{Name: "rin_test.fifo"}}
+	prefix := "https://sqs.example.com/"
+	m := &receiveRecorder{mockSQS: mockSQS{queueURL: prefix, queues: map[string][]*sqs.Message{}}}
+	useMockSQS(t, m)
+	if err := rin.Run(context.Background(), config, rin.RunOptions{BatchMode: true}); err != nil {
+		t.Fatal(err)
+	}
+	if got := m.attributeNames(prefix + "rin_test"); hasName(got, "MessageDeduplicationId") {
+		t.Errorf("MessageDeduplicationId must not be requested from the standard queue: %v", got)
+	}
+	if got := m.attributeNames(prefix + "rin_test.fifo"); !hasName(got, "MessageDeduplicationId") {
+		t.Errorf("MessageDeduplicationId must be requested from the FIFO queue of queues: %v", got)
+	}
+}
+
+func hasName(names []string, name string) bool {
+	for _, n := range names {
+		if n == name {
+			return true
+		}
+	}
+	return false
+}
+
+func TestMessageAttributes(t *testing.T) {
+	msg := &rin.Message{Attributes: map[string]string{
+		"SentTimestamp":           "1600000000000",
+		"ApproximateReceiveCount": "3",
+	}}
+	if n := msg.ReceiveCount(); n != 3 {
+		t.Errorf("unexpected receive count %d", n)
+	}
+	if at := msg.SentAt(); at.Unix() != 1600000000 {
+		t.Errorf("unexpected sent time %s", at)
+	}
+}
+
+func TestRunWithFIFODeduplication(t *testing.T) {
+	config := loadTestConfig(t, "test/config.yml")
+	fe := useFakeExecutor(t)
+	body := readFixture(t, "test/notification.json")
+	src := rin.NewMemorySource()
+	for _, id := range []string{"dedup-1", "dedup-1", "dedup-2"} {
+		src.AddMessage(&rin.Message{
+			Body:       body,
+			Attributes: map[string]string{"MessageDeduplicationId": id},
+		})
+	}
+	config.MaxInFlightMessages = 1
+	if err := rin.RunWithSource(context.Background(), config, src, true); err != nil {
+		t.Fatal(err)
+	}
+	if n := len(fe.queries); n != 2 {
+		t.Errorf("a message which has the same MessageDeduplicationId must be skipped: %d COPY", n)
+	}
+	if n := len(src.Deleted()); n != 3 {
+		t.Errorf("the duplicate message must be deleted: %d", n)
+	}
+}
+
+// receiveSQS records ReceiveMessage requests, and returns a message for each queue once.
+type receiveSQS struct {
+	sqsiface.SQSAPI
+	mu       sync.Mutex
+	body     string
+	received map[string]*sqs.ReceiveMessageInput
+}
+
+func (m *receiveSQS) GetQueueUrlWithContext(ctx aws.Context, in *sqs.GetQueueUrlInput, opts ...request.Option) (*sqs.GetQueueUrlOutput, error) {
+	return &sqs.GetQueueUrlOutput{QueueUrl: in.QueueName}, nil
+}
+
+func (m *receiveSQS) ReceiveMessageWithContext(ctx aws.Context, in *sqs.ReceiveMessageInput, opts ...request.Option) (*sqs.ReceiveMessageOutput, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if _, ok := m.received[*in.QueueUrl]; ok {
+		return &sqs.ReceiveMessageOutput{}, nil
+	}
+	m.received[*in.QueueUrl] = in
+	return &sqs.ReceiveMessageOutput{Messages: []*sqs.Message{{
+		MessageId:     in.QueueUrl,
+		ReceiptHandle: in.QueueUrl,
+		Body:          aws.String(m.body),
+	}}}, nil
+}
+
+func (m *receiveSQS) DeleteMessageWithContext(ctx aws.Context, in *sqs.DeleteMessageInput, opts ...request.Option) (*sqs.DeleteMessageOutput, error) {
+	return &sqs.DeleteMessageOutput{}, nil
+}
+
+func TestRunQueues(t *testing.T) {
+	m := &receiveSQS{body: readFixture(t, "test/notification.json"), received: map[string]*sqs.ReceiveMessageInput{}}
+	useMockSQS(t, m)
+	config := loadConfigWith(t, `queues:
+  - name: rin_busy
+    wait_time: 20s
+    visibility_timeout: 10m
+    max_inflight_messages: 4
+  - name: rin_idle
+    wait_time: 5s
+targets:
+  - redshift:
+      table: foo
+    s3:
+      key_prefix: test/foo/
+`)
+	fe := &fakeExecutor{}
+	if err := rin.Run(context.Background(), config, rin.RunOptions{Executor: fe, BatchMode: true}); err != nil {
+		t.Fatal(err)
+	}
+	if len(m.received) != 3 || len(fe.queries) != 3 {
+		t.Fatalf("all queues must be received: %v %v", m.received, fe.queries)
+	}
+	if in := m.received["rin_test"]; in.WaitTimeSeconds != nil || in.VisibilityTimeout != nil {
+		t.Errorf("queue_name must use the settings of the queue: %v", in)
+	}
+	if in := m.received["rin_busy"]; aws.Int64Value(in.WaitTimeSeconds) != 20 || aws.Int64Value(in.VisibilityTimeout) != 600 {
+		t.Errorf("settings of rin_busy must be applied: %v", in)
+	}
+	if in := m.received["rin_idle"]; aws.Int64Value(in.WaitTimeSeconds) != 5 || in.VisibilityTimeout != nil {
+		t.Errorf("settings of rin_idle must be applied: %v", in)
+	}
+}
@@ -0,0 +1,89 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go/service/sqs/sqsiface"
+)
+
+// MaxWaitTime is the max wait time of SQS long polling.
+const MaxWaitTime = 20 * time.Second
+
+// Queue is a SQS queue of queues, received by its own worker in addition to queue_name.
+type Queue struct {
+	Name string `yaml:"name"`
+	// WaitTime is the wait time of long polling. Default is the setting of the queue.
+	WaitTime time.Duration `yaml:"wait_time"`
+	// VisibilityTimeout is the visibility timeout of received messages. Default is the setting of the queue.
+	VisibilityTimeout time.Duration `yaml:"visibility_timeout"`
+	// MaxInFlightMessages is the max number of messages of the queue processed concurrently. Default is max_inflight_messages.
+	MaxInFlightMessages int `yaml:"max_inflight_messages"`
+}
+
+func (q *Queue) validate() error {
+	if q.Name == "" {
+		return fmt.Errorf("name is required")
+	}
+	if q.WaitTime < 0 || q.WaitTime > MaxWaitTime {
+		return fmt.Errorf("wait_time of %s must be up to %s", q.Name, MaxWaitTime)
+	}
+	if q.VisibilityTimeout < 0 || q.VisibilityTimeout > MaxVisibilityTimeout {
+		return fmt.Errorf("visibility_timeout of %s must be up to %s", q.Name, MaxVisibilityTimeout)
+	}
+	return nil
+}
+
+// queueSource is a MessageSource received by a worker.
+type queueSource struct {
+	src MessageSource
+	// maxInFlight is the max number of messages in flight. 0 is max_inflight_messages of the config.
+	maxInFlight int
+}
+
+// newQueueSource returns the source of the queue with its settings.
+func newQueueSource(ctx context.Context, c *Config, svc sqsiface.SQSAPI, q *Queue, skipCheck bool) (queueSource, error) {
+	var src *SQSSource
+	if skipCheck {
+		src = NewLazySQSSource(svc, q.Name)
+	} else {
+		var err error
+		if src, err = NewSQSSource(ctx, svc, q.Name); err != nil {
+			return queueSource{}, err
+		}
+	}
+	src.SetAttributeNames(c.receiveAttributeNames(q.Name))
+	src.SetWaitTimeSeconds(int64(q.WaitTime / time.Second))
+	src.SetVisibilityTimeout(int64(q.VisibilityTimeout / time.Second))
+	return queueSource{src: src, maxInFlight: q.MaxInFlightMessages}, nil
+}
+
+// workers runs a worker for each source, and returns the first error of them.
+// When a worker fails, the others are shut down. Workers share the budget of max_inflight_bytes.
+func workers(ctx context.Context, sources []queueSource, batchMode bool) error {
+	budget := newByteBudget(CurrentConfig().MaxInFlightBytes)
+	if len(sources) == 1 {
+		return worker(ctx, sources[0].src, batchMode, sources[0].maxInFlight, budget)
+	}
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	var wg sync.WaitGroup
+	errs := make(chan error, len(sources))
+	for _, s := range sources {
+		wg.Add(1)
+		go func(s queueSource) {
+			defer wg.Done()
+			if err := worker(ctx, s.src, batchMode, s.maxInFlight, budget); err != nil {
+				log.Println("[error] Worker failed.", err)
+				errs <- err
+				cancel()
+			}
+		}(s)
+	}
+	wg.Wait()
+	close(errs)
+	return <-errs
+}
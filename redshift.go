@@ -1,14 +1,21 @@
 package main
 
 import (
+	"context"
 	"database/sql"
+	"errors"
+	"fmt"
 	"log"
+	"net/url"
+	"regexp"
+	"strconv"
 	"strings"
 	"sync"
+	"time"
 
 	"github.com/aws/aws-sdk-go/aws"
 	"github.com/aws/aws-sdk-go/service/redshift"
-	_ "github.com/lib/pq"
+	"github.com/lib/pq"
 )
 
 var (
@@ -17,36 +24,329 @@ var (
 	redshiftSvc *redshift.Redshift
 )
 
+// ObjectNotFoundError is returned when the source object of COPY does not exist.
+// The record can't be imported by retries, so it is skipped.
+type ObjectNotFoundError struct {
+	s string
+}
+
+func (e ObjectNotFoundError) Error() string {
+	return e.s
+}
+
+// objectNotFoundRegexp matches COPY errors caused by a missing source object.
+var objectNotFoundRegexp = regexp.MustCompile(`(?i)(NoSuchKey|The specified (S3 )?(key|prefix) .*does not exist)`)
+
+// missingTableRegexp matches COPY errors caused by an undefined target table.
+var missingTableRegexp = regexp.MustCompile(`relation "[^"]*" does not exist`)
+
+// isMissingTable reports whether the err is caused by an undefined target table (e.g. recreated by a migration).
+func isMissingTable(err error) bool {
+	var e *pq.Error
+	if errors.As(err, &e) && e.Code == "42P01" {
+		return true
+	}
+	return err != nil && missingTableRegexp.MatchString(err.Error())
+}
+
 func Import(event Event) (int, error) {
-	var processed int
+	return ImportWithContext(context.Background(), CurrentConfig(), event)
+}
+
+func ImportWithContext(ctx context.Context, c *Config, event Event) (int, error) {
+	var processed, failed int
+	var lastErr error
 	for _, record := range event.Records {
-	TARGETS:
-		for _, target := range config.Targets {
-			if ok, cap := target.MatchEventRecord(record); ok {
-				if target.Discard {
-					processed++
-					break TARGETS
-				}
-				err := ImportRedshift(target, record, cap)
-				if err != nil {
-					if aws.BoolValue(config.Redshift.ReconnectOnError) {
-						DisconnectToRedshift(target)
-					}
-					return processed, err
-				} else {
-					processed++
-				}
-				if target.Break {
-					break TARGETS
-				}
+		if c.DedupeWindow > 0 && recentRecords.isDuplicate(record, time.Now(), c.DedupeWindow) {
+			log.Printf("[info] [%s] Skip duplicate record %s within %s", CorrelationID(ctx), record, c.DedupeWindow)
+			processed++
+			continue
+		}
+		n, err := importRecord(ctx, c, record)
+		processed += n
+		if c.DedupeWindow > 0 && (err != nil || n == 0) {
+			recentRecords.forget(record)
+		}
+		if err == nil {
+			continue
+		}
+		if c.PartialFailure != PartialFailureSkip {
+			return processed, err
+		}
+		if _, ok := err.(*PausedError); ok {
+			log.Printf("[info] [%s] Leave the message for record %s. %s", CorrelationID(ctx), record, err)
+			return processed, err
+		}
+		if _, ok := err.(*SQLBuildError); ok {
+			// not skipped, handled by sql_error
+			return processed, err
+		}
+		if c.RetryOnMissingTable && isMissingTable(err) {
+			log.Printf("[warn] [%s] Target table of record %s does not exist. Retry the message later.", CorrelationID(ctx), record)
+			return processed, err
+		}
+		log.Printf("[error] [%s] Skip failed record %s. %s", CorrelationID(ctx), record, err)
+		failed++
+		lastErr = err
+	}
+	if failed > 0 && failed == len(event.Records) {
+		// all records were failed. retry the message.
+		return processed, lastErr
+	}
+	return processed, nil
+}
+
+func importRecord(ctx context.Context, c *Config, record *EventRecord) (int, error) {
+	var processed int
+	var paused *Target
+	var failed error
+	continueOnError := c.FanoutError == FanoutErrorContinue
+	filter := targetFilterFrom(ctx)
+	mctx, endMatch := startSpan(ctx, SpanMatch)
+	matched, err := c.matchTargets(mctx, record, true)
+	endMatch(recordAttrs(record), err)
+	if err != nil {
+		return processed, err
+	}
+	for _, m := range matched {
+		target, cap := m.target, m.capture
+		tracef(ctx, TraceMatched, "record %s to target %s", record, target)
+		logResolvedTarget(ctx, c, target)
+		if target.Discard {
+			log.Printf("[info] [%s] Discard record %s by target %s", CorrelationID(ctx), record, target)
+			processed++
+			break
+		}
+		if filter.Paused(target) {
+			log.Printf("[debug] [%s] Target %s is paused for record %s", CorrelationID(ctx), target, record)
+			paused = target
+			continue
+		}
+		if err := target.CheckRecord(record); err != nil {
+			if c.Strict {
+				return processed, err
+			}
+			log.Printf("[warn] [%s] Skip target %s for record %s. %s", CorrelationID(ctx), target, record, err)
+			continue
+		}
+		if continueOnError && completedTargets.completed(record, target) {
+			log.Printf("[info] [%s] Skip target %s for record %s. It was imported before redelivery", CorrelationID(ctx), target, record)
+			processed++
+			if target.Break {
+				break
 			}
+			continue
+		}
+		err := importRedshiftWithRetry(ctx, c, target, record, cap)
+		if err != nil {
+			summarizeFailed(ctx, target)
 		}
+		if _, ok := err.(ObjectNotFoundError); ok {
+			log.Printf("[error] [%s] Give up importing record %s to target %s. %s", CorrelationID(ctx), record, target, err)
+			processed++
+		} else if err != nil {
+			if !continueOnError {
+				return processed, err
+			}
+			log.Printf("[error] [%s] Import record %s to target %s failed. Continue to the remaining targets. %s", CorrelationID(ctx), record, target, err)
+			if failed == nil {
+				failed = err
+			}
+		} else {
+			processed++
+			if continueOnError {
+				completedTargets.complete(record, target, time.Now())
+			}
+		}
+		if target.Break {
+			break
+		}
+	}
+	if failed != nil {
+		return processed, failed
+	}
+	if paused != nil {
+		// the record is imported to the paused target on redelivery
+		return processed, &PausedError{paused.String()}
+	}
+	if continueOnError {
+		completedTargets.forget(record)
 	}
 	return processed, nil
 }
 
+type matchedTarget struct {
+	target  *Target
+	capture *[]string
+}
+
+// FindTargets returns targets matched by the record in definition order, without runtime filters.
+// Matching stops at a target with break or discard, and targets disabled or refused by allowed_sources are excluded.
+// Fallback targets are returned only when no other targets are matched.
+// When tags of the object can't be read for object_tags, the error is logged and targets matched before it are returned.
+func (c *Config) FindTargets(r EventRecord) []*Target {
+	return c.FindTargetsWithFilter(r, TargetFilter{})
+}
+
+// FindTargetsWithFilter returns targets matched by the record like FindTargets, filtered by f as RunOptions.Filter.
+// Targets without the labels of f are never matched, and targets paused by f are excluded.
+func (c *Config) FindTargetsWithFilter(r EventRecord, f TargetFilter) []*Target {
+	matched, err := c.matchTargets(withTargetFilter(context.Background(), f), &r, false)
+	if err != nil {
+		log.Printf("[warn] Can't find targets for record %s. %s", r, err)
+	}
+	var targets []*Target
+	for _, m := range matched {
+		if !f.Paused(m.target) {
+			targets = append(targets, m.target)
+		}
+	}
+	return targets
+}
+
+// MatchFunc returns the target of the record, and whether the record is matched by it.
+type MatchFunc func(EventRecord) (*Target, bool)
+
+type matchFuncKey struct{}
+
+func withMatchFunc(ctx context.Context, f MatchFunc) context.Context {
+	return context.WithValue(ctx, matchFuncKey{}, f)
+}
+
+func matchFuncFrom(ctx context.Context) MatchFunc {
+	f, _ := ctx.Value(matchFuncKey{}).(MatchFunc)
+	return f
+}
+
+// matchTargets returns targets matched by the record. Fallback targets are matched only when no other targets are matched.
+// A record matched by the MatchFunc of ctx is imported to its target only. Targets refused by allowed_sources are logged when verbose.
+func (c *Config) matchTargets(ctx context.Context, record *EventRecord, verbose bool) ([]matchedTarget, error) {
+	if match := matchFuncFrom(ctx); match != nil {
+		if target, ok := match(*record); ok && target != nil {
+			log.Printf("[debug] [%s] Record %s is matched to target %s by the custom match", CorrelationID(ctx), record, target)
+			return c.customMatched(ctx, record, target, verbose)
+		}
+	}
+	matched, err := c.matchTargetsOf(ctx, record, false, verbose)
+	if err != nil || len(matched) > 0 {
+		return matched, err
+	}
+	return c.matchTargetsOf(ctx, record, true, verbose)
+}
+
+// customMatched checks the target matched by the custom match as targets of the config.
+// A refused target leaves the record unmatched instead of falling back to targets of the config.
+func (c *Config) customMatched(ctx context.Context, record *EventRecord, target *Target, verbose bool) ([]matchedTarget, error) {
+	if !target.IsEnabled() || !targetFilterFrom(ctx).Selected(target) || !c.targetAllowed(ctx, record, target, verbose) {
+		return nil, nil
+	}
+	ok, cap := target.MatchEventRecord(record)
+	if !ok {
+		if r := target.Redshift; r != nil && maxPlaceHolder(r.Schema+"."+r.Table) > 0 {
+			return nil, &MatchError{target.String(), fmt.Errorf("placeholders of the table are not captured from the key %s, which is not matched by the target", record.S3.Object.Key)}
+		}
+		cap = &[]string{}
+	}
+	return []matchedTarget{{target, cap}}, nil
+}
+
+// targetAllowed reports whether the source of the record is allowed by allowed_sources for the target.
+func (c *Config) targetAllowed(ctx context.Context, record *EventRecord, target *Target, verbose bool) bool {
+	if target.Discard || c.SourceAllowed(record.S3.Bucket.Name, target.SourceKey(record.S3.Object.Key)) {
+		return true
+	}
+	if verbose {
+		log.Printf("[warn] [%s] Refused to import record %s by target %s. The source is not in allowed_sources", CorrelationID(ctx), record, target)
+	}
+	return false
+}
+
+func (c *Config) matchTargetsOf(ctx context.Context, record *EventRecord, fallback, verbose bool) ([]matchedTarget, error) {
+	var matched []matchedTarget
+	filter := targetFilterFrom(ctx)
+	for _, target := range c.candidateTargets(record) {
+		if target.Fallback != fallback || !filter.Selected(target) {
+			continue
+		}
+		ok, cap := target.MatchEventRecord(record)
+		if !ok {
+			continue
+		}
+		if len(target.ObjectTags) > 0 {
+			tags, err := objectTags(ctx, target.S3.Region, record.S3.Bucket.Name, record.S3.Object.Key)
+			if err != nil {
+				return matched, err
+			}
+			if !tagsMatch(tags, target.ObjectTags) {
+				continue
+			}
+		}
+		if !c.targetAllowed(ctx, record, target, verbose) {
+			continue
+		}
+		matched = append(matched, matchedTarget{target, cap})
+		if target.Discard || target.Break {
+			break
+		}
+	}
+	return matched, nil
+}
+
+// importRedshiftWithRetry imports the record to the target, and retries by max_retries of the target.
+func importRedshiftWithRetry(ctx context.Context, c *Config, target *Target, record *EventRecord, cap *[]string) (err error) {
+	ctx, endSpan := startSpan(ctx, SpanCopy)
+	defer func() {
+		attrs := recordAttrs(record)
+		attrs[AttrTable] = target.plainTableName(cap)
+		endSpan(attrs, err)
+	}()
+	maxRetries := aws.IntValue(target.MaxRetries)
+	// clusters imported already are not retried
+	done := make(map[string]bool)
+	if c.FanoutError == FanoutErrorContinue {
+		// nor imported before redelivery
+		completedTargets.completedClusters(record, target, done)
+		defer func() { completedTargets.completeClusters(record, target, done, time.Now()) }()
+	}
+	for i := 0; ; i++ {
+		err := importClusters(ctx, c, target, record, cap, done)
+		if err == nil {
+			return nil
+		}
+		if _, ok := err.(ObjectNotFoundError); ok {
+			return err
+		}
+		if _, ok := err.(*SQLBuildError); ok {
+			return err
+		}
+		if c.DiskFull != nil && isDiskFull(err) {
+			// retrying hammers the cluster out of disk
+			return err
+		}
+		for _, r := range target.Clusters() {
+			if !done[r.DSN()] && aws.BoolValue(r.ReconnectOnError) {
+				disconnectCluster(r)
+			}
+		}
+		if i >= maxRetries {
+			return err
+		}
+		log.Printf("[warn] [%s] Retry to import to target %s after %s (%d/%d)", CorrelationID(ctx), target, target.RetryInterval, i+1, maxRetries)
+		select {
+		case <-ctx.Done():
+			return err
+		case <-time.After(target.RetryInterval):
+		}
+	}
+}
+
 func DisconnectToRedshift(target *Target) {
-	r := target.Redshift
+	for _, r := range target.Clusters() {
+		disconnectCluster(r)
+	}
+}
+
+func disconnectCluster(r *Redshift) {
 	dsn := r.DSN()
 	log.Println("[info] Disconnect to Redshift", r.VisibleDSN())
 
@@ -59,9 +359,37 @@ func DisconnectToRedshift(target *Target) {
 	delete(DBPool, dsn)
 }
 
-func ConnectToRedshift(target *Target) (*sql.DB, error) {
-	r := target.Redshift
-	dsn := r.DSN()
+// parseDSN restores Redshift connection parameters from a DSN built by Redshift.DSN.
+func parseDSN(dsn string) (*Redshift, error) {
+	u, err := url.Parse(dsn)
+	if err != nil {
+		return nil, err
+	}
+	if u.User == nil {
+		return nil, fmt.Errorf("user is not defined in DSN")
+	}
+	r := &Redshift{
+		Host:   u.Hostname(),
+		User:   u.User.Username(),
+		DBName: strings.TrimPrefix(u.Path, "/"),
+
+		ApplicationName: u.Query().Get("application_name"),
+	}
+	r.Password, _ = u.User.Password()
+	if p := u.Port(); p != "" {
+		if r.Port, err = strconv.Atoi(p); err != nil {
+			return nil, err
+		}
+	}
+	return r, nil
+}
+
+// ConnectToRedshift returns the pool of the DSN in DBPool. A new pool is configured by settings, the redshift section of the config.
+func ConnectToRedshift(dsn string, settings *Redshift) (*sql.DB, error) {
+	r, err := parseDSN(dsn)
+	if err != nil {
+		return nil, err
+	}
 
 	DBPoolMutex.Lock()
 	defer DBPoolMutex.Unlock()
@@ -97,41 +425,252 @@ func ConnectToRedshift(target *Target) (*sql.DB, error) {
 	if err != nil {
 		return nil, err
 	}
+	settings.ConfigurePool(db)
 	DBPool[dsn] = db
 	return db, nil
 }
 
-func ImportRedshift(target *Target, record *EventRecord, cap *[]string) error {
-	log.Printf("[info] Import to target %s from record %s", target, record)
-	db, err := ConnectToRedshift(target)
-	if err != nil {
+// poolSettings returns the redshift section of the active config, which configures pools of RedshiftExecutor.
+func poolSettings() *Redshift {
+	if c := CurrentConfig(); c != nil {
+		return c.Redshift
+	}
+	return nil
+}
+
+// configurePools applies settings to all pools in DBPool. SwapConfig reapplies the settings of the activated config.
+func configurePools(settings *Redshift) {
+	DBPoolMutex.Lock()
+	defer DBPoolMutex.Unlock()
+	for _, db := range DBPool {
+		settings.ConfigurePool(db)
+	}
+}
+
+// Defaults of conn_max_lifetime and conn_max_idle_time.
+var (
+	DefaultConnMaxLifetime = time.Hour
+	DefaultConnMaxIdleTime = 5 * time.Minute
+)
+
+// ConnPool is the settings of a connection pool implemented by *sql.DB.
+type ConnPool interface {
+	SetConnMaxLifetime(d time.Duration)
+	SetConnMaxIdleTime(d time.Duration)
+	SetMaxOpenConns(n int)
+}
+
+// ConfigurePool applies conn_max_lifetime, conn_max_idle_time and max_total_conns to the pool. A nil Redshift applies the defaults.
+func (r *Redshift) ConfigurePool(db ConnPool) {
+	var maxOpen int
+	if r != nil {
+		maxOpen = r.MaxTotalConns
+	}
+	// all connections of the pool, including health checks and queries besides COPY
+	db.SetMaxOpenConns(maxOpen)
+	lifetime, idle := DefaultConnMaxLifetime, DefaultConnMaxIdleTime
+	if r != nil && r.ConnMaxLifetime > 0 {
+		lifetime = r.ConnMaxLifetime
+	}
+	if r != nil && r.ConnMaxIdleTime > 0 {
+		idle = r.ConnMaxIdleTime
+	}
+	db.SetConnMaxLifetime(lifetime)
+	db.SetConnMaxIdleTime(idle)
+}
+
+func ImportRedshift(ctx context.Context, c *Config, target *Target, record *EventRecord, cap *[]string) error {
+	return importClusters(ctx, c, target, record, cap, make(map[string]bool))
+}
+
+// importClusters imports the record to clusters of the target which are not done yet.
+// It succeeds when the quorum of clusters are done.
+func importClusters(ctx context.Context, c *Config, target *Target, record *EventRecord, cap *[]string, done map[string]bool) error {
+	id := CorrelationID(ctx)
+	log.Printf("[info] [%s] Import to target %s from record %s", id, target, record)
+	if err := waitForCopyDelay(ctx, target, record); err != nil {
 		return err
 	}
-	txn, err := db.Begin()
+	if target.CheckExists {
+		bucket, key := record.S3.Bucket.Name, record.S3.Object.Key
+		exists, err := objectExists(ctx, target.S3.Region, bucket, key)
+		if err != nil {
+			return err
+		}
+		if !exists {
+			return ObjectNotFoundError{fmt.Sprintf("s3://%s/%s does not exist", bucket, key)}
+		}
+	}
+	if target.SkipArchived {
+		class, err := archivedClass(ctx, target, record)
+		if err != nil {
+			return err
+		}
+		if class != "" {
+			log.Printf("[warn] [%s] Skip importing record %s to target %s. The object is archived in storage class %s, and can't be read by COPY", id, record, target, class)
+			return nil
+		}
+	}
+	option := target.SQLOption
+	if target.Format == FormatFromMetadata {
+		format, err := formatFromMetadata(ctx, target.S3.Region, record.S3.Bucket.Name, record.S3.Object.Key)
+		if err != nil {
+			return err
+		}
+		log.Printf("[debug] [%s] format from metadata: %s", id, format)
+		option = strings.TrimSpace(format + " " + option)
+	}
+	release, err := waitForOrder(ctx, target, record, cap)
 	if err != nil {
 		return err
 	}
-	defer txn.Rollback()
+	defer release()
+	clusters := target.Clusters()
+	var failed error
+	var rows *int64
+	for _, r := range clusters {
+		dsn := r.DSN()
+		if done[dsn] {
+			continue
+		}
+		var n *int64
+		var err error
+		if target.AddPartition != nil {
+			err = addPartitionToCluster(ctx, c, target.forCluster(r), record, cap)
+		} else {
+			n, err = copyToCluster(ctx, c, target.forCluster(r), record, cap, option)
+		}
+		if _, ok := err.(ObjectNotFoundError); ok {
+			return err
+		}
+		if err != nil {
+			if failed == nil {
+				failed = err
+			}
+			continue
+		}
+		done[dsn] = true
+		if rows == nil {
+			rows = n
+		}
+	}
+	if failed != nil {
+		if len(done) < target.quorum() {
+			return failed
+		}
+		log.Printf("[warn] [%s] COPY to %d of %d clusters of target %s succeeded by the quorum %d. %s", id, len(done), len(clusters), target, target.quorum(), failed)
+	}
+	now := time.Now()
+	if latency, ok := LoadLatency(record, now); ok {
+		log.Printf("[info] [%s] Load latency of target %s: %s", id, target, latency.Round(time.Millisecond))
+		observe(loadLatency, target.metricKey(), LatencyBuckets, latency)
+	}
+	recordTargetSuccess(target, now)
+	recordBytesLoaded(target.plainTableName(cap), record.S3.Object.Size)
+	analyzeLoaded(ctx, target, cap, record.S3.Object.Size)
+	summarizeLoaded(ctx, target, rows, record.S3.Object.Size)
+	log.Printf("[info] [%s] Audit: loaded to target %s from %s", id, target, record.AuditString())
+	notifyLoaded(ctx, target, record, cap, rows, now)
+	return nil
+}
 
-	query, err := target.BuildCopySQL(record.S3.Object.Key, config.Credentials, cap)
+// resolveTable returns the target which copies to the table resolved by table_resolver on the cluster.
+func resolveTable(ctx context.Context, target *Target, record *EventRecord, cap *[]string) (*Target, error) {
+	q, ok := executorFrom(ctx).(ValueQuerier)
+	if !ok {
+		return nil, &SQLBuildError{Target: target.String(), Err: fmt.Errorf("table_resolver is not supported by the executor")}
+	}
+	query := target.TableResolverSQL(record.S3.Bucket.Name, record.S3.Object.Key, cap)
+	log.Printf("[debug] [%s] SQL to resolve the table: %s", CorrelationID(ctx), query)
+	name, err := q.QueryValue(ctx, target.Redshift.DSN(), query)
+	if err == sql.ErrNoRows || (err == nil && (name == "" || strings.Contains(name, "$"))) {
+		return nil, &SQLBuildError{Target: target.String(), Err: fmt.Errorf("table_resolver resolved no table %q for key %s", name, record.S3.Object.Key)}
+	}
 	if err != nil {
-		return err
+		return nil, fmt.Errorf("failed to resolve the table by table_resolver, %s", err)
 	}
-	log.Println("[debug] SQL:", query)
+	log.Printf("[info] [%s] Resolved the table of target %s to %s", CorrelationID(ctx), target, name)
+	return target.withTable(name), nil
+}
 
-	stmt, err := txn.Prepare(query)
+// copyToCluster executes COPY for the record on the cluster of the target, and returns the number of loaded rows if reported.
+func copyToCluster(ctx context.Context, c *Config, target *Target, record *EventRecord, cap *[]string, option string) (*int64, error) {
+	id := CorrelationID(ctx)
+	if target.TableResolver != "" {
+		resolved, err := resolveTable(ctx, target, record, cap)
+		if err != nil {
+			return nil, err
+		}
+		target = resolved
+	}
+	cred, err := resolveCredentials(target.CopyCredentials(c.Credentials))
 	if err != nil {
-		return err
+		return nil, err
+	}
+	copyTarget := target
+	if target.BatchID != nil {
+		copyTarget = target.stagingTarget()
+	}
+	query, err := copyTarget.buildCopySQL(record.S3.Bucket.Name, record.S3.Object.Key, cred, cap, option)
+	if err == nil {
+		err = c.checkSQLLength(query)
+	}
+	var preSQL string
+	if err == nil {
+		preSQL, err = target.PreCopySQL(record.S3.Bucket.Name, record.S3.Object.Key, cap)
 	}
-	defer stmt.Close()
-	_, err = stmt.Exec()
 	if err != nil {
-		return err
+		return nil, &SQLBuildError{Target: target.String(), Err: err}
 	}
-
-	err = txn.Commit()
+	redacted := redactCredentials(query, cred)
+	log.Printf("[debug] [%s] SQL: %s", id, c.logSQL(redacted))
+	tracef(ctx, TraceSQL, "%s", c.logSQL(redacted))
+	queries := target.Redshift.SessionSQLs()
+	if preSQL != "" {
+		log.Printf("[debug] [%s] SQL before COPY: %s", id, c.logSQL(preSQL))
+		queries = append(queries, preSQL)
+	}
+	var afterCopy []string
+	if target.BatchID != nil {
+		var beforeCopy []string
+		beforeCopy, afterCopy = target.BatchIDSQLs(ctx, record.S3.Bucket.Name, record.S3.Object.Key, cap)
+		log.Printf("[debug] [%s] SQL of batch_id: %s", id, c.logSQL(strings.Join(append(beforeCopy, afterCopy...), "; ")))
+		queries = append(queries, beforeCopy...)
+	}
+	copyAt := len(queries)
+	queries = append(queries, query)
+	queries = append(queries, afterCopy...)
+	if successSQL := target.SuccessSQL(record.S3.Bucket.Name, record.S3.Object.Key, cap); successSQL != "" {
+		log.Printf("[debug] [%s] SQL on success: %s", id, c.logSQL(successSQL))
+		queries = append(queries, successSQL)
+	}
+	if err := waitForMinInterval(ctx, target, cap); err != nil {
+		return nil, err
+	}
+	audited := append([]string(nil), queries...)
+	audited[copyAt] = redacted
+	if err := auditSQL(ctx, c, target, audited); err != nil {
+		return nil, err
+	}
+	ctx, durations := withCopyDurations(ctx)
+	ctx, rows := withCopyRows(ctx)
+	result, err := execCopy(ctx, c, target.Redshift.DSN(), target.tableKey(cap), queries, target.ReportLoadErrors)
 	if err != nil {
-		return err
+		log.Printf("[error] [%s] COPY failed. %s", id, err)
+		tracef(ctx, TraceCopy, "failed to target %s. %s", target, err)
+		if objectNotFoundRegexp.MatchString(err.Error()) {
+			return nil, ObjectNotFoundError{err.Error()}
+		}
+		return nil, &CopyError{target.String(), err}
 	}
-	return nil
+	log.Printf("[info] [%s] COPY completed to target %s.%s", id, target, result)
+	tracef(ctx, TraceCopy, "completed to target %s.%s", target, result)
+	if durations.recorded() {
+		log.Printf("[info] [%s] COPY durations %s", id, durations)
+		observeCopyDurations(durations)
+	}
+	if *rows < 0 {
+		return nil, nil
+	}
+	return rows, nil
 }
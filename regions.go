@@ -0,0 +1,38 @@
+package main
+
+import (
+	"fmt"
+	"log"
+)
+
+// checkRegions cross-checks the region of credentials, buckets and clusters of targets.
+// Suspicious combinations are logged as warnings, or fail in strict mode.
+func (c *Config) checkRegions() error {
+	var errs ValidationErrors
+	api := c.AWSCredentials().AWS_REGION
+	for i, t := range c.Targets {
+		if t.Discard || !t.IsEnabled() || t.Redshift == nil || t.S3 == nil {
+			continue
+		}
+		bucket := t.S3.Region
+		for _, r := range t.Clusters() {
+			cluster := r.ClusterRegion()
+			var err error
+			switch {
+			case bucket != "" && cluster != "" && bucket != cluster && !t.CrossRegion:
+				err = fmt.Errorf("targets[%d] %s copies from the bucket in %s to the cluster %s in %s without cross_region", i, t, bucket, r.VisibleDSN(), cluster)
+			case api != "" && bucket != "" && cluster != "" && api != bucket && api != cluster:
+				err = fmt.Errorf("targets[%d] %s has the bucket in %s and the cluster %s in %s, but the region of credentials is %s", i, t, bucket, r.VisibleDSN(), cluster, api)
+			}
+			if err == nil {
+				continue
+			}
+			if c.Strict {
+				errs = append(errs, err)
+			} else {
+				log.Printf("[warn] Region mismatch: %s", err)
+			}
+		}
+	}
+	return errs.err()
+}
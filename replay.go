@@ -0,0 +1,79 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log"
+)
+
+// Replay imports records of the S3 event file (a path or URL) by targets of the config file without any queue.
+// When dryRun is true, it writes matched targets and their SQL without executing COPY.
+func Replay(ctx context.Context, configFile, eventFile string, dryRun bool, w io.Writer) error {
+	log.Println("[info] Loading config:", configFile)
+	c, err := LoadConfig(configFile)
+	if err != nil {
+		return err
+	}
+	b, err := loadSrcFrom(eventFile)
+	if err != nil {
+		return fmt.Errorf("failed to read event %s, %s", eventFile, err)
+	}
+	event, err := ParseEventWithEncoding(b, c.MessageEncoding)
+	if err != nil {
+		return err
+	}
+	initSessions(c)
+	return ReplayEvent(ctx, c, event, dryRun, w)
+}
+
+// ReplayEvent writes targets matched by each record of the event and their redacted SQL, and imports the record unless dryRun.
+func ReplayEvent(ctx context.Context, c *Config, event Event, dryRun bool, w io.Writer) error {
+	ctx = withCorrelationID(ctx, newCorrelationID())
+	var failed int
+	for _, record := range event.Records {
+		fmt.Fprintln(w, record)
+		matched, err := c.matchTargets(ctx, record, true)
+		if err != nil {
+			fmt.Fprintf(w, "\tNG %s\n", err)
+			failed++
+			continue
+		}
+		if len(matched) == 0 {
+			fmt.Fprintln(w, "\tno targets matched")
+			continue
+		}
+		for _, m := range matched {
+			target := m.target
+			if target.Discard {
+				fmt.Fprintf(w, "\t%s: discard\n", target)
+				continue
+			}
+			var sql string
+			if target.AddPartition != nil {
+				sql, err = target.BuildAddPartitionSQL(record.S3.Bucket.Name, record.S3.Object.Key, m.capture)
+			} else {
+				_, sql, err = target.BuildCopySQLRedacted(record.S3.Object.Key, c.Credentials, m.capture)
+			}
+			if err != nil {
+				fmt.Fprintf(w, "\t%s: NG %s\n", target, err)
+				continue
+			}
+			fmt.Fprintf(w, "\t%s: %s\n", target, sql)
+		}
+		if dryRun {
+			continue
+		}
+		n, err := ImportWithContext(ctx, c, Event{Records: []*EventRecord{record}})
+		if err != nil {
+			fmt.Fprintf(w, "\tNG %s\n", err)
+			failed++
+			continue
+		}
+		fmt.Fprintf(w, "\tOK %d actions\n", n)
+	}
+	if failed > 0 {
+		return fmt.Errorf("%d of %d records failed", failed, len(event.Records))
+	}
+	return nil
+}
@@ -0,0 +1,35 @@
+package rin_test
+
+import (
+	"bytes"
+	"context"
+	"os"
+	"strings"
+	"testing"
+
+	rin "github.com/fujiwara/Rin"
+)
+
+func TestReplay(t *testing.T) {
+	os.Setenv("AWS_SECRET_ACCESS_KEY", "SSS")
+	fe := useFakeExecutor(t)
+	var out bytes.Buffer
+	if err := rin.Replay(context.Background(), "test/config.yml", "test/event.v2.2.json", true, &out); err != nil {
+		t.Fatal(err)
+	}
+	if len(fe.queries) != 0 {
+		t.Errorf("dry run must not execute COPY: %v", fe.queries)
+	}
+	expected := `COPY "foo" FROM 's3://test.bucket.test/test/foo/xxx.json' CREDENTIALS '***'`
+	if !strings.Contains(out.String(), expected) || strings.Contains(out.String(), "SSS") {
+		t.Errorf("matched targets and redacted SQL must be reported:\n%s", out.String())
+	}
+
+	out.Reset()
+	if err := rin.Replay(context.Background(), "test/config.yml", "test/event.v2.2.json", false, &out); err != nil {
+		t.Fatal(err)
+	}
+	if len(fe.queries) != 1 || !strings.Contains(out.String(), "OK 1 actions") {
+		t.Errorf("the record must be imported: %v\n%s", fe.queries, out.String())
+	}
+}
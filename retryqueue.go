@@ -0,0 +1,91 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"strconv"
+	"time"
+)
+
+// RetryCountAttribute is the message attribute which has the number of times a message was sent to the retry queue.
+const RetryCountAttribute = "RinRetryCount"
+
+// MaxRetryQueueDelay is the maximum delay of SQS messages.
+const MaxRetryQueueDelay = 15 * time.Minute
+
+// RetryQueue republishes a failed message to the queue with an increasing delay,
+// instead of redelivery by the visibility timeout.
+type RetryQueue struct {
+	// QueueName must be received by Rin, queue_name or one of queues. Default is queue_name.
+	QueueName string `yaml:"queue_name"`
+	// MaxAttempts is the number of times a message is sent to the queue. After that, the message is left for redelivery.
+	MaxAttempts int `yaml:"max_attempts"`
+	// Delay is the delay of the first retry, doubled by each attempt up to MaxDelay.
+	Delay    time.Duration `yaml:"delay"`
+	MaxDelay time.Duration `yaml:"max_delay"`
+}
+
+func (q *RetryQueue) validate() error {
+	if q.MaxAttempts <= 0 {
+		return fmt.Errorf("retry_queue.max_attempts must be a positive number")
+	}
+	if q.Delay < time.Second || q.Delay > MaxRetryQueueDelay {
+		return fmt.Errorf("retry_queue.delay must be between 1s and %s", MaxRetryQueueDelay)
+	}
+	if q.MaxDelay != 0 && (q.MaxDelay < q.Delay || q.MaxDelay > MaxRetryQueueDelay) {
+		return fmt.Errorf("retry_queue.max_delay must be between delay and %s", MaxRetryQueueDelay)
+	}
+	return nil
+}
+
+// delay returns the delay of the retry after the attempts.
+func (q *RetryQueue) delay(attempts int) time.Duration {
+	max := q.MaxDelay
+	if max == 0 {
+		max = MaxRetryQueueDelay
+	}
+	d := q.Delay
+	for i := 0; i < attempts && d < max; i++ {
+		d *= 2
+	}
+	if d > max {
+		d = max
+	}
+	return d
+}
+
+// retryCount returns the number of times the message was sent to the retry queue.
+func retryCount(msg *Message) int {
+	n, _ := strconv.Atoi(msg.MessageAttributes[RetryCountAttribute])
+	return n
+}
+
+// sendToRetryQueue republishes the message to the retry queue, and reports whether the message was sent.
+// The message is not sent when it has been retried max_attempts times.
+func sendToRetryQueue(ctx context.Context, q *RetryQueue, src MessageSource, msg *Message) bool {
+	msgId := CorrelationID(ctx)
+	rs, ok := src.(RetrySource)
+	if !ok {
+		log.Printf("[warn] [%s] The message source can't send messages to %s.", msgId, q.QueueName)
+		return false
+	}
+	n := retryCount(msg)
+	if n >= q.MaxAttempts {
+		log.Printf("[warn] [%s] The message was retried %d times by %s. Leave the message.", msgId, n, q.QueueName)
+		return false
+	}
+	attrs := make(map[string]string, len(msg.MessageAttributes)+1)
+	for name, v := range msg.MessageAttributes {
+		attrs[name] = v
+	}
+	attrs[RetryCountAttribute] = strconv.Itoa(n + 1)
+	retry := &Message{Body: msg.Body, MessageAttributes: attrs}
+	delay := q.delay(n)
+	if err := rs.SendToQueueWithDelay(ctx, q.QueueName, retry, delay); err != nil {
+		log.Printf("[error] [%s] Can't send the message to %s. %s", msgId, q.QueueName, err)
+		return false
+	}
+	log.Printf("[info] [%s] Sent the message to %s. attempt: %d, delay: %s", msgId, q.QueueName, n+1, delay)
+	return true
+}
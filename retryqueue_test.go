@@ -0,0 +1,60 @@
+package rin_test
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"testing"
+	"time"
+
+	rin "github.com/fujiwara/Rin"
+)
+
+func TestRetryQueue(t *testing.T) {
+	config := loadTestConfig(t, "test/config.yml")
+	config.RetryQueue = &rin.RetryQueue{
+		QueueName:   "rin_retry",
+		MaxAttempts: 3,
+		Delay:       10 * time.Second,
+		MaxDelay:    30 * time.Second,
+	}
+	fe := useFakeExecutor(t)
+	fe.err = errors.New("COPY failed")
+
+	msg := &rin.Message{Body: readFixture(t, "test/notification.json")}
+	expectedDelays := []time.Duration{10 * time.Second, 20 * time.Second, 30 * time.Second}
+	for i, expected := range expectedDelays {
+		src := rin.NewMemorySource()
+		src.AddMessage(msg)
+		if err := rin.RunWithSource(context.Background(), config, src, true); err != nil {
+			t.Fatal(err)
+		}
+		if n := len(src.Deleted()); n != 1 {
+			t.Fatalf("attempt %d: the message sent to the retry queue must be deleted: %d", i+1, n)
+		}
+		sent, delays := src.Sent("rin_retry"), src.Delays("rin_retry")
+		if len(sent) != 1 || len(delays) != 1 {
+			t.Fatalf("attempt %d: a message must be sent to the retry queue: %v", i+1, sent)
+		}
+		if delays[0] != expected {
+			t.Errorf("attempt %d: unexpected delay %s, expected %s", i+1, delays[0], expected)
+		}
+		if got := sent[0].MessageAttributes[rin.RetryCountAttribute]; got != fmt.Sprint(i+1) {
+			t.Errorf("attempt %d: unexpected %s %s", i+1, rin.RetryCountAttribute, got)
+		}
+		if sent[0].Body != msg.Body {
+			t.Errorf("attempt %d: the body must be kept", i+1)
+		}
+		msg = sent[0]
+	}
+
+	// over max_attempts, the message is left for redelivery
+	src := rin.NewMemorySource()
+	src.AddMessage(msg)
+	if err := rin.RunWithSource(context.Background(), config, src, true); err != nil {
+		t.Fatal(err)
+	}
+	if len(src.Sent("rin_retry")) != 0 || len(src.InFlight()) != 1 {
+		t.Errorf("the message over max_attempts must be left")
+	}
+}
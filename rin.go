@@ -2,27 +2,38 @@ package main
 
 import (
 	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
 	"log"
 	"os"
 	"os/signal"
+	"strings"
 	"sync"
+	"sync/atomic"
 	"syscall"
 	"time"
 
 	"github.com/aws/aws-sdk-go/aws"
 	"github.com/aws/aws-sdk-go/aws/credentials"
 	"github.com/aws/aws-sdk-go/aws/session"
-	"github.com/aws/aws-sdk-go/service/sqs"
 )
 
-var config *Config
+var activeConfig atomic.Value
 var MaxDeleteRetry = 8
+
+// DeleteRetryInterval is the base of intervals between retries to delete a message. The n-th retry waits n*n times of it.
+var DeleteRetryInterval = time.Second
 var Sessions = &SessionStore{}
 
 type SessionStore struct {
 	SQS      *session.Session
 	Redshift *session.Session
 	S3       *session.Session
+	SNS      *session.Session
+	DynamoDB *session.Session
+	STS      *session.Session
 }
 
 var TrapSignals = []os.Signal{
@@ -40,10 +51,96 @@ func (e NoMessageError) Error() string {
 	return e.s
 }
 
+type correlationIDKey struct{}
+
+func newCorrelationID() string {
+	b := make([]byte, 4)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+func withCorrelationID(ctx context.Context, id string) context.Context {
+	return context.WithValue(ctx, correlationIDKey{}, id)
+}
+
+// CorrelationID returns the ID correlating log lines of a message processed in ctx.
+func CorrelationID(ctx context.Context) string {
+	if id, ok := ctx.Value(correlationIDKey{}).(string); ok {
+		return id
+	}
+	return "-"
+}
+
+// CurrentConfig returns the active config.
+func CurrentConfig() *Config {
+	c, _ := activeConfig.Load().(*Config)
+	return c
+}
+
+// SwapConfig replaces the active config by c, and returns the previous one.
+// Messages in flight keep using the config which was active when they were received.
+// Pools in DBPool are reconfigured by the redshift section of c.
+func SwapConfig(c *Config) *Config {
+	prev := CurrentConfig()
+	activeConfig.Store(c)
+	if c != nil {
+		configurePools(c.Redshift)
+	}
+	return prev
+}
+
+// reloadConfig activates the config returned by reload. A config which fails validation is never activated,
+// even if reload returns no error, and the last good config keeps active.
+func reloadConfig(reload func() (*Config, error)) {
+	log.Println("[info] Reloading config")
+	c, err := reload()
+	if err == nil {
+		if c == nil {
+			err = fmt.Errorf("no config")
+		} else {
+			err = c.validate()
+		}
+	}
+	if err != nil {
+		log.Printf("[error] Rejected the reloaded config. Keep the current config with %d targets. %s", len(CurrentConfig().Targets), err)
+		return
+	}
+	for _, target := range c.Targets {
+		log.Println("[info] Define target", target.String())
+	}
+	SwapConfig(c)
+	log.Println("[info] Reloaded config")
+}
+
+func initSessions(config *Config) {
+	if Sessions.SQS != nil {
+		return
+	}
+	cred := config.AWSCredentials()
+	c := &aws.Config{
+		Region: aws.String(cred.AWS_REGION),
+	}
+	if chain := NewCredentialChain(config); chain != nil {
+		c.Credentials = chain
+	} else if cred.AWS_ACCESS_KEY_ID != "" {
+		c.Credentials = credentials.NewStaticCredentials(
+			cred.AWS_ACCESS_KEY_ID,
+			cred.AWS_SECRET_ACCESS_KEY,
+			"",
+		)
+	}
+	sess := session.Must(session.NewSession(c))
+	Sessions.SQS = sess
+	Sessions.Redshift = sess
+	Sessions.S3 = sess
+	Sessions.SNS = sess
+	Sessions.DynamoDB = sess
+	Sessions.STS = sess
+}
+
 func DryRun(configFile string, batchMode bool) error {
-	var err error
 	log.Println("[info] Loading config:", configFile)
-	config, err = LoadConfig(configFile)
+	config, err := LoadConfig(configFile)
 	if err != nil {
 		return err
 	}
@@ -53,185 +150,715 @@ func DryRun(configFile string, batchMode bool) error {
 	return nil
 }
 
-func Run(configFile string, batchMode bool) error {
-	return RunWithContext(context.Background(), configFile, batchMode)
+// RunOptions are dependencies and modes of Run. Zero values use the real SQS and Redshift.
+type RunOptions struct {
+	// Source is the MessageSource. When nil, the SQS queue of queue_name is used.
+	Source MessageSource
+	// Executor executes COPY. When nil, DefaultExecutor is used.
+	Executor Executor
+	// BatchMode exits when no messages are available.
+	BatchMode bool
+	// Reload reloads the config on SIGHUP. When nil, SIGHUP shuts down the worker.
+	Reload func() (*Config, error)
+	// Filter pauses targets. Messages matched only paused targets are left on the queue.
+	Filter TargetFilter
+	// MaxRuntime shuts down the worker after the duration, regardless of messages in the queue.
+	MaxRuntime time.Duration
+	// TargetProvider loads targets in addition to the config by target_provider.interval.
+	// When nil, the provider defined in target_provider of the config is used.
+	TargetProvider TargetProvider
+	// Result counts messages succeeded and failed, for the exit code of batch mode.
+	Result *BatchResult
+	// FailFast stops receiving messages after the first message failed by COPY, and Run returns the error
+	// after messages in flight are completed. The failed message is left on the queue.
+	FailFast bool
+	// SkipQueueCheck starts the worker without resolving the queue of queue_name.
+	// By default, Run fails when the queue does not exist.
+	SkipQueueCheck bool
+	// Summary accumulates the stats logged at shutdown. When nil, a new Summary is used.
+	Summary *Summary
+	// Tracer starts spans of processing messages. When nil, DefaultTracer is used.
+	Tracer Tracer
+	// Match matches records before targets of the config. A record matched by it is imported to the target only,
+	// instead of targets of the config. The target must be complete as targets of the config (e.g. one of Config.Targets),
+	// and is checked by allowed_sources, Filter and enabled as them. When nil or not matched, records are matched by targets of the config.
+	Match MatchFunc
+}
+
+// Run runs a worker for the config until ctx is canceled or a signal is received.
+func Run(ctx context.Context, c *Config, opts RunOptions) error {
+	sources := []queueSource{{src: opts.Source}}
+	if opts.Source == nil {
+		initSessions(c)
+		var sqsSrc *SQSSource
+		if opts.SkipQueueCheck {
+			sqsSrc = NewLazySQSSource(sqsClient(), c.QueueName)
+		} else {
+			var err error
+			if sqsSrc, err = NewSQSSource(ctx, sqsClient(), c.QueueName); err != nil {
+				return err
+			}
+		}
+		sqsSrc.SetAttributeNames(c.receiveAttributeNames(c.QueueName))
+		sources[0].src = sqsSrc
+		for _, q := range c.Queues {
+			s, err := newQueueSource(ctx, c, sqsClient(), q, opts.SkipQueueCheck)
+			if err != nil {
+				return err
+			}
+			sources = append(sources, s)
+		}
+	}
+	if opts.Executor != nil {
+		ctx = withExecutor(ctx, opts.Executor)
+	}
+	if opts.Tracer != nil {
+		ctx = withTracer(ctx, opts.Tracer)
+	}
+	if opts.Match != nil {
+		ctx = withMatchFunc(ctx, opts.Match)
+	}
+	ctx = withTargetFilter(ctx, opts.Filter)
+	ctx = withBatchResult(ctx, opts.Result)
+	summary := opts.Summary
+	if summary == nil {
+		summary = &Summary{}
+	}
+	ctx = withSummary(ctx, summary)
+	if opts.FailFast {
+		ctx = context.WithValue(ctx, failFastKey{}, true)
+	}
+	// the refresher also applies target_provider of reloaded configs
+	refresher := &targetRefresher{provider: opts.TargetProvider, base: c}
+	refreshing := opts.Reload != nil || refresher.providerOf(c) != nil
+	pctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	if refreshing {
+		composed, err := refresher.compose(pctx, c)
+		if err != nil {
+			return fmt.Errorf("failed to load targets from the target provider, %s", err)
+		}
+		for _, target := range composed.Targets[len(c.Targets):] {
+			log.Println("[info] Define target", target.String(), "by the target provider")
+		}
+		if opts.Reload != nil {
+			opts.Reload = refresher.reload(pctx, opts.Reload)
+		}
+		c = composed
+	}
+	// activated before the refresher replaces it
+	SwapConfig(c)
+	if refreshing {
+		go refresher.run(pctx)
+	}
+	if opts.MaxRuntime > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, opts.MaxRuntime)
+		defer cancel()
+	}
+	start := time.Now()
+	err := run(ctx, c, sources, opts.BatchMode, opts.Reload)
+	if ctx.Err() == context.DeadlineExceeded {
+		log.Printf("[info] Max runtime %s exceeded.", opts.MaxRuntime)
+	}
+	summary.mu.Lock()
+	summary.Runtime = time.Since(start)
+	summary.mu.Unlock()
+	log.Printf("[info] Summary: %s", summary)
+	return err
 }
 
 func RunWithContext(ctx context.Context, configFile string, batchMode bool) error {
-	var err error
+	return RunConfigFile(ctx, configFile, RunOptions{BatchMode: batchMode})
+}
+
+// RunConfigFile loads the config file and runs a worker for it. SIGHUP reloads the config file.
+func RunConfigFile(ctx context.Context, configFile string, opts RunOptions) error {
 	log.Println("[info] Loading config:", configFile)
-	config, err = LoadConfig(configFile)
+	config, err := LoadConfig(configFile)
 	if err != nil {
 		return err
 	}
 	for _, target := range config.Targets {
 		log.Println("[info] Define target", target.String())
 	}
-
-	if Sessions.SQS == nil {
-		c := &aws.Config{
-			Region: aws.String(config.Credentials.AWS_REGION),
-		}
-		if config.Credentials.AWS_ACCESS_KEY_ID != "" {
-			c.Credentials = credentials.NewStaticCredentials(
-				config.Credentials.AWS_ACCESS_KEY_ID,
-				config.Credentials.AWS_SECRET_ACCESS_KEY,
-				"",
-			)
-		}
-		sess := session.Must(session.NewSession(c))
-		Sessions.SQS = sess
-		Sessions.Redshift = sess
-		Sessions.S3 = sess
+	opts.Reload = func() (*Config, error) {
+		return LoadConfig(configFile)
 	}
-	sqsSvc := sqs.New(Sessions.SQS)
+	return Run(ctx, config, opts)
+}
 
+// RunWithSource runs a worker which processes messages from the src.
+func RunWithSource(ctx context.Context, c *Config, src MessageSource, batchMode bool) error {
+	return Run(ctx, c, RunOptions{Source: src, BatchMode: batchMode})
+}
+
+// run runs a worker by c, which is activated by SwapConfig already.
+// When reload is not nil, SIGHUP reloads the config by it instead of shutting down.
+func run(ctx context.Context, c *Config, sources []queueSource, batchMode bool, reload func() (*Config, error)) error {
 	signalCh := make(chan os.Signal, 1)
 	signal.Notify(signalCh, TrapSignals...)
+	defer signal.Stop(signalCh)
 	ctx, cancel := context.WithCancel(ctx)
 	defer cancel()
 	var wg sync.WaitGroup
-	wg.Add(2) // signal handler + sqsWorker
+	wg.Add(1) // signal handler
+
+	stall.reset()
+	diskFullCircuit.reset()
+	copyCircuit.reset()
+	if c.StallWindow > 0 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			runStallWatchdog(ctx, c.StallWindow)
+		}()
+	}
+
+	if w, ok := executorFrom(ctx).(Warmer); ok && c.RedshiftHealthInterval > 0 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			runRedshiftHealth(ctx, w, c.RedshiftHealthInterval)
+		}()
+	}
+
+	if c.HTTP.Addr != "" {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			runHTTPServer(ctx, c)
+		}()
+	}
 
 	// wait for signal
 	go func() {
 		defer wg.Done()
-		sig := <-signalCh
-		log.Printf("[info] Got signal: %s(%d)", sig, sig)
-		log.Println("[info] Shutting down worker...")
-		cancel()
+		for {
+			select {
+			case sig := <-signalCh:
+				log.Printf("[info] Got signal: %s(%d)", sig, sig)
+				if sig == syscall.SIGHUP && reload != nil {
+					reloadConfig(reload)
+					continue
+				}
+				log.Println("[info] Shutting down worker...")
+				cancel()
+				return
+			case <-ctx.Done():
+				return
+			}
+		}
 	}()
 
-	// run worker
-	err = sqsWorker(ctx, &wg, sqsSvc, batchMode)
+	// run worker after starting up
+	err := startup(ctx, c, batchMode)
+	if err == nil {
+		err = workers(ctx, sources, batchMode)
+	}
+	cancel()
 
 	wg.Wait()
 	log.Println("[info] Shutdown.")
-	if ctx.Err() == context.Canceled {
-		// normally exit
-		return nil
-	}
 	return err
 }
 
-func waitForRetry() {
-	log.Println("[warn] Retry after 10 sec.")
-	time.Sleep(10 * time.Second)
+func waitForRetry(ctx context.Context) {
+	waitForRetryAfter(ctx, 10*time.Second)
+}
+
+func waitForRetryAfter(ctx context.Context, d time.Duration) {
+	log.Printf("[warn] Retry after %s.", d)
+	select {
+	case <-ctx.Done():
+	case <-time.After(d):
+	}
+}
+
+// missingTableFailures counts consecutive messages failed by missing tables, for backoff.
+var missingTableFailures int32
+
+const maxMissingTableBackoff = 5 * time.Minute
+
+// missingTableBackoff returns the wait before retrying a message failed by a missing table.
+// It doubles from 10 sec. by consecutive failures.
+func missingTableBackoff() time.Duration {
+	n := atomic.AddInt32(&missingTableFailures, 1)
+	d := 10 * time.Second
+	for i := int32(1); i < n && d < maxMissingTableBackoff; i++ {
+		d *= 2
+	}
+	if d > maxMissingTableBackoff {
+		d = maxMissingTableBackoff
+	}
+	return d
 }
 
-func sqsWorker(ctx context.Context, wg *sync.WaitGroup, svc *sqs.SQS, batchMode bool) error {
+type failFastKey struct{}
+
+func failFastFrom(ctx context.Context) bool {
+	b, _ := ctx.Value(failFastKey{}).(bool)
+	return b
+}
+
+// inFlightSlot is a slot of max_inflight_messages held by a message.
+// The slot is yielded while polling async COPYs, so the worker receives other messages meanwhile.
+type inFlightSlot struct {
+	mu      sync.Mutex
+	ch      chan struct{}
+	yielded int
+}
+
+// yield frees the slot until reclaim. Concurrent COPYs of a message share the slot.
+func (s *inFlightSlot) yield() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.yielded == 0 {
+		<-s.ch
+	}
+	s.yielded++
+}
+
+// reclaim takes the slot back, waiting for other messages to complete.
+func (s *inFlightSlot) reclaim() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.yielded--
+	if s.yielded == 0 {
+		s.ch <- struct{}{}
+	}
+}
+
+type inFlightSlotKey struct{}
+
+func withInFlightSlot(ctx context.Context, s *inFlightSlot) context.Context {
+	return context.WithValue(ctx, inFlightSlotKey{}, s)
+}
+
+func inFlightSlotFrom(ctx context.Context) *inFlightSlot {
+	s, _ := ctx.Value(inFlightSlotKey{}).(*inFlightSlot)
+	return s
+}
+
+// worker processes messages of the src. maxInFlight overrides max_inflight_messages when positive.
+// budget limits the size of messages received but not completed yet by all workers.
+func worker(ctx context.Context, src MessageSource, batchMode bool, maxInFlight int, budget *byteBudget) (err error) {
 	var mode string
 	if batchMode {
 		mode = "Batch"
 	} else {
 		mode = "Worker"
 	}
-	log.Printf("[info] Starting up SQS %s", mode)
-	defer log.Printf("[info] Shutdown SQS %s", mode)
-	defer wg.Done()
+	log.Printf("[info] Starting up %s", mode)
+	defer log.Printf("[info] Shutdown %s", mode)
 
-	log.Println("[info] Connect to SQS:", config.QueueName)
-	res, err := svc.GetQueueUrlWithContext(ctx, &sqs.GetQueueUrlInput{
-		QueueName: aws.String(config.QueueName),
-	})
-	if err != nil {
-		return err
+	// inFlight limits the number of messages received but not completed yet.
+	if maxInFlight <= 0 {
+		maxInFlight = CurrentConfig().maxInFlightMessages()
 	}
+	inFlight := make(chan struct{}, maxInFlight)
+	// messages in flight are processed within shutdown_grace after shutting down.
+	msgCtx, cancel := graceContext(ctx, CurrentConfig().ShutdownGrace)
+	defer cancel()
+	var wg sync.WaitGroup
+	failFast := failFastFrom(ctx)
+	// failed receives the first message failed by COPY in fail fast mode
+	failed := make(chan error, 1)
+	defer func() {
+		wg.Wait()
+		if err != nil {
+			return
+		}
+		select {
+		case e := <-failed:
+			// failed after the last message was received
+			err = failFastError(e)
+		default:
+		}
+	}()
 	for {
 		select {
 		case <-ctx.Done():
 			return nil
+		case err := <-failed:
+			return failFastError(err)
+		case inFlight <- struct{}{}:
+		}
+		select {
+		case err := <-failed:
+			<-inFlight
+			return failFastError(err)
 		default:
 		}
-		if err := handleMessage(ctx, svc, res.QueueUrl); err != nil {
+		budget.wait(ctx)
+		diskFullCircuit.wait(ctx)
+		probe := copyCircuit.acquire(ctx)
+		if ctx.Err() != nil {
+			<-inFlight
+			return nil
+		}
+		msg, err := src.Receive(ctx)
+		if err != nil {
+			<-inFlight
+			copyCircuit.cancel(probe)
 			if _, ok := err.(NoMessageError); ok {
 				if batchMode {
-					break
-				} else {
-					continue
-				}
-				if ctx.Err() == context.Canceled {
 					return nil
 				}
-				if !batchMode {
-					waitForRetry()
-				}
+				continue
+			}
+			if ctx.Err() != nil {
+				return nil
+			}
+			log.Println("[error] Can't receive message.", err)
+			if !batchMode {
+				waitForRetry(ctx)
 			}
+			continue
 		}
+		// a snapshot of the config for the message
+		c := CurrentConfig()
+		reserved := budget.reserve(int64(len(msg.Body)))
+		wg.Add(1)
+		go func(msg *Message, probe bool) {
+			defer wg.Done()
+			defer func() { <-inFlight }()
+			defer reserved.release()
+			slot := &inFlightSlot{ch: inFlight}
+			mctx, copies := withCopyAttempts(withInFlightSlot(withByteReservation(msgCtx, reserved), slot))
+			err := handleMessage(mctx, c, src, msg)
+			copied := atomic.LoadInt32(copies) > 0
+			recordBatchResult(ctx, err)
+			summarizeMessage(ctx, err)
+			var ce *CopyError
+			if failFast && errors.As(err, &ce) {
+				select {
+				case failed <- err:
+				default:
+				}
+				return
+			}
+			var pe *PausedError
+			if err == nil {
+				atomic.StoreInt32(&missingTableFailures, 0)
+				diskFullCircuit.succeeded()
+				copyCircuit.record(c.CircuitBreaker, nil, probe, copied, time.Now())
+			} else if errors.As(err, &pe) {
+				// the message left for paused targets is not a failure to back off
+				copyCircuit.cancel(probe)
+			} else if ctx.Err() == nil && !batchMode {
+				switch {
+				case c.DiskFull != nil && isDiskFull(err):
+					diskFullCircuit.trip(c.DiskFull, time.Now())
+					copyCircuit.cancel(probe)
+				case copyCircuit.record(c.CircuitBreaker, err, probe, copied, time.Now()):
+					// the circuit breaker stops processing messages instead of retrying
+				case c.RetryOnMissingTable && isMissingTable(err):
+					waitForRetryAfter(ctx, missingTableBackoff())
+				default:
+					waitForRetry(ctx)
+				}
+			}
+		}(msg, probe)
 	}
-	return nil
 }
 
-func handleMessage(ctx context.Context, svc *sqs.SQS, queueUrl *string) error {
+func failFastError(err error) error {
+	log.Println("[error] Stop receiving messages by fail fast.", err)
+	return fmt.Errorf("stopped by fail fast after a message failed. %s", err)
+}
+
+// graceContext returns a context which has values of ctx, and is canceled when the grace has passed since ctx is done.
+func graceContext(ctx context.Context, grace time.Duration) (context.Context, context.CancelFunc) {
+	if grace <= 0 {
+		return context.WithCancel(ctx)
+	}
+	gctx, cancel := context.WithCancel(valueOnlyContext{ctx})
+	go func() {
+		select {
+		case <-ctx.Done():
+		case <-gctx.Done():
+			return
+		}
+		log.Printf("[info] Waiting for messages in flight up to %s.", grace)
+		select {
+		case <-time.After(grace):
+			cancel()
+		case <-gctx.Done():
+		}
+	}()
+	return gctx, cancel
+}
+
+// valueOnlyContext is a context which is never canceled, but has values of the parent.
+type valueOnlyContext struct {
+	context.Context
+}
+
+func (valueOnlyContext) Deadline() (time.Time, bool) { return time.Time{}, false }
+func (valueOnlyContext) Done() <-chan struct{}       { return nil }
+func (valueOnlyContext) Err() error                  { return nil }
+
+func handleMessage(ctx context.Context, c *Config, src MessageSource, msg *Message) (err error) {
 	var completed = false
-	res, err := svc.ReceiveMessageWithContext(ctx, &sqs.ReceiveMessageInput{
-		MaxNumberOfMessages: aws.Int64(1),
-		QueueUrl:            queueUrl,
-	})
-	if err != nil {
-		return err
+	msgId := newCorrelationID()
+	ctx = withCorrelationID(ctx, msgId)
+	ctx, endSpan := startSpan(ctx, SpanMessage)
+	spanAttrs := map[string]string{AttrMessageID: msg.ID}
+	defer func() { endSpan(spanAttrs, err) }()
+	log.Printf("[info] [%s] Starting process message. MessageId: %s", msgId, msg.ID)
+	log.Printf("[debug] [%s] handle: %s", msgId, msg.Handle)
+	if n := msg.ReceiveCount(); n > 0 {
+		log.Printf("[debug] [%s] receive count: %d, age: %s", msgId, n, time.Since(msg.SentAt()).Round(time.Second))
 	}
-	if len(res.Messages) == 0 {
-		return NoMessageError{"No messages"}
+	log.Printf("[debug] [%s] body: %s", msgId, msg.Body)
+	if c.MessageTimeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, c.MessageTimeout)
+		defer cancel()
 	}
-	msg := res.Messages[0]
-	msgId := *msg.MessageId
-	log.Printf("[info] [%s] Starting process message.", msgId)
-	log.Printf("[debug] [%s] handle: %s", msgId, *msg.ReceiptHandle)
-	log.Printf("[debug] [%s] body: %s", msgId, *msg.Body)
 
+	var trace *MessageTrace
+	if c.TraceOnError {
+		ctx, trace = withTrace(ctx, msg.ID)
+		tracef(ctx, TraceReceived, "receive count: %d, body: %s", msg.ReceiveCount(), msg.Body)
+	}
 	defer func() {
 		if !completed {
-			log.Printf("[info] [%s] Aborted message. ReceiptHandle: %s", msgId, *msg.ReceiptHandle)
+			if ctx.Err() == context.DeadlineExceeded {
+				log.Printf("[warn] [%s] Processing the message exceeded message_timeout %s", msgId, c.MessageTimeout)
+			}
+			log.Printf("[info] [%s] Aborted message. ReceiptHandle: %s", msgId, msg.Handle)
+			if trace != nil {
+				log.Printf("[error] [%s] Trace: %s", msgId, trace)
+			}
+		}
+	}()
+
+	dedupID := msg.DeduplicationID()
+	if recentMessages.checkAndRemember(dedupID, time.Now(), c.messageDedupeWindow()) {
+		log.Printf("[info] [%s] Skip duplicate message of MessageDeduplicationId %s within %s", msgId, dedupID, c.messageDedupeWindow())
+		deleteMessage(ctx, src, msg)
+		completed = true
+		return nil
+	}
+	var remember bool
+	defer func() {
+		if !remember {
+			// the message left or failed is not a duplicate on redelivery
+			recentMessages.forgetKey(dedupID)
 		}
 	}()
 
-	event, err := ParseEvent([]byte(*msg.Body))
+	_, endParse := startSpan(ctx, SpanParse)
+	body, err := messageBody(ctx, c, msg)
 	if err != nil {
-		log.Printf("[error] [%s] Can't parse event from Body. %s", msgId, err)
+		endParse(nil, err)
+		log.Printf("[error] [%s] Can't read Body. %s", msgId, err)
 		return err
 	}
+	// the payload of an S3 pointer is counted by max_inflight_bytes instead of the body
+	byteReservationFrom(ctx).resize(int64(len(body)))
+	event, err := ParseEventWithEncoding(body, c.MessageEncoding)
+	endParse(eventAttrs(event), err)
+	if err != nil {
+		return handleMalformed(ctx, c, src, msg, body, &completed, err)
+	}
+	tracef(ctx, TraceParsed, "%s", event)
+	ctx = withMessageObjects(ctx, event)
+	for _, r := range event.Records {
+		if r.MessageAttributes == nil {
+			// raw message delivery of SNS passes the attributes as SQS message attributes
+			r.MessageAttributes = msg.MessageAttributes
+		}
+	}
+	if n := len(event.Records); c.MaxRecordsPerMessage > 0 && n > c.MaxRecordsPerMessage {
+		log.Printf("[error] [%s] The message has %d records over max_records_per_message %d. Send the message to %s.", msgId, n, c.MaxRecordsPerMessage, c.DeadLetterQueueName)
+		err := fmt.Errorf("the message has %d records over max_records_per_message %d", n, c.MaxRecordsPerMessage)
+		if err := sendToDeadLetterQueue(ctx, c, src, msg, err); err != nil {
+			return err
+		}
+		deleteMessage(ctx, src, msg)
+		completed = true
+		return nil
+	}
+	if c.Delivery == DeliveryAtMostOnce {
+		if err := deleteMessage(ctx, src, msg); err != nil {
+			return err
+		}
+	}
 	if event.IsTestEvent() {
 		log.Printf("[info] [%s] Skipping %s", msgId, event.String())
 	} else {
 		log.Printf("[info] [%s] Importing event: %s", msgId, event)
-		n, err := Import(event)
+		stall.received(time.Now())
+		stopHeartbeat := startVisibilityHeartbeat(ctx, c.VisibilityHeartbeat, src, msg)
+		n, err := ImportWithContext(ctx, c, event)
+		stopHeartbeat()
 		if err != nil {
+			var pe *PausedError
+			if errors.As(err, &pe) {
+				// neither retried by retry_queue nor deleted, processed after the target is resumed
+				log.Printf("[info] [%s] Leave the message. %s", msgId, err)
+				return err
+			}
 			log.Printf("[error] [%s] Import failed. %s", msgId, err)
+			if _, ok := err.(*SQLBuildError); ok {
+				return handleSQLError(ctx, c, src, msg, &completed, err)
+			}
+			if c.RetryQueue != nil && sendToRetryQueue(ctx, c.RetryQueue, src, msg) {
+				if c.Delivery != DeliveryAtMostOnce {
+					deleteMessage(ctx, src, msg)
+				}
+				completed = true
+			}
 			return err
 		}
 		if n == 0 {
-			log.Printf("[warn] [%s] All events were not matched for any targets. Ignored.", msgId)
+			if leave, err := handleUnmatched(ctx, c, src, msg, event); err != nil {
+				return err
+			} else if leave {
+				completed = true
+				return nil
+			}
 		} else {
+			stall.processed()
 			log.Printf("[info] [%s] %d actions completed.", msgId, n)
 		}
 	}
-	_, err = svc.DeleteMessage(&sqs.DeleteMessageInput{
-		QueueUrl:      queueUrl,
-		ReceiptHandle: msg.ReceiptHandle,
-	})
-	if err != nil {
-		log.Printf("[warn] [%s] Can't delete message. %s", msgId, err)
-		// retry
-		for i := 1; i <= MaxDeleteRetry; i++ {
-			log.Printf("[info] [%s] Retry to delete after %d sec.", msgId, i*i)
-			time.Sleep(time.Duration(i*i) * time.Second)
-			_, err = svc.DeleteMessage(&sqs.DeleteMessageInput{
-				QueueUrl:      queueUrl,
-				ReceiptHandle: msg.ReceiptHandle,
-			})
-			if err == nil {
-				log.Printf("[info] [%s] Message was deleted successfuly.", msgId)
-				break
-			}
-			log.Printf("[warn] [%s] Can't delete message. %s", msgId, err)
-			if i == MaxDeleteRetry {
-				log.Printf("[error] [%s] Max retry count reached. Giving up.", msgId)
-			}
-		}
+	if c.Delivery != DeliveryAtMostOnce {
+		deleteMessage(ctx, src, msg)
 	}
 
+	remember = true
 	completed = true
 	log.Printf("[info] [%s] Completed message.", msgId)
 	return nil
 }
+
+// sendToQueue sends the message to the queue by the source.
+func sendToQueue(ctx context.Context, src MessageSource, queueName string, msg *Message) error {
+	dls, ok := src.(DeadLetterSource)
+	if !ok {
+		return fmt.Errorf("the message source can't send messages to %s", queueName)
+	}
+	if err := dls.SendToQueue(ctx, queueName, msg); err != nil {
+		log.Printf("[error] [%s] Can't send the message to %s. %s", CorrelationID(ctx), queueName, err)
+		return err
+	}
+	return nil
+}
+
+// handleSQLError applies the sql_error policy to the message which has a record failed to build COPY SQL.
+func handleSQLError(ctx context.Context, c *Config, src MessageSource, msg *Message, completed *bool, err error) error {
+	msgId := CorrelationID(ctx)
+	if c.SQLError != SQLErrorDLQ {
+		log.Printf("[error] [%s] Can't build COPY SQL. Leave the message, it will be received again. %s", msgId, err)
+		return err
+	}
+	log.Printf("[error] [%s] Can't build COPY SQL. Send the message to %s. %s", msgId, c.DeadLetterQueueName, err)
+	if err := sendToDeadLetterQueue(ctx, c, src, msg, err); err != nil {
+		return err
+	}
+	if c.Delivery != DeliveryAtMostOnce {
+		deleteMessage(ctx, src, msg)
+	}
+	*completed = true
+	return nil
+}
+
+// handleUnmatched applies the unmatched policy to the message, and reports whether the message is left in the source.
+func handleUnmatched(ctx context.Context, c *Config, src MessageSource, msg *Message, event Event) (bool, error) {
+	msgId := CorrelationID(ctx)
+	switch c.Unmatched {
+	case UnmatchedDelete:
+		log.Printf("[warn] [%s] All events were not matched for any targets. Delete the message. %s", msgId, event)
+	case UnmatchedDLQ:
+		log.Printf("[warn] [%s] All events were not matched for any targets. Send the message to %s. %s", msgId, c.UnmatchedQueueName, event)
+		if err := sendToQueue(ctx, src, c.UnmatchedQueueName, msg); err != nil {
+			return false, err
+		}
+	default:
+		log.Printf("[warn] [%s] All events were not matched for any targets. Leave the message, it will be received again. %s", msgId, event)
+		return true, nil
+	}
+	return false, nil
+}
+
+// maxMalformedPrefix is the length of the prefix of a malformed body in logs.
+const maxMalformedPrefix = 64
+
+// handleMalformed applies the malformed policy to the message whose body can't be parsed as an event.
+func handleMalformed(ctx context.Context, c *Config, src MessageSource, msg *Message, body []byte, completed *bool, err error) error {
+	msgId := CorrelationID(ctx)
+	prefix := body
+	if len(prefix) > maxMalformedPrefix {
+		prefix = prefix[:maxMalformedPrefix]
+	}
+	log.Printf("[error] [%s] Can't parse event from Body (%d bytes, starts with %q). %s", msgId, len(body), prefix, err)
+	switch c.malformed() {
+	case MalformedDLQ:
+		log.Printf("[warn] [%s] Send the malformed message to %s.", msgId, c.DeadLetterQueueName)
+		if err := sendToDeadLetterQueue(ctx, c, src, msg, err); err != nil {
+			return err
+		}
+	case MalformedDelete:
+		log.Printf("[warn] [%s] Delete the malformed message.", msgId)
+	default:
+		log.Printf("[warn] [%s] Leave the malformed message, it will be received again.", msgId)
+		return err
+	}
+	deleteMessage(ctx, src, msg)
+	*completed = true
+	return nil
+}
+
+// deleteMessage deletes the message with retries, and returns the last error when giving up.
+// A message which failed to be deleted will be received again, and its objects may be imported duplicately.
+func deleteMessage(ctx context.Context, src MessageSource, msg *Message) (err error) {
+	msgId := CorrelationID(ctx)
+	ctx, endSpan := startSpan(ctx, SpanDelete)
+	defer func() { endSpan(map[string]string{AttrMessageID: msg.ID}, err) }()
+	err = src.Delete(ctx, msg.Handle)
+	if err == nil {
+		tracef(ctx, TraceDeleted, "%s", msg.ID)
+		return nil
+	}
+	sqsDeleteFailures.Add(1)
+	log.Printf("[warn] [%s] Can't delete message. ReceiptHandle: %s Objects: %s. %s", msgId, msg.Handle, messageObjects(ctx), err)
+	// retry
+	for i := 1; i <= MaxDeleteRetry; i++ {
+		d := time.Duration(i*i) * DeleteRetryInterval
+		log.Printf("[info] [%s] Retry to delete after %s.", msgId, d)
+		time.Sleep(d)
+		err = src.Delete(ctx, msg.Handle)
+		if err == nil {
+			log.Printf("[info] [%s] Message was deleted successfuly.", msgId)
+			tracef(ctx, TraceDeleted, "%s", msg.ID)
+			return nil
+		}
+		sqsDeleteFailures.Add(1)
+		log.Printf("[warn] [%s] Can't delete message. ReceiptHandle: %s Objects: %s. %s", msgId, msg.Handle, messageObjects(ctx), err)
+	}
+	sqsDeleteGaveUp.Add(1)
+	log.Printf("[error] [%s] Max retry count reached. Giving up. The message will be received again. ReceiptHandle: %s Objects: %s", msgId, msg.Handle, messageObjects(ctx))
+	return err
+}
+
+type messageObjectsKey struct{}
+
+// withMessageObjects returns a context which has s3:// URIs of the records of the event, for logs of the message.
+func withMessageObjects(ctx context.Context, event Event) context.Context {
+	objects := make([]string, 0, len(event.Records))
+	for _, r := range event.Records {
+		objects = append(objects, fmt.Sprintf(S3URITemplate, r.S3.Bucket.Name, r.S3.Object.Key))
+	}
+	return context.WithValue(ctx, messageObjectsKey{}, strings.Join(objects, ", "))
+}
+
+func messageObjects(ctx context.Context) string {
+	if s, ok := ctx.Value(messageObjectsKey{}).(string); ok && s != "" {
+		return s
+	}
+	return "(unknown)"
+}
@@ -0,0 +1,102 @@
+// Package rintest provides fakes for testing programs which use Rin.
+package rintest
+
+import (
+	"context"
+	"strings"
+	"sync"
+)
+
+// Executor is an in-memory Executor of Rin. It records every statement passed to it, and fails
+// statements by errors injected with FailOn. Statements of a failed Exec are not committed,
+// like a transaction.
+type Executor struct {
+	mu        sync.Mutex
+	executed  []Statement
+	committed []Statement
+	failures  []failure
+}
+
+// Statement is a statement passed to Executor.
+type Statement struct {
+	DSN   string
+	Query string
+}
+
+type failure struct {
+	substr string
+	err    error
+}
+
+// NewExecutor returns an empty Executor.
+func NewExecutor() *Executor {
+	return &Executor{}
+}
+
+// FailOn makes statements which contain substr fail with err.
+func (e *Executor) FailOn(substr string, err error) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	e.failures = append(e.failures, failure{substr, err})
+}
+
+// Exec records the queries in order. It stops at the first query which fails by FailOn.
+func (e *Executor) Exec(ctx context.Context, dsn string, queries ...string) error {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	var tx []Statement
+	for _, query := range queries {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		st := Statement{DSN: dsn, Query: query}
+		e.executed = append(e.executed, st)
+		if err := e.failure(query); err != nil {
+			return err
+		}
+		tx = append(tx, st)
+	}
+	e.committed = append(e.committed, tx...)
+	return nil
+}
+
+func (e *Executor) failure(query string) error {
+	for _, f := range e.failures {
+		if strings.Contains(query, f.substr) {
+			return f.err
+		}
+	}
+	return nil
+}
+
+// Executed returns all statements passed to Exec, including failed ones.
+func (e *Executor) Executed() []Statement {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	return append([]Statement{}, e.executed...)
+}
+
+// Committed returns statements of Exec calls which succeeded.
+func (e *Executor) Committed() []Statement {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	return append([]Statement{}, e.committed...)
+}
+
+// Queries returns queries of committed statements.
+func (e *Executor) Queries() []string {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	queries := make([]string, len(e.committed))
+	for i, st := range e.committed {
+		queries[i] = st.Query
+	}
+	return queries
+}
+
+// Reset clears recorded statements and injected errors.
+func (e *Executor) Reset() {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	e.executed, e.committed, e.failures = nil, nil, nil
+}
@@ -0,0 +1,55 @@
+package rintest_test
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"testing"
+
+	"github.com/fujiwara/Rin/rintest"
+)
+
+func TestExecutor(t *testing.T) {
+	e := rintest.NewExecutor()
+	ctx := context.Background()
+	if err := e.Exec(ctx, "dsn1", "SET query_group TO 'rin'", "COPY foo"); err != nil {
+		t.Fatal(err)
+	}
+	errCopy := errors.New("COPY failed")
+	e.FailOn("COPY bar", errCopy)
+	if err := e.Exec(ctx, "dsn2", "COPY bar", "INSERT INTO loads"); err != errCopy {
+		t.Errorf("injected error must be returned: %v", err)
+	}
+
+	if n := len(e.Executed()); n != 3 {
+		t.Errorf("statements until the failure must be recorded: %v", e.Executed())
+	}
+	committed := e.Committed()
+	if len(committed) != 2 || committed[1].DSN != "dsn1" || committed[1].Query != "COPY foo" {
+		t.Errorf("only statements of succeeded Exec must be committed: %v", committed)
+	}
+
+	e.Reset()
+	if err := e.Exec(ctx, "dsn2", "COPY bar"); err != nil {
+		t.Errorf("injected errors must be cleared by Reset: %v", err)
+	}
+	if q := e.Queries(); len(q) != 1 || q[0] != "COPY bar" {
+		t.Errorf("unexpected queries %v", q)
+	}
+}
+
+func ExampleExecutor() {
+	e := rintest.NewExecutor()
+	e.FailOn(`"broken"`, errors.New("relation does not exist"))
+
+	// pass e to rin by RunOptions{Executor: e}, or as DefaultExecutor.
+	ctx := context.Background()
+	e.Exec(ctx, "dsn", `COPY "events" FROM 's3://bucket/key'`)
+	err := e.Exec(ctx, "dsn", `COPY "broken" FROM 's3://bucket/key'`)
+
+	fmt.Println(e.Queries())
+	fmt.Println(err)
+	// Output:
+	// [COPY "events" FROM 's3://bucket/key']
+	// relation does not exist
+}
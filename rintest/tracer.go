@@ -0,0 +1,61 @@
+package rintest
+
+import (
+	"context"
+	"sync"
+)
+
+// Tracer is an in-memory Tracer of Rin, like an in-memory exporter of OpenTelemetry.
+// It records spans when they are ended.
+type Tracer struct {
+	mu    sync.Mutex
+	next  int
+	spans []Span
+}
+
+// Span is a span ended in Tracer. Parent is the ID of the parent span, or 0 for a root span.
+type Span struct {
+	ID     int
+	Parent int
+	Name   string
+	Attrs  map[string]string
+	Err    error
+}
+
+type spanKey struct{}
+
+// NewTracer returns an empty Tracer.
+func NewTracer() *Tracer {
+	return &Tracer{}
+}
+
+// StartSpan starts a span as a child of the span in ctx.
+func (t *Tracer) StartSpan(ctx context.Context, name string) (context.Context, func(attrs map[string]string, err error)) {
+	t.mu.Lock()
+	t.next++
+	span := Span{ID: t.next, Name: name}
+	t.mu.Unlock()
+	if parent, ok := ctx.Value(spanKey{}).(int); ok {
+		span.Parent = parent
+	}
+	return context.WithValue(ctx, spanKey{}, span.ID), func(attrs map[string]string, err error) {
+		span.Attrs, span.Err = attrs, err
+		t.mu.Lock()
+		defer t.mu.Unlock()
+		t.spans = append(t.spans, span)
+	}
+}
+
+// Spans returns ended spans in the order of ending.
+func (t *Tracer) Spans() []Span {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return append([]Span{}, t.spans...)
+}
+
+// Reset clears recorded spans.
+func (t *Tracer) Reset() {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.spans = nil
+}
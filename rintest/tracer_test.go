@@ -0,0 +1,35 @@
+package rintest_test
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/fujiwara/Rin/rintest"
+)
+
+func TestTracer(t *testing.T) {
+	tr := rintest.NewTracer()
+	ctx, endParent := tr.StartSpan(context.Background(), "parent")
+	_, endChild := tr.StartSpan(ctx, "child")
+	errChild := errors.New("failed")
+	endChild(map[string]string{"k": "v"}, errChild)
+	endParent(nil, nil)
+
+	spans := tr.Spans()
+	if len(spans) != 2 {
+		t.Fatalf("unexpected spans %v", spans)
+	}
+	child, parent := spans[0], spans[1]
+	if child.Name != "child" || child.Parent != parent.ID || child.Attrs["k"] != "v" || child.Err != errChild {
+		t.Errorf("unexpected child span %v", child)
+	}
+	if parent.Name != "parent" || parent.Parent != 0 {
+		t.Errorf("unexpected parent span %v", parent)
+	}
+
+	tr.Reset()
+	if n := len(tr.Spans()); n != 0 {
+		t.Errorf("spans must be cleared by Reset: %d", n)
+	}
+}
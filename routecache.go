@@ -0,0 +1,88 @@
+package main
+
+import (
+	"container/list"
+	"strings"
+	"sync"
+)
+
+// routeCache is an LRU cache of candidate targets by the bucket and a prefix of keys which ends with "/".
+// A prefix is cached only when all keys which have the prefix have the same candidates.
+type routeCache struct {
+	mu      sync.Mutex
+	size    int
+	entries map[routeCacheKey]*list.Element
+	lru     *list.List
+}
+
+type routeCacheKey struct {
+	bucket *bucketIndex
+	prefix string
+}
+
+type routeCacheEntry struct {
+	key     routeCacheKey
+	targets []*Target
+}
+
+// newRouteCache returns a cache of the size. It returns nil when size is zero, and a nil cache caches nothing.
+func newRouteCache(size int) *routeCache {
+	if size <= 0 {
+		return nil
+	}
+	return &routeCache{
+		size:    size,
+		entries: make(map[routeCacheKey]*list.Element),
+		lru:     list.New(),
+	}
+}
+
+// get returns candidates of the key cached by a prefix of the key.
+func (c *routeCache) get(b *bucketIndex, key string) ([]*Target, bool) {
+	if c == nil {
+		return nil, false
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for i := 0; i < len(key); i++ {
+		if key[i] != '/' {
+			continue
+		}
+		if e, ok := c.entries[routeCacheKey{b, key[:i+1]}]; ok {
+			c.lru.MoveToFront(e)
+			routeCacheHits.Add(1)
+			return e.Value.(*routeCacheEntry).targets, true
+		}
+	}
+	routeCacheMisses.Add(1)
+	return nil, false
+}
+
+// put caches candidates of the key by the shortest prefix which ends with "/" and is not shorter than n,
+// the length of the prefix which determines the candidates.
+func (c *routeCache) put(b *bucketIndex, key string, n int, targets []*Target) {
+	if c == nil || n > len(key) {
+		return
+	}
+	start := n - 1
+	if start < 0 {
+		start = 0
+	}
+	i := strings.IndexByte(key[start:], '/')
+	if i < 0 {
+		return
+	}
+	k := routeCacheKey{b, key[:start+i+1]}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if e, ok := c.entries[k]; ok {
+		c.lru.MoveToFront(e)
+		return
+	}
+	c.entries[k] = c.lru.PushFront(&routeCacheEntry{key: k, targets: targets})
+	for c.lru.Len() > c.size {
+		e := c.lru.Back()
+		c.lru.Remove(e)
+		delete(c.entries, e.Value.(*routeCacheEntry).key)
+	}
+}
@@ -0,0 +1,68 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"log"
+	"strings"
+)
+
+// RouteTest writes targets matched by each object of the keys file (a path or URL) by FindTargets.
+// Each line of the file is a s3:// URI or a bucket and a key separated by spaces. Empty lines and lines starting with # are skipped.
+// Each line of the output is the s3:// URI and the tables of matched targets separated by a tab, "discard" for discard targets, or "-" for no targets.
+func RouteTest(configFile, keysFile string, w io.Writer) error {
+	log.Println("[info] Loading config:", configFile)
+	c, err := LoadConfig(configFile)
+	if err != nil {
+		return err
+	}
+	b, err := loadSrcFrom(keysFile)
+	if err != nil {
+		return fmt.Errorf("failed to read keys %s, %s", keysFile, err)
+	}
+	scanner := bufio.NewScanner(bytes.NewReader(b))
+	for n := 1; scanner.Scan(); n++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		bucket, key, ok := parseObjectLine(line)
+		if !ok {
+			return fmt.Errorf("%s:%d: %q is not a s3:// URI nor a bucket and a key", keysFile, n, line)
+		}
+		var r EventRecord
+		r.S3.Bucket.Name = bucket
+		r.S3.Object.Key = key
+		routes := []string{}
+		for _, t := range c.FindTargets(r) {
+			if t.Discard {
+				routes = append(routes, "discard")
+				continue
+			}
+			_, cap := t.Match(bucket, key)
+			routes = append(routes, t.plainTableName(cap))
+		}
+		if len(routes) == 0 {
+			routes = append(routes, "-")
+		}
+		fmt.Fprintf(w, S3URITemplate+"\t%s\n", bucket, key, strings.Join(routes, ","))
+	}
+	return scanner.Err()
+}
+
+func parseObjectLine(line string) (string, string, bool) {
+	if strings.HasPrefix(line, "s3://") {
+		parts := strings.SplitN(strings.TrimPrefix(line, "s3://"), "/", 2)
+		if len(parts) != 2 || parts[0] == "" || parts[1] == "" {
+			return "", "", false
+		}
+		return parts[0], parts[1], true
+	}
+	fields := strings.Fields(line)
+	if len(fields) != 2 {
+		return "", "", false
+	}
+	return fields[0], fields[1], true
+}
@@ -0,0 +1,27 @@
+package rin_test
+
+import (
+	"bytes"
+	"os"
+	"strings"
+	"testing"
+
+	rin "github.com/fujiwara/Rin"
+)
+
+func TestRouteTest(t *testing.T) {
+	os.Setenv("AWS_SECRET_ACCESS_KEY", "SSS")
+	var out bytes.Buffer
+	if err := rin.RouteTest("test/config.yml", "test/route_keys.txt", &out); err != nil {
+		t.Fatal(err)
+	}
+	expected := readFixture(t, "test/route_keys.golden")
+	if out.String() != expected {
+		t.Errorf("unexpected routes:\nExpected:\n%s\nGot:\n%s", expected, out.String())
+	}
+
+	err := rin.RouteTest("test/config.yml", "test/route_keys_invalid.txt", &out)
+	if err == nil || !strings.Contains(err.Error(), ":2: ") {
+		t.Errorf("an invalid line must be reported with the line number: %v", err)
+	}
+}
@@ -0,0 +1,233 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"mime"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/aws/aws-sdk-go/service/s3/s3iface"
+)
+
+// S3API is the S3 client used to inspect objects.
+// When nil, a client for the region of the bucket is created from Sessions.S3.
+var S3API s3iface.S3API
+
+func s3Client(region string) s3iface.S3API {
+	if S3API != nil {
+		return S3API
+	}
+	return s3.New(Sessions.S3, aws.NewConfig().WithRegion(region))
+}
+
+const FormatFromMetadata = "from-metadata"
+
+// ContentTypeFormats maps Content-Type of objects to COPY data format options.
+var ContentTypeFormats = map[string]string{
+	"application/json":               "JSON 'auto'",
+	"application/x-ndjson":           "JSON 'auto'",
+	"text/csv":                       "CSV",
+	"text/tab-separated-values":      "DELIMITER '\\t'",
+	"application/x-parquet":          "FORMAT AS PARQUET",
+	"application/vnd.apache.parquet": "FORMAT AS PARQUET",
+	"application/avro":               "FORMAT AS AVRO 'auto'",
+}
+
+// formatFromMetadata returns COPY data format options by Content-Type and Content-Encoding of the object.
+func formatFromMetadata(ctx context.Context, region, bucket, key string) (string, error) {
+	res, err := s3Client(region).HeadObjectWithContext(ctx, &s3.HeadObjectInput{
+		Bucket: aws.String(bucket),
+		Key:    aws.String(key),
+	})
+	if err != nil {
+		return "", fmt.Errorf("failed to head s3://%s/%s, %s", bucket, key, err)
+	}
+	contentType := aws.StringValue(res.ContentType)
+	mediaType, _, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		return "", fmt.Errorf("invalid Content-Type %q of s3://%s/%s", contentType, bucket, key)
+	}
+	format, ok := ContentTypeFormats[mediaType]
+	if !ok {
+		return "", fmt.Errorf("no format for Content-Type %q of s3://%s/%s", contentType, bucket, key)
+	}
+	if aws.StringValue(res.ContentEncoding) == "gzip" {
+		format = format + " GZIP"
+	}
+	return format, nil
+}
+
+// objectExists reports whether the object exists by HEAD.
+func objectExists(ctx context.Context, region, bucket, key string) (bool, error) {
+	_, err := s3Client(region).HeadObjectWithContext(ctx, &s3.HeadObjectInput{
+		Bucket: aws.String(bucket),
+		Key:    aws.String(key),
+	})
+	if err == nil {
+		return true, nil
+	}
+	if aerr, ok := err.(awserr.Error); ok && (aerr.Code() == "NotFound" || aerr.Code() == s3.ErrCodeNoSuchKey) {
+		return false, nil
+	}
+	return false, fmt.Errorf("failed to head s3://%s/%s, %s", bucket, key, err)
+}
+
+// ArchivedStorageClasses are storage classes of objects which can't be read by COPY without restoring.
+var ArchivedStorageClasses = []string{s3.StorageClassGlacier, "DEEP_ARCHIVE"}
+
+func isArchivedClass(class string) bool {
+	for _, c := range ArchivedStorageClasses {
+		if class == c {
+			return true
+		}
+	}
+	return false
+}
+
+// archivedClass returns the storage class of the object when it is archived and not restored.
+// The storage class of the record is used when present, otherwise the object is HEADed by head_storage_class.
+func archivedClass(ctx context.Context, target *Target, record *EventRecord) (string, error) {
+	if class := record.S3.Object.StorageClass; class != "" || !target.HeadStorageClass {
+		if isArchivedClass(class) {
+			return class, nil
+		}
+		return "", nil
+	}
+	bucket, key := record.S3.Bucket.Name, record.S3.Object.Key
+	res, err := s3Client(target.S3.Region).HeadObjectWithContext(ctx, &s3.HeadObjectInput{
+		Bucket: aws.String(bucket),
+		Key:    aws.String(key),
+	})
+	if err != nil {
+		return "", fmt.Errorf("failed to head s3://%s/%s, %s", bucket, key, err)
+	}
+	class := aws.StringValue(res.StorageClass)
+	if !isArchivedClass(class) || strings.Contains(aws.StringValue(res.Restore), `ongoing-request="false"`) {
+		// STANDARD is omitted, and a restored copy can be read
+		return "", nil
+	}
+	return class, nil
+}
+
+// PayloadS3PointerClasses are class names of S3 pointers written by the SQS extended client libraries
+// instead of message bodies over the size limit of SQS.
+var PayloadS3PointerClasses = []string{
+	"software.amazon.payloadoffloading.PayloadS3Pointer",
+	"com.amazon.sqs.javamessaging.MessageS3Pointer",
+}
+
+type payloadS3Pointer struct {
+	Bucket string `json:"s3BucketName"`
+	Key    string `json:"s3Key"`
+}
+
+// parsePayloadS3Pointer parses b as an S3 pointer of the extended client. It returns nil when b is not a pointer.
+func parsePayloadS3Pointer(b []byte) *payloadS3Pointer {
+	b = bytes.TrimSpace(b)
+	if len(b) == 0 || b[0] != '[' {
+		return nil
+	}
+	var v []json.RawMessage
+	if err := json.Unmarshal(b, &v); err != nil || len(v) != 2 {
+		return nil
+	}
+	var class string
+	if err := json.Unmarshal(v[0], &class); err != nil {
+		return nil
+	}
+	for _, c := range PayloadS3PointerClasses {
+		if class != c {
+			continue
+		}
+		var p payloadS3Pointer
+		if err := json.Unmarshal(v[1], &p); err != nil || p.Bucket == "" || p.Key == "" {
+			return nil
+		}
+		return &p
+	}
+	return nil
+}
+
+// messageBody returns the body of the message. When the body is an S3 pointer of the extended client,
+// it returns the payload fetched from S3.
+func messageBody(ctx context.Context, c *Config, msg *Message) ([]byte, error) {
+	b := []byte(msg.Body)
+	p := parsePayloadS3Pointer(b)
+	if p == nil {
+		return b, nil
+	}
+	log.Printf("[info] [%s] Fetching the message body from s3://%s/%s", CorrelationID(ctx), p.Bucket, p.Key)
+	res, err := s3Client(c.bucketRegion(p.Bucket)).GetObjectWithContext(ctx, &s3.GetObjectInput{
+		Bucket: aws.String(p.Bucket),
+		Key:    aws.String(p.Key),
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to get the message body from s3://%s/%s, %s", p.Bucket, p.Key, err)
+	}
+	defer res.Body.Close()
+	return ioutil.ReadAll(res.Body)
+}
+
+// ObjectTagsCacheTTL is duration to cache tags of objects read for object_tags of targets.
+var ObjectTagsCacheTTL = time.Minute
+
+type cachedTags struct {
+	tags      map[string]string
+	expiresAt time.Time
+}
+
+var tagsCache = struct {
+	sync.Mutex
+	entries map[string]cachedTags
+}{entries: make(map[string]cachedTags)}
+
+// objectTags returns tags of the object by GetObjectTagging. Tags are cached for ObjectTagsCacheTTL.
+func objectTags(ctx context.Context, region, bucket, key string) (map[string]string, error) {
+	name := fmt.Sprintf(S3URITemplate, bucket, key)
+	now := time.Now()
+	tagsCache.Lock()
+	e, ok := tagsCache.entries[name]
+	tagsCache.Unlock()
+	if ok && now.Before(e.expiresAt) {
+		return e.tags, nil
+	}
+	res, err := s3Client(region).GetObjectTaggingWithContext(ctx, &s3.GetObjectTaggingInput{
+		Bucket: aws.String(bucket),
+		Key:    aws.String(key),
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to get tags of %s, %s", name, err)
+	}
+	tags := make(map[string]string, len(res.TagSet))
+	for _, t := range res.TagSet {
+		tags[aws.StringValue(t.Key)] = aws.StringValue(t.Value)
+	}
+	tagsCache.Lock()
+	defer tagsCache.Unlock()
+	for k, e := range tagsCache.entries {
+		if !now.Before(e.expiresAt) {
+			delete(tagsCache.entries, k)
+		}
+	}
+	tagsCache.entries[name] = cachedTags{tags, now.Add(ObjectTagsCacheTTL)}
+	return tags, nil
+}
+
+// tagsMatch reports whether tags have all values of required.
+func tagsMatch(tags, required map[string]string) bool {
+	for k, v := range required {
+		if tv, ok := tags[k]; !ok || tv != v {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,302 @@
+package rin_test
+
+import (
+	"context"
+	"io/ioutil"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/aws/request"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/aws/aws-sdk-go/service/s3/s3iface"
+	rin "github.com/fujiwara/Rin"
+)
+
+type mockS3 struct {
+	s3iface.S3API
+	head    *s3.HeadObjectOutput
+	headErr error
+	heads   []string
+	objects map[string]string
+	gets    []string
+	tags    map[string]map[string]string
+	tagGets []string
+}
+
+func (m *mockS3) GetObjectTaggingWithContext(ctx aws.Context, in *s3.GetObjectTaggingInput, opts ...request.Option) (*s3.GetObjectTaggingOutput, error) {
+	name := *in.Bucket + "/" + *in.Key
+	m.tagGets = append(m.tagGets, name)
+	tags, ok := m.tags[name]
+	if !ok {
+		return nil, awserr.New(s3.ErrCodeNoSuchKey, "The specified key does not exist.", nil)
+	}
+	out := &s3.GetObjectTaggingOutput{}
+	for k, v := range tags {
+		out.TagSet = append(out.TagSet, &s3.Tag{Key: aws.String(k), Value: aws.String(v)})
+	}
+	return out, nil
+}
+
+func (m *mockS3) GetObjectWithContext(ctx aws.Context, in *s3.GetObjectInput, opts ...request.Option) (*s3.GetObjectOutput, error) {
+	m.gets = append(m.gets, *in.Bucket+"/"+*in.Key)
+	body, ok := m.objects[*in.Bucket+"/"+*in.Key]
+	if !ok {
+		return nil, awserr.New(s3.ErrCodeNoSuchKey, "The specified key does not exist.", nil)
+	}
+	return &s3.GetObjectOutput{Body: ioutil.NopCloser(strings.NewReader(body))}, nil
+}
+
+func (m *mockS3) HeadObjectWithContext(ctx aws.Context, in *s3.HeadObjectInput, opts ...request.Option) (*s3.HeadObjectOutput, error) {
+	m.heads = append(m.heads, *in.Key)
+	if m.headErr != nil {
+		return nil, m.headErr
+	}
+	return m.head, nil
+}
+
+func useMockS3(t *testing.T, m *mockS3) {
+	orig := rin.S3API
+	rin.S3API = m
+	t.Cleanup(func() { rin.S3API = orig })
+}
+
+func TestFormatFromMetadata(t *testing.T) {
+	config := loadTestConfig(t, "test/config.yml")
+	config.Targets[1].Format = rin.FormatFromMetadata
+	config.Targets[1].SQLOption = ""
+	fe := useFakeExecutor(t)
+	m := &mockS3{head: &s3.HeadObjectOutput{
+		ContentType:     aws.String("text/csv; charset=utf-8"),
+		ContentEncoding: aws.String("gzip"),
+	}}
+	useMockS3(t, m)
+
+	event, err := rin.ParseEvent([]byte(readFixture(t, "test/notification.json")))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := rin.ImportWithContext(context.Background(), config, event); err != nil {
+		t.Fatal(err)
+	}
+	if len(m.heads) != 1 || m.heads[0] != "test/foo/bar.json" {
+		t.Errorf("unexpected HEAD requests %v", m.heads)
+	}
+	expected := `/* Rin */ COPY "foo" FROM 's3://test.bucket.test/test/foo/bar.json' CREDENTIALS 'aws_access_key_id=AAA;aws_secret_access_key=SSS' REGION 'ap-northeast-1' CSV GZIP`
+	if len(fe.queries) != 1 || fe.queries[0] != expected {
+		t.Errorf("unexpected SQL:\nExpected:%s\nGot:%v", expected, fe.queries)
+	}
+}
+
+func TestCheckExists(t *testing.T) {
+	config := loadTestConfig(t, "test/config.yml")
+	config.Targets[1].CheckExists = true
+	fe := useFakeExecutor(t)
+	m := &mockS3{headErr: awserr.New("NotFound", "Not Found", nil)}
+	useMockS3(t, m)
+
+	body := readFixture(t, "test/notification.json")
+	src := rin.NewMemorySource(body)
+	if err := rin.RunWithSource(context.Background(), config, src, true); err != nil {
+		t.Fatal(err)
+	}
+	if len(m.heads) != 1 || m.heads[0] != "test/foo/bar.json" {
+		t.Errorf("unexpected HEAD requests %v", m.heads)
+	}
+	if len(fe.queries) != 0 {
+		t.Errorf("COPY must not be executed for missing object: %v", fe.queries)
+	}
+	if n := len(src.Deleted()); n != 1 {
+		t.Errorf("message for missing object must be deleted: %d", n)
+	}
+
+	m.headErr = nil
+	m.head = &s3.HeadObjectOutput{}
+	src = rin.NewMemorySource(body)
+	if err := rin.RunWithSource(context.Background(), config, src, true); err != nil {
+		t.Fatal(err)
+	}
+	if len(fe.queries) != 1 {
+		t.Errorf("COPY must be executed for existing object: %v", fe.queries)
+	}
+}
+
+func TestRunWithPayloadS3Pointer(t *testing.T) {
+	config := loadTestConfig(t, "test/config.yml")
+	fe := useFakeExecutor(t)
+	m := &mockS3{objects: map[string]string{
+		"rin-large-payloads/c8d1b1d0-8d6b-4d6a-9d1c-6c1d0f6b2b3a": readFixture(t, "test/notification.json"),
+	}}
+	useMockS3(t, m)
+
+	src := rin.NewMemorySource(
+		readFixture(t, "test/message.s3_pointer.json"),
+		readFixture(t, "test/notification.json"),
+	)
+	if err := rin.RunWithSource(context.Background(), config, src, true); err != nil {
+		t.Fatal(err)
+	}
+	if len(m.gets) != 1 {
+		t.Errorf("the payload must be fetched once: %v", m.gets)
+	}
+	if len(fe.queries) != 2 || fe.queries[0] != fe.queries[1] {
+		t.Errorf("the pointed payload must be imported as the inline body: %v", fe.queries)
+	}
+	if n := len(src.Deleted()); n != 2 {
+		t.Errorf("unexpected deleted messages %d", n)
+	}
+
+	// a missing payload leaves the message
+	m.objects = nil
+	src = rin.NewMemorySource(readFixture(t, "test/message.s3_pointer.json"))
+	if err := rin.RunWithSource(context.Background(), config, src, true); err != nil {
+		t.Fatal(err)
+	}
+	if n := len(src.InFlight()); n != 1 {
+		t.Errorf("message of a missing payload must not be deleted: %d", n)
+	}
+}
+
+func TestMaxInFlightBytesOfPayloadS3Pointer(t *testing.T) {
+	config := loadTestConfig(t, "test/config.yml")
+	payload := readFixture(t, "test/notification.json") + strings.Repeat(" ", 4096)
+	config.MaxInFlightBytes = 1024
+	useMockS3(t, &mockS3{objects: map[string]string{
+		"rin-large-payloads/c8d1b1d0-8d6b-4d6a-9d1c-6c1d0f6b2b3a": payload,
+	}})
+	be := &blockingExecutor{started: make(chan string), release: make(chan struct{})}
+	orig := rin.DefaultExecutor
+	rin.DefaultExecutor = be
+	defer func() { rin.DefaultExecutor = orig }()
+
+	src := rin.NewMemorySource(readFixture(t, "test/message.s3_pointer.json"))
+	done := make(chan error)
+	go func() {
+		done <- rin.RunWithSource(context.Background(), config, src, true)
+	}()
+	select {
+	case <-be.started:
+	case <-time.After(3 * time.Second):
+		t.Fatal("COPY was not started")
+	}
+	if n := rin.InFlightBytes(); n != int64(len(payload)) {
+		t.Errorf("the fetched payload must be counted in flight: %d bytes, want %d", n, len(payload))
+	}
+	close(be.release)
+	if err := <-done; err != nil {
+		t.Fatal(err)
+	}
+	if n := rin.InFlightBytes(); n != 0 {
+		t.Errorf("bytes in flight must be released: %d", n)
+	}
+}
+
+func TestImportObjectTags(t *testing.T) {
+	config := loadConfigWith(t, `targets:
+  - redshift:
+      table: orders
+    s3:
+      key_prefix: test/tagged/
+    object_tags:
+      dataset: orders
+    break: true
+
+  - redshift:
+      table: users
+    s3:
+      key_prefix: test/tagged/
+    object_tags:
+      dataset: users
+    break: true
+`)
+	m := &mockS3{tags: map[string]map[string]string{
+		"test.bucket.test/test/tagged/a.json": {"dataset": "users", "owner": "x"},
+		"test.bucket.test/test/tagged/b.json": {"dataset": "orders"},
+		"test.bucket.test/test/tagged/c.json": {},
+	}}
+	useMockS3(t, m)
+	tests := []struct {
+		key   string
+		table string
+	}{
+		{"test/tagged/a.json", "users"},
+		{"test/tagged/b.json", "orders"},
+		{"test/tagged/c.json", ""},
+		{"test/tagged/a.json", "users"},
+	}
+	for _, tt := range tests {
+		fe := useFakeExecutor(t)
+		event := rin.Event{Records: []*rin.EventRecord{{}}}
+		event.Records[0].S3.Bucket.Name = "test.bucket.test"
+		event.Records[0].S3.Object.Key = tt.key
+		if _, err := rin.ImportWithContext(context.Background(), config, event); err != nil {
+			t.Fatal(err)
+		}
+		if tt.table == "" {
+			if len(fe.queries) != 0 {
+				t.Errorf("%s: must not match any targets: %v", tt.key, fe.queries)
+			}
+		} else if len(fe.queries) != 1 || countQueries(fe.queries, tt.table) != 1 {
+			t.Errorf("%s: must be imported to %s: %v", tt.key, tt.table, fe.queries)
+		}
+	}
+	if len(m.tagGets) != 3 {
+		t.Errorf("tags must be read once per object: %v", m.tagGets)
+	}
+
+	event := rin.Event{Records: []*rin.EventRecord{{}}}
+	event.Records[0].S3.Bucket.Name = "test.bucket.test"
+	event.Records[0].S3.Object.Key = "test/tagged/missing.json"
+	if _, err := rin.ImportWithContext(context.Background(), config, event); err == nil {
+		t.Error("import must be failed when tags can't be read")
+	}
+}
+
+func TestSkipArchived(t *testing.T) {
+	config := loadTestConfig(t, "test/config.yml")
+	for _, target := range config.Targets {
+		target.SkipArchived = true
+	}
+	fe := useFakeExecutor(t)
+	m := &mockS3{head: &s3.HeadObjectOutput{StorageClass: aws.String("DEEP_ARCHIVE")}}
+	useMockS3(t, m)
+	archived := `{"Records":[{"eventName":"ObjectCreated:Put","s3":{"bucket":{"name":"test.bucket.test"},"object":{"key":"test/foo/x.json","size":10,"storageClass":"GLACIER"}}}]}`
+	standard := `{"Records":[{"eventName":"ObjectCreated:Put","s3":{"bucket":{"name":"test.bucket.test"},"object":{"key":"test/foo/y.json","size":10,"storageClass":"STANDARD"}}}]}`
+	unknown := `{"Records":[{"eventName":"ObjectCreated:Put","s3":{"bucket":{"name":"test.bucket.test"},"object":{"key":"test/foo/z.json","size":10}}}]}`
+	src := rin.NewMemorySource(archived, standard, unknown)
+	if err := rin.RunWithSource(context.Background(), config, src, true); err != nil {
+		t.Fatal(err)
+	}
+	if len(fe.queries) != 2 || !strings.Contains(fe.queries[0], "test/foo/y.json") || !strings.Contains(fe.queries[1], "test/foo/z.json") {
+		t.Errorf("only the archived object must be skipped: %v", fe.queries)
+	}
+	if n := len(src.Deleted()); n != 3 {
+		t.Errorf("the skipped message must be deleted: %d", n)
+	}
+	if len(m.heads) != 0 {
+		t.Errorf("objects must not be HEADed without head_storage_class: %v", m.heads)
+	}
+
+	// by HEAD
+	for _, target := range config.Targets {
+		target.HeadStorageClass = true
+	}
+	fe.queries = nil
+	src = rin.NewMemorySource(unknown)
+	if err := rin.RunWithSource(context.Background(), config, src, true); err != nil {
+		t.Fatal(err)
+	}
+	if len(fe.queries) != 0 || len(m.heads) != 1 {
+		t.Errorf("the archived object must be skipped by HEAD: %v %v", fe.queries, m.heads)
+	}
+	m.head.Restore = aws.String(`ongoing-request="false", expiry-date="Fri, 21 Dec 2012 00:00:00 GMT"`)
+	src = rin.NewMemorySource(unknown)
+	if err := rin.RunWithSource(context.Background(), config, src, true); err != nil {
+		t.Fatal(err)
+	}
+	if len(fe.queries) != 1 {
+		t.Errorf("the restored object must be imported: %v", fe.queries)
+	}
+}
@@ -0,0 +1,388 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/service/sqs"
+	"github.com/aws/aws-sdk-go/service/sqs/sqsiface"
+)
+
+// Message is a message received from a MessageSource.
+type Message struct {
+	ID     string
+	Handle string
+	Body   string
+
+	// Attributes are SQS system attributes, and MessageAttributes are string values of SQS message attributes.
+	Attributes        map[string]string
+	MessageAttributes map[string]string
+}
+
+// ReceiveCount returns ApproximateReceiveCount of the message, or 0 when it is not received.
+func (m *Message) ReceiveCount() int {
+	n, _ := strconv.Atoi(m.Attributes[sqs.MessageSystemAttributeNameApproximateReceiveCount])
+	return n
+}
+
+// DeduplicationID returns MessageDeduplicationId of the message received from a FIFO queue, or an empty string.
+func (m *Message) DeduplicationID() string {
+	return m.Attributes[sqs.MessageSystemAttributeNameMessageDeduplicationId]
+}
+
+// SentAt returns SentTimestamp of the message, or zero time when it is not received.
+func (m *Message) SentAt() time.Time {
+	ms, err := strconv.ParseInt(m.Attributes[sqs.MessageSystemAttributeNameSentTimestamp], 10, 64)
+	if err != nil {
+		return time.Time{}
+	}
+	return time.Unix(0, ms*int64(time.Millisecond))
+}
+
+// MessageSource is a source of S3 event messages.
+type MessageSource interface {
+	// Receive returns a message. It returns NoMessageError when no messages are available.
+	Receive(ctx context.Context) (*Message, error)
+	// Delete deletes a message identified by the handle.
+	Delete(ctx context.Context, handle string) error
+}
+
+// DeadLetterSource is a MessageSource which can send a message to another queue.
+type DeadLetterSource interface {
+	MessageSource
+	// SendToQueue sends a copy of the message with its MessageAttributes to the queue.
+	SendToQueue(ctx context.Context, queueName string, msg *Message) error
+}
+
+// RetrySource is a MessageSource which can send a message to another queue with a delay of delivery.
+type RetrySource interface {
+	MessageSource
+	// SendToQueueWithDelay sends a copy of the message with its MessageAttributes to the queue, delivered after the delay.
+	SendToQueueWithDelay(ctx context.Context, queueName string, msg *Message, delay time.Duration) error
+}
+
+// VisibilitySource is a MessageSource which can extend the visibility timeout of a message in flight.
+type VisibilitySource interface {
+	MessageSource
+	// ChangeVisibility makes the message invisible for the timeout from now.
+	ChangeVisibility(ctx context.Context, handle string, timeout time.Duration) error
+}
+
+// SQSSource is a MessageSource which receives messages from a SQS queue.
+type SQSSource struct {
+	svc       sqsiface.SQSAPI
+	queueName string
+	mu        sync.Mutex
+	queueUrl  *string
+
+	attributeNames        []string
+	messageAttributeNames []string
+	visibilityTimeout     int64
+	waitTimeSeconds       int64
+}
+
+// SetWaitTimeSeconds sets the wait time in seconds of long polling by Receive. 0 uses the default of the queue.
+func (s *SQSSource) SetWaitTimeSeconds(sec int64) {
+	s.waitTimeSeconds = sec
+}
+
+// SetVisibilityTimeout sets the visibility timeout in seconds of received messages. 0 uses the default of the queue.
+func (s *SQSSource) SetVisibilityTimeout(sec int64) {
+	s.visibilityTimeout = sec
+}
+
+// SetAttributeNames sets names of system attributes and message attributes requested by Receive.
+func (s *SQSSource) SetAttributeNames(attributeNames, messageAttributeNames []string) {
+	s.attributeNames, s.messageAttributeNames = attributeNames, messageAttributeNames
+}
+
+func NewSQSSource(ctx context.Context, svc sqsiface.SQSAPI, queueName string) (*SQSSource, error) {
+	log.Println("[info] Connect to SQS:", queueName)
+	res, err := svc.GetQueueUrlWithContext(ctx, &sqs.GetQueueUrlInput{
+		QueueName: aws.String(queueName),
+	})
+	if err != nil {
+		if ae, ok := err.(awserr.Error); ok && ae.Code() == sqs.ErrCodeQueueDoesNotExist {
+			return nil, &ConfigError{Err: fmt.Errorf("queue %s not found. %s", queueName, err)}
+		}
+		return nil, err
+	}
+	return &SQSSource{svc: svc, queueName: queueName, queueUrl: res.QueueUrl}, nil
+}
+
+// NewLazySQSSource returns a SQSSource which resolves the URL of the queue at the first use instead of at startup.
+// Errors of the resolution are returned by each call until resolved.
+func NewLazySQSSource(svc sqsiface.SQSAPI, queueName string) *SQSSource {
+	log.Println("[info] Connect to SQS without checking the queue:", queueName)
+	return &SQSSource{svc: svc, queueName: queueName}
+}
+
+func (s *SQSSource) url(ctx context.Context) (*string, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.queueUrl != nil {
+		return s.queueUrl, nil
+	}
+	u, err := queueURL(ctx, s.svc, s.queueName)
+	if err != nil {
+		return nil, err
+	}
+	s.queueUrl = u
+	return u, nil
+}
+
+func (s *SQSSource) Receive(ctx context.Context) (*Message, error) {
+	u, err := s.url(ctx)
+	if err != nil {
+		return nil, err
+	}
+	in := &sqs.ReceiveMessageInput{
+		MaxNumberOfMessages: aws.Int64(1),
+		QueueUrl:            u,
+	}
+	if s.visibilityTimeout > 0 {
+		in.VisibilityTimeout = aws.Int64(s.visibilityTimeout)
+	}
+	if s.waitTimeSeconds > 0 {
+		in.WaitTimeSeconds = aws.Int64(s.waitTimeSeconds)
+	}
+	if len(s.attributeNames) > 0 {
+		in.AttributeNames = aws.StringSlice(s.attributeNames)
+	}
+	if len(s.messageAttributeNames) > 0 {
+		in.MessageAttributeNames = aws.StringSlice(s.messageAttributeNames)
+	}
+	res, err := s.svc.ReceiveMessageWithContext(ctx, in)
+	if err != nil {
+		return nil, err
+	}
+	if len(res.Messages) == 0 {
+		return nil, NoMessageError{"No messages"}
+	}
+	msg := res.Messages[0]
+	m := &Message{
+		ID:                aws.StringValue(msg.MessageId),
+		Handle:            aws.StringValue(msg.ReceiptHandle),
+		Body:              aws.StringValue(msg.Body),
+		Attributes:        aws.StringValueMap(msg.Attributes),
+		MessageAttributes: make(map[string]string, len(msg.MessageAttributes)),
+	}
+	for name, v := range msg.MessageAttributes {
+		if v.StringValue != nil {
+			m.MessageAttributes[name] = *v.StringValue
+		}
+	}
+	return m, nil
+}
+
+func (s *SQSSource) Delete(ctx context.Context, handle string) error {
+	u, err := s.url(ctx)
+	if err != nil {
+		return err
+	}
+	_, err = s.svc.DeleteMessageWithContext(ctx, &sqs.DeleteMessageInput{
+		QueueUrl:      u,
+		ReceiptHandle: aws.String(handle),
+	})
+	return err
+}
+
+func (s *SQSSource) ChangeVisibility(ctx context.Context, handle string, timeout time.Duration) error {
+	u, err := s.url(ctx)
+	if err != nil {
+		return err
+	}
+	_, err = s.svc.ChangeMessageVisibilityWithContext(ctx, &sqs.ChangeMessageVisibilityInput{
+		QueueUrl:          u,
+		ReceiptHandle:     aws.String(handle),
+		VisibilityTimeout: aws.Int64(int64(timeout / time.Second)),
+	})
+	return err
+}
+
+func (s *SQSSource) SendToQueue(ctx context.Context, queueName string, msg *Message) error {
+	res, err := s.svc.GetQueueUrlWithContext(ctx, &sqs.GetQueueUrlInput{
+		QueueName: aws.String(queueName),
+	})
+	if err != nil {
+		return err
+	}
+	in := &sqs.SendMessageInput{
+		QueueUrl:    res.QueueUrl,
+		MessageBody: aws.String(msg.Body),
+	}
+	if len(msg.MessageAttributes) > 0 {
+		in.MessageAttributes = messageAttributeValues(msg)
+	}
+	_, err = s.svc.SendMessageWithContext(ctx, in)
+	return err
+}
+
+func (s *SQSSource) SendToQueueWithDelay(ctx context.Context, queueName string, msg *Message, delay time.Duration) error {
+	res, err := s.svc.GetQueueUrlWithContext(ctx, &sqs.GetQueueUrlInput{
+		QueueName: aws.String(queueName),
+	})
+	if err != nil {
+		return err
+	}
+	_, err = s.svc.SendMessageWithContext(ctx, &sqs.SendMessageInput{
+		QueueUrl:          res.QueueUrl,
+		MessageBody:       aws.String(msg.Body),
+		MessageAttributes: messageAttributeValues(msg),
+		DelaySeconds:      aws.Int64(int64(delay / time.Second)),
+	})
+	return err
+}
+
+func messageAttributeValues(msg *Message) map[string]*sqs.MessageAttributeValue {
+	attrs := make(map[string]*sqs.MessageAttributeValue, len(msg.MessageAttributes))
+	for name, v := range msg.MessageAttributes {
+		attrs[name] = &sqs.MessageAttributeValue{
+			DataType:    aws.String("String"),
+			StringValue: aws.String(v),
+		}
+	}
+	return attrs
+}
+
+// MemorySource is an in-memory MessageSource for testing.
+// Received messages stay in flight until deleted.
+type MemorySource struct {
+	mu       sync.Mutex
+	seq      int
+	queue    []*Message
+	inFlight map[string]*Message
+	deleted  []*Message
+	sent     map[string][]*Message
+	delays   map[string][]time.Duration
+	timeouts map[string][]time.Duration
+}
+
+func NewMemorySource(bodies ...string) *MemorySource {
+	s := &MemorySource{
+		inFlight: make(map[string]*Message),
+		sent:     make(map[string][]*Message),
+		delays:   make(map[string][]time.Duration),
+		timeouts: make(map[string][]time.Duration),
+	}
+	for _, body := range bodies {
+		s.Add(body)
+	}
+	return s
+}
+
+// Add enqueues a message which has the body.
+func (s *MemorySource) Add(body string) {
+	s.AddMessage(&Message{Body: body})
+}
+
+// AddMessage enqueues the message. ID and Handle of the message are assigned by the source.
+func (s *MemorySource) AddMessage(msg *Message) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.seq++
+	id := strconv.Itoa(s.seq)
+	msg.ID, msg.Handle = id, "handle-"+id
+	s.queue = append(s.queue, msg)
+}
+
+func (s *MemorySource) Receive(ctx context.Context) (*Message, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if len(s.queue) == 0 {
+		return nil, NoMessageError{"No messages"}
+	}
+	msg := s.queue[0]
+	s.queue = s.queue[1:]
+	s.inFlight[msg.Handle] = msg
+	return msg, nil
+}
+
+func (s *MemorySource) Delete(ctx context.Context, handle string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	msg, ok := s.inFlight[handle]
+	if !ok {
+		return fmt.Errorf("message not found for handle %s", handle)
+	}
+	delete(s.inFlight, handle)
+	s.deleted = append(s.deleted, msg)
+	return nil
+}
+
+// Len returns the number of messages not received yet.
+func (s *MemorySource) Len() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return len(s.queue)
+}
+
+// Deleted returns messages deleted from the source.
+func (s *MemorySource) Deleted() []*Message {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]*Message{}, s.deleted...)
+}
+
+// InFlight returns messages received but not deleted yet.
+func (s *MemorySource) InFlight() []*Message {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	msgs := make([]*Message, 0, len(s.inFlight))
+	for _, msg := range s.inFlight {
+		msgs = append(msgs, msg)
+	}
+	return msgs
+}
+
+func (s *MemorySource) SendToQueue(ctx context.Context, queueName string, msg *Message) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.sent[queueName] = append(s.sent[queueName], msg)
+	return nil
+}
+
+// Sent returns messages sent to the queue by SendToQueue or SendToQueueWithDelay.
+func (s *MemorySource) Sent(queueName string) []*Message {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]*Message{}, s.sent[queueName]...)
+}
+
+func (s *MemorySource) SendToQueueWithDelay(ctx context.Context, queueName string, msg *Message, delay time.Duration) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.sent[queueName] = append(s.sent[queueName], msg)
+	s.delays[queueName] = append(s.delays[queueName], delay)
+	return nil
+}
+
+// Delays returns delays of messages sent to the queue by SendToQueueWithDelay.
+func (s *MemorySource) Delays(queueName string) []time.Duration {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]time.Duration{}, s.delays[queueName]...)
+}
+
+func (s *MemorySource) ChangeVisibility(ctx context.Context, handle string, timeout time.Duration) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, ok := s.inFlight[handle]; !ok {
+		return fmt.Errorf("message not found for handle %s", handle)
+	}
+	s.timeouts[handle] = append(s.timeouts[handle], timeout)
+	return nil
+}
+
+// VisibilityChanges returns timeouts of the message in flight changed by ChangeVisibility.
+func (s *MemorySource) VisibilityChanges(handle string) []time.Duration {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]time.Duration{}, s.timeouts[handle]...)
+}
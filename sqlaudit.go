@@ -0,0 +1,78 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"sync"
+	"time"
+)
+
+// SQLAuditRecord is a line of sql_audit_file, written before the statement is executed.
+type SQLAuditRecord struct {
+	Time          time.Time `json:"time"`
+	CorrelationID string    `json:"correlation_id"`
+	Target        string    `json:"target"`
+	SQL           string    `json:"sql"`
+}
+
+var sqlAudit = &sqlAuditFile{}
+
+// sqlAuditFile appends records to the file of the path, and reopens it when the path is changed by reloading.
+type sqlAuditFile struct {
+	mu   sync.Mutex
+	path string
+	f    *os.File
+}
+
+func (a *sqlAuditFile) write(path string, records []SQLAuditRecord) error {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if a.f == nil || a.path != path {
+		if a.f != nil {
+			a.f.Close()
+		}
+		f, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0600)
+		if err != nil {
+			a.f = nil
+			return err
+		}
+		a.f, a.path = f, path
+	}
+	var b []byte
+	for _, r := range records {
+		line, err := json.Marshal(r)
+		if err != nil {
+			return err
+		}
+		b = append(append(b, line...), '\n')
+	}
+	if _, err := a.f.Write(b); err != nil {
+		return err
+	}
+	// the records must survive a crash during the execution
+	return a.f.Sync()
+}
+
+// auditSQL appends the statements to sql_audit_file before they are executed. Credentials must be redacted by the caller.
+// The statements must not be executed when it fails, because they would not be archived.
+func auditSQL(ctx context.Context, c *Config, target *Target, statements []string) error {
+	if c.SQLAuditFile == "" {
+		return nil
+	}
+	now := time.Now()
+	records := make([]SQLAuditRecord, 0, len(statements))
+	for _, s := range statements {
+		records = append(records, SQLAuditRecord{
+			Time:          now,
+			CorrelationID: CorrelationID(ctx),
+			Target:        target.String(),
+			SQL:           s,
+		})
+	}
+	if err := sqlAudit.write(c.SQLAuditFile, records); err != nil {
+		return fmt.Errorf("failed to write sql_audit_file %s, %s", c.SQLAuditFile, err)
+	}
+	return nil
+}
@@ -0,0 +1,76 @@
+package main
+
+import (
+	"context"
+	"log"
+	"sync"
+	"time"
+)
+
+// stall detects that messages are received but none of them are processed.
+var stall = &stallDetector{}
+
+type stallDetector struct {
+	mu sync.Mutex
+	// since is the time when the first message was received after the last processed message.
+	since  time.Time
+	warned bool
+}
+
+func (d *stallDetector) reset() {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.since = time.Time{}
+	d.warned = false
+}
+
+func (d *stallDetector) received(now time.Time) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if d.since.IsZero() {
+		d.since = now
+	}
+}
+
+func (d *stallDetector) processed() {
+	d.reset()
+}
+
+// stalled returns the time since messages are not processed, when it exceeds the window.
+func (d *stallDetector) stalled(now time.Time, window time.Duration) (time.Duration, bool) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if window <= 0 || d.since.IsZero() {
+		return 0, false
+	}
+	elapsed := now.Sub(d.since)
+	return elapsed, elapsed >= window
+}
+
+// check logs a warning once for a stall.
+func (d *stallDetector) check(now time.Time, window time.Duration) {
+	elapsed, ok := d.stalled(now, window)
+	if !ok {
+		return
+	}
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if d.warned {
+		return
+	}
+	d.warned = true
+	log.Printf("[warn] Messages were received but none were processed for %s. Check the targets match the keys.", elapsed.Truncate(time.Second))
+}
+
+func runStallWatchdog(ctx context.Context, window time.Duration) {
+	ticker := time.NewTicker(window / 2)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case now := <-ticker.C:
+			stall.check(now, window)
+		}
+	}
+}
@@ -0,0 +1,204 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Warmer is an optional interface of Executor to verify connectivity to Redshift before receiving messages.
+type Warmer interface {
+	Warmup(ctx context.Context, dsn string) error
+}
+
+// Warmup connects to the Redshift and pings it, to fill DBPool.
+func (e *RedshiftExecutor) Warmup(ctx context.Context, dsn string) error {
+	db, err := ConnectToRedshift(dsn, poolSettings())
+	if err != nil {
+		return err
+	}
+	return db.PingContext(ctx)
+}
+
+// ColumnLister is an optional interface of Executor to verify tables of targets by verify_schema.
+type ColumnLister interface {
+	// TableColumns returns names of columns of the table. It returns no columns when the table does not exist.
+	TableColumns(ctx context.Context, dsn, schema, table string) ([]string, error)
+}
+
+const tableColumnsQuery = `SELECT column_name FROM information_schema.columns WHERE table_schema = $1 AND table_name = $2 ORDER BY ordinal_position`
+
+// TableColumns queries information_schema.columns.
+func (e *RedshiftExecutor) TableColumns(ctx context.Context, dsn, schema, table string) ([]string, error) {
+	db, err := ConnectToRedshift(dsn, poolSettings())
+	if err != nil {
+		return nil, err
+	}
+	rows, err := db.QueryContext(ctx, tableColumnsQuery, schema, table)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var columns []string
+	for rows.Next() {
+		var col string
+		if err := rows.Scan(&col); err != nil {
+			return nil, err
+		}
+		columns = append(columns, col)
+	}
+	return columns, rows.Err()
+}
+
+// startingUp is set to 1 while the startup sequence is in progress.
+var startingUp int32
+
+// StartingUp reports whether the worker is in the startup sequence and has not begun receiving messages yet.
+func StartingUp() bool {
+	return atomic.LoadInt32(&startingUp) == 1
+}
+
+// startup waits startup_delay, cross-checks regions of targets, and warms up connections to all Redshift of targets when warmup is enabled.
+// In daemon mode, warmup is retried until succeeded.
+func startup(ctx context.Context, c *Config, batchMode bool) error {
+	atomic.StoreInt32(&startingUp, 1)
+	defer atomic.StoreInt32(&startingUp, 0)
+	if d := c.StartupDelay; d > 0 {
+		log.Printf("[info] Waiting %s before starting up", d)
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-time.After(d):
+		}
+	}
+	if err := c.checkRegions(); err != nil {
+		log.Println("[error] Region check failed.", err)
+		return err
+	}
+	if w, ok := executorFrom(ctx).(Warmer); ok && c.Warmup {
+		for {
+			err := warmup(ctx, c, w)
+			if err == nil {
+				break
+			}
+			log.Println("[error] Warmup failed.", err)
+			if batchMode || ctx.Err() != nil {
+				return err
+			}
+			waitForRetry(ctx)
+		}
+	}
+	if c.VerifySchema {
+		l, ok := executorFrom(ctx).(ColumnLister)
+		if !ok {
+			return fmt.Errorf("verify_schema is not supported by the executor")
+		}
+		if err := verifySchema(ctx, c, l); err != nil {
+			log.Println("[error] Schema verification failed.", err)
+			return err
+		}
+	}
+	return nil
+}
+
+// DefaultWarmupConcurrency is the default number of clusters warmed up concurrently.
+var DefaultWarmupConcurrency = 8
+
+func (c *Config) warmupConcurrency() int {
+	if c.WarmupConcurrency <= 0 {
+		return DefaultWarmupConcurrency
+	}
+	return c.WarmupConcurrency
+}
+
+// warmup warms up connections to distinct clusters of targets concurrently, and returns all failures.
+func warmup(ctx context.Context, c *Config, w Warmer) error {
+	warmed := make(map[string]bool)
+	var clusters []*Redshift
+	for _, t := range c.Targets {
+		if t.Discard || !t.IsEnabled() || t.Redshift == nil {
+			continue
+		}
+		for _, r := range t.Clusters() {
+			if dsn := r.DSN(); !warmed[dsn] {
+				warmed[dsn] = true
+				clusters = append(clusters, r)
+			}
+		}
+	}
+	var (
+		wg     sync.WaitGroup
+		mu     sync.Mutex
+		failed []*WarmupError
+	)
+	sem := make(chan struct{}, c.warmupConcurrency())
+	for _, r := range clusters {
+		wg.Add(1)
+		sem <- struct{}{}
+		go func(r *Redshift) {
+			defer wg.Done()
+			defer func() { <-sem }()
+			log.Println("[info] Warming up connection to", r.VisibleDSN())
+			if err := w.Warmup(ctx, r.DSN()); err != nil {
+				mu.Lock()
+				failed = append(failed, &WarmupError{DSN: r.VisibleDSN(), Err: err})
+				mu.Unlock()
+			}
+		}(r)
+	}
+	wg.Wait()
+	sort.Slice(failed, func(i, j int) bool { return failed[i].DSN < failed[j].DSN })
+	var errs WarmupErrors
+	for _, err := range failed {
+		errs = append(errs, err)
+	}
+	return errs.err()
+}
+
+// verifySchema verifies that tables of targets with columns exist and have the columns.
+// Tables which have placeholders are not verified, because they are determined by keys of objects.
+func verifySchema(ctx context.Context, c *Config, l ColumnLister) error {
+	for _, t := range c.Targets {
+		if t.Discard || !t.IsEnabled() || t.Redshift == nil || len(t.Columns) == 0 {
+			continue
+		}
+		// mirrors may have their own schemas and tables
+		for _, r := range t.Clusters() {
+			if placeHolderRegexp.MatchString(r.Schema + r.Table) {
+				log.Printf("[warn] Can't verify the schema of target %s on %s which has placeholders in the table name", t, r.VisibleDSN())
+				continue
+			}
+			schema := r.Schema
+			if schema == "" {
+				schema = "public"
+			}
+			columns, err := l.TableColumns(ctx, r.DSN(), schema, r.Table)
+			if err != nil {
+				return fmt.Errorf("can't get columns of %s.%s on %s, %s", schema, r.Table, r.VisibleDSN(), err)
+			}
+			if len(columns) == 0 {
+				return fmt.Errorf("table %s.%s of target %s does not exist on %s", schema, r.Table, t, r.VisibleDSN())
+			}
+			exists := make(map[string]bool, len(columns))
+			for _, col := range columns {
+				exists[strings.ToLower(col)] = true
+			}
+			var missing []string
+			for _, col := range t.Columns {
+				if !exists[strings.ToLower(col)] {
+					missing = append(missing, col)
+				}
+			}
+			if len(missing) > 0 {
+				return fmt.Errorf("table %s.%s of target %s on %s has no columns %s", schema, r.Table, t, r.VisibleDSN(), strings.Join(missing, ", "))
+			}
+			log.Printf("[info] Verified the schema of %s.%s on %s", schema, r.Table, r.VisibleDSN())
+		}
+	}
+	return nil
+}
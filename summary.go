@@ -0,0 +1,119 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Summary is the stats of a worker, logged as JSON at shutdown.
+type Summary struct {
+	mu sync.Mutex
+	// Messages is the number of processed messages, and Failed is the number of them failed.
+	Messages int64 `json:"messages"`
+	Failed   int64 `json:"failed_messages"`
+	// Targets are the counts of records imported to each target, keyed by the position and the route of the target.
+	Targets map[string]*TargetSummary `json:"targets"`
+	// Rows is the number of rows loaded, when reported by the Executor. Bytes is the total size of loaded objects.
+	Rows  int64 `json:"rows"`
+	Bytes int64 `json:"bytes"`
+	// Runtime is the duration of the worker.
+	Runtime time.Duration `json:"-"`
+}
+
+// TargetSummary is the counts of records imported to a target.
+type TargetSummary struct {
+	Succeeded int64 `json:"succeeded"`
+	Failed    int64 `json:"failed"`
+}
+
+func (s *Summary) target(t *Target) *TargetSummary {
+	if s.Targets == nil {
+		s.Targets = make(map[string]*TargetSummary)
+	}
+	ts, ok := s.Targets[t.metricKey()]
+	if !ok {
+		ts = &TargetSummary{}
+		s.Targets[t.metricKey()] = ts
+	}
+	return ts
+}
+
+// Target returns the counts of the target.
+func (s *Summary) Target(t *Target) TargetSummary {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if ts, ok := s.Targets[t.metricKey()]; ok {
+		return *ts
+	}
+	return TargetSummary{}
+}
+
+func (s *Summary) String() string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var b strings.Builder
+	enc := json.NewEncoder(&b)
+	enc.SetEscapeHTML(false) // targets have "=>"
+	err := enc.Encode(struct {
+		*Summary
+		Runtime string `json:"runtime"`
+	}{s, s.Runtime.Round(time.Millisecond).String()})
+	if err != nil {
+		return err.Error()
+	}
+	return strings.TrimSuffix(b.String(), "\n")
+}
+
+type summaryKey struct{}
+
+func withSummary(ctx context.Context, s *Summary) context.Context {
+	return context.WithValue(ctx, summaryKey{}, s)
+}
+
+func summaryFrom(ctx context.Context) *Summary {
+	s, _ := ctx.Value(summaryKey{}).(*Summary)
+	return s
+}
+
+// summarizeMessage counts the message processed in ctx.
+func summarizeMessage(ctx context.Context, err error) {
+	s := summaryFrom(ctx)
+	if s == nil {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.Messages++
+	if err != nil {
+		s.Failed++
+	}
+}
+
+// summarizeLoaded counts the record loaded to the target in ctx.
+func summarizeLoaded(ctx context.Context, t *Target, rows *int64, size int64) {
+	s := summaryFrom(ctx)
+	if s == nil {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.target(t).Succeeded++
+	if rows != nil {
+		s.Rows += *rows
+	}
+	s.Bytes += size
+}
+
+// summarizeFailed counts the record failed to import to the target in ctx.
+func summarizeFailed(ctx context.Context, t *Target) {
+	s := summaryFrom(ctx)
+	if s == nil {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.target(t).Failed++
+}
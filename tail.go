@@ -0,0 +1,73 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log"
+	"time"
+)
+
+// TailVisibilityTimeout is the visibility timeout in seconds of messages received by tail.
+// Messages return to the queue soon, because tail never deletes them.
+var TailVisibilityTimeout int64 = 1
+
+// TailConfigFile prints events in the queue of the config file without importing nor deleting them.
+func TailConfigFile(ctx context.Context, configFile string, w io.Writer) error {
+	log.Println("[info] Loading config:", configFile)
+	c, err := LoadConfig(configFile)
+	if err != nil {
+		return err
+	}
+	initSessions(c)
+	src, err := NewSQSSource(ctx, sqsClient(), c.QueueName)
+	if err != nil {
+		return err
+	}
+	src.SetVisibilityTimeout(TailVisibilityTimeout)
+	return Tail(ctx, c, src, w)
+}
+
+// Tail prints bucket, key and size of records of messages received from src until ctx is done.
+// A message is printed once even if it is received again.
+func Tail(ctx context.Context, c *Config, src MessageSource, w io.Writer) error {
+	seen := make(map[string]bool)
+	for {
+		msg, err := src.Receive(ctx)
+		if ctx.Err() != nil {
+			return nil
+		}
+		if err != nil {
+			if _, ok := err.(NoMessageError); !ok {
+				log.Println("[warn] Can't receive message.", err)
+			}
+			select {
+			case <-ctx.Done():
+				return nil
+			case <-time.After(time.Second):
+			}
+			continue
+		}
+		if seen[msg.ID] {
+			continue
+		}
+		seen[msg.ID] = true
+		body, err := messageBody(ctx, c, msg)
+		if err != nil {
+			fmt.Fprintf(w, "%s\tunreadable: %s\n", msg.ID, err)
+			continue
+		}
+		event, err := ParseEventWithEncoding(body, c.MessageEncoding)
+		if err != nil {
+			fmt.Fprintf(w, "%s\tunparsable: %s\n", msg.ID, err)
+			continue
+		}
+		if event.IsTestEvent() {
+			fmt.Fprintf(w, "%s\t%s\n", msg.ID, event)
+			continue
+		}
+		for _, r := range event.Records {
+			fmt.Fprintf(w, "%s\t%s\ts3://%s/%s\t%d\n", msg.ID, r.EventName, r.S3.Bucket.Name, r.S3.Object.Key, r.S3.Object.Size)
+		}
+	}
+}
@@ -0,0 +1,39 @@
+package rin_test
+
+import (
+	"bytes"
+	"context"
+	"strings"
+	"testing"
+	"time"
+
+	rin "github.com/fujiwara/Rin"
+)
+
+func TestTail(t *testing.T) {
+	config := loadTestConfig(t, "test/config.yml")
+	fe := useFakeExecutor(t)
+	src := rin.NewMemorySource(
+		readFixture(t, "test/notification.json"),
+		readFixture(t, "test/testevent.json"),
+		"broken",
+	)
+	ctx, cancel := context.WithTimeout(context.Background(), 200*time.Millisecond)
+	defer cancel()
+	var out bytes.Buffer
+	if err := rin.Tail(ctx, config, src, &out); err != nil {
+		t.Fatal(err)
+	}
+	s := out.String()
+	for _, expected := range []string{"s3://test.bucket.test/test/foo/bar.json\t443", "s3:TestEvent", "unparsable"} {
+		if !strings.Contains(s, expected) {
+			t.Errorf("output must contain %s: %s", expected, s)
+		}
+	}
+	if n := len(src.Deleted()); n != 0 {
+		t.Errorf("tail must not delete messages: %d", n)
+	}
+	if len(fe.queries) != 0 {
+		t.Errorf("tail must not COPY: %v", fe.queries)
+	}
+}
@@ -0,0 +1,133 @@
+package main
+
+import (
+	"sort"
+	"strings"
+)
+
+// targetIndex finds candidate targets of a record by the bucket and a trie of key_prefix, instead of scanning all targets.
+// Candidates are matched by the targets in definition order as the linear scan.
+type targetIndex struct {
+	// targets is the slice of the config indexed. The index is not used for other slices.
+	targets          []*Target
+	ignoreBucketCase bool
+	buckets          map[string]*bucketIndex
+	// cache is created with the index, so it is invalidated by reloading the config.
+	cache *routeCache
+}
+
+type bucketIndex struct {
+	// others are targets which are not indexed by key_prefix: without key_prefix, or with key_strip_prefix or normalize_separators. They are candidates of any keys.
+	others   []int
+	prefixes prefixNode
+}
+
+type prefixNode struct {
+	targets  []int
+	children map[byte]*prefixNode
+}
+
+func (n *prefixNode) add(prefix string, i int) {
+	for j := 0; j < len(prefix); j++ {
+		if n.children == nil {
+			n.children = make(map[byte]*prefixNode)
+		}
+		child, ok := n.children[prefix[j]]
+		if !ok {
+			child = &prefixNode{}
+			n.children[prefix[j]] = child
+		}
+		n = child
+	}
+	n.targets = append(n.targets, i)
+}
+
+// collect appends targets which have prefixes of the key. It also returns the length of the prefix of the key
+// which determines the targets, or len(key)+1 when the key is a part of longer prefixes.
+func (n *prefixNode) collect(key string, indexes []int) ([]int, int) {
+	indexes = append(indexes, n.targets...)
+	for j := 0; j < len(key); j++ {
+		if n.children == nil {
+			return indexes, j
+		}
+		child, ok := n.children[key[j]]
+		if !ok {
+			return indexes, j + 1
+		}
+		n = child
+		indexes = append(indexes, n.targets...)
+	}
+	if n.children == nil {
+		return indexes, len(key)
+	}
+	return indexes, len(key) + 1
+}
+
+func newTargetIndex(targets []*Target, ignoreBucketCase bool, cacheSize int) *targetIndex {
+	idx := &targetIndex{
+		targets:          targets,
+		ignoreBucketCase: ignoreBucketCase,
+		buckets:          make(map[string]*bucketIndex),
+		cache:            newRouteCache(cacheSize),
+	}
+	for i, t := range targets {
+		b := idx.bucket(t.S3.Bucket, true)
+		if t.S3.KeyPrefix != "" && len(t.S3.KeyStripPrefix) == 0 && !t.S3.NormalizeSeparators {
+			b.prefixes.add(t.S3.KeyPrefix, i)
+		} else {
+			b.others = append(b.others, i)
+		}
+	}
+	return idx
+}
+
+func (idx *targetIndex) bucket(name string, create bool) *bucketIndex {
+	if idx.ignoreBucketCase {
+		name = strings.ToLower(name)
+	}
+	b, ok := idx.buckets[name]
+	if !ok && create {
+		b = &bucketIndex{}
+		idx.buckets[name] = b
+	}
+	return b
+}
+
+// candidates returns targets which may match the object in definition order.
+func (idx *targetIndex) candidates(bucket, key string) []*Target {
+	b := idx.bucket(bucket, false)
+	if b == nil {
+		return nil
+	}
+	if targets, ok := idx.cache.get(b, key); ok {
+		return targets
+	}
+	indexes, n := b.prefixes.collect(key, append([]int(nil), b.others...))
+	sort.Ints(indexes)
+	targets := make([]*Target, len(indexes))
+	for i, j := range indexes {
+		targets[i] = idx.targets[j]
+	}
+	idx.cache.put(b, key, n, targets)
+	return targets
+}
+
+func (idx *targetIndex) indexes(targets []*Target) bool {
+	if idx == nil || len(idx.targets) != len(targets) {
+		return false
+	}
+	return len(targets) == 0 || &idx.targets[0] == &targets[0]
+}
+
+func (c *Config) buildTargetIndex() {
+	c.targetIndex = newTargetIndex(c.Targets, c.IgnoreBucketCase, c.RouteCacheSize)
+}
+
+// candidateTargets returns targets which may match the record. All targets are returned when the targets are not indexed,
+// e.g. the config is not loaded by LoadConfig or targets are replaced after loading.
+func (c *Config) candidateTargets(record *EventRecord) []*Target {
+	if !c.targetIndex.indexes(c.Targets) {
+		return c.Targets
+	}
+	return c.targetIndex.candidates(record.S3.Bucket.Name, record.S3.Object.Key)
+}
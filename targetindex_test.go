@@ -0,0 +1,178 @@
+package rin_test
+
+import (
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	rin "github.com/fujiwara/Rin"
+)
+
+// tenantConfig writes a config which has a target for each tenant, a regexp target and a fallback target.
+func tenantConfig(tb testing.TB, tenants int) *rin.Config {
+	var b strings.Builder
+	b.WriteString(`queue_name: rin_test
+credentials:
+  aws_access_key_id: AAA
+  aws_secret_access_key: SSS
+  aws_region: ap-northeast-1
+s3:
+  bucket: test.bucket.test
+  region: ap-northeast-1
+redshift:
+  host: localhost
+  port: 5432
+  dbname: test
+  user: test_user
+  password: test_pass
+targets:
+  - redshift:
+      table: archive
+    s3:
+      key_regexp: ^archive/([a-z]+)/
+`)
+	for i := 0; i < tenants; i++ {
+		fmt.Fprintf(&b, "  - redshift:\n      schema: tenant%d\n      table: events\n    s3:\n      key_prefix: tenant%d/\n", i, i)
+	}
+	b.WriteString(`  - redshift:
+      table: quarantine
+    fallback: true
+`)
+	name := filepath.Join(tb.TempDir(), "config.yml")
+	if err := ioutil.WriteFile(name, []byte(b.String()), 0644); err != nil {
+		tb.Fatal(err)
+	}
+	config, err := rin.LoadConfig(name)
+	if err != nil {
+		tb.Fatal(err)
+	}
+	return config
+}
+
+// linearConfig returns a copy of the config scanning all targets, because replaced targets are not indexed.
+func linearConfig(c *rin.Config) *rin.Config {
+	linear := *c
+	linear.Targets = append([]*rin.Target(nil), c.Targets...)
+	return &linear
+}
+
+func targetNames(targets []*rin.Target) string {
+	names := make([]string, 0, len(targets))
+	for _, t := range targets {
+		if t.Discard {
+			names = append(names, "discard")
+		} else {
+			names = append(names, t.Redshift.Schema+"."+t.Redshift.Table)
+		}
+	}
+	return strings.Join(names, ",")
+}
+
+func TestFindTargetsIndex(t *testing.T) {
+	records := []struct{ bucket, key string }{
+		{"test.bucket.test", "test/foo/xxx.json"},
+		{"test.bucket.test", "test/foo/discard/xxx.json"},
+		{"test.bucket.test", "test/bar/break/xxx.csv"},
+		{"test.bucket.test", "test/barbaz/xxx.csv"},
+		{"example.bucket", "test/s1/t2/xxx.json"},
+		{"test.bucket.test", "tenant1/xxx.json"},
+		{"test.bucket.test", "tenant12/xxx.json"},
+		{"test.bucket.test", "tenant123/xxx.json"},
+		{"test.bucket.test", "archive/logs/xxx.json"},
+		{"test.bucket.test", "unknown/xxx.json"},
+		{"other.bucket.test", "tenant1/xxx.json"},
+	}
+	for _, config := range []*rin.Config{loadTestConfig(t, "test/config.yml"), tenantConfig(t, 100)} {
+		linear := linearConfig(config)
+		for _, rec := range records {
+			var r rin.EventRecord
+			r.S3.Bucket.Name = rec.bucket
+			r.S3.Object.Key = rec.key
+			indexed, scanned := targetNames(config.FindTargets(r)), targetNames(linear.FindTargets(r))
+			if indexed != scanned {
+				t.Errorf("s3://%s/%s: indexed targets %s differ from %s", rec.bucket, rec.key, indexed, scanned)
+			}
+		}
+	}
+}
+
+func BenchmarkFindTargets(b *testing.B) {
+	config := tenantConfig(b, 5000)
+	var r rin.EventRecord
+	r.S3.Bucket.Name = "test.bucket.test"
+	r.S3.Object.Key = "tenant4321/2021/01/02/xxx.json"
+	for name, c := range map[string]*rin.Config{"index": config, "linear": linearConfig(config)} {
+		b.Run(name, func(b *testing.B) {
+			for i := 0; i < b.N; i++ {
+				if targets := c.FindTargets(r); len(targets) != 1 {
+					b.Fatalf("unexpected targets %v", targets)
+				}
+			}
+		})
+	}
+}
+
+func TestFindTargetsRouteCache(t *testing.T) {
+	find := func(c *rin.Config, key string) string {
+		var r rin.EventRecord
+		r.S3.Bucket.Name = "test.bucket.test"
+		r.S3.Object.Key = key
+		return targetNames(c.FindTargets(r))
+	}
+	name := writeConfigWith(t, `route_cache_size: 2
+targets:
+  - redshift:
+      table: app
+    s3:
+      key_prefix: logs/app/
+  - redshift:
+      table: web
+    s3:
+      key_prefix: logs/web/
+  - redshift:
+      table: web_error
+    s3:
+      key_prefix: logs/web/error
+`)
+	config := loadTestConfig(t, name)
+	linear := linearConfig(config)
+	keys := []string{
+		"logs/app/2021/01/01/a.json",
+		"logs/app/2021/01/02/b.json",
+		"logs/web/2021/01/01/a.json",
+		"logs/web/error/a.json",
+		"logs/web/2021/01/02/b.json",
+		"logs/web/errors.json",
+		"logs/other/a.json",
+		"logs/app/2021/01/03/c.json",
+	}
+	hits, misses := rin.RouteCacheStats()
+	for _, key := range keys {
+		if cached, scanned := find(config, key), find(linear, key); cached != scanned {
+			t.Errorf("%s: cached targets %s differ from %s", key, cached, scanned)
+		}
+	}
+	// logs/web/ can't be cached because of the longer prefix logs/web/error, but logs/web/2021/ can.
+	// logs/other/ is hit by the second lookup for fallback targets.
+	// logs/app/ is evicted from the cache of size 2.
+	h, m := rin.RouteCacheStats()
+	if h-hits != 3 || m-misses != 6 {
+		t.Errorf("unexpected hits %d and misses %d", h-hits, m-misses)
+	}
+
+	// the cache is invalidated by reloading
+	reloaded := loadTestConfig(t, name)
+	reloaded.Targets[0].Redshift.Table = "app_v2"
+	hits, misses = rin.RouteCacheStats()
+	if got := find(reloaded, "logs/app/2021/01/04/d.json"); got != ".app_v2" {
+		t.Errorf("unexpected targets after reloading %s", got)
+	}
+	if got := find(reloaded, "logs/app/2021/01/05/e.json"); got != ".app_v2" {
+		t.Errorf("unexpected targets after reloading %s", got)
+	}
+	if h, m := rin.RouteCacheStats(); h-hits != 1 || m-misses != 1 {
+		t.Errorf("the reloaded config must start with an empty cache: hits %d misses %d", h-hits, m-misses)
+	}
+}
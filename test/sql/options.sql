@@ -0,0 +1,3 @@
+CSV DELIMITER ','
+IGNOREHEADER 1
+TIMEFORMAT 'auto'
@@ -0,0 +1,5 @@
+-- options of CSV files exported by the app
+CSV DELIMITER ',' -- don't change the delimiter
+IGNOREHEADER 1
+TIMEFORMAT 'auto'  -- 'YYYY-MM-DD'
+NULL AS '--'
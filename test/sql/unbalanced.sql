@@ -0,0 +1,2 @@
+CSV DELIMITER ','
+TIMEFORMAT 'auto
@@ -0,0 +1,78 @@
+package main
+
+import (
+	"context"
+	"log"
+	"sync"
+	"time"
+)
+
+// copyThrottle spaces COPYs to the same table by min_interval of the target.
+var copyThrottle = &throttle{next: make(map[string]time.Time)}
+
+type throttle struct {
+	mu   sync.Mutex
+	next map[string]time.Time
+}
+
+// reserve reserves the time of the next COPY to the key, and returns the delay until the time.
+func (th *throttle) reserve(key string, now time.Time, interval time.Duration) time.Duration {
+	th.mu.Lock()
+	defer th.mu.Unlock()
+	at := now
+	if next, ok := th.next[key]; ok && next.After(now) {
+		at = next
+	}
+	th.next[key] = at.Add(interval)
+	return at.Sub(now)
+}
+
+// tableKey identifies the table of the target on the cluster.
+func (t *Target) tableKey(cap *[]string) string {
+	return t.Redshift.Host + "/" + t.Redshift.DBName + "/" + t.tableName(cap)
+}
+
+// waitForMinInterval waits until a COPY to the table of the target is allowed by min_interval.
+func waitForMinInterval(ctx context.Context, target *Target, cap *[]string) error {
+	if target.MinInterval <= 0 {
+		return nil
+	}
+	table := target.tableName(cap)
+	d := copyThrottle.reserve(target.tableKey(cap), time.Now(), target.MinInterval)
+	if d <= 0 {
+		return nil
+	}
+	log.Printf("[info] [%s] Waiting %s for min_interval of %s", CorrelationID(ctx), d, table)
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-timer.C:
+		return nil
+	}
+}
+
+// waitForCopyDelay waits until copy_delay of the target has passed since the event time of the record.
+// When the event time is unknown, it waits for the whole delay.
+func waitForCopyDelay(ctx context.Context, target *Target, record *EventRecord) error {
+	if target.CopyDelay <= 0 {
+		return nil
+	}
+	d := target.CopyDelay
+	if at, err := time.Parse(time.RFC3339Nano, record.EventTime); err == nil {
+		d = time.Until(at.Add(target.CopyDelay))
+	}
+	if d <= 0 {
+		return nil
+	}
+	log.Printf("[info] [%s] Waiting %s for copy_delay of target %s", CorrelationID(ctx), d.Round(time.Millisecond), target)
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-timer.C:
+		return nil
+	}
+}
@@ -0,0 +1,47 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"time"
+)
+
+// CopyDurations are durations of the phases of COPY recorded by an Executor.
+type CopyDurations struct {
+	// Connect is the duration until the transaction of COPY began on a connection.
+	Connect time.Duration
+	Copy    time.Duration
+	Commit  time.Duration
+}
+
+func (d *CopyDurations) String() string {
+	return fmt.Sprintf("connect=%s copy=%s commit=%s", d.Connect, d.Copy, d.Commit)
+}
+
+func (d *CopyDurations) recorded() bool {
+	return d.Connect > 0 || d.Copy > 0 || d.Commit > 0
+}
+
+type copyDurationsKey struct{}
+
+func withCopyDurations(ctx context.Context) (context.Context, *CopyDurations) {
+	d := &CopyDurations{}
+	return context.WithValue(ctx, copyDurationsKey{}, d), d
+}
+
+// CopyDurationsFrom returns CopyDurations which an Executor records durations executing in ctx to.
+// It returns a discarded value when durations are not recorded.
+func CopyDurationsFrom(ctx context.Context) *CopyDurations {
+	if d, ok := ctx.Value(copyDurationsKey{}).(*CopyDurations); ok {
+		return d
+	}
+	return &CopyDurations{}
+}
+
+// since returns the duration since t, and sets t to now.
+func since(t *time.Time) time.Duration {
+	now := time.Now()
+	d := now.Sub(*t)
+	*t = now
+	return d
+}
@@ -0,0 +1,63 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"sync"
+	"time"
+)
+
+// Stages of a message recorded in MessageTrace.
+const (
+	TraceReceived = "received"
+	TraceParsed   = "parsed"
+	TraceMatched  = "matched"
+	TraceSQL      = "sql"
+	TraceCopy     = "copy"
+	TraceDeleted  = "deleted"
+)
+
+// MessageTrace is the lifecycle of a message, logged as JSON when processing the message failed by trace_on_error.
+type MessageTrace struct {
+	mu        sync.Mutex
+	MessageID string       `json:"message_id"`
+	Events    []TraceEvent `json:"events"`
+}
+
+// TraceEvent is a stage of a message.
+type TraceEvent struct {
+	Time   time.Time `json:"time"`
+	Stage  string    `json:"stage"`
+	Detail string    `json:"detail"`
+}
+
+func (t *MessageTrace) add(stage, detail string) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.Events = append(t.Events, TraceEvent{Time: time.Now(), Stage: stage, Detail: detail})
+}
+
+func (t *MessageTrace) String() string {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	b, err := json.Marshal(t)
+	if err != nil {
+		return err.Error()
+	}
+	return string(b)
+}
+
+type traceKey struct{}
+
+func withTrace(ctx context.Context, messageID string) (context.Context, *MessageTrace) {
+	t := &MessageTrace{MessageID: messageID}
+	return context.WithValue(ctx, traceKey{}, t), t
+}
+
+// tracef records the stage to the trace of the message processed in ctx. It does nothing without a trace.
+func tracef(ctx context.Context, stage, format string, args ...interface{}) {
+	if t, ok := ctx.Value(traceKey{}).(*MessageTrace); ok {
+		t.add(stage, fmt.Sprintf(format, args...))
+	}
+}
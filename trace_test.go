@@ -0,0 +1,63 @@
+package rin_test
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"log"
+	"os"
+	"strings"
+	"testing"
+
+	rin "github.com/fujiwara/Rin"
+)
+
+func TestTraceOnError(t *testing.T) {
+	config := loadTestConfig(t, "test/config.yml")
+	config.TraceOnError = true
+	config.Delivery = rin.DeliveryAtMostOnce
+	fe := useFakeExecutor(t)
+	fe.err = errors.New("COPY failed")
+	var buf bytes.Buffer
+	log.SetOutput(&buf)
+	src := rin.NewMemorySource(readFixture(t, "test/notification.json"))
+	err := rin.RunWithSource(context.Background(), config, src, true)
+	log.SetOutput(os.Stderr)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var trace *rin.MessageTrace
+	scanner := bufio.NewScanner(&buf)
+	scanner.Buffer(nil, 1024*1024)
+	for scanner.Scan() {
+		line := scanner.Text()
+		i := strings.Index(line, "Trace: ")
+		if i < 0 || !strings.Contains(line, "[error]") {
+			continue
+		}
+		trace = &rin.MessageTrace{}
+		if err := json.Unmarshal([]byte(line[i+len("Trace: "):]), trace); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if trace == nil {
+		t.Fatalf("trace must be logged at error level:\n%s", buf.String())
+	}
+	var stages []string
+	for _, e := range trace.Events {
+		stages = append(stages, e.Stage)
+	}
+	expected := []string{rin.TraceReceived, rin.TraceParsed, rin.TraceDeleted, rin.TraceMatched, rin.TraceSQL, rin.TraceCopy}
+	if strings.Join(stages, ",") != strings.Join(expected, ",") {
+		t.Errorf("unexpected stages %v, expected %v", stages, expected)
+	}
+	if !strings.Contains(trace.Events[len(trace.Events)-1].Detail, "COPY failed") {
+		t.Errorf("the copy result must be traced: %v", trace.Events)
+	}
+	if strings.Contains(buf.String(), "SSS") {
+		t.Error("the trace must not contain credentials")
+	}
+}
@@ -0,0 +1,70 @@
+package main
+
+import (
+	"context"
+	"strconv"
+)
+
+// Names of spans started by a Tracer.
+const (
+	SpanMessage = "rin.message"
+	SpanParse   = "rin.parse"
+	SpanMatch   = "rin.match"
+	SpanCopy    = "rin.copy"
+	SpanDelete  = "rin.delete"
+)
+
+// Attributes of spans started by a Tracer, by the OpenTelemetry semantic conventions.
+const (
+	AttrMessageID = "messaging.message.id"
+	AttrRecords   = "rin.records"
+	AttrBucket    = "aws.s3.bucket"
+	AttrKey       = "aws.s3.key"
+	AttrTable     = "db.sql.table"
+)
+
+// Tracer starts spans of processing a message. A span of SpanMessage has child spans of the stages.
+// NewOTelTracer adapts an OpenTelemetry TracerProvider to it.
+type Tracer interface {
+	// StartSpan starts a span as a child of the span in ctx, and returns ctx which has the span.
+	// end finishes the span with the attributes, and the error when the stage failed.
+	StartSpan(ctx context.Context, name string) (context.Context, func(attrs map[string]string, err error))
+}
+
+// DefaultTracer is the Tracer used when RunOptions has no Tracer. When nil, no spans are started.
+var DefaultTracer Tracer
+
+type tracerKey struct{}
+
+func withTracer(ctx context.Context, t Tracer) context.Context {
+	return context.WithValue(ctx, tracerKey{}, t)
+}
+
+func tracerFrom(ctx context.Context) Tracer {
+	if t, ok := ctx.Value(tracerKey{}).(Tracer); ok {
+		return t
+	}
+	return DefaultTracer
+}
+
+// startSpan starts the span by the Tracer of ctx. It does nothing without a Tracer.
+func startSpan(ctx context.Context, name string) (context.Context, func(attrs map[string]string, err error)) {
+	t := tracerFrom(ctx)
+	if t == nil {
+		return ctx, func(map[string]string, error) {}
+	}
+	return t.StartSpan(ctx, name)
+}
+
+func recordAttrs(record *EventRecord) map[string]string {
+	return map[string]string{
+		AttrBucket: record.S3.Bucket.Name,
+		AttrKey:    record.S3.Object.Key,
+	}
+}
+
+func eventAttrs(event Event) map[string]string {
+	return map[string]string{
+		AttrRecords: strconv.Itoa(len(event.Records)),
+	}
+}
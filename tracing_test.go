@@ -0,0 +1,143 @@
+package rin_test
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	rin "github.com/fujiwara/Rin"
+	"github.com/fujiwara/Rin/rintest"
+	"go.opentelemetry.io/otel/codes"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+)
+
+func TestRunTracer(t *testing.T) {
+	config := loadTestConfig(t, "test/config.yml")
+	tr := rintest.NewTracer()
+	src := rin.NewMemorySource(readFixture(t, "test/notification.json"))
+	opts := rin.RunOptions{Source: src, Executor: rintest.NewExecutor(), Tracer: tr, BatchMode: true}
+	if err := rin.Run(context.Background(), config, opts); err != nil {
+		t.Fatal(err)
+	}
+
+	spans := make(map[string]rintest.Span)
+	for _, s := range tr.Spans() {
+		spans[s.Name] = s
+	}
+	msg, ok := spans[rin.SpanMessage]
+	if !ok || msg.Parent != 0 || msg.Err != nil {
+		t.Fatalf("the span of the message must be ended: %v", tr.Spans())
+	}
+	for _, name := range []string{rin.SpanParse, rin.SpanMatch, rin.SpanCopy, rin.SpanDelete} {
+		s, ok := spans[name]
+		if !ok {
+			t.Errorf("the span %s must be ended: %v", name, tr.Spans())
+			continue
+		}
+		if s.Parent != msg.ID || s.Err != nil {
+			t.Errorf("the span %s must be a child of the message: %v", name, s)
+		}
+	}
+	if a := spans[rin.SpanParse].Attrs; a[rin.AttrRecords] != "1" {
+		t.Errorf("unexpected attributes of parse %v", a)
+	}
+	for _, name := range []string{rin.SpanMatch, rin.SpanCopy} {
+		if a := spans[name].Attrs; a[rin.AttrBucket] != "test.bucket.test" || a[rin.AttrKey] != "test/foo/bar.json" {
+			t.Errorf("unexpected attributes of %s %v", name, a)
+		}
+	}
+	if a := spans[rin.SpanCopy].Attrs; a[rin.AttrTable] != "foo" {
+		t.Errorf("unexpected table of copy %v", a)
+	}
+	if id := spans[rin.SpanDelete].Attrs[rin.AttrMessageID]; id == "" || id != msg.Attrs[rin.AttrMessageID] {
+		t.Errorf("unexpected message ID of delete %v", spans[rin.SpanDelete].Attrs)
+	}
+}
+
+func TestRunOTelTracer(t *testing.T) {
+	config := loadTestConfig(t, "test/config.yml")
+	exp := tracetest.NewInMemoryExporter()
+	tp := sdktrace.NewTracerProvider(sdktrace.WithSyncer(exp))
+	src := rin.NewMemorySource(readFixture(t, "test/notification.json"))
+	opts := rin.RunOptions{Source: src, Executor: rintest.NewExecutor(), Tracer: rin.NewOTelTracer(tp), BatchMode: true}
+	if err := rin.Run(context.Background(), config, opts); err != nil {
+		t.Fatal(err)
+	}
+
+	spans := make(map[string]tracetest.SpanStub)
+	for _, s := range exp.GetSpans() {
+		spans[s.Name] = s
+	}
+	msg, ok := spans[rin.SpanMessage]
+	if !ok || msg.Parent.IsValid() {
+		t.Fatalf("the span of the message must be exported as a root: %v", exp.GetSpans())
+	}
+	for _, name := range []string{rin.SpanParse, rin.SpanMatch, rin.SpanCopy, rin.SpanDelete} {
+		s, ok := spans[name]
+		if !ok {
+			t.Errorf("the span %s must be exported", name)
+			continue
+		}
+		if s.Parent.SpanID() != msg.SpanContext.SpanID() || s.SpanContext.TraceID() != msg.SpanContext.TraceID() {
+			t.Errorf("the span %s must be a child of the message", name)
+		}
+		if s.Status.Code == codes.Error {
+			t.Errorf("the span %s must not be an error: %v", name, s.Status)
+		}
+	}
+	attrs := make(map[string]string)
+	for _, kv := range spans[rin.SpanCopy].Attributes {
+		attrs[string(kv.Key)] = kv.Value.AsString()
+	}
+	if attrs[rin.AttrBucket] != "test.bucket.test" || attrs[rin.AttrKey] != "test/foo/bar.json" || attrs[rin.AttrTable] != "foo" {
+		t.Errorf("unexpected attributes of copy %v", attrs)
+	}
+}
+
+func TestRunOTelTracerError(t *testing.T) {
+	config := loadTestConfig(t, "test/config.yml")
+	exp := tracetest.NewInMemoryExporter()
+	tp := sdktrace.NewTracerProvider(sdktrace.WithSyncer(exp))
+	src := rin.NewMemorySource(readFixture(t, "test/notification.json"))
+	fe := &fakeExecutor{err: errors.New("COPY failed")}
+	opts := rin.RunOptions{Source: src, Executor: fe, Tracer: rin.NewOTelTracer(tp), BatchMode: true}
+	rin.Run(context.Background(), config, opts)
+
+	for _, s := range exp.GetSpans() {
+		if s.Name != rin.SpanCopy {
+			continue
+		}
+		if s.Status.Code != codes.Error || len(s.Events) == 0 {
+			t.Errorf("the span of the failed COPY must record the error: %v %v", s.Status, s.Events)
+		}
+		return
+	}
+	t.Errorf("the span of COPY must be exported: %v", exp.GetSpans())
+}
+
+func TestSetupOTelTracer(t *testing.T) {
+	defer setenv(t, "OTEL_EXPORTER_OTLP_ENDPOINT", "http://localhost:4318")()
+	orig := rin.DefaultTracer
+	defer func() { rin.DefaultTracer = orig }()
+
+	defer setenv(t, "OTEL_TRACES_EXPORTER", "none")()
+	rin.DefaultTracer = nil
+	if _, err := rin.SetupOTelTracer(context.Background()); err != nil || rin.DefaultTracer != nil {
+		t.Errorf("OTEL_TRACES_EXPORTER=none must not install a tracer: %v", err)
+	}
+
+	setenv(t, "OTEL_TRACES_EXPORTER", "zipkin")
+	if _, err := rin.SetupOTelTracer(context.Background()); err == nil {
+		t.Error("an unsupported exporter must be an error")
+	}
+
+	setenv(t, "OTEL_TRACES_EXPORTER", "")
+	shutdown, err := rin.SetupOTelTracer(context.Background())
+	if err != nil || rin.DefaultTracer == nil {
+		t.Fatalf("the OTLP endpoint must install a tracer: %v", err)
+	}
+	if err := shutdown(context.Background()); err != nil {
+		t.Error(err)
+	}
+}
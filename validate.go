@@ -0,0 +1,196 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"log"
+	"strings"
+)
+
+// ValidateSQL generates COPY SQL of targets matched by the bucket and key, and validates them by ValidateCopySQL.
+// ADD PARTITION of add_partition targets is written without validation.
+// It writes the redacted SQL of each target, and returns an error when no targets are matched or any SQL is malformed.
+func ValidateSQL(configFile, bucket, key string, w io.Writer) error {
+	log.Println("[info] Loading config:", configFile)
+	config, err := LoadConfig(configFile)
+	if err != nil {
+		return err
+	}
+	var matched, invalid int
+	for _, target := range config.Targets {
+		ok, cap := target.Match(bucket, key)
+		if !ok {
+			continue
+		}
+		if target.Discard {
+			fmt.Fprintf(w, "%s: discard\n", target)
+			break
+		}
+		matched++
+		var redacted string
+		if target.AddPartition != nil {
+			redacted, err = target.BuildAddPartitionSQL(bucket, key, cap)
+		} else if _, redacted, err = target.BuildCopySQLRedacted(key, config.Credentials, cap); err == nil {
+			err = ValidateCopySQL(redacted)
+		}
+		if err != nil {
+			fmt.Fprintf(w, "%s: NG %s\n", target, err)
+			invalid++
+		} else {
+			fmt.Fprintf(w, "%s: OK %s\n", target, redacted)
+		}
+		if target.Break {
+			break
+		}
+	}
+	if matched == 0 {
+		return fmt.Errorf("s3://%s/%s is not matched for any targets", bucket, key)
+	}
+	if invalid > 0 {
+		return fmt.Errorf("%d of %d statements are malformed", invalid, matched)
+	}
+	return nil
+}
+
+type sqlToken struct {
+	kind  byte // 'w': word, 's': string, 'i': quoted identifier, 'p': punctuation
+	value string
+}
+
+// tokenizeSQL splits the query into tokens. Comments are dropped.
+func tokenizeSQL(query string) ([]sqlToken, error) {
+	var tokens []sqlToken
+	for i := 0; i < len(query); {
+		c := query[i]
+		switch {
+		case c == ' ' || c == '\t' || c == '\n' || c == '\r':
+			i++
+		case strings.HasPrefix(query[i:], "/*"):
+			end := strings.Index(query[i+2:], "*/")
+			if end < 0 {
+				return nil, fmt.Errorf("unterminated comment at %d", i)
+			}
+			i += end + 4
+		case c == '\'' || c == '"':
+			j := i + 1
+			for {
+				n := strings.IndexByte(query[j:], c)
+				if n < 0 {
+					return nil, fmt.Errorf("unterminated quote %c at %d", c, i)
+				}
+				j += n + 1
+				if j < len(query) && query[j] == c {
+					// escaped quote
+					j++
+					continue
+				}
+				break
+			}
+			kind := byte('s')
+			if c == '"' {
+				kind = 'i'
+			}
+			tokens = append(tokens, sqlToken{kind, query[i:j]})
+			i = j
+		case strings.IndexByte("(),.;=", c) >= 0:
+			tokens = append(tokens, sqlToken{'p', string(c)})
+			i++
+		default:
+			j := i
+			for j < len(query) && strings.IndexByte(" \t\n\r'\"(),.;=", query[j]) < 0 {
+				j++
+			}
+			tokens = append(tokens, sqlToken{'w', strings.ToUpper(query[i:j])})
+			i = j
+		}
+	}
+	return tokens, nil
+}
+
+// ValidateCopySQL checks the COPY statement for common mistakes: unbalanced quotes and parentheses, and the order of clauses.
+// It is not a full parser of Redshift SQL.
+func ValidateCopySQL(query string) error {
+	tokens, err := tokenizeSQL(query)
+	if err != nil {
+		return err
+	}
+	next := func() sqlToken {
+		if len(tokens) == 0 {
+			return sqlToken{}
+		}
+		t := tokens[0]
+		tokens = tokens[1:]
+		return t
+	}
+	if t := next(); t.kind != 'w' || t.value != "COPY" {
+		return fmt.Errorf("statement must start with COPY")
+	}
+	// table [(columns)]
+	for {
+		if t := next(); t.kind != 'i' && t.kind != 'w' {
+			return fmt.Errorf("COPY must be followed by a table name")
+		}
+		if len(tokens) == 0 || tokens[0].value != "." {
+			break
+		}
+		next()
+	}
+	if len(tokens) > 0 && tokens[0].value == "(" {
+		next()
+		for {
+			if t := next(); t.kind != 'i' && t.kind != 'w' {
+				return fmt.Errorf("column list must contain column names")
+			}
+			t := next()
+			if t.value == ")" {
+				break
+			}
+			if t.value != "," {
+				return fmt.Errorf("unterminated column list")
+			}
+		}
+	}
+	if t := next(); t.value != "FROM" {
+		return fmt.Errorf("table must be followed by FROM")
+	}
+	if t := next(); t.kind != 's' {
+		return fmt.Errorf("FROM must be followed by a quoted source")
+	}
+	var depth int
+	seen := make(map[string]bool)
+	for len(tokens) > 0 {
+		t := next()
+		switch t.value {
+		case "(":
+			depth++
+		case ")":
+			depth--
+			if depth < 0 {
+				return fmt.Errorf("unbalanced parentheses")
+			}
+		case "FROM", "COPY":
+			return fmt.Errorf("%s appears more than once", t.value)
+		case "CREDENTIALS", "IAM_ROLE", "REGION", "MANIFEST", "ENCRYPTED":
+			if seen[t.value] {
+				return fmt.Errorf("%s appears more than once", t.value)
+			}
+			seen[t.value] = true
+		case ";":
+			if len(tokens) > 0 {
+				return fmt.Errorf("statement must not contain multiple statements")
+			}
+		}
+		if t.kind == 'w' && (t.value == "CREDENTIALS" || t.value == "REGION") {
+			if len(tokens) == 0 || tokens[0].kind != 's' {
+				return fmt.Errorf("%s must be followed by a quoted value", t.value)
+			}
+		}
+	}
+	if depth != 0 {
+		return fmt.Errorf("unbalanced parentheses")
+	}
+	if !seen["CREDENTIALS"] && !seen["IAM_ROLE"] {
+		return fmt.Errorf("statement must have CREDENTIALS or IAM_ROLE")
+	}
+	return nil
+}
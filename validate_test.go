@@ -0,0 +1,73 @@
+package rin_test
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+
+	rin "github.com/fujiwara/Rin"
+)
+
+func TestValidateSQL(t *testing.T) {
+	var out bytes.Buffer
+	name := writeConfigWith(t, `targets:
+  - redshift:
+      table: valid
+    s3:
+      key_prefix: test/valid/
+    sql_option: "JSON 'auto' GZIP"
+  - redshift:
+      table: duplicate_region
+    s3:
+      key_prefix: test/duplicate_region/
+    sql_option: "JSON 'auto' REGION 'us-east-1'"
+  - redshift:
+      table: unbalanced_parentheses
+    s3:
+      key_prefix: test/unbalanced_parentheses/
+    sql_option: "FORMAT AS CSV TIMEFORMAT ('auto'"
+sql_option: null
+`)
+	if err := rin.ValidateSQL(name, "test.bucket.test", "test/valid/x.json", &out); err != nil {
+		t.Fatalf("valid SQL must pass: %s %s", err, out.String())
+	}
+	if !strings.Contains(out.String(), "OK") || strings.Contains(out.String(), "SSS") {
+		t.Errorf("unexpected output %s", out.String())
+	}
+
+	for _, key := range []string{"test/duplicate_region/x.json", "test/unbalanced_parentheses/x.json"} {
+		out.Reset()
+		if err := rin.ValidateSQL(name, "test.bucket.test", key, &out); err == nil {
+			t.Errorf("malformed SQL for %s must fail: %s", key, out.String())
+		}
+	}
+
+	if err := rin.ValidateSQL(name, "test.bucket.test", "unknown/x.json", &out); err == nil {
+		t.Error("unmatched key must fail")
+	}
+}
+
+func TestValidateCopySQL(t *testing.T) {
+	valid := []string{
+		`/* Rin */ COPY "public"."foo" ("id", "name") FROM 's3://bucket/it''s.json' CREDENTIALS '***' REGION 'ap-northeast-1' JSON 'auto' GZIP`,
+		`COPY foo FROM 's3://bucket/key' IAM_ROLE 'arn:aws:iam::123456789012:role/r' CSV;`,
+	}
+	for _, q := range valid {
+		if err := rin.ValidateCopySQL(q); err != nil {
+			t.Errorf("%s must be valid: %s", q, err)
+		}
+	}
+	malformed := []string{
+		`COPY "foo" FROM 's3://bucket/key CREDENTIALS '***'`,
+		`COPY "foo" CREDENTIALS '***' FROM 's3://bucket/key'`,
+		`COPY "foo" FROM 's3://bucket/key'`,
+		`/* Rin COPY "foo" FROM 's3://bucket/key' CREDENTIALS '***'`,
+		`COPY "foo" FROM 's3://bucket/key' CREDENTIALS '***'; DROP TABLE "foo"`,
+		`SELECT 1`,
+	}
+	for _, q := range malformed {
+		if err := rin.ValidateCopySQL(q); err == nil {
+			t.Errorf("%s must be malformed", q)
+		}
+	}
+}
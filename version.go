@@ -0,0 +1,38 @@
+package main
+
+import (
+	"runtime"
+	"runtime/debug"
+)
+
+// BuildInfo describes the running build. The values are embedded by ldflags.
+type BuildInfo struct {
+	Version   string `json:"version"`
+	Commit    string `json:"commit"`
+	BuildDate string `json:"build_date"`
+	GoVersion string `json:"go_version"`
+}
+
+// CurrentBuildInfo returns BuildInfo of the running build.
+// When built without ldflags, the version is taken from the module info, and others are "unknown".
+func CurrentBuildInfo() BuildInfo {
+	b := BuildInfo{
+		Version:   version,
+		Commit:    commit,
+		BuildDate: buildDate,
+		GoVersion: runtime.Version(),
+	}
+	if b.Version == "" {
+		b.Version = "devel"
+		if info, ok := debug.ReadBuildInfo(); ok && info.Main.Version != "" {
+			b.Version = info.Main.Version
+		}
+	}
+	if b.Commit == "" {
+		b.Commit = "unknown"
+	}
+	if b.BuildDate == "" {
+		b.BuildDate = "unknown"
+	}
+	return b
+}